@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -8,6 +9,8 @@ import (
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/quantizer"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/DataDog/datadog-trace-agent/statsd"
 	"github.com/DataDog/datadog-trace-agent/watchdog"
 	log "github.com/cihub/seelog"
 )
@@ -18,6 +21,7 @@ type processedTrace struct {
 	Trace     model.Trace
 	Root      *model.Span
 	Env       string
+	Version   string // version of the application, from the root span
 	Sublayers []model.SublayerValue
 }
 
@@ -35,6 +39,12 @@ type Agent struct {
 	Sampler      *Sampler
 	Writer       *Writer
 
+	health *healthChecker
+	cutoff *lateSpanCutoff
+	window *statsWindow // nil unless sliding window stats are enabled
+
+	flushOffset time.Duration // delay of the flushes after the boundaries of the bucket interval
+
 	// config
 	conf *config.AgentConfig
 
@@ -52,17 +62,51 @@ func NewAgent(conf *config.AgentConfig) *Agent {
 	c := NewConcentrator(
 		conf.ExtraAggregators,
 		conf.BucketInterval.Nanoseconds(),
+		conf.StatsDurationGranularity.Nanoseconds(),
 	)
+	for service, interval := range conf.ServiceBucketIntervals {
+		c.serviceBsizes[service] = interval.Nanoseconds()
+	}
+	c.weightedDistributions = conf.StatsWeightedDistributions
+	c.errorDistributions = conf.StatsErrorDistributions
+	c.maxResourcesPerService = conf.MaxResourcesPerService
+	c.keptFlushes = conf.StatsRecentFlushes
+	c.maxBucketsPerFlush = conf.MaxBucketsPerFlush
+	c.maxMemory = conf.StatsMaxMemory
+	if c.maxMemory > 0 {
+		// evictions are rare, a few of them are enough to absorb a burst
+		c.evictions = make(chan []model.StatsBucket, 10)
+	}
+	c.minDistributionSamples = conf.StatsMinSamples
+	c.flagLowSampleDistributions = conf.StatsFlagLowSamples
+	c.syntheticsMarker = conf.StatsSynthetics
+	c.syntheticsApart = conf.StatsSyntheticsApart
+	c.resourceTemplate = conf.StatsResourceTemplate
+	if conf.StatsInputSize > 0 {
+		c.in = make(chan concentratorInput, conf.StatsInputSize)
+		c.dropOldest = conf.StatsInputDropOldest
+	}
 	s := NewSampler(conf)
 
 	w := NewWriter(conf)
 	w.inServices = r.services
 
+	h := newHealthChecker(c, conf.BucketInterval, s.samplerEngine.(*sampler.Sampler).Backend)
+
+	var sw *statsWindow
+	if conf.StatsWindow > 0 {
+		sw = newStatsWindow(c, conf.StatsWindow, conf.StatsWindowBuckets)
+	}
+
 	return &Agent{
 		Receiver:     r,
 		Concentrator: c,
 		Sampler:      s,
 		Writer:       w,
+		health:       h,
+		cutoff:       newLateSpanCutoff(conf),
+		window:       sw,
+		flushOffset:  randomFlushOffset(conf.FlushJitter, conf.BucketInterval),
 		conf:         conf,
 		exit:         exit,
 		die:          die,
@@ -71,7 +115,10 @@ func NewAgent(conf *config.AgentConfig) *Agent {
 
 // Run starts routers routines and individual pieces then stop them when the exit order is received
 func (a *Agent) Run() {
-	flushTicker := time.NewTicker(a.conf.BucketInterval)
+	if a.flushOffset > 0 {
+		log.Infof("flushing %s after the boundaries of the bucket interval", a.flushOffset)
+	}
+	flushTicker := newFlushTicker(a.conf.BucketInterval, a.flushOffset)
 	defer flushTicker.Stop()
 
 	// it's really important to use a ticker for this, and with a not too short
@@ -80,15 +127,34 @@ func (a *Agent) Run() {
 	watchdogTicker := time.NewTicker(a.conf.WatchdogInterval)
 	defer watchdogTicker.Stop()
 
+	http.HandleFunc("/health", a.health.handleHealth)
+	http.HandleFunc("/ready", a.health.handleReady)
+	http.HandleFunc("/debug/analyze", a.handleAnalyze)
+	if a.window != nil {
+		http.HandleFunc("/debug/stats_window", a.window.handleQuery)
+	}
+
 	a.Receiver.Run()
+	a.Concentrator.Run()
 	a.Writer.Run()
 	a.Sampler.Run()
 
+	a.health.setReady()
+
 	for {
 		select {
 		case t := <-a.Receiver.traces:
 			a.Process(t)
+		case sb := <-a.Concentrator.evictions:
+			// buckets flushed early to stay within the memory budget
+			a.sendPayload(model.AgentPayload{
+				HostName: a.conf.HostName,
+				Env:      a.conf.DefaultEnv,
+				Stats:    sb,
+			})
 		case <-flushTicker.C:
+			a.cutoff.tune()
+
 			p := model.AgentPayload{
 				HostName: a.conf.HostName,
 				Env:      a.conf.DefaultEnv,
@@ -98,6 +164,9 @@ func (a *Agent) Run() {
 			go func() {
 				defer watchdog.LogOnPanic()
 				p.Stats = a.Concentrator.Flush()
+				if a.conf.StatsDurationMetrics {
+					emitDurationMetrics(p.Stats)
+				}
 				wg.Done()
 			}()
 			go func() {
@@ -108,22 +177,73 @@ func (a *Agent) Run() {
 
 			wg.Wait()
 
-			a.Writer.inPayloads <- p
+			a.sendPayload(p)
 		case <-watchdogTicker.C:
 			a.watchdog()
 		case <-a.exit:
 			log.Info("exiting")
 			close(a.Receiver.exit)
+			// ship the traces already sampled, they would be lost otherwise
+			a.Writer.inPayloads <- model.AgentPayload{
+				HostName: a.conf.HostName,
+				Env:      a.conf.DefaultEnv,
+				Traces:   a.Sampler.Drain(),
+			}
 			a.Writer.Stop()
 			a.Sampler.Stop()
+			a.Concentrator.Stop()
 			return
 		}
 	}
 }
 
+// sendPayload hands a flushed payload to the writer, reporting when the writer
+// does not keep up and the agent has to wait for it.
+func (a *Agent) sendPayload(p model.AgentPayload) {
+	select {
+	case a.Writer.inPayloads <- p:
+		return
+	default:
+	}
+
+	statsd.Client.Count("datadog.trace_agent.concentrator.flush_blocked", 1, nil, 1)
+	a.Writer.inPayloads <- p
+}
+
 // Process is the default work unit that receives a trace, transforms it and
 // passes it downstream
 func (a *Agent) Process(t model.Trace) {
+	pt, weight, sampled, ok := a.prepareTrace(t, true)
+	if !ok {
+		return
+	}
+
+	if a.inStats(pt.Root) {
+		if a.Concentrator.in != nil {
+			a.Concentrator.Enqueue(pt, weight)
+		} else {
+			watchdog.Go(func() {
+				a.Concentrator.Add(pt, weight)
+			})
+		}
+		if a.window != nil {
+			watchdog.Go(func() {
+				a.window.Add(pt, weight)
+			})
+		}
+	}
+	if sampled {
+		watchdog.Go(func() {
+			a.Sampler.Add(pt)
+		})
+	}
+}
+
+// prepareTrace transforms a trace before it is passed downstream, returning its
+// weight in the stats and whether it goes through sampling. ok is false if the
+// trace must be skipped. Traces ending too long ago are only dropped if dropLate
+// is set, it makes no sense for traces replayed offline.
+func (a *Agent) prepareTrace(t model.Trace, dropLate bool) (pt processedTrace, weight float64, sampled bool, ok bool) {
 	if len(t) == 0 {
 		// XXX Should never happen since we reject empty traces during
 		// normalization.
@@ -131,38 +251,168 @@ func (a *Agent) Process(t model.Trace) {
 		return
 	}
 
+	// sort once for all, so that the spans are in a canonical order for all
+	// the computations below, and the root stays valid
+	t.Sort()
+
+	if !t.HasRoot() {
+		// the sublayers of rootless traces are computed from a span which is
+		// not their actual root
+		statsd.Client.Count("datadog.trace_agent.trace.rootless", 1, a.Receiver.origins.tags(t), 1)
+		switch a.conf.RootlessTraces {
+		case model.RootlessReject:
+			log.Debugf("skipping trace without root, trace ID:%d", t[0].TraceID)
+			atomic.AddInt64(&a.Receiver.stats.TracesDropped, 1)
+			atomic.AddInt64(&a.Receiver.stats.SpansDropped, int64(len(t)))
+			return
+		case model.RootlessSynthesize:
+			t = t.WithVirtualRoot()
+			t.Sort()
+		}
+	}
+
 	root := t.GetRoot()
-	if root.End() < model.Now()-2*a.conf.BucketInterval.Nanoseconds() {
-		log.Debugf("skipping trace with root too far in past, root:%v", *root)
-		atomic.AddInt64(&a.Receiver.stats.TracesDropped, 1)
-		atomic.AddInt64(&a.Receiver.stats.SpansDropped, int64(len(t)))
+	now := model.Now()
+	if dropLate {
+		lag := time.Duration(now - root.End())
+		a.cutoff.observe(lag)
+		if lag > a.cutoff.cutoff() {
+			log.Debugf("skipping trace with root too far in past, root:%v", *root)
+			atomic.AddInt64(&a.Receiver.stats.TracesDropped, 1)
+			atomic.AddInt64(&a.Receiver.stats.SpansDropped, int64(len(t)))
+			statsd.Client.Count("datadog.trace_agent.late_spans", int64(len(t)), a.Receiver.origins.tags(t), 1)
+			return
+		}
+	}
+
+	// long traces can hold spans which ended long before their root, these
+	// would land in stats buckets which were already flushed
+	if dropLate && a.conf.DropLateSpans {
+		var late int
+		if t, late = t.DropSpansEndedBefore(now - a.cutoff.cutoff().Nanoseconds()); late > 0 {
+			atomic.AddInt64(&a.Receiver.stats.SpansDropped, int64(late))
+			statsd.Client.Count("datadog.trace_agent.late_spans", int64(late), a.Receiver.origins.tags(t), 1)
+			root = t.GetRoot()
+		}
+	}
+
+	sampled = a.isSampled(t)
+	if !sampled && !a.conf.ShortTracesInStats {
+		log.Debugf("skipping trace with too few spans, root:%v", *root)
 		return
 	}
 
-	sublayers := model.ComputeSublayers(&t)
-	model.SetSublayersOnSpan(root, sublayers)
+	statsd.Client.Histogram("datadog.trace_agent.trace.depth", float64(t.Depth()), nil, 1)
+	statsd.Client.Histogram("datadog.trace_agent.trace.width", float64(t.MaxWidth()), nil, 1)
+
+	for i := range t {
+		t[i].SetTypeFromKind(a.conf.SpanKindTypes)
+	}
+
+	// the receiver normalized the trace already, the sublayers are computed
+	// from the final durations of its spans
+	var sublayers []model.SublayerValue
+	if a.conf.SublayersEnabled {
+		sublayers = a.computeSublayers(t)
+		if a.conf.SublayerMetricsOnSpan {
+			model.SetSublayersOnSpan(root, sublayers)
+		}
+		if a.conf.SublayerTagsOnSpan {
+			model.SetTopSublayersOnSpan(root, sublayers)
+		}
+	}
 
 	for i := range t {
 		t[i] = quantizer.Quantize(t[i])
 	}
 
-	pt := processedTrace{
+	// the sampler sets its rates in the metrics of the root while the
+	// concentrator copies it concurrently, the map must exist beforehand
+	if root.Metrics == nil {
+		root.Metrics = make(map[string]float64)
+	}
+
+	pt = processedTrace{
 		Trace:     t,
 		Root:      root,
-		Env:       a.conf.DefaultEnv,
+		Env:       a.traceEnv(t, root),
+		Version:   root.Meta["version"],
 		Sublayers: sublayers,
 	}
-	if tenv := t.GetEnv(); tenv != "" {
-		pt.Env = tenv
+
+	// diagnostic only, skewed traces are still processed
+	if skewed := t.ClockSkewedSpans(); skewed > 0 {
+		statsd.Client.Count("datadog.trace_agent.trace.clock_skew", int64(skewed), []string{"env:" + pt.Env}, 1)
+	}
+
+	weight = pt.weight() // need to do this now because sampler edits .Metrics map
+	if a.conf.StatsExtrapolateSampled {
+		weight *= root.ExtrapolationWeight()
+	}
+	return pt, weight, sampled, true
+}
+
+// traceEnv returns the env of the trace: the one of its root, which prevails
+// over the ones of the other spans if they differ, or else the first one set on
+// its spans, or else the default env
+func (a *Agent) traceEnv(t model.Trace, root *model.Span) string {
+	if env := root.Meta["env"]; env != "" {
+		return env
+	}
+	if env := t.GetEnv(); env != "" {
+		return env
+	}
+	return a.conf.DefaultEnv
+}
+
+// computeSublayers returns all the sublayers of the trace enabled in the configuration
+func (a *Agent) computeSublayers(t model.Trace) []model.SublayerValue {
+	var sublayers []model.SublayerValue
+	if a.conf.SublayerMetricsOnSpan {
+		// the sublayers already pinned on the root, e.g. by a client, were
+		// computed before the durations were normalized and services dropped:
+		// they are replaced rather than mixed with the new ones
+		sublayers = model.RecomputeSublayers(&t, a.conf.SublayerMode, a.conf.SublayerMinDuration.Nanoseconds())
+	} else {
+		sublayers = model.ComputeSublayers(&t, a.conf.SublayerMode, a.conf.SublayerMinDuration.Nanoseconds())
+	}
+	if a.conf.SublayerByCaller {
+		sublayers = append(sublayers, model.ComputeCallerSublayers(&t, a.conf.SublayerMode, a.conf.SublayerMinDuration.Nanoseconds())...)
 	}
+	if a.conf.SublayerByError {
+		sublayers = append(sublayers, model.ComputeErrorSublayers(&t, a.conf.SublayerMode, a.conf.SublayerMinDuration.Nanoseconds())...)
+	}
+	if a.conf.SublayerIdleTime {
+		sublayers = append(sublayers, model.SublayerValue{
+			Metric: "_sublayers.idle",
+			Value:  float64(t.IdleTime()),
+		})
+	}
+	return sublayers
+}
+
+// isSampled returns true if the trace has enough spans to go through sampling
+func (a *Agent) isSampled(t model.Trace) bool {
+	return len(t) >= a.conf.MinTraceSpans
+}
 
-	weight := pt.weight() // need to do this now because sampler edits .Metrics map
-	watchdog.Go(func() {
-		a.Concentrator.Add(pt, weight)
-	})
-	watchdog.Go(func() {
-		a.Sampler.Add(pt)
-	})
+// inStats returns true if the trace of the given root should be counted in the
+// stats, according to its sampling priority
+func (a *Agent) inStats(root *model.Span) bool {
+	if len(a.conf.StatsSamplingPriorities) == 0 {
+		return true
+	}
+	priority, ok := root.SamplingPriority()
+	if !ok {
+		// clients not supporting priorities cannot flag their traces
+		return true
+	}
+	for _, p := range a.conf.StatsSamplingPriorities {
+		if p == priority {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *Agent) watchdog() {
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"runtime"
 	"strings"
 	"testing"
@@ -10,6 +13,8 @@ import (
 
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestWatchdog(t *testing.T) {
@@ -71,11 +76,195 @@ func TestWatchdog(t *testing.T) {
 	buf[len(buf)-1] = 2
 }
 
-func BenchmarkAgentTraceProcessing(b *testing.B) {
+func TestAgentMinTraceSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	// by default all the traces are sampled
+	assert.True(agent.isSampled(model.Trace{model.Span{SpanID: 1}}))
+
+	conf.MinTraceSpans = 2
+	assert.False(agent.isSampled(model.Trace{}))
+	assert.False(agent.isSampled(model.Trace{model.Span{SpanID: 1}}))
+	assert.True(agent.isSampled(model.Trace{model.Span{SpanID: 1}, model.Span{SpanID: 2, ParentID: 1}}))
+	assert.True(agent.isSampled(model.Trace{model.Span{SpanID: 1}, model.Span{SpanID: 2, ParentID: 1}, model.Span{SpanID: 3, ParentID: 1}}))
+}
+
+func TestAgentShortTracesNotInStats(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.MinTraceSpans = 2
+	conf.ShortTracesInStats = false
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	agent.Process(model.Trace{model.Span{TraceID: 1, SpanID: 1, Service: "probe", Name: "health", Resource: "GET /health", Start: model.Now(), Duration: 100}})
+
+	// the trace is skipped synchronously, before reaching the concentrator or the sampler
+	agent.Concentrator.mu.Lock()
+	assert.Equal(0, len(agent.Concentrator.buckets))
+	agent.Concentrator.mu.Unlock()
+	agent.Sampler.mu.Lock()
+	assert.Equal(0, agent.Sampler.traceCount)
+	agent.Sampler.mu.Unlock()
+}
+
+func TestAgentSublayersDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.SublayersEnabled = false
+	conf.SublayerIdleTime = true
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	tr := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Type: "web", Start: now, Duration: 100},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Type: "sql", Start: now, Duration: 10},
+	}
+	agent.Process(tr)
+
+	// read the trace once the sampler is done with it
+	sampled := waitSampledTraces(agent)
+	if !assert.Len(sampled, 1) {
+		return
+	}
+	for _, s := range sampled[0] {
+		for k := range s.Metrics {
+			assert.False(strings.HasPrefix(k, "_sublayers."), k)
+		}
+	}
+
+	// the stats are still computed, without sublayers
+	counts := waitConcentratorCounts(agent)
+	assert.NotEmpty(counts)
+	for k := range counts {
+		assert.False(strings.Contains(k, "_sublayers."), k)
+	}
+}
+
+func TestAgentSublayerTagsOnSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.SublayerMetricsOnSpan = false
+	conf.SublayerTagsOnSpan = true
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	tr := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Type: "web", Start: now, Duration: 100},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Type: "sql", Start: now, Duration: 80},
+	}
+	agent.Process(tr)
+
+	// read the trace once the sampler is done with it
+	sampled := waitSampledTraces(agent)
+	if !assert.Len(sampled, 1) {
+		return
+	}
+	root := sampled[0].GetRoot()
+	assert.Equal("db", root.Meta["_dd.top_sublayer.sublayer_service"])
+	assert.Equal("sql", root.Meta["_dd.top_sublayer.sublayer_type"])
+	for k := range root.Metrics {
+		assert.False(strings.HasPrefix(k, "_sublayers."), k)
+	}
+
+	// the sublayers are still counted in the stats
+	counts := waitConcentratorCounts(agent)
+	assert.Equal(80.0, counts["http.request|_sublayers.duration.by_service|env:none,resource:GET /,service:web,sublayer_service:db"].Value)
+}
+
+func TestAgentSublayersRecomputed(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	tr := model.Trace{
+		// sublayers computed before the cache spans were dropped
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Type: "web", Start: now, Duration: 100,
+			Metrics: map[string]float64{
+				"_sublayers.duration.by_service.sublayer_service:cache": 30,
+				"_sublayers.duration.by_service.sublayer_service:web":   70,
+				"_sublayers.span_count":                                 3,
+			}},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Type: "sql", Start: now, Duration: 80},
+	}
+
+	pt, _, _, ok := agent.prepareTrace(tr, false)
+	assert.True(ok)
+	assert.Equal(2.0, pt.Root.Metrics["_sublayers.span_count"])
+	assert.Equal(80.0, pt.Root.Metrics["_sublayers.duration.by_service.sublayer_service:db"])
+	assert.Equal(20.0, pt.Root.Metrics["_sublayers.duration.by_service.sublayer_service:web"])
+	_, ok = pt.Root.Metrics["_sublayers.duration.by_service.sublayer_service:cache"]
+	assert.False(ok)
+}
+
+// waitSampledTraces returns the traces sampled by the agent once the traces it
+// processed are added to the sampler asynchronously
+func waitSampledTraces(agent *Agent) []model.Trace {
+	var sampled []model.Trace
+	for deadline := time.Now().Add(time.Second); len(sampled) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		sampled = append(sampled, agent.Sampler.Flush()...)
+	}
+	return sampled
+}
+
+// waitConcentratorCounts returns the counts of the concentrator once the
+// traces processed by the agent are added to it asynchronously
+func waitConcentratorCounts(agent *Agent) map[string]model.Count {
+	var counts map[string]model.Count
+	for deadline := time.Now().Add(time.Second); counts == nil && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		agent.Concentrator.mu.Lock()
+		for _, b := range agent.Concentrator.buckets {
+			counts = b.Export().Counts
+		}
+		agent.Concentrator.mu.Unlock()
+	}
+	return counts
+}
+
+func TestAgentStatsExtrapolateSampled(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		extrapolate bool
+		hits        float64
+	}{
+		{false, 2},
+		{true, 8},
+	} {
+		conf := config.NewDefaultAgentConfig()
+		conf.StatsExtrapolateSampled = tc.extrapolate
+		conf.APIKeys = append(conf.APIKeys, "")
+		agent := NewAgent(conf)
+
+		// sampled at 50% by the client, then at 25% by an upstream agent
+		agent.Process(model.Trace{model.Span{
+			TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: model.Now(), Duration: 100,
+			Metrics: map[string]float64{model.SpanSampleRateMetricKey: 0.5, model.SpanAgentSampleRateMetricKey: 0.25},
+		}})
+
+		counts := waitConcentratorCounts(agent)
+		assert.Equal(tc.hits, counts["http.request|hits|env:none,resource:GET /,service:web"].Value)
+	}
+}
+
+func benchmarkAgentTraceProcessing(b *testing.B, sublayers bool) {
 	// Disable debug logs in these tests
 	config.NewLoggerLevelCustom("INFO", "/var/log/datadog/trace-agent.log")
 
 	conf := config.NewDefaultAgentConfig()
+	conf.SublayersEnabled = sublayers
 	conf.APIKeys = append(conf.APIKeys, "")
 	agent := NewAgent(conf)
 	b.ResetTimer()
@@ -85,6 +274,14 @@ func BenchmarkAgentTraceProcessing(b *testing.B) {
 	}
 }
 
+func BenchmarkAgentTraceProcessing(b *testing.B) {
+	benchmarkAgentTraceProcessing(b, true)
+}
+
+func BenchmarkAgentTraceProcessingWithoutSublayers(b *testing.B) {
+	benchmarkAgentTraceProcessing(b, false)
+}
+
 func BenchmarkWatchdog(b *testing.B) {
 	conf := config.NewDefaultAgentConfig()
 	conf.APIKeys = append(conf.APIKeys, "apikey_2")
@@ -96,3 +293,329 @@ func BenchmarkWatchdog(b *testing.B) {
 		agent.watchdog()
 	}
 }
+
+func TestAgentFlushBlocked(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.FlushQueueSize = 2
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+	assert.Equal(2, cap(agent.Writer.inPayloads))
+
+	// the writer is not running, so it behaves as a stalled consumer
+	agent.sendPayload(model.AgentPayload{Env: "1"})
+	agent.sendPayload(model.AgentPayload{Env: "2"})
+
+	sent := make(chan struct{})
+	go func() {
+		agent.sendPayload(model.AgentPayload{Env: "3"})
+		close(sent)
+	}()
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.concentrator.flush_blocked")
+	assert.Equal("datadog.trace_agent.concentrator.flush_blocked:1|c", metrics[0])
+
+	// the payload is still delivered once the writer catches up
+	for _, env := range []string{"1", "2", "3"} {
+		assert.Equal(env, (<-agent.Writer.inPayloads).Env)
+	}
+	<-sent
+}
+
+func TestAgentClockSkew(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	tr := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100, Meta: map[string]string{"env": "prod"}},
+		// the child started before its parent, its host clock is late
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Start: now - 50, Duration: 10},
+	}
+	agent.Process(tr)
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.trace.clock_skew")
+	assert.Equal("datadog.trace_agent.trace.clock_skew:1|c|#env:prod", metrics[0])
+
+	// the trace is not dropped
+	counts := waitConcentratorCounts(agent)
+	assert.Equal(1.0, counts["db.query|hits|env:prod,resource:SELECT,service:db"].Value)
+}
+
+func TestAgentMixedEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	tr := model.Trace{
+		// the child was sent first, but the env of the root prevails
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Start: now - 50, Duration: 10, Meta: map[string]string{"env": "staging"}},
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now - 100, Duration: 100, Meta: map[string]string{"env": "prod"}},
+	}
+	agent.Process(tr)
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.trace.mixed_env")
+	assert.Equal("datadog.trace_agent.trace.mixed_env:1|c|#env:prod", metrics[0])
+
+	// all the spans are counted in the env of the root
+	counts := waitConcentratorCounts(agent)
+	assert.Equal(1.0, counts["db.query|hits|env:prod,resource:SELECT,service:db"].Value)
+	assert.Equal(1.0, counts["http.request|hits|env:prod,resource:GET /,service:web"].Value)
+}
+
+func TestAgentDropLateSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.DropLateSpans = true
+	conf.APIEnabled = false
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	// a long trace, whose first child ended way before the cutoff
+	now := model.Now()
+	start := now - time.Hour.Nanoseconds()
+	tr := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: start, Duration: now - start, Meta: map[string]string{"env": "prod"}},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Start: start, Duration: 10},
+		model.Span{TraceID: 1, SpanID: 3, ParentID: 1, Service: "cache", Name: "cache.get", Resource: "GET", Start: now - 20, Duration: 10},
+	}
+	agent.Process(tr)
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.late_spans")
+	assert.Equal("datadog.trace_agent.late_spans:1|c", metrics[0])
+
+	// dropped from the stats
+	counts := waitConcentratorCounts(agent)
+	assert.Equal(1.0, counts["cache.get|hits|env:prod,resource:GET,service:cache"].Value)
+	_, ok := counts["db.query|hits|env:prod,resource:SELECT,service:db"]
+	assert.False(ok)
+
+	// and from the sampled traces
+	var sampled []model.Trace
+	for deadline := time.Now().Add(time.Second); len(sampled) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		sampled = append(sampled, agent.Sampler.Flush()...)
+	}
+	if !assert.Len(sampled, 1) {
+		return
+	}
+	assert.Len(sampled[0], 2)
+	for _, s := range sampled[0] {
+		assert.NotEqual(uint64(2), s.SpanID)
+	}
+}
+
+func TestAgentRootlessTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	// the root of these spans was not received
+	now := model.Now()
+	rootless := func() model.Trace {
+		return model.Trace{
+			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now - 100, Duration: 80},
+			model.Span{TraceID: 1, SpanID: 3, ParentID: 2, Service: "db", Name: "db.query", Resource: "SELECT", Start: now - 90, Duration: 50},
+			model.Span{TraceID: 1, SpanID: 4, ParentID: 1, Service: "cache", Name: "cache.get", Resource: "GET", Start: now - 10, Duration: 10},
+		}
+	}
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	conf.RootlessTraces = model.RootlessReject
+	agent := NewAgent(conf)
+
+	_, _, _, ok := agent.prepareTrace(rootless(), true)
+	assert.False(ok)
+	assert.Equal(int64(1), agent.Receiver.stats.TracesDropped)
+	assert.Equal(int64(3), agent.Receiver.stats.SpansDropped)
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.trace.rootless")
+	assert.Equal("datadog.trace_agent.trace.rootless:1|c", metrics[0])
+
+	conf.RootlessTraces = model.RootlessSynthesize
+	agent = NewAgent(conf)
+
+	pt, _, _, ok := agent.prepareTrace(rootless(), true)
+	assert.True(ok)
+	assert.Len(pt.Trace, 4)
+	assert.Equal(model.VirtualRootName, pt.Root.Name)
+	assert.NotEqual(uint64(1), pt.Root.SpanID)
+	assert.Equal(now-100, pt.Root.Start)
+	assert.Equal(int64(100), pt.Root.Duration)
+	// the sublayers are computed from the virtual root
+	assert.Equal(4.0, pt.Root.Metrics["_sublayers.span_count"])
+	statsdServer.waitMetrics(t, "datadog.trace_agent.trace.rootless")
+}
+
+func TestAgentLowercaseNames(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.LowercaseNames = true
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+	server := httptest.NewServer(http.HandlerFunc(agent.Receiver.httpHandleWithVersion(v03, agent.Receiver.handleTraces)))
+	defer server.Close()
+
+	now := model.Now()
+	var traces model.Traces
+	for i, variant := range [][2]string{{"Checkout", "HTTP.Request"}, {"checkout", "http.request"}, {"CHECKOUT", "Http.Request"}} {
+		traces = append(traces, model.Trace{
+			model.Span{TraceID: uint64(i + 1), SpanID: 1, Service: variant[0], Name: variant[1], Resource: "POST /cart", Start: now, Duration: 100},
+		})
+	}
+	data, err := json.Marshal(traces)
+	assert.Nil(err)
+	resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(data))
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	for range traces {
+		select {
+		case tr := <-agent.Receiver.traces:
+			agent.Process(tr)
+		case <-time.After(time.Second):
+			t.Fatal("missing trace")
+		}
+	}
+
+	// the case variants are aggregated together
+	key := "http.request|hits|env:none,resource:POST /cart,service:checkout"
+	var counts map[string]model.Count
+	for deadline := time.Now().Add(time.Second); counts[key].Value < 3 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		counts = waitConcentratorCounts(agent)
+	}
+	assert.Equal(3.0, counts[key].Value)
+	for k := range counts {
+		assert.Contains(k, "http.request|")
+		assert.Contains(k, ",service:checkout")
+	}
+}
+
+func TestAgentMetaKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ExtraAggregators = []string{"customer"}
+	conf.APIMetaKeys = []string{"env"}
+	conf.APIEnabled = false
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	tr := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100,
+			Meta: map[string]string{"env": "prod", "customer": "acme", "http.url": "/users/1"}},
+	}
+	agent.Process(tr)
+
+	// the stats are computed with all the meta
+	counts := waitConcentratorCounts(agent)
+	assert.Equal(1.0, counts["http.request|hits|env:prod,resource:GET /,service:web,customer:acme"].Value)
+
+	var sampled []model.Trace
+	for deadline := time.Now().Add(time.Second); len(sampled) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		sampled = append(sampled, agent.Sampler.Flush()...)
+	}
+	if !assert.Len(sampled, 1) {
+		return
+	}
+
+	// the traces sent only have the configured meta
+	agent.Writer.addPayload(model.AgentPayload{HostName: "test.host", Env: "prod", Traces: sampled})
+	if assert.Len(agent.Writer.payloadBuffer, 1) {
+		shipped := agent.Writer.payloadBuffer[0].payload.Traces[0]
+		assert.Equal(map[string]string{"env": "prod"}, shipped[0].Meta)
+		assert.Equal(uint64(1), shipped[0].SpanID)
+	}
+	// without altering the trace processed
+	assert.Equal("acme", sampled[0][0].Meta["customer"])
+}
+
+func TestAgentStatsSamplingPriorities(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	withPriority := func(p float64) *model.Span {
+		return &model.Span{SpanID: 1, Metrics: map[string]float64{model.SamplingPriorityMetricKey: p}}
+	}
+
+	// by default all the traces are counted
+	for _, p := range []float64{-1, 0, 1, 2} {
+		assert.True(agent.inStats(withPriority(p)))
+	}
+	assert.True(agent.inStats(&model.Span{SpanID: 1}))
+
+	conf.StatsSamplingPriorities = []int{1, 2}
+	assert.False(agent.inStats(withPriority(-1)))
+	assert.False(agent.inStats(withPriority(0)))
+	assert.True(agent.inStats(withPriority(1)))
+	assert.True(agent.inStats(withPriority(2)))
+	// traces without a priority are still counted
+	assert.True(agent.inStats(&model.Span{SpanID: 1}))
+}
+
+func TestAgentFlushMarkersIgnored(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	// flushes are driven by the agent ticker only, markers received in
+	// quick succession never trigger one
+	lastFlush := agent.Concentrator.LastFlush()
+	agent.Process(model.NewTraceFlushMarker())
+	agent.Process(model.NewTraceFlushMarker())
+
+	assert.Equal(lastFlush, agent.Concentrator.LastFlush())
+	assert.Len(agent.Concentrator.buckets, 0)
+}
+
+func TestAgentFlushMarkerInProgressBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	agent.Process(model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100},
+	})
+	counts := waitConcentratorCounts(agent)
+	assert.Equal(1.0, counts["http.request|hits|env:none,resource:GET /,service:web"].Value)
+
+	// a marker does not force the bucket in progress out either, it is only
+	// flushed by the agent ticker once complete
+	lastFlush := agent.Concentrator.LastFlush()
+	agent.Process(model.NewTraceFlushMarker())
+
+	assert.Equal(lastFlush, agent.Concentrator.LastFlush())
+	assert.Len(agent.Concentrator.buckets, 1)
+	assert.Len(agent.Concentrator.Flush(), 0)
+}
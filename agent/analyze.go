@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantizer"
+)
+
+// analyzeResponse is what /debug/analyze returns for a trace
+type analyzeResponse struct {
+	Sublayers []model.SublayerValue `json:"sublayers"`
+	Stats     model.StatsBucket     `json:"stats"`
+}
+
+// handleAnalyze returns the sublayers and the stats computed for the JSON trace
+// posted, so that client developers can check their instrumentation. The trace
+// goes through the same steps as in Process, but it is neither added to the
+// stats nor sampled.
+func (a *Agent) handleAnalyze(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body := model.NewLimitedReader(req.Body, maxRequestBodyLength)
+	defer body.Close()
+
+	var t model.Trace
+	if err := json.NewDecoder(body).Decode(&t); err != nil {
+		http.Error(w, "cannot decode trace: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := model.NormalizeTrace(t)
+	if err != nil {
+		http.Error(w, "invalid trace: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.Sort()
+	root := t.GetRoot()
+	for i := range t {
+		t[i].SetTypeFromKind(a.conf.SpanKindTypes)
+	}
+
+	var sublayers []model.SublayerValue
+	if a.conf.SublayersEnabled {
+		sublayers = a.computeSublayers(t)
+	}
+
+	for i := range t {
+		t[i] = quantizer.Quantize(t[i])
+	}
+
+	pt := processedTrace{
+		Trace:     t,
+		Root:      root,
+		Env:       a.traceEnv(t, root),
+		Version:   root.Meta["version"],
+		Sublayers: sublayers,
+	}
+
+	weight := pt.weight()
+	if a.conf.StatsExtrapolateSampled {
+		weight *= root.ExtrapolationWeight()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analyzeResponse{
+		Sublayers: sublayers,
+		Stats:     a.Concentrator.Analyze(pt, weight),
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentAnalyze(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	now := model.Now()
+	tr := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100, Meta: map[string]string{"env": "prod"}},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Type: "sql", Resource: "SELECT * FROM users WHERE id = 42", Start: now + 10, Duration: 40},
+	}
+	data, err := json.Marshal(tr)
+	assert.Nil(err)
+
+	rec := httptest.NewRecorder()
+	agent.handleAnalyze(rec, httptest.NewRequest("POST", "/debug/analyze", bytes.NewBuffer(data)))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var resp analyzeResponse
+	assert.Nil(json.NewDecoder(rec.Body).Decode(&resp))
+
+	sublayers := make(map[string]float64)
+	for _, s := range resp.Sublayers {
+		sublayers[s.Metric+"|"+s.Tag.Name+":"+s.Tag.Value] = s.Value
+	}
+	assert.Equal(60.0, sublayers["_sublayers.duration.by_service|sublayer_service:web"])
+	assert.Equal(40.0, sublayers["_sublayers.duration.by_service|sublayer_service:db"])
+	assert.Equal(2.0, sublayers["_sublayers.span_count|:"])
+
+	// the stats are computed from the quantized spans
+	assert.Equal(1.0, resp.Stats.Counts["http.request|hits|env:prod,resource:GET /,service:web"].Value)
+	assert.Equal(1.0, resp.Stats.Counts["db.query|hits|env:prod,resource:SELECT * FROM users WHERE id = ?,service:db"].Value)
+
+	// the trace does not enter the pipeline
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(agent.Concentrator.Flush(), 0)
+	assert.Len(agent.Concentrator.buckets, 0)
+	assert.Len(agent.Sampler.Flush(), 0)
+
+	// invalid traces are reported
+	rec = httptest.NewRecorder()
+	agent.handleAnalyze(rec, httptest.NewRequest("POST", "/debug/analyze", bytes.NewBufferString("[]")))
+	assert.Equal(http.StatusBadRequest, rec.Code)
+}
@@ -3,31 +3,157 @@ package main
 import (
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/cihub/seelog"
 
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/statsd"
+	"github.com/DataDog/datadog-trace-agent/watchdog"
 )
 
 // Concentrator produces time bucketed statistics from a stream of raw traces.
 // https://en.wikipedia.org/wiki/Knelson_concentrator
 // Gets an imperial shitton of traces, and outputs pre-computed data structures
 // allowing to find the gold (stats) amongst the traces.
+// It has no flush loop of its own: the agent calls Flush on every bucket
+// interval, so flushing never depends on a flush marker being received. With a
+// bounded input, see Enqueue, Run adds the traces queued in it.
+//
+// Services can have their own bucket interval, e.g. a longer one for services
+// with little traffic so that their distributions are meaningful. Their buckets
+// are still flushed on the ticks of the global interval, once they are as old as
+// twice their own interval: longer buckets are flushed up to one global interval
+// after that, and shorter ones are flushed in batches, up to one global interval
+// late. The late span cutoff of the agent is derived from the global interval,
+// so with a shorter interval, late spans can open a bucket which was already
+// flushed, which is then flushed again with these spans only.
 type Concentrator struct {
-	aggregators []string
-	bsize       int64
+	aggregators         []string
+	bsize               int64
+	serviceBsizes       map[string]int64 // bucket size of the services overriding bsize
+	durationGranularity int64            // durations are rounded to it in the distributions, 0 to disable
+	// durations are weighted in the distributions by the number of spans of
+	// their resource in the trace
+	weightedDistributions bool
+	// durations of errors and successes are in separate distributions
+	errorDistributions bool
+	// distributions with fewer samples are suppressed, or flagged if
+	// flagLowSampleDistributions is set, 0 to disable
+	minDistributionSamples     int
+	flagLowSampleDistributions bool
+	// maximum number of distinct resources per service in a bucket, 0 for no limit
+	maxResourcesPerService int
+	// number of flushes kept in recentFlushes, for debugging, 0 to disable
+	keptFlushes int
+	// maximum number of buckets returned by a flush, the oldest first, 0 for no limit
+	maxBucketsPerFlush int
+	// approximate memory budget of the buckets in bytes, 0 for no limit. Once
+	// it is exceeded, the least recently updated buckets are flushed early.
+	maxMemory int64
+	// if set, the buckets evicted to stay within maxMemory are handed off to it
+	// to be flushed right away, rather than with the next flush
+	evictions chan []model.StatsBucket
+	// spans with this meta are excluded from the stats, or counted apart if
+	// syntheticsApart is set, disabled if its name is empty
+	syntheticsMarker model.Tag
+	syntheticsApart  bool
+	// if set, the resource of the spans is derived from their meta with it
+	resourceTemplate *model.ResourceTemplate
 
-	buckets map[int64]*model.StatsRawBucket // buckets used to aggregate stats per timestamp
+	buckets map[bucketKey]*model.StatsRawBucket // buckets used to aggregate stats per timestamp
+	size    int64                               // approximate size of the buckets in bytes
+	updates map[bucketKey]int64                 // number of the last update of each bucket, if maxMemory is set
+	update  int64                               // number of the last update of any bucket
+	envs    map[string]struct{}                 // envs seen since the last flush
+	traces  int64                               // traces added since the last flush
+	spans   int64                               // spans added since the last flush
 	mu      sync.Mutex
+
+	evicted     map[bucketKey]evictedBucket // buckets evicted to stay within maxMemory, waiting to be flushed
+	evictedSize int64                       // approximate size of the evicted buckets in bytes
+
+	recentFlushes [][]model.StatsBucket // ring of the last keptFlushes flushes
+	nextFlush     int                   // index of the next flush in recentFlushes
+
+	lastFlush int64            // unix nanosecond timestamp of the last flush, accessed atomically
+	now       func() time.Time // time of the flushes, replaced in tests
+
+	// bounded input of the traces, see Enqueue, nil if disabled
+	in chan concentratorInput
+	// whether the oldest traces of a full input are dropped, instead of the new ones
+	dropOldest bool
+	exit       chan struct{}
+}
+
+// concentratorInput is a trace waiting in the input of the concentrator
+type concentratorInput struct {
+	pt     processedTrace
+	weight float64
+}
+
+// bucketKey identifies a bucket, services with their own bucket interval having
+// buckets of their own
+type bucketKey struct {
+	start    int64
+	duration int64
+}
+
+// bucketKeys sorts bucket keys from the oldest bucket to the most recent one
+type bucketKeys []bucketKey
+
+func (k bucketKeys) Len() int      { return len(k) }
+func (k bucketKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k bucketKeys) Less(i, j int) bool {
+	return k[i].start < k[j].start || (k[i].start == k[j].start && k[i].duration < k[j].duration)
+}
+
+// ConcentratorConfig is a read-only view of the effective configuration of a
+// concentrator, which can be safely published.
+type ConcentratorConfig struct {
+	BucketInterval      time.Duration `json:"bucket_interval"`
+	FlushDelay          time.Duration `json:"flush_delay"` // buckets are flushed once they are this old
+	Aggregators         []string      `json:"aggregators"`
+	DurationGranularity time.Duration `json:"duration_granularity"`
+
+	ServiceBucketIntervals map[string]time.Duration `json:"service_bucket_intervals"`
+
+	WeightedDistributions  bool `json:"weighted_distributions"`
+	ErrorDistributions     bool `json:"error_distributions"`
+	MaxResourcesPerService int  `json:"max_resources_per_service"`
+	KeptFlushes            int  `json:"kept_flushes"`
+	MaxBucketsPerFlush     int  `json:"max_buckets_per_flush"`
+
+	MinDistributionSamples     int  `json:"min_distribution_samples"`
+	FlagLowSampleDistributions bool `json:"flag_low_sample_distributions"`
+
+	MaxMemory int64 `json:"max_memory"`
+
+	SyntheticsMarker string `json:"synthetics_marker"`
+	SyntheticsApart  bool   `json:"synthetics_apart"`
+	ResourceTemplate string `json:"resource_template"`
+
+	InputSize       int  `json:"input_size"`
+	InputDropOldest bool `json:"input_drop_oldest"`
 }
 
-// NewConcentrator initializes a new concentrator ready to be started
-func NewConcentrator(aggregators []string, bsize int64) *Concentrator {
+// NewConcentrator initializes a new concentrator ready to be started. Durations
+// inserted in the distributions are rounded to durationGranularity nanoseconds,
+// unless it is 0.
+func NewConcentrator(aggregators []string, bsize int64, durationGranularity int64) *Concentrator {
 	c := Concentrator{
-		aggregators: aggregators,
-		bsize:       bsize,
-		buckets:     make(map[int64]*model.StatsRawBucket),
+		aggregators:         aggregators,
+		bsize:               bsize,
+		durationGranularity: durationGranularity,
+		serviceBsizes:       make(map[string]int64),
+		buckets:             make(map[bucketKey]*model.StatsRawBucket),
+		updates:             make(map[bucketKey]int64),
+		evicted:             make(map[bucketKey]evictedBucket),
+		envs:                make(map[string]struct{}),
+		lastFlush:           time.Now().UnixNano(),
+		now:                 time.Now,
+		exit:                make(chan struct{}),
 	}
 	sort.Strings(c.aggregators)
 	return &c
@@ -35,51 +161,445 @@ func NewConcentrator(aggregators []string, bsize int64) *Concentrator {
 
 // Add appends to the proper stats bucket this trace's statistics
 func (c *Concentrator) Add(t processedTrace, weight float64) {
+	// the spans are all counted in the env of the trace, the one of its root
+	// if it has one, even with other envs set on some of them
+	if mixed := t.Trace.MixedEnvSpans(t.Env); mixed > 0 {
+		statsd.Client.Count("datadog.trace_agent.trace.mixed_env", 1, []string{"env:" + t.Env}, 1)
+	}
+
 	c.mu.Lock()
 
+	c.envs[t.Env] = struct{}{}
+	c.traces++
+	c.spans += int64(len(t.Trace))
+
+	distWeights := c.distributionWeights(t.Trace)
 	for _, s := range t.Trace {
-		btime := s.End() - s.End()%c.bsize
-		b, ok := c.buckets[btime]
+		bsize := c.bucketSize(s.Service)
+		key := bucketKey{start: s.End() - s.End()%bsize, duration: bsize}
+		b, ok := c.buckets[key]
 		if !ok {
-			b = model.NewStatsRawBucket(btime, c.bsize)
-			c.buckets[btime] = b
+			b = c.newRawBucket(key)
+			c.buckets[key] = b
 		}
-
-		if t.Root != nil && s.SpanID == t.Root.SpanID && t.Sublayers != nil {
-			// handle sublayers
-			b.HandleSpan(s, t.Env, c.aggregators, weight, &t.Sublayers)
-		} else {
-			b.HandleSpan(s, t.Env, c.aggregators, weight, nil)
+		size := b.ApproxSizeBytes()
+		c.handleSpan(b, s, t, weight, distWeights)
+		c.size += b.ApproxSizeBytes() - size
+		if c.maxMemory > 0 {
+			c.update++
+			c.updates[key] = c.update
 		}
 	}
+	if c.maxMemory > 0 {
+		c.enforceMaxMemory()
+	}
 
 	c.mu.Unlock()
 }
 
-// Flush deletes and returns complete statistic buckets
+// Enqueue queues the trace in the bounded input of the concentrator, to be added
+// by Run. When the input is full, because the concentrator falls behind, e.g.
+// while it flushes, the oldest queued traces are dropped if dropOldest is set,
+// or else this trace, rather than buffering them without bound. The dropped
+// traces are counted.
+func (c *Concentrator) Enqueue(pt processedTrace, weight float64) {
+	in := concentratorInput{pt: pt, weight: weight}
+	var dropped int64
+	for {
+		select {
+		case c.in <- in:
+			if dropped > 0 {
+				statsd.Client.Count("datadog.trace_agent.concentrator.input_dropped", dropped, nil, 1)
+			}
+			return
+		default:
+		}
+		if !c.dropOldest {
+			statsd.Client.Count("datadog.trace_agent.concentrator.input_dropped", dropped+1, nil, 1)
+			return
+		}
+		select {
+		case <-c.in:
+			dropped++
+		default:
+			// emptied in the meantime
+		}
+	}
+}
+
+// Run starts adding the traces queued in the bounded input, if enabled
+func (c *Concentrator) Run() {
+	if c.in == nil {
+		return
+	}
+	watchdog.Go(func() {
+		for {
+			select {
+			case in := <-c.in:
+				c.Add(in.pt, in.weight)
+			case <-c.exit:
+				return
+			}
+		}
+	})
+}
+
+// Stop stops adding the traces of the bounded input
+func (c *Concentrator) Stop() {
+	close(c.exit)
+}
+
+// evictedBucket is a bucket evicted to stay within maxMemory, waiting to be
+// flushed
+type evictedBucket struct {
+	bucket model.StatsBucket
+	size   int64 // approximate size of the raw buckets it was exported from
+}
+
+// enforceMaxMemory keeps the buckets, including the evicted ones waiting to be
+// flushed, within maxMemory. The least recently updated buckets are evicted:
+// they are exported to be flushed early, and the spans they could still receive
+// go to new buckets, merged with them if they are still there when flushed.
+// Once the evicted buckets take more than half of maxMemory, they are handed off
+// to evictions to be flushed right away. If they cannot be, the oldest are
+// dropped, which is counted. It must be called with the lock held.
+func (c *Concentrator) enforceMaxMemory() {
+	for c.size+c.evictedSize > c.maxMemory {
+		if len(c.buckets) > 0 && c.evictedSize <= c.maxMemory/2 {
+			var lru bucketKey
+			first := true
+			for key := range c.buckets {
+				if first || c.updates[key] < c.updates[lru] {
+					lru, first = key, false
+				}
+			}
+			log.Debugf("concentrator above its memory budget of %d bytes, evicting bucket %d", c.maxMemory, lru.start)
+			c.evict(lru)
+			continue
+		}
+		if c.handOffEvicted() {
+			continue
+		}
+
+		var oldest bucketKey
+		first := true
+		for key := range c.evicted {
+			if first || key.start < oldest.start {
+				oldest, first = key, false
+			}
+		}
+		log.Warnf("concentrator above its memory budget of %d bytes, dropping the stats of bucket %d", c.maxMemory, oldest.start)
+		c.evictedSize -= c.evicted[oldest].size
+		delete(c.evicted, oldest)
+		statsd.Client.Count("datadog.trace_agent.concentrator.dropped_buckets", 1, nil, 1)
+	}
+}
+
+// evict exports the live bucket with this key into the evicted buckets, merging
+// it with a previous eviction of the same key. It must be called with the lock
+// held.
+func (c *Concentrator) evict(key bucketKey) {
+	b := c.buckets[key]
+	size := b.ApproxSizeBytes()
+	bucket := b.Export()
+	for service, n := range b.RolledUpResources() {
+		statsd.Client.Count("datadog.trace_agent.concentrator.resources_rolled_up", n, []string{"service:" + service}, 1)
+	}
+	c.size -= size
+	c.evictedSize += size
+	if e, ok := c.evicted[key]; ok {
+		// merged buckets are accounted for the sum of their parts, an upper bound
+		e.bucket.Merge(bucket)
+		bucket, size = e.bucket, e.size+size
+	}
+	c.evicted[key] = evictedBucket{bucket: bucket, size: size}
+	delete(c.buckets, key)
+	delete(c.updates, key)
+	statsd.Client.Count("datadog.trace_agent.concentrator.evicted_buckets", 1, nil, 1)
+}
+
+// handOffEvicted hands the evicted buckets off to evictions, if it is set and
+// has room, to be flushed right away. The ones whose key has a live bucket again
+// are kept, to be merged with it when it is flushed. It returns whether some
+// buckets were handed off. It must be called with the lock held.
+func (c *Concentrator) handOffEvicted() bool {
+	// only the concentrator sends, under the lock: the room cannot be taken
+	if c.evictions == nil || len(c.evictions) == cap(c.evictions) {
+		return false
+	}
+
+	var sb []model.StatsBucket
+	for key, e := range c.evicted {
+		if _, ok := c.buckets[key]; ok {
+			continue
+		}
+		sb = append(sb, e.bucket)
+		c.evictedSize -= e.size
+		delete(c.evicted, key)
+	}
+	if len(sb) == 0 {
+		return false
+	}
+	c.evictions <- sb
+	statsd.Client.Count("datadog.trace_agent.concentrator.early_flushed_buckets", int64(len(sb)), nil, 1)
+	return true
+}
+
+// Analyze returns the stats the concentrator would compute for this trace, in
+// a single bucket, without adding them to its own buckets
+func (c *Concentrator) Analyze(t processedTrace, weight float64) model.StatsBucket {
+	var start int64
+	if t.Root != nil {
+		start = t.Root.End() - t.Root.End()%c.bsize
+	}
+	b := c.newRawBucket(bucketKey{start: start, duration: c.bsize})
+	distWeights := c.distributionWeights(t.Trace)
+	for _, s := range t.Trace {
+		c.handleSpan(b, s, t, weight, distWeights)
+	}
+	return b.Export()
+}
+
+// newRawBucket returns an empty bucket computing stats with the settings of the
+// concentrator
+func (c *Concentrator) newRawBucket(key bucketKey) *model.StatsRawBucket {
+	b := model.NewStatsRawBucket(key.start, key.duration)
+	b.SetDurationGranularity(c.durationGranularity)
+	b.SetErrorDistributions(c.errorDistributions)
+	b.SetMaxResourcesPerService(c.maxResourcesPerService)
+	b.SetMinDistributionSamples(c.minDistributionSamples, c.flagLowSampleDistributions)
+	b.SetSyntheticsFilter(c.syntheticsMarker, c.syntheticsApart)
+	b.SetResourceTemplate(c.resourceTemplate)
+	return b
+}
+
+// spanResource identifies the spans of a resource within a trace
+type spanResource struct {
+	service, name, resource string
+}
+
+// distributionWeights returns the number of spans of each resource of the trace,
+// which weighs their durations in the distributions, or nil if they are not
+// weighted
+func (c *Concentrator) distributionWeights(t model.Trace) map[spanResource]int {
+	if !c.weightedDistributions {
+		return nil
+	}
+	weights := make(map[spanResource]int)
+	for i := range t {
+		weights[spanResource{service: t[i].Service, name: t[i].Name, resource: t[i].Resource}]++
+	}
+	return weights
+}
+
+// handleSpan adds the stats of a span of the trace to the bucket, its duration
+// weighted by distWeights if not nil
+func (c *Concentrator) handleSpan(b *model.StatsRawBucket, s model.Span, t processedTrace, weight float64, distWeights map[spanResource]int) {
+	distWeight := 1
+	if distWeights != nil {
+		distWeight = distWeights[spanResource{service: s.Service, name: s.Name, resource: s.Resource}]
+	}
+
+	if t.Root != nil && s.SpanID == t.Root.SpanID && t.Sublayers != nil {
+		// handle sublayers
+		b.HandleSpanWeighted(s, t.Env, t.Version, c.aggregators, weight, distWeight, &t.Sublayers)
+	} else {
+		b.HandleSpanWeighted(s, t.Env, t.Version, c.aggregators, weight, distWeight, nil)
+	}
+}
+
+// Flush deletes and returns complete statistic buckets. If there are more than
+// maxBucketsPerFlush, e.g. after the writer was blocked by an outage, only the
+// oldest ones are returned and the others are left for the next flushes, so that
+// the payloads stay small enough to be accepted. The buckets evicted to stay
+// within maxMemory are flushed early, as if complete, unless their key has a live
+// bucket again, in which case they are merged with it when it is flushed.
 func (c *Concentrator) Flush() []model.StatsBucket {
+	return c.flushAt(model.Now())
+}
+
+// flushAt flushes the buckets complete at now, a unix nanosecond timestamp, see
+// Flush
+func (c *Concentrator) flushAt(now int64) []model.StatsBucket {
 	var sb []model.StatsBucket
-	now := model.Now()
+	rolledUp := make(map[string]int64)
+	flushStart := time.Now()
 
 	c.mu.Lock()
-	for ts, srb := range c.buckets {
-		bucket := srb.Export()
-
+	var keys bucketKeys
+	for key := range c.buckets {
 		// always keep one bucket opened
 		// this is a trade-off: we accept slightly late traces (clock skew and stuff)
 		// but we delay flushing by at most 2 buckets
-		if ts > now-2*c.bsize {
+		if key.start > now-2*key.duration {
 			continue
 		}
+		keys = append(keys, key)
+	}
+	for key := range c.evicted {
+		if _, ok := c.buckets[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	if c.maxBucketsPerFlush > 0 && len(keys) > c.maxBucketsPerFlush {
+		sort.Sort(keys)
+		log.Debugf("%d buckets to flush, leaving %d for the next flushes", len(keys), len(keys)-c.maxBucketsPerFlush)
+		keys = keys[:c.maxBucketsPerFlush]
+	}
 
-		log.Debugf("flushing bucket %d", ts)
+	for _, key := range keys {
+		var bucket model.StatsBucket
+		e, evicted := c.evicted[key]
+		if srb, ok := c.buckets[key]; ok {
+			bucket = srb.Export()
+			for service, n := range srb.RolledUpResources() {
+				rolledUp[service] += n
+			}
+			if evicted {
+				bucket.Merge(e.bucket)
+			}
+			c.size -= srb.ApproxSizeBytes()
+			delete(c.buckets, key)
+			delete(c.updates, key)
+		} else {
+			bucket = e.bucket
+		}
+		c.evictedSize -= e.size
+		delete(c.evicted, key)
+		log.Debugf("flushing bucket %d", key.start)
 		for _, d := range bucket.Distributions {
 			statsd.Client.Histogram("datadog.trace_agent.distribution.len", float64(d.Summary.N), nil, 1)
 		}
 		sb = append(sb, bucket)
-		delete(c.buckets, ts)
 	}
+	envs := len(c.envs)
+	c.envs = make(map[string]struct{})
+	traces, spans := c.traces, c.spans
+	c.traces, c.spans = 0, 0
+	c.keepFlush(sb)
 	c.mu.Unlock()
 
+	// services with too many resources usually miss some obfuscation rules
+	for service, n := range rolledUp {
+		statsd.Client.Count("datadog.trace_agent.concentrator.resources_rolled_up", n, []string{"service:" + service}, 1)
+	}
+
+	// many envs usually come from typos in the configuration of the clients
+	statsd.Client.Gauge("datadog.trace_agent.concentrator.distinct_envs", float64(envs), nil, 1)
+
+	// many spans per trace usually come from over-instrumentation
+	if traces > 0 {
+		statsd.Client.Gauge("datadog.trace_agent.spans_per_trace", float64(spans)/float64(traces), nil, 1)
+	}
+
+	// the throughput of the agent, to scale it
+	flushTime := c.now()
+	if elapsed := flushTime.Sub(c.LastFlush()); elapsed > 0 {
+		statsd.Client.Gauge("datadog.trace_agent.concentrator.spans_per_second", float64(spans)/elapsed.Seconds(), nil, 1)
+	}
+
+	// in milliseconds, the lock is held during the whole flush, blocking the
+	// ingestion of traces
+	statsd.Client.Histogram("datadog.trace_agent.concentrator.flush_time", time.Since(flushStart).Seconds()*1000, nil, 1)
+	statsd.Client.Count("datadog.trace_agent.concentrator.flushed_buckets", int64(len(sb)), nil, 1)
+
+	atomic.StoreInt64(&c.lastFlush, flushTime.UnixNano())
+
 	return sb
 }
+
+// keepFlush adds the flushed buckets to recentFlushes, evicting the oldest flush
+// once keptFlushes are kept. It must be called with the lock held.
+func (c *Concentrator) keepFlush(sb []model.StatsBucket) {
+	if c.keptFlushes <= 0 {
+		return
+	}
+	if len(c.recentFlushes) < c.keptFlushes {
+		c.recentFlushes = append(c.recentFlushes, sb)
+	} else {
+		c.recentFlushes[c.nextFlush] = sb
+	}
+	c.nextFlush = (c.nextFlush + 1) % c.keptFlushes
+}
+
+// RecentFlushes returns the buckets of the last flushes, from the oldest to the
+// most recent, if the concentrator keeps them. The buckets are shared with the
+// payloads they were flushed in, they must not be modified.
+func (c *Concentrator) RecentFlushes() [][]model.StatsBucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flushes := make([][]model.StatsBucket, 0, len(c.recentFlushes))
+	if len(c.recentFlushes) == c.keptFlushes {
+		// the ring is full, the oldest flush is the next one to be evicted
+		flushes = append(flushes, c.recentFlushes[c.nextFlush:]...)
+		return append(flushes, c.recentFlushes[:c.nextFlush]...)
+	}
+	return append(flushes, c.recentFlushes...)
+}
+
+// bucketSize returns the size of the buckets of the given service, in nanoseconds
+func (c *Concentrator) bucketSize(service string) int64 {
+	if bsize, ok := c.serviceBsizes[service]; ok {
+		return bsize
+	}
+	return c.bsize
+}
+
+// flushDelay returns how old, in nanoseconds, a bucket of the global interval
+// has to be to be flushed
+func (c *Concentrator) flushDelay() int64 {
+	return 2 * c.bsize
+}
+
+// ConfigView returns the effective configuration of the concentrator. It does
+// not take the concentrator lock since this configuration never changes.
+func (c *Concentrator) ConfigView() ConcentratorConfig {
+	aggregators := make([]string, len(c.aggregators))
+	copy(aggregators, c.aggregators)
+	serviceBucketIntervals := make(map[string]time.Duration, len(c.serviceBsizes))
+	for service, bsize := range c.serviceBsizes {
+		serviceBucketIntervals[service] = time.Duration(bsize)
+	}
+	var syntheticsMarker, resourceTemplate string
+	if c.syntheticsMarker.Name != "" {
+		syntheticsMarker = c.syntheticsMarker.String()
+	}
+	if c.resourceTemplate != nil {
+		resourceTemplate = c.resourceTemplate.String()
+	}
+
+	return ConcentratorConfig{
+		BucketInterval: time.Duration(c.bsize),
+		FlushDelay:     time.Duration(c.flushDelay()),
+		Aggregators:    aggregators,
+
+		DurationGranularity: time.Duration(c.durationGranularity),
+
+		ServiceBucketIntervals: serviceBucketIntervals,
+
+		WeightedDistributions:  c.weightedDistributions,
+		ErrorDistributions:     c.errorDistributions,
+		MaxResourcesPerService: c.maxResourcesPerService,
+		KeptFlushes:            c.keptFlushes,
+		MaxBucketsPerFlush:     c.maxBucketsPerFlush,
+
+		MinDistributionSamples:     c.minDistributionSamples,
+		FlagLowSampleDistributions: c.flagLowSampleDistributions,
+
+		MaxMemory: c.maxMemory,
+
+		SyntheticsMarker: syntheticsMarker,
+		SyntheticsApart:  c.syntheticsApart,
+		ResourceTemplate: resourceTemplate,
+
+		InputSize:       cap(c.in),
+		InputDropOldest: c.dropOldest,
+	}
+}
+
+// LastFlush returns the time of the last flush. It does not take the
+// concentrator lock, so it is cheap enough to be used by health checks.
+func (c *Concentrator) LastFlush() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastFlush))
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/stretchr/testify/assert"
 )
@@ -12,7 +15,7 @@ import (
 var testBucketInterval = time.Duration(2 * time.Second).Nanoseconds()
 
 func NewTestConcentrator() *Concentrator {
-	return NewConcentrator([]string{}, time.Second.Nanoseconds())
+	return NewConcentrator([]string{}, time.Second.Nanoseconds(), 0)
 }
 
 // getTsInBucket gives a timestamp in ns which is `offset` buckets late
@@ -39,7 +42,7 @@ func testSpan(c *Concentrator, spanID uint64, duration, offset int64, service, r
 
 func TestConcentratorStatsCounts(t *testing.T) {
 	assert := assert.New(t)
-	c := NewConcentrator([]string{}, testBucketInterval)
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
 
 	now := model.Now()
 	alignedNow := now - now%c.bsize
@@ -138,3 +141,582 @@ func TestConcentratorStatsCounts(t *testing.T) {
 		assert.Equal(val, int64(count.Value), "Wrong value for count %s", key)
 	}
 }
+
+func TestConcentratorConfigView(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ExtraAggregators = []string{"version", "peer.service"}
+	c := NewConcentrator(conf.ExtraAggregators, conf.BucketInterval.Nanoseconds(), conf.StatsDurationGranularity.Nanoseconds())
+
+	view := c.ConfigView()
+	assert.Equal(conf.BucketInterval, view.BucketInterval)
+	assert.Equal(2*conf.BucketInterval, view.FlushDelay)
+	assert.Equal([]string{"peer.service", "version"}, view.Aggregators)
+
+	// the view cannot be used to alter the concentrator
+	view.Aggregators[0] = "env"
+	assert.Equal("peer.service", c.ConfigView().Aggregators[0])
+}
+
+func TestConcentratorFlushMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+
+	// two buckets old enough to be flushed, one still open
+	trace := model.Trace{
+		testSpan(c, 1, 50, 3, "A1", "resource1", 0),
+		testSpan(c, 2, 40, 2, "A1", "resource1", 0),
+		testSpan(c, 3, 30, 0, "A1", "resource1", 0),
+	}
+	c.Add(processedTrace{Trace: trace, Env: "none"}, 1)
+	c.Flush()
+
+	metrics := statsdServer.waitMetrics(t,
+		"datadog.trace_agent.concentrator.flush_time",
+		"datadog.trace_agent.concentrator.flushed_buckets",
+	)
+	assert.True(strings.HasSuffix(metrics[0], "|h"), metrics[0])
+	assert.Equal("datadog.trace_agent.concentrator.flushed_buckets:2|c", metrics[1])
+}
+
+func TestConcentratorSpansPerSecond(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+	c.Flush()
+	statsdServer.waitMetrics(t, "datadog.trace_agent.concentrator.flushed_buckets")
+
+	// 30 spans in 10 seconds
+	for i := 0; i < 10; i++ {
+		trace := model.Trace{
+			testSpan(c, uint64(3*i), 50, 0, "A1", "resource1", 0),
+			testSpan(c, uint64(3*i+1), 40, 0, "A1", "resource1", 0),
+			testSpan(c, uint64(3*i+2), 30, 0, "A1", "resource1", 0),
+		}
+		c.Add(processedTrace{Trace: trace, Env: "none"}, 1)
+	}
+	now = now.Add(10 * time.Second)
+	c.Flush()
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.concentrator.spans_per_second")
+	assert.Equal("datadog.trace_agent.concentrator.spans_per_second:3.000000|g", metrics[0])
+	assert.Equal(now, c.LastFlush())
+}
+
+func TestConcentratorDistinctEnvs(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+
+	for i, env := range []string{"prod", "staging", "prod", "prdo"} {
+		trace := model.Trace{testSpan(c, uint64(i), 50, 0, "A1", "resource1", 0)}
+		c.Add(processedTrace{Trace: trace, Env: env}, 1)
+	}
+	c.Flush()
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.concentrator.distinct_envs")
+	assert.Equal("datadog.trace_agent.concentrator.distinct_envs:3.000000|g", metrics[0])
+
+	// the envs are reset on every flush
+	c.Flush()
+
+	metrics = statsdServer.waitMetrics(t, "datadog.trace_agent.concentrator.distinct_envs")
+	assert.Equal("datadog.trace_agent.concentrator.distinct_envs:0.000000|g", metrics[0])
+}
+
+func TestConcentratorSpansPerTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+
+	add := func(spans int) {
+		var trace model.Trace
+		for i := 0; i < spans; i++ {
+			trace = append(trace, testSpan(c, uint64(i+1), 50, 0, "A1", "resource1", 0))
+		}
+		c.Add(processedTrace{Trace: trace, Env: "none"}, 1)
+	}
+
+	add(1)
+	add(2)
+	add(5)
+	c.Flush()
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.spans_per_trace")
+	assert.Equal("datadog.trace_agent.spans_per_trace:2.666667|g", metrics[0])
+
+	// the counters are reset on every flush, nothing is reported without traces
+	c.Flush()
+	add(4)
+	c.Flush()
+
+	metrics = statsdServer.waitMetrics(t, "datadog.trace_agent.spans_per_trace")
+	assert.Equal("datadog.trace_agent.spans_per_trace:4.000000|g", metrics[0])
+}
+
+func TestConcentratorRecentFlushes(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.keptFlushes = 3
+
+	// each flush holds the bucket of a single service
+	flush := func(i int) {
+		service := fmt.Sprintf("service%d", i)
+		c.Add(processedTrace{Trace: model.Trace{testSpan(c, uint64(i), 50, 3, service, "resource1", 0)}, Env: "none"}, 1)
+		assert.Len(c.Flush(), 1)
+	}
+	services := func() []string {
+		var services []string
+		for _, sb := range c.RecentFlushes() {
+			assert.Len(sb, 1)
+			for _, count := range sb[0].Counts {
+				services = append(services, count.TagSet.Get("service").Value)
+				break
+			}
+		}
+		return services
+	}
+
+	assert.Len(c.RecentFlushes(), 0)
+	flush(1)
+	flush(2)
+	assert.Equal([]string{"service1", "service2"}, services())
+
+	// the oldest flushes are evicted
+	flush(3)
+	flush(4)
+	flush(5)
+	assert.Equal([]string{"service3", "service4", "service5"}, services())
+	assert.Len(c.recentFlushes, 3)
+
+	// disabled by default
+	c = NewConcentrator([]string{}, testBucketInterval, 0)
+	flush(1)
+	assert.Len(c.RecentFlushes(), 0)
+}
+
+func TestConcentratorEnvsNotMixed(t *testing.T) {
+	assert := assert.New(t)
+
+	// even with env in the aggregators, the env of the trace is the one used
+	c := NewConcentrator([]string{"env"}, testBucketInterval, 0)
+
+	prod := testSpan(c, 1, 50, 3, "A1", "resource1", 0)
+	staging := testSpan(c, 2, 30, 3, "A1", "resource1", 1)
+	staging.Meta = map[string]string{"env": "prod"}
+
+	c.Add(processedTrace{Trace: model.Trace{prod}, Env: "prod"}, 1)
+	c.Add(processedTrace{Trace: model.Trace{staging}, Env: "staging"}, 1)
+
+	counts := make(map[string]float64)
+	for _, b := range c.Flush() {
+		for k, v := range b.Counts {
+			counts[k] += v.Value
+		}
+	}
+
+	assert.Equal(map[string]float64{
+		"query|hits|env:prod,resource:resource1,service:A1":        1,
+		"query|errors|env:prod,resource:resource1,service:A1":      0,
+		"query|duration|env:prod,resource:resource1,service:A1":    50,
+		"query|hits|env:staging,resource:resource1,service:A1":     1,
+		"query|errors|env:staging,resource:resource1,service:A1":   1,
+		"query|duration|env:staging,resource:resource1,service:A1": 30,
+	}, counts)
+}
+
+func TestConcentratorServiceBucketIntervals(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.serviceBsizes["batch"] = 4 * testBucketInterval
+
+	now := model.Now()
+	alignedNow := now - now%c.bsize
+	alignedBatch := now - now%(4*testBucketInterval)
+
+	span := func(id uint64, service string, end int64) model.Span {
+		return model.Span{SpanID: id, Service: service, Name: "query", Resource: "q", Start: end - 10, Duration: 10}
+	}
+	trace := model.Trace{
+		// the default interval, in 2 distinct flushable buckets
+		span(1, "web", alignedNow-3*testBucketInterval+1),
+		span(2, "web", alignedNow-4*testBucketInterval+1),
+		// the batch interval, both in the same flushable bucket
+		span(3, "batch", alignedBatch-8*testBucketInterval+1),
+		span(4, "batch", alignedBatch-5*testBucketInterval-1),
+		// not flushable yet for the batch interval, though it would be for the default one
+		span(5, "batch", alignedBatch-4*testBucketInterval+1),
+	}
+	c.Add(processedTrace{Trace: trace, Env: "none"}, 1)
+
+	hits := make(map[string][]float64)
+	for _, b := range c.Flush() {
+		for _, cnt := range b.Counts {
+			if cnt.Measure != model.HITS {
+				continue
+			}
+			service := cnt.TagSet.Get("service").Value
+			assert.Equal(c.bucketSize(service), b.Duration, service)
+			assert.Equal(int64(0), b.Start%b.Duration, service)
+			hits[service] = append(hits[service], cnt.Value)
+		}
+	}
+	assert.Equal([]float64{1, 1}, hits["web"])
+	assert.Equal([]float64{2}, hits["batch"])
+
+	// the last batch span is flushed once its bucket is old enough
+	assert.Len(c.buckets, 1)
+	for key := range c.buckets {
+		assert.Equal(4*testBucketInterval, key.duration)
+	}
+
+	assert.Equal(map[string]time.Duration{"batch": time.Duration(4 * testBucketInterval)}, c.ConfigView().ServiceBucketIntervals)
+}
+
+func TestConcentratorMaxResourcesPerService(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.maxResourcesPerService = 2
+
+	// spans of a same bucket, with too many distinct resources
+	var trace model.Trace
+	for i, resource := range []string{"GET /users/1", "GET /users/2", "GET /users/3", "GET /users/4", "GET /users/5"} {
+		trace = append(trace, testSpan(c, uint64(i+1), 10, 3, "users", resource, 0))
+	}
+	c.Add(processedTrace{Trace: trace, Env: "none"}, 1)
+
+	counts := make(map[string]float64)
+	for _, b := range c.Flush() {
+		for k, v := range b.Counts {
+			counts[k] += v.Value
+		}
+	}
+	assert.Equal(float64(3), counts["query|hits|env:none,resource:__toomany__,service:users"])
+	assert.Len(counts, 3*3)
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.concentrator.resources_rolled_up")
+	assert.Equal("datadog.trace_agent.concentrator.resources_rolled_up:3|c|#service:users", metrics[0])
+	assert.Equal(2, c.ConfigView().MaxResourcesPerService)
+}
+
+func TestConcentratorWeightedDistributions(t *testing.T) {
+	assert := assert.New(t)
+
+	// a resource called 3 times in the trace, and another one once
+	trace := func(c *Concentrator) model.Trace {
+		return model.Trace{
+			testSpan(c, 1, 100, 0, "web", "GET /", 0),
+			testSpan(c, 2, 10, 0, "db", "SELECT", 0),
+			testSpan(c, 3, 10, 0, "db", "SELECT", 0),
+			testSpan(c, 4, 10, 0, "db", "SELECT", 0),
+		}
+	}
+	distributions := func(weighted bool) map[string]int {
+		c := NewConcentrator([]string{}, testBucketInterval, 0)
+		c.weightedDistributions = weighted
+		c.Add(processedTrace{Trace: trace(c), Env: "none"}, 1)
+
+		n := make(map[string]int)
+		for _, b := range c.flushAt(model.Now() + 3*c.bsize) {
+			for k, d := range b.Distributions {
+				n[k] += d.Summary.N
+			}
+		}
+		return n
+	}
+
+	assert.Equal(map[string]int{
+		"query|duration|env:none,resource:GET /,service:web": 1,
+		"query|duration|env:none,resource:SELECT,service:db": 3,
+	}, distributions(false))
+
+	// each span of the resource weighs 3
+	assert.Equal(map[string]int{
+		"query|duration|env:none,resource:GET /,service:web": 1,
+		"query|duration|env:none,resource:SELECT,service:db": 9,
+	}, distributions(true))
+}
+
+func TestConcentratorMaxBucketsPerFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.maxBucketsPerFlush = 2
+
+	// 5 expired buckets, piled up during an outage, and the current one
+	for offset := int64(0); offset < 8; offset++ {
+		if offset == 1 || offset == 2 {
+			continue
+		}
+		c.Add(processedTrace{Trace: model.Trace{testSpan(c, uint64(offset), 50, offset, "service", "resource1", 0)}, Env: "none"}, 1)
+	}
+
+	var starts []int64
+	for i := 0; i < 3; i++ {
+		sb := c.Flush()
+		if i < 2 {
+			assert.Len(sb, 2)
+		} else {
+			assert.Len(sb, 1)
+		}
+		for _, b := range sb {
+			starts = append(starts, b.Start)
+		}
+	}
+	// the oldest first, each bucket once
+	now := model.Now()
+	alignedNow := now - now%testBucketInterval
+	assert.Equal([]int64{
+		alignedNow - 7*testBucketInterval,
+		alignedNow - 6*testBucketInterval,
+		alignedNow - 5*testBucketInterval,
+		alignedNow - 4*testBucketInterval,
+		alignedNow - 3*testBucketInterval,
+	}, starts)
+
+	// the current bucket is left in progress
+	assert.Len(c.Flush(), 0)
+	assert.Len(c.buckets, 1)
+}
+
+// assertMemory checks that the sizes tracked by the concentrator match its
+// buckets, and returns them
+func assertMemory(assert *assert.Assertions, c *Concentrator) int64 {
+	var size, evictedSize int64
+	for _, b := range c.buckets {
+		size += b.ApproxSizeBytes()
+	}
+	for _, e := range c.evicted {
+		evictedSize += e.size
+	}
+	assert.Equal(size, c.size)
+	assert.Equal(evictedSize, c.evictedSize)
+	return size + evictedSize
+}
+
+func TestConcentratorMaxMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	add := func(id uint64, offset int64) {
+		c.Add(processedTrace{Trace: model.Trace{testSpan(c, id, 50, offset, "service", "resource1", 0)}, Env: "none"}, 1)
+	}
+
+	// measure the size of a bucket with a single aggregation
+	add(1, 0)
+	size := c.size
+	assert.True(size > 0)
+	c = NewConcentrator([]string{}, testBucketInterval, 0)
+	c.maxMemory = 2*size + size/2
+
+	// 2 buckets fit in the budget
+	add(1, 1)
+	add(2, 0)
+	assert.Len(c.buckets, 2)
+	assert.Len(c.evicted, 0)
+	assertMemory(assert, c)
+
+	// the old bucket was updated again, the current one is the least recently
+	// updated when a third bucket exceeds the budget: it is evicted, then the old
+	// one. Without evictions to hand them off to, the oldest evicted bucket is
+	// dropped to fit in the budget, which is counted.
+	add(3, 1)
+	add(4, 3)
+	assert.Len(c.buckets, 1)
+	assert.Len(c.evicted, 1)
+	assert.True(assertMemory(assert, c) <= c.maxMemory)
+	statsdServer.waitMetrics(t, "datadog.trace_agent.concentrator.dropped_buckets")
+
+	now := model.Now()
+	alignedNow := now - now%c.bsize
+	_, ok := c.evicted[bucketKey{start: alignedNow, duration: c.bsize}]
+	assert.True(ok)
+
+	// evicted buckets are flushed early, within the cap of buckets per flush
+	c.maxBucketsPerFlush = 1
+	sb := c.Flush()
+	if assert.Len(sb, 1) {
+		assert.Equal(alignedNow-3*c.bsize, sb[0].Start)
+	}
+	sb = c.Flush()
+	if assert.Len(sb, 1) {
+		assert.Equal(alignedNow, sb[0].Start)
+		assert.Equal(float64(1), sb[0].Counts["query|hits|env:none,resource:resource1,service:service"].Value)
+	}
+	assert.Len(c.evicted, 0)
+	assert.Len(c.buckets, 0)
+	assert.Len(c.updates, 0)
+	assert.Equal(int64(0), assertMemory(assert, c))
+	assert.Len(c.Flush(), 0)
+}
+
+func TestConcentratorMaxMemoryEarlyFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	add := func(id uint64, offset int64) {
+		c.Add(processedTrace{Trace: model.Trace{testSpan(c, id, 50, offset, "service", "resource1", 0)}, Env: "none"}, 1)
+	}
+	hits := func(sb []model.StatsBucket) float64 {
+		var hits float64
+		for _, b := range sb {
+			hits += b.Counts["query|hits|env:none,resource:resource1,service:service"].Value
+		}
+		return hits
+	}
+
+	add(1, 0)
+	size := c.size
+	c = NewConcentrator([]string{}, testBucketInterval, 0)
+	c.maxMemory = 2*size + size/2
+	c.evictions = make(chan []model.StatsBucket, 1)
+
+	// the evicted buckets are handed off together to be flushed right away,
+	// nothing is lost
+	add(1, 1)
+	add(2, 0)
+	add(3, 1)
+	add(4, 3)
+	assert.Len(c.buckets, 1)
+	assert.Len(c.evicted, 0)
+	assert.True(assertMemory(assert, c) <= c.maxMemory)
+	select {
+	case sb := <-c.evictions:
+		assert.Len(sb, 2)
+		assert.Equal(float64(3), hits(sb))
+	default:
+		t.Fatal("no bucket flushed early")
+	}
+
+	// a bucket alone above the budget is flushed right away, once per trace
+	// since the next traces go to new buckets
+	c.Flush()
+	c.maxMemory = size / 2
+	for i := uint64(0); i < 3; i++ {
+		add(i, 0)
+		assert.Len(c.buckets, 0)
+		assert.Len(c.evicted, 0)
+		select {
+		case sb := <-c.evictions:
+			assert.Equal(float64(1), hits(sb))
+		default:
+			t.Fatal("no bucket flushed early")
+		}
+	}
+
+	// the evicted buckets cannot be handed off while the evictions are full, the
+	// oldest of them is dropped once they exceed half of the budget
+	c.maxMemory = 3 * size
+	c.evictions <- nil
+	add(5, 0)
+	add(6, 1)
+	add(7, 2)
+	add(8, 3)
+	assert.Len(c.evicted, 1)
+	assert.True(assertMemory(assert, c) <= c.maxMemory)
+	assert.Equal(float64(3), hits(c.flushAt(model.Now()+4*c.bsize)))
+}
+
+func TestConcentratorEvictionsMerged(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	c.maxMemory = 1 << 30
+	add := func(id uint64) {
+		c.Add(processedTrace{Trace: model.Trace{testSpan(c, id, 50, 0, "service", "resource1", 0)}, Env: "none"}, 1)
+	}
+
+	// the same bucket evicted twice is flushed once
+	now := model.Now()
+	key := bucketKey{start: now - now%c.bsize, duration: c.bsize}
+	add(1)
+	c.evict(key)
+	add(2)
+	c.evict(key)
+	assert.Len(c.buckets, 0)
+	assert.Len(c.evicted, 1)
+	assertMemory(assert, c)
+
+	// once its key has a live bucket again, the evicted bucket waits for it to be
+	// complete, to be flushed along with it in a single bucket
+	add(3)
+	assert.Len(c.Flush(), 0)
+	sb := c.flushAt(key.start + 2*key.duration)
+	if assert.Len(sb, 1) {
+		assert.Equal(key.start, sb[0].Start)
+		assert.Equal(float64(3), sb[0].Counts["query|hits|env:none,resource:resource1,service:service"].Value)
+	}
+	assert.Equal(int64(0), assertMemory(assert, c))
+}
+
+func TestConcentratorInputDropped(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	for _, dropOldest := range []bool{false, true} {
+		c := NewConcentrator([]string{}, testBucketInterval, 0)
+		c.in = make(chan concentratorInput, 3)
+		c.dropOldest = dropOldest
+
+		// the concentrator is not running, its input fills up
+		for i := 0; i < 10; i++ {
+			trace := model.Trace{testSpan(c, uint64(i), 50, 0, "A1", fmt.Sprintf("resource%d", i), 0)}
+			c.Enqueue(processedTrace{Trace: trace, Env: "none"}, 1)
+		}
+		for i := 0; i < 7; i++ {
+			metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.concentrator.input_dropped")
+			assert.Equal("datadog.trace_agent.concentrator.input_dropped:1|c", metrics[0])
+		}
+
+		// the first traces are kept, or the last ones when dropping the oldest
+		expected := []string{"resource0", "resource1", "resource2"}
+		if dropOldest {
+			expected = []string{"resource7", "resource8", "resource9"}
+		}
+		c.Run()
+		var counts map[string]model.Count
+		for deadline := time.Now().Add(time.Second); len(counts) < 3*len(expected) && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			counts = make(map[string]model.Count)
+			c.mu.Lock()
+			for _, b := range c.buckets {
+				for k, v := range b.Export().Counts {
+					counts[k] = v
+				}
+			}
+			c.mu.Unlock()
+		}
+		c.Stop()
+		assert.Len(counts, 3*len(expected), "drop oldest: %v", dropOldest)
+		for _, resource := range expected {
+			_, ok := counts["query|hits|env:none,resource:"+resource+",service:A1"]
+			assert.True(ok, "drop oldest: %v, %s missing", dropOldest, resource)
+		}
+	}
+}
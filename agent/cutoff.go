@@ -0,0 +1,82 @@
+package main
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/quantile"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// lateSpanCutoffMinSamples is the number of lags to observe before tuning the
+// cutoff, below that the percentile is too noisy to be trusted.
+const lateSpanCutoffMinSamples = 100
+
+// lateSpanCutoff decides how late a trace can be received before being dropped.
+// By default the cutoff is fixed, but it can be tuned to a percentile of the lag
+// observed between the end of the traces and their reception, plus a margin.
+// The tuned cutoff stays between min and the fixed one: later traces would go to
+// buckets already flushed, and a tiny cutoff would drop the traces as soon as the
+// lag grows a little. It is not thread safe.
+type lateSpanCutoff struct {
+	fixed      time.Duration
+	min        time.Duration
+	percentile float64 // in [0, 1], 0 disables the tuning
+	margin     time.Duration
+
+	lags    *quantile.SliceSummary // lags observed since the last tuning, in nanoseconds
+	current time.Duration
+}
+
+// newLateSpanCutoff returns a cutoff defaulting to twice the bucket interval,
+// which can be tuned down to half the bucket interval.
+func newLateSpanCutoff(conf *config.AgentConfig) *lateSpanCutoff {
+	fixed := 2 * conf.BucketInterval
+	return &lateSpanCutoff{
+		fixed:      fixed,
+		min:        conf.BucketInterval / 2,
+		percentile: conf.LateSpanCutoffPercentile,
+		margin:     conf.LateSpanCutoffMargin,
+		lags:       quantile.NewSliceSummary(),
+		current:    fixed,
+	}
+}
+
+// isAdaptive returns true if the cutoff is tuned from the observed lags.
+func (c *lateSpanCutoff) isAdaptive() bool {
+	return c.percentile > 0
+}
+
+// observe records the lag of a received trace.
+func (c *lateSpanCutoff) observe(lag time.Duration) {
+	if !c.isAdaptive() {
+		return
+	}
+	if lag < 0 {
+		// clock skew, the trace is not late at all
+		lag = 0
+	}
+	c.lags.Insert(float64(lag), uint64(c.lags.N))
+}
+
+// cutoff returns the maximum lag after which traces are dropped.
+func (c *lateSpanCutoff) cutoff() time.Duration {
+	return c.current
+}
+
+// tune updates the cutoff from the lags observed since the last call, if there
+// are enough of them, and reports it.
+func (c *lateSpanCutoff) tune() {
+	if c.isAdaptive() && c.lags.N >= lateSpanCutoffMinSamples {
+		c.current = time.Duration(c.lags.Quantile(c.percentile)) + c.margin
+		if c.current > c.fixed {
+			c.current = c.fixed
+		}
+		if c.current < c.min {
+			c.current = c.min
+		}
+		c.lags = quantile.NewSliceSummary()
+	}
+
+	statsd.Client.Gauge("datadog.trace_agent.late_span_cutoff", c.current.Seconds(), nil, 1)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLateSpanCutoffFixed(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	c := newLateSpanCutoff(conf)
+
+	for i := 0; i < 1000; i++ {
+		c.observe(time.Hour)
+	}
+	c.tune()
+
+	assert.Equal(2*conf.BucketInterval, c.cutoff())
+}
+
+func TestLateSpanCutoffAdaptive(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.LateSpanCutoffPercentile = 0.95
+	conf.LateSpanCutoffMargin = time.Second
+	c := newLateSpanCutoff(conf)
+
+	// not enough samples, the fixed cutoff is kept
+	for i := 0; i < lateSpanCutoffMinSamples-1; i++ {
+		c.observe(time.Second)
+	}
+	c.tune()
+	assert.Equal(2*conf.BucketInterval, c.cutoff())
+
+	// 99% of the traces are less than 10 seconds late, the others are way later
+	// and must not influence the p95
+	r := rand.New(rand.NewSource(42))
+	c = newLateSpanCutoff(conf)
+	for i := 0; i < 10000; i++ {
+		if i%100 == 0 {
+			c.observe(time.Hour)
+			continue
+		}
+		c.observe(time.Duration(r.Int63n(int64(10 * time.Second))))
+	}
+	c.tune()
+
+	cutoff := c.cutoff() - conf.LateSpanCutoffMargin
+	assert.True(cutoff >= 8*time.Second, "cutoff too low: %v", cutoff)
+	assert.True(cutoff <= 10*time.Second, "cutoff too high: %v", cutoff)
+
+	// observed lags are reset after each tuning, the cutoff never goes below
+	// half the bucket interval
+	for i := 0; i < lateSpanCutoffMinSamples; i++ {
+		c.observe(-time.Second)
+	}
+	c.tune()
+	assert.Equal(conf.BucketInterval/2, c.cutoff())
+
+	// nor above the fixed cutoff, the spans would go to flushed buckets
+	for i := 0; i < lateSpanCutoffMinSamples; i++ {
+		c.observe(time.Minute)
+	}
+	c.tune()
+	assert.Equal(2*conf.BucketInterval, c.cutoff())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// flushTicker ticks when the agent flushes. With an offset, the ticks happen at
+// this offset after the boundaries of the bucket interval since the epoch, so
+// that agents drawing different offsets spread their flushes instead of hitting
+// the API at the same time. Without one, it ticks every interval.
+type flushTicker struct {
+	C <-chan time.Time
+
+	interval time.Duration
+	offset   time.Duration
+
+	now   func() time.Time                     // current time, replaced in tests
+	after func(time.Duration) <-chan time.Time // waits for the next tick, replaced in tests
+
+	c    chan time.Time
+	exit chan struct{}
+}
+
+// newFlushTicker returns a ticker ticking every interval, offset after the
+// boundaries of the interval if offset is positive.
+func newFlushTicker(interval, offset time.Duration) *flushTicker {
+	return startFlushTicker(interval, offset, time.Now, time.After)
+}
+
+// startFlushTicker returns a flushTicker timed with the given clock
+func startFlushTicker(interval, offset time.Duration, now func() time.Time, after func(time.Duration) <-chan time.Time) *flushTicker {
+	c := make(chan time.Time, 1)
+	t := &flushTicker{
+		C:        c,
+		interval: interval,
+		offset:   offset,
+		now:      now,
+		after:    after,
+		c:        c,
+		exit:     make(chan struct{}),
+	}
+	go t.run()
+
+	return t
+}
+
+// run ticks until the ticker is stopped. The delay until the next tick is
+// computed again after each of them, so that the ticks do not drift from the
+// offset.
+func (t *flushTicker) run() {
+	for {
+		delay := t.interval
+		if t.offset > 0 {
+			delay = flushDelay(t.now(), t.interval, t.offset)
+			if delay == 0 {
+				// right on the offset, which was just ticked
+				delay = t.interval
+			}
+		}
+
+		select {
+		case now := <-t.after(delay):
+			t.tick(now)
+		case <-t.exit:
+			return
+		}
+	}
+}
+
+// tick sends the tick unless the previous one was not received yet, dropping it
+// like a time.Ticker does
+func (t *flushTicker) tick(now time.Time) {
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+// Stop stops the ticker, no more ticks are sent.
+func (t *flushTicker) Stop() {
+	close(t.exit)
+}
+
+// flushDelay returns how long to wait from now until the next boundary of the
+// interval since the epoch, plus offset. It is always less than the interval.
+func flushDelay(now time.Time, interval, offset time.Duration) time.Duration {
+	delay := interval - time.Duration(now.UnixNano()%int64(interval)) + offset%interval
+	if delay >= interval {
+		delay -= interval
+	}
+	return delay
+}
+
+// randomFlushOffset draws the flush offset of the agent in [0, jitter). It is
+// kept below the bucket interval so that buckets are delayed by less than an
+// interval, and never kept after the late spans they can receive are dropped.
+func randomFlushOffset(jitter, interval time.Duration) time.Duration {
+	if jitter <= 0 || interval <= 0 {
+		return 0
+	}
+	if jitter > interval {
+		jitter = interval
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	interval := 10 * time.Second
+	now := time.Unix(103, 0)
+	for offset, expected := range map[time.Duration]time.Duration{
+		0:               7 * time.Second,
+		2 * time.Second: 9 * time.Second,
+		3 * time.Second: 0,
+		5 * time.Second: 2 * time.Second,
+	} {
+		delay := flushDelay(now, interval, offset)
+		assert.Equal(expected, delay, "offset: %s", offset)
+		assert.Equal(int64(offset), now.Add(delay).UnixNano()%int64(interval), "offset: %s", offset)
+	}
+}
+
+func TestRandomFlushOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(time.Duration(0), randomFlushOffset(0, 10*time.Second))
+
+	for i := 0; i < 100; i++ {
+		offset := randomFlushOffset(3*time.Second, 10*time.Second)
+		assert.True(offset >= 0 && offset < 3*time.Second, "offset: %s", offset)
+
+		// kept below the bucket interval
+		offset = randomFlushOffset(time.Minute, 10*time.Second)
+		assert.True(offset >= 0 && offset < 10*time.Second, "offset: %s", offset)
+	}
+}
+
+// fakeTickerClock times a flushTicker, the test decides when its waits end
+type fakeTickerClock struct {
+	now   time.Time
+	waits chan time.Duration
+	fire  chan time.Time
+}
+
+func newFakeTickerClock(now time.Time) *fakeTickerClock {
+	return &fakeTickerClock{now: now, waits: make(chan time.Duration, 1), fire: make(chan time.Time)}
+}
+
+func (c *fakeTickerClock) Now() time.Time { return c.now }
+
+func (c *fakeTickerClock) After(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.fire
+}
+
+// next lets the ticker wait until its next tick and returns how long it waited
+func (c *fakeTickerClock) next(t *testing.T) time.Duration {
+	var d time.Duration
+	select {
+	case d = <-c.waits:
+	case <-time.After(time.Second):
+		t.Fatal("the ticker is not waiting")
+	}
+	c.now = c.now.Add(d)
+	c.fire <- c.now
+	return d
+}
+
+func TestFlushTickerOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	interval := 10 * time.Second
+	offset := 3 * time.Second
+
+	clock := newFakeTickerClock(time.Unix(1000, 5e8))
+	c := NewConcentrator([]string{}, interval.Nanoseconds(), 0)
+	now := clock.now.UnixNano()
+	bucketStart := now - now%c.bsize
+	c.Add(processedTrace{Trace: model.Trace{model.Span{SpanID: 1, Service: "web", Name: "query", Resource: "GET /", Start: now - 1, Duration: 1}}, Env: "none"}, 1)
+
+	ticker := startFlushTicker(interval, offset, clock.Now, clock.After)
+	defer ticker.Stop()
+
+	// the first tick happens at the offset after the next boundary, then every
+	// interval
+	for i, expected := range []time.Duration{2500 * time.Millisecond, interval, interval} {
+		assert.Equal(expected, clock.next(t), "tick %d", i)
+
+		var tick time.Time
+		select {
+		case tick = <-ticker.C:
+		case <-time.After(time.Second):
+			t.Fatal("no tick received")
+		}
+		assert.Equal(offset, time.Duration(tick.UnixNano()%interval.Nanoseconds()), "tick %d", i)
+
+		// the bucket is flushed at the offset after it would be without it
+		sb := c.flushAt(tick.UnixNano())
+		if i < 2 {
+			assert.Len(sb, 0, "tick %d", i)
+			continue
+		}
+		if assert.Len(sb, 1) {
+			assert.Equal(bucketStart, sb[0].Start)
+			assert.Equal(bucketStart+2*c.bsize+offset.Nanoseconds(), tick.UnixNano())
+		}
+	}
+}
+
+func TestFlushTickerNoOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := newFakeTickerClock(time.Unix(1000, 5e8))
+	ticker := startFlushTicker(10*time.Second, 0, clock.Now, clock.After)
+	defer ticker.Stop()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(10*time.Second, clock.next(t))
+		assert.Equal(clock.now, <-ticker.C)
+	}
+}
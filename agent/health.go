@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/sampler"
+)
+
+// healthStallPeriods is the number of periods a loop can miss before being
+// considered as stalled
+const healthStallPeriods = 3
+
+// healthChecker tells if the processing pipeline is still alive by looking at
+// the last time its periodic loops ticked. It never takes the locks of the
+// components it watches, so that it stays cheap and does not hang when they do.
+type healthChecker struct {
+	concentrator  *Concentrator
+	flushInterval time.Duration
+
+	backend *sampler.Backend
+
+	ready int32 // set to 1, atomically, once the pipeline is running
+}
+
+func newHealthChecker(c *Concentrator, flushInterval time.Duration, b *sampler.Backend) *healthChecker {
+	return &healthChecker{
+		concentrator:  c,
+		flushInterval: flushInterval,
+		backend:       b,
+	}
+}
+
+// setReady marks the pipeline as started
+func (h *healthChecker) setReady() {
+	atomic.StoreInt32(&h.ready, 1)
+}
+
+// check returns an error describing the first stalled loop found, if any
+func (h *healthChecker) check(now time.Time) error {
+	if since := now.Sub(h.concentrator.LastFlush()); since > healthStallPeriods*h.flushInterval {
+		return fmt.Errorf("concentrator did not flush for %s", since)
+	}
+	if since := now.Sub(h.backend.LastDecay()); since > healthStallPeriods*h.backend.DecayPeriod() {
+		return fmt.Errorf("sampler did not decay scores for %s", since)
+	}
+	return nil
+}
+
+// handleHealth reports the liveness of the pipeline
+func (h *healthChecker) handleHealth(w http.ResponseWriter, req *http.Request) {
+	if err := h.check(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	HTTPOK(w)
+}
+
+// handleReady reports if the pipeline is started and alive
+func (h *healthChecker) handleReady(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&h.ready) == 0 {
+		http.Error(w, "not started", http.StatusServiceUnavailable)
+		return
+	}
+	h.handleHealth(w, req)
+}
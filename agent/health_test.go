@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewTestConcentrator()
+	b := sampler.NewBackend(time.Second)
+	h := newHealthChecker(c, time.Second, b)
+
+	// not ready until the pipeline is started
+	rec := httptest.NewRecorder()
+	h.handleReady(rec, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+
+	h.setReady()
+
+	rec = httptest.NewRecorder()
+	h.handleReady(rec, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+}
+
+func TestHealthCheckStalledDecay(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewTestConcentrator()
+	b := sampler.NewBackend(time.Second)
+	h := newHealthChecker(c, time.Hour, b)
+	h.setReady()
+
+	// the decay loop did not run for more than healthStallPeriods periods
+	now := time.Now().Add(healthStallPeriods*time.Second + time.Second)
+	assert.NotNil(h.check(now))
+	c.Flush()
+	assert.NotNil(h.check(now))
+
+	// it runs again, we're back to normal
+	b.DecayScore()
+	assert.Nil(h.check(time.Now()))
+
+	// simulate a stall using a decay period short enough to be missed
+	b = sampler.NewBackend(time.Millisecond)
+	h = newHealthChecker(c, time.Hour, b)
+	h.setReady()
+	time.Sleep(10 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	h.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.handleReady(rec, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestHealthCheckStalledFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewTestConcentrator()
+	b := sampler.NewBackend(time.Hour)
+	h := newHealthChecker(c, time.Millisecond, b)
+	time.Sleep(10 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	h.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+
+	c.Flush()
+
+	rec = httptest.NewRecorder()
+	h.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+}
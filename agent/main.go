@@ -38,7 +38,7 @@ func handleSignal(exit chan struct{}) {
 
 // die logs an error message and makes the program exit immediately.
 func die(format string, args ...interface{}) {
-	if opts.info || opts.version {
+	if opts.info || opts.version || opts.analyzeFile != "" {
 		// here, we've silenced the logger, and just want plain console output
 		fmt.Printf(format, args...)
 		fmt.Print("")
@@ -58,6 +58,7 @@ var opts struct {
 	info         bool
 	cpuprofile   string
 	memprofile   string
+	analyzeFile  string
 }
 
 // version info sourced from build flags
@@ -105,6 +106,7 @@ func init() {
 	flag.StringVar(&opts.configFile, "config", "/etc/datadog/trace-agent.ini", "Trace agent ini config file.")
 	flag.BoolVar(&opts.version, "version", false, "Show version information and exit")
 	flag.BoolVar(&opts.info, "info", false, "Show info about running trace agent process and exit")
+	flag.StringVar(&opts.analyzeFile, "analyze-file", "", "Run the JSON traces of this file, or of stdin if set to -, through the stats and the sampling, print the results and exit")
 
 	// profiling arguments
 	flag.StringVar(&opts.cpuprofile, "cpuprofile", "", "Write cpu profile to file")
@@ -116,7 +118,7 @@ func init() {
 // main is the entrypoint of our code
 func main() {
 	// configure a default logger before anything so we can observe initialization
-	if opts.info || opts.version {
+	if opts.info || opts.version || opts.analyzeFile != "" {
 		log.UseLogger(log.Disabled)
 	} else {
 		config.NewLoggerLevelCustom("DEBUG", "/var/log/datadog/trace-agent.log")
@@ -184,6 +186,13 @@ func main() {
 		return
 	}
 
+	if opts.analyzeFile != "" {
+		if err := analyzeFile(agentConf, opts.analyzeFile, os.Stdout); err != nil {
+			die("cannot analyze %s: %v\n", opts.analyzeFile, err)
+		}
+		return
+	}
+
 	// Exit if tracing is not enabled
 	if !agentConf.Enabled {
 		log.Info(agentDisabledMessage)
@@ -220,6 +229,11 @@ func main() {
 	log.Infof("trace-agent running on host %s", agentConf.HostName)
 	agent.Run()
 
+	// send the last metrics, which could be buffered
+	if err := statsd.Close(); err != nil {
+		log.Errorf("cannot flush dogstatsd metrics: %v", err)
+	}
+
 	// collect memory profile
 	if opts.memprofile != "" {
 		f, err := os.Create(opts.memprofile)
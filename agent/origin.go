@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+const (
+	// originLangMeta and originTracerVersionMeta are the meta set by the
+	// clients to tell the language and version of their tracer
+	originLangMeta          = "language"
+	originTracerVersionMeta = "_dd.tracer_version"
+
+	// originOther is the value of the origin tags once there are too many
+	// distinct origins, originUnknown the one of a missing meta
+	originOther   = "other"
+	originUnknown = "unknown"
+)
+
+// originTagger returns the tags telling the origin of a trace, i.e. the language
+// and version of the tracer which sent it, to tag internal metrics with them so
+// that buggy tracer versions are easy to spot. Beyond max distinct origins, the
+// new ones are tagged as "other" to bound the cardinality of the metrics. A nil
+// originTagger returns no tags.
+type originTagger struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[[2]string]struct{}
+}
+
+func newOriginTagger(max int) *originTagger {
+	return &originTagger{
+		max:  max,
+		seen: make(map[[2]string]struct{}),
+	}
+}
+
+// tags returns the origin tags of the trace, nil if it has no origin meta
+func (o *originTagger) tags(t model.Trace) []string {
+	if o == nil {
+		return nil
+	}
+
+	var origin [2]string
+	for _, s := range t {
+		if origin[0] == "" {
+			origin[0] = s.Meta[originLangMeta]
+		}
+		if origin[1] == "" {
+			origin[1] = s.Meta[originTracerVersionMeta]
+		}
+	}
+	if origin[0] == "" && origin[1] == "" {
+		return nil
+	}
+	for i, v := range origin {
+		if v == "" {
+			origin[i] = originUnknown
+		}
+	}
+	// tags are normalized as a whole, the values can start with a digit
+	origin[0] = model.NormalizeTag("lang:" + origin[0])
+	origin[1] = model.NormalizeTag("tracer_version:" + origin[1])
+
+	o.mu.Lock()
+	if _, ok := o.seen[origin]; !ok {
+		if len(o.seen) < o.max {
+			o.seen[origin] = struct{}{}
+		} else {
+			origin = [2]string{"lang:" + originOther, "tracer_version:" + originOther}
+		}
+	}
+	o.mu.Unlock()
+
+	return []string{origin[0], origin[1]}
+}
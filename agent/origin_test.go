@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginTagger(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := func(meta map[string]string) model.Trace {
+		return model.Trace{
+			model.Span{TraceID: 1, SpanID: 1, Service: "web", Meta: meta},
+			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db"},
+		}
+	}
+
+	o := newOriginTagger(2)
+	assert.Equal([]string{"lang:go", "tracer_version:1.2.0"}, o.tags(trace(map[string]string{"language": "Go", "_dd.tracer_version": "1.2.0"})))
+	assert.Equal([]string{"lang:python", "tracer_version:unknown"}, o.tags(trace(map[string]string{"language": "python"})))
+	assert.Nil(o.tags(trace(nil)))
+
+	// beyond 2 distinct origins, the new ones are grouped
+	assert.Equal([]string{"lang:other", "tracer_version:other"}, o.tags(trace(map[string]string{"language": "ruby", "_dd.tracer_version": "0.9"})))
+	assert.Equal([]string{"lang:go", "tracer_version:1.2.0"}, o.tags(trace(map[string]string{"language": "go", "_dd.tracer_version": "1.2.0"})))
+
+	// disabled
+	o = nil
+	assert.Nil(o.tags(trace(map[string]string{"language": "go"})))
+}
+
+func TestReceiverOriginTags(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.OriginTags = true
+	r := NewHTTPReceiver(conf)
+	server := httptest.NewServer(http.HandlerFunc(r.httpHandleWithVersion(v03, r.handleTraces)))
+	defer server.Close()
+
+	now := model.Now()
+	traces := model.Traces{model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100,
+			Meta: map[string]string{"language": "go", "_dd.tracer_version": "1.2.0"}},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Start: now, Duration: 50},
+	}}
+	data, err := json.Marshal(traces)
+	assert.Nil(err)
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(data))
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.receiver.accepted_spans")
+	assert.Equal("datadog.trace_agent.receiver.accepted_spans:2|c|#lang:go,tracer_version:1.2.0", metrics[0])
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
 	"strings"
@@ -27,6 +29,7 @@ const (
 	maxRequestBodyLength = 10 * 1024 * 1024
 	tagTraceHandler      = "handler:traces"
 	tagServiceHandler    = "handler:services"
+	tagZipkinHandler     = "handler:zipkin"
 )
 
 // APIVersion is a dumb way to version our collector handlers
@@ -45,6 +48,11 @@ const (
 	// Traces: msgpack/JSON (Content-Type) slice of traces
 	// Services: msgpack/JSON, map[string]map[string][string]
 	v03 APIVersion = "v0.3"
+	// v03Tagged
+	// Traces: msgpack/JSON (Content-Type) map with a slice of traces under "traces",
+	// and the tags common to all their spans under "tags". This is not the v0.4 of
+	// the clients, which sends a slice of traces like v03.
+	v03Tagged APIVersion = "v0.3-tagged"
 )
 
 // HTTPReceiver is a collector that uses HTTP protocol and just holds
@@ -59,6 +67,11 @@ type HTTPReceiver struct {
 	logger *errorLogger
 	stats  receiverStats
 
+	// spans of these services are dropped as soon as they are received
+	ignoredServices map[string]struct{}
+	// tags metrics by the origin of the traces, nil if disabled
+	origins *originTagger
+
 	exit chan struct{}
 
 	maxRequestBodyLength int64
@@ -67,6 +80,16 @@ type HTTPReceiver struct {
 
 // NewHTTPReceiver returns a pointer to a new HTTPReceiver
 func NewHTTPReceiver(conf *config.AgentConfig) *HTTPReceiver {
+	ignoredServices := make(map[string]struct{}, len(conf.IgnoreServices))
+	for _, s := range conf.IgnoreServices {
+		ignoredServices[s] = struct{}{}
+	}
+
+	var origins *originTagger
+	if conf.OriginTags {
+		origins = newOriginTagger(conf.MaxOriginTags)
+	}
+
 	// use buffered channels so that handlers are not waiting on downstream processing
 	return &HTTPReceiver{
 		traces:   make(chan model.Trace, 5000), // about 1000 traces/sec for 5 sec
@@ -75,6 +98,9 @@ func NewHTTPReceiver(conf *config.AgentConfig) *HTTPReceiver {
 		logger:   &errorLogger{},
 		exit:     make(chan struct{}),
 
+		ignoredServices: ignoredServices,
+		origins:         origins,
+
 		maxRequestBodyLength: maxRequestBodyLength,
 		debug:                strings.ToLower(conf.LogLevel) == "debug",
 	}
@@ -93,6 +119,10 @@ func (r *HTTPReceiver) Run() {
 	// current collector API
 	http.HandleFunc("/v0.3/traces", r.httpHandleWithVersion(v03, r.handleTraces))
 	http.HandleFunc("/v0.3/services", r.httpHandleWithVersion(v03, r.handleServices))
+	http.HandleFunc("/v0.3/tagged_traces", r.httpHandleWithVersion(v03Tagged, r.handleTraces))
+
+	// spans of the services instrumented with Zipkin
+	http.HandleFunc("/api/v2/spans", r.httpHandle(r.handleZipkinSpans))
 
 	// expvar implicitely publishes "/debug/vars" on the same port
 
@@ -106,6 +136,15 @@ func (r *HTTPReceiver) Run() {
 		log.Error(err)
 	}
 
+	// endpoints serving the apps of other envs than DefaultEnv
+	for port, env := range r.conf.ReceiverDefaultEnvs {
+		envAddr := fmt.Sprintf("%s:%d", r.conf.ReceiverHost, port)
+		handler := withDefaultEnv(env, http.DefaultServeMux)
+		if err := r.listen(envAddr, fmt.Sprintf(" (env:%s)", env), handler); err != nil {
+			log.Error(err)
+		}
+	}
+
 	watchdog.Go(func() {
 		r.logStats()
 	})
@@ -113,6 +152,12 @@ func (r *HTTPReceiver) Run() {
 
 // Listen creates a new HTTP server listening on the provided address.
 func (r *HTTPReceiver) Listen(addr, logExtra string) error {
+	return r.listen(addr, logExtra, nil)
+}
+
+// listen creates a new HTTP server listening on the provided address and
+// serving requests with handler, or with http.DefaultServeMux if nil.
+func (r *HTTPReceiver) listen(addr, logExtra string, handler http.Handler) error {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("cannot listen on %s: %v", addr, err)
@@ -130,6 +175,7 @@ func (r *HTTPReceiver) Listen(addr, logExtra string) error {
 	}
 
 	server := http.Server{
+		Handler:      handler,
 		ReadTimeout:  time.Second * time.Duration(timeout),
 		WriteTimeout: time.Second * time.Duration(timeout),
 	}
@@ -146,6 +192,26 @@ func (r *HTTPReceiver) Listen(addr, logExtra string) error {
 	return nil
 }
 
+// defaultEnvKey is the context key of the default env of the endpoint a request
+// was received on
+type defaultEnvKey struct{}
+
+// withDefaultEnv returns a handler serving requests with h, the traces they
+// carry defaulting to env instead of DefaultEnv
+func withDefaultEnv(env string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), defaultEnvKey{}, env)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// requestDefaultEnv returns the default env of the endpoint the request was
+// received on, or an empty string if the agent DefaultEnv applies
+func requestDefaultEnv(req *http.Request) string {
+	env, _ := req.Context().Value(defaultEnvKey{}).(string)
+	return env
+}
+
 func (r *HTTPReceiver) httpHandle(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		req.Body = model.NewLimitedReader(req.Body, r.maxRequestBodyLength)
@@ -174,6 +240,7 @@ func (r *HTTPReceiver) handleTraces(v APIVersion, w http.ResponseWriter, req *ht
 	var traces model.Traces
 	contentType := req.Header.Get("Content-Type")
 
+	decodeStart := time.Now()
 	switch v {
 	case v01:
 		// We cannot use decodeReceiverPayload because []model.Span does not
@@ -197,17 +264,33 @@ func (r *HTTPReceiver) handleTraces(v APIVersion, w http.ResponseWriter, req *ht
 	case v02:
 		fallthrough
 	case v03:
+		if r.conf.ReceiverStreamingDecoding {
+			r.handleTracesStream(v, w, req)
+			return
+		}
 		if err := decodeReceiverPayload(req.Body, &traces, v, contentType); err != nil {
 			r.logger.Errorf("cannot decode %s traces payload: %v", v, err)
 			HTTPDecodingError(err, []string{tagTraceHandler, fmt.Sprintf("v:%s", v)}, w)
 			return
 		}
 
+	case v03Tagged:
+		var payload model.TracePayload
+		if err := decodeReceiverPayload(req.Body, &payload, v, contentType); err != nil {
+			r.logger.Errorf("cannot decode %s traces payload: %v", v, err)
+			HTTPDecodingError(err, []string{tagTraceHandler, fmt.Sprintf("v:%s", v)}, w)
+			return
+		}
+		payload.SpreadTags()
+		traces = payload.Traces
+
 	default:
 		HTTPEndpointNotSupported([]string{tagTraceHandler, fmt.Sprintf("v:%s", v)}, w)
 		return
 	}
 
+	decodeTime := time.Since(decodeStart)
+
 	HTTPOK(w)
 
 	bytesRead := req.Body.(*model.LimitedReader).Count
@@ -215,38 +298,224 @@ func (r *HTTPReceiver) handleTraces(v APIVersion, w http.ResponseWriter, req *ht
 		atomic.AddInt64(&r.stats.TracesBytes, int64(bytesRead))
 	}
 
+	decodeTags := []string{tagTraceHandler, fmt.Sprintf("v:%s", v), contentTypeTag(contentType)}
+	statsd.Client.Histogram("datadog.trace_agent.receiver.decode_time", decodeTime.Seconds()*1000, decodeTags, 1)
+	statsd.Client.Histogram("datadog.trace_agent.receiver.payload_bytes", float64(bytesRead), decodeTags, 1)
+
 	// normalize data
+	env := requestDefaultEnv(req)
+	for i := range traces {
+		r.processTrace(traces[i], env)
+	}
+}
+
+// handleZipkinSpans handles a payload of Zipkin v2 JSON spans, which are grouped
+// in traces and then processed like the native ones
+func (r *HTTPReceiver) handleZipkinSpans(w http.ResponseWriter, req *http.Request) {
+	contentType := req.Header.Get("Content-Type")
+	if contentType != "" {
+		// clients usually add parameters, e.g. "application/json; charset=utf-8"
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			// the protobuf format is not supported
+			r.logger.Errorf("rejecting zipkin request, unsupported media type %q", contentType)
+			HTTPFormatError([]string{tagZipkinHandler}, w)
+			return
+		}
+		contentType = mediaType
+	}
+
+	var zspans []model.ZipkinSpan
+	decodeStart := time.Now()
+	err := json.NewDecoder(req.Body).Decode(&zspans)
+	var traces model.Traces
+	if err == nil {
+		traces, err = model.TracesFromZipkinSpans(zspans)
+	}
+	if err != nil {
+		r.logger.Errorf("cannot decode zipkin spans payload: %v", err)
+		HTTPDecodingError(err, []string{tagZipkinHandler}, w)
+		return
+	}
+	decodeTime := time.Since(decodeStart)
+
+	// what Zipkin collectors answer
+	w.WriteHeader(http.StatusAccepted)
+
+	bytesRead := req.Body.(*model.LimitedReader).Count
+	if bytesRead > 0 {
+		atomic.AddInt64(&r.stats.TracesBytes, int64(bytesRead))
+	}
+
+	decodeTags := []string{tagZipkinHandler, contentTypeTag(contentType)}
+	statsd.Client.Histogram("datadog.trace_agent.receiver.decode_time", decodeTime.Seconds()*1000, decodeTags, 1)
+	statsd.Client.Histogram("datadog.trace_agent.receiver.payload_bytes", float64(bytesRead), decodeTags, 1)
+
+	env := requestDefaultEnv(req)
 	for i := range traces {
-		spans := len(traces[i])
-		normTrace, err := model.NormalizeTrace(traces[i])
+		r.processTrace(traces[i], env)
+	}
+}
+
+// handleTracesStream handles a v02 or v03 payload of traces by decoding them
+// one at a time and handing them off as they come, so that large payloads are
+// never held in memory at once. Traces decoded before an invalid part of the
+// payload are still processed, though the client gets a decoding error.
+func (r *HTTPReceiver) handleTracesStream(v APIVersion, w http.ResponseWriter, req *http.Request) {
+	contentType := req.Header.Get("Content-Type")
+
+	var dec model.TracesDecoder
+	switch contentType {
+	case "application/msgpack":
+		dec = model.NewMsgpackTracesDecoder(req.Body)
+	case "application/json", "text/json", "":
+		dec = model.NewJSONTracesDecoder(req.Body)
+	default:
+		r.logger.Errorf("rejecting client request, unsupported media type %q", contentType)
+		HTTPFormatError([]string{tagTraceHandler, fmt.Sprintf("v:%s", v)}, w)
+		return
+	}
+
+	env := requestDefaultEnv(req)
+	var decodeTime time.Duration
+	for {
+		decodeStart := time.Now()
+		t, err := dec.Next()
+		decodeTime += time.Since(decodeStart)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			atomic.AddInt64(&r.stats.TracesDropped, 1)
-			atomic.AddInt64(&r.stats.SpansDropped, int64(spans))
+			r.logger.Errorf("cannot decode %s traces payload: %v", v, err)
+			HTTPDecodingError(err, []string{tagTraceHandler, fmt.Sprintf("v:%s", v)}, w)
+			return
+		}
+		r.processTrace(t, env)
+	}
 
-			errorMsg := fmt.Sprintf("dropping trace reason: %s (debug for more info), %v", err, normTrace)
-			if len(errorMsg) > 150 && r.debug {
-				errorMsg = errorMsg[:150] + "..."
-			}
-			r.logger.Errorf(errorMsg)
-		} else {
-			atomic.AddInt64(&r.stats.SpansDropped, int64(spans-len(normTrace)))
+	HTTPOK(w)
+
+	bytesRead := req.Body.(*model.LimitedReader).Count
+	if bytesRead > 0 {
+		atomic.AddInt64(&r.stats.TracesBytes, int64(bytesRead))
+	}
+
+	decodeTags := []string{tagTraceHandler, fmt.Sprintf("v:%s", v), contentTypeTag(contentType)}
+	statsd.Client.Histogram("datadog.trace_agent.receiver.decode_time", decodeTime.Seconds()*1000, decodeTags, 1)
+	statsd.Client.Histogram("datadog.trace_agent.receiver.payload_bytes", float64(bytesRead), decodeTags, 1)
+}
+
+// processTrace normalizes a received trace and hands it off to the agent. Spans
+// with a zero trace ID are either rejected along with their trace, or split into
+// traces of their own when AssignZeroTraceIDs is set. Traces without an env get
+// defaultEnv, if not empty.
+func (r *HTTPReceiver) processTrace(t model.Trace, defaultEnv string) {
+	traces, zero := t.SplitZeroTraceIDs()
+	if zero == 0 {
+		r.acceptTrace(t, defaultEnv)
+		return
+	}
+
+	if !r.conf.AssignZeroTraceIDs {
+		statsd.Client.Count("datadog.trace_agent.receiver.zero_trace_id", int64(zero), []string{"action:rejected"}, 1)
+		// the normalization drops the trace
+		r.acceptTrace(t, defaultEnv)
+		return
+	}
+
+	statsd.Client.Count("datadog.trace_agent.receiver.zero_trace_id", int64(zero), []string{"action:assigned"}, 1)
+	for _, t := range traces {
+		r.acceptTrace(t, defaultEnv)
+	}
+}
+
+// acceptTrace normalizes a trace and hands it off to the agent
+func (r *HTTPReceiver) acceptTrace(t model.Trace, defaultEnv string) {
+	spans := len(t)
+	normTrace, err := r.limitResources(t)
+	if err == nil {
+		normTrace, err = model.NormalizeTrace(normTrace)
+	}
+	if err != nil {
+		atomic.AddInt64(&r.stats.TracesDropped, 1)
+		atomic.AddInt64(&r.stats.SpansDropped, int64(spans))
 
-			// if our downstream consumer is slow, we drop the trace on the floor
-			// this is a safety net against us using too much memory
-			// when clients flood us
+		errorMsg := fmt.Sprintf("dropping trace reason: %s (debug for more info), %v", err, normTrace)
+		if len(errorMsg) > 150 && r.debug {
+			errorMsg = errorMsg[:150] + "..."
+		}
+		r.logger.Errorf(errorMsg)
+	} else {
+		atomic.AddInt64(&r.stats.SpansDropped, int64(spans-len(normTrace)))
+
+		if len(r.conf.ServiceAliases) > 0 {
+			normTrace.RenameServices(r.conf.ServiceAliases)
+		}
+
+		if r.conf.LowercaseNames {
+			normTrace.LowercaseNames()
+		}
+
+		var duplicates int
+		if normTrace, duplicates = normTrace.DropDuplicateSpanIDs(); duplicates > 0 {
+			log.Debugf("dropped %d spans with a duplicate span ID from trace %d", duplicates, normTrace[0].TraceID)
+			statsd.Client.Count("datadog.trace_agent.trace.duplicate_span_id", int64(duplicates), nil, 1)
+			atomic.AddInt64(&r.stats.SpansDropped, int64(duplicates))
+		}
+
+		if len(r.ignoredServices) > 0 {
+			var ignored int
+			normTrace, ignored = normTrace.DropServices(r.ignoredServices)
+			atomic.AddInt64(&r.stats.SpansIgnored, int64(ignored))
+		}
+
+		if defaultEnv != "" {
+			normTrace.SetDefaultEnv(defaultEnv)
+		}
+
+		// if our downstream consumer is slow, we drop the trace on the floor
+		// this is a safety net against us using too much memory
+		// when clients flood us
+		if len(normTrace) > 0 {
 			select {
 			case r.traces <- normTrace:
+				if r.origins != nil {
+					statsd.Client.Count("datadog.trace_agent.receiver.accepted_spans", int64(len(normTrace)), r.origins.tags(normTrace), 1)
+				}
 			default:
 				atomic.AddInt64(&r.stats.TracesDropped, 1)
-				atomic.AddInt64(&r.stats.SpansDropped, int64(spans))
+				atomic.AddInt64(&r.stats.SpansDropped, int64(len(normTrace)))
 
 				r.logger.Errorf("dropping trace reason: rate-limited")
 			}
 		}
+	}
+
+	atomic.AddInt64(&r.stats.TracesReceived, 1)
+	atomic.AddInt64(&r.stats.SpansReceived, int64(spans))
+}
 
-		atomic.AddInt64(&r.stats.TracesReceived, 1)
-		atomic.AddInt64(&r.stats.SpansReceived, int64(spans))
+// limitResources truncates the oversized resources of a trace, or rejects the
+// trace if RejectLongResources is set, since a single huge resource bloats all
+// the structures it goes through downstream
+func (r *HTTPReceiver) limitResources(t model.Trace) (model.Trace, error) {
+	max := r.conf.MaxResourceLen
+	if max <= 0 {
+		return t, nil
 	}
+
+	if r.conf.RejectLongResources {
+		if n := t.OversizedResources(max); n > 0 {
+			statsd.Client.Count("datadog.trace_agent.receiver.oversized_resource", int64(n), []string{"action:rejected"}, 1)
+			return t, fmt.Errorf("resource too long (max %d chars)", max)
+		}
+		return t, nil
+	}
+
+	if n := t.TruncateResources(max); n > 0 {
+		statsd.Client.Count("datadog.trace_agent.receiver.oversized_resource", int64(n), []string{"action:truncated"}, 1)
+	}
+	return t, nil
 }
 
 // handleServices handle a request with a list of several services
@@ -261,6 +530,10 @@ func (r *HTTPReceiver) handleServices(v APIVersion, w http.ResponseWriter, req *
 		return
 	}
 
+	if len(r.conf.ServiceAliases) > 0 {
+		servicesMeta.RenameServices(r.conf.ServiceAliases)
+	}
+
 	statsd.Client.Count("datadog.trace_agent.receiver.service", int64(len(servicesMeta)), nil, 1)
 	HTTPOK(w)
 
@@ -297,6 +570,9 @@ func (r *HTTPReceiver) logStats() {
 		tdropped := atomic.SwapInt64(&r.stats.TracesDropped, 0)
 		accStats.TracesDropped += tdropped
 
+		signored := atomic.SwapInt64(&r.stats.SpansIgnored, 0)
+		accStats.SpansIgnored += signored
+
 		statsd.Client.Gauge("datadog.trace_agent.heartbeat", 1, []string{fmt.Sprintf("version:%s", Version)}, 1)
 
 		statsd.Client.Count("datadog.trace_agent.receiver.traces", tracesBytes, []string{"endpoint:traces"}, 1)
@@ -305,6 +581,7 @@ func (r *HTTPReceiver) logStats() {
 		statsd.Client.Count("datadog.trace_agent.receiver.trace", traces, nil, 1)
 		statsd.Client.Count("datadog.trace_agent.receiver.span_dropped", sdropped, nil, 1)
 		statsd.Client.Count("datadog.trace_agent.receiver.trace_dropped", tdropped, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.ingest.ignored", signored, nil, 1)
 
 		if now.Sub(lastLog) >= time.Minute {
 			updateReceiverStats(accStats)
@@ -333,6 +610,22 @@ type receiverStats struct {
 	SpansDropped int64
 	// SpansReceived is the number of traces dropped
 	TracesDropped int64
+	// SpansIgnored is the number of spans dropped because their service is ignored
+	SpansIgnored int64
+}
+
+// contentTypeTag returns the tag identifying the content type of a payload. The
+// content types the receiver does not know are tagged as "other", so that the
+// headers of the clients do not end up in the tags.
+func contentTypeTag(contentType string) string {
+	switch contentType {
+	case "":
+		contentType = "none"
+	case "application/msgpack", "application/json", "text/json":
+	default:
+		contentType = "other"
+	}
+	return fmt.Sprintf("content_type:%s", contentType)
 }
 
 func decodeReceiverPayload(r io.Reader, dest msgp.Decodable, v APIVersion, contentType string) error {
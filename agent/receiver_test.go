@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -189,6 +190,568 @@ func TestReceiverJSONDecoder(t *testing.T) {
 	}
 }
 
+func TestReceiverIgnoreServices(t *testing.T) {
+	assert := assert.New(t)
+	conf := config.NewDefaultAgentConfig()
+	conf.IgnoreServices = []string{"envoy.internal"}
+	r := NewHTTPReceiver(conf)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(r.httpHandleWithVersion(v03, r.handleTraces)),
+	)
+	defer server.Close()
+
+	traces := model.Traces{
+		model.Trace{
+			model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: model.Now(), Duration: 100},
+			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "envoy.internal", Name: "proxy", Resource: "proxy", Start: model.Now(), Duration: 50},
+			model.Span{TraceID: 1, SpanID: 3, ParentID: 2, Service: "db", Name: "db.query", Resource: "SELECT", Start: model.Now(), Duration: 10},
+		},
+		// a trace made only of ignored spans is not passed downstream
+		model.Trace{
+			model.Span{TraceID: 2, SpanID: 4, Service: "envoy.internal", Name: "proxy", Resource: "proxy", Start: model.Now(), Duration: 50},
+		},
+	}
+
+	data, err := json.Marshal(traces)
+	assert.Nil(err)
+	resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(data))
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	select {
+	case rt := <-r.traces:
+		if assert.Len(rt, 2) {
+			assert.Equal(uint64(1), rt[0].SpanID)
+			assert.Equal(uint64(3), rt[1].SpanID)
+			assert.Equal(uint64(1), rt[1].ParentID)
+		}
+	default:
+		t.Fatalf("no data received")
+	}
+
+	select {
+	case rt := <-r.traces:
+		t.Fatalf("trace of ignored spans should have been dropped: %v", rt)
+	default:
+	}
+
+	assert.Equal(int64(2), r.stats.SpansIgnored)
+	assert.Equal(int64(0), r.stats.SpansDropped)
+}
+
+func TestReceiverDuplicateSpanIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	r := NewHTTPReceiver(config.NewDefaultAgentConfig())
+	server := httptest.NewServer(
+		http.HandlerFunc(r.httpHandleWithVersion(v03, r.handleTraces)),
+	)
+	defer server.Close()
+
+	traces := model.Traces{
+		model.Trace{
+			model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: model.Now(), Duration: 100},
+			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Start: model.Now(), Duration: 10},
+			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "cache", Name: "redis.command", Resource: "GET", Start: model.Now(), Duration: 5},
+		},
+	}
+
+	data, err := json.Marshal(traces)
+	assert.Nil(err)
+	resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(data))
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	select {
+	case rt := <-r.traces:
+		// only the first span of each ID is kept
+		if assert.Len(rt, 2) {
+			assert.Equal("web", rt[0].Service)
+			assert.Equal("db", rt[1].Service)
+		}
+	default:
+		t.Fatalf("no data received")
+	}
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.trace.duplicate_span_id")
+	assert.Equal("datadog.trace_agent.trace.duplicate_span_id:1|c", metrics[0])
+	assert.Equal(int64(1), r.stats.SpansDropped)
+}
+
+func TestReceiverOversizedResources(t *testing.T) {
+	now := model.Now()
+	traces := model.Traces{
+		model.Trace{
+			model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100},
+			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: strings.Repeat("SELECT ", 1000), Start: now, Duration: 10},
+		},
+		model.Trace{model.Span{TraceID: 2, SpanID: 3, Service: "web", Name: "http.request", Resource: "GET /users", Start: now, Duration: 100}},
+	}
+	data, err := json.Marshal(traces)
+	assert.Nil(t, err)
+
+	for _, tc := range []struct {
+		reject bool
+		metric string
+	}{
+		{false, "datadog.trace_agent.receiver.oversized_resource:1|c|#action:truncated"},
+		{true, "datadog.trace_agent.receiver.oversized_resource:1|c|#action:rejected"},
+	} {
+		assert := assert.New(t)
+
+		statsdServer := newTestStatsdServer(t)
+		conf := config.NewDefaultAgentConfig()
+		conf.MaxResourceLen = 100
+		conf.RejectLongResources = tc.reject
+		r := NewHTTPReceiver(conf)
+		server := httptest.NewServer(
+			http.HandlerFunc(r.httpHandleWithVersion(v03, r.handleTraces)),
+		)
+
+		resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(data))
+		assert.Nil(err)
+		assert.Equal(200, resp.StatusCode)
+		resp.Body.Close()
+		server.Close()
+
+		metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.receiver.oversized_resource")
+		assert.Equal(tc.metric, metrics[0])
+		statsdServer.Close()
+
+		var received []model.Trace
+	loop:
+		for {
+			select {
+			case rt := <-r.traces:
+				received = append(received, rt)
+			default:
+				break loop
+			}
+		}
+
+		if tc.reject {
+			// the whole trace is dropped, not the other one
+			assert.Len(received, 1)
+			assert.Equal(uint64(2), received[0][0].TraceID)
+			assert.Equal(int64(1), r.stats.TracesDropped)
+			assert.Equal(int64(2), r.stats.SpansDropped)
+			continue
+		}
+
+		assert.Len(received, 2)
+		assert.Equal(100, len(received[0][1].Resource))
+		assert.Equal("GET /", received[0][0].Resource)
+		assert.Equal(int64(0), r.stats.TracesDropped)
+	}
+}
+
+func TestReceiverDecodeMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	r := NewHTTPReceiver(config.NewDefaultAgentConfig())
+	server := httptest.NewServer(
+		http.HandlerFunc(r.httpHandleWithVersion(v03, r.handleTraces)),
+	)
+	defer server.Close()
+
+	traces := fixtures.GetTestTrace(1, 1)
+	jsonData, err := json.Marshal(traces)
+	assert.Nil(err)
+	var msgpackData bytes.Buffer
+	assert.Nil(msgp.Encode(&msgpackData, traces))
+
+	for _, tc := range []struct {
+		contentType string
+		data        []byte
+	}{
+		{"application/json", jsonData},
+		{"application/msgpack", msgpackData.Bytes()},
+	} {
+		resp, err := http.Post(server.URL, tc.contentType, bytes.NewReader(tc.data))
+		assert.Nil(err)
+		assert.Equal(200, resp.StatusCode)
+		resp.Body.Close()
+
+		metrics := statsdServer.waitMetrics(t,
+			"datadog.trace_agent.receiver.decode_time",
+			"datadog.trace_agent.receiver.payload_bytes",
+		)
+
+		tag := "content_type:" + tc.contentType
+		// in milliseconds
+		assert.True(strings.HasPrefix(metrics[0], "datadog.trace_agent.receiver.decode_time:"), metrics[0])
+		assert.Contains(metrics[0], "|h|")
+		assert.Contains(metrics[0], tag)
+		assert.True(strings.HasPrefix(metrics[1], fmt.Sprintf("datadog.trace_agent.receiver.payload_bytes:%d.", len(tc.data))), metrics[1])
+		assert.Contains(metrics[1], tag)
+	}
+}
+
+func TestReceiverServiceAliases(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ServiceAliases = map[string]string{"checkout-svc": "checkout"}
+	r := NewHTTPReceiver(conf)
+	server := httptest.NewServer(
+		http.HandlerFunc(r.httpHandleWithVersion(v03, r.handleTraces)),
+	)
+	defer server.Close()
+
+	// old enough for the stats to be flushed right away
+	start := model.Now() - time.Minute.Nanoseconds()
+	traces := model.Traces{
+		model.Trace{model.Span{TraceID: 1, SpanID: 1, Service: "checkout", Name: "http.request", Resource: "POST /cart", Start: start, Duration: 100}},
+		model.Trace{model.Span{TraceID: 2, SpanID: 2, Service: "Checkout-Svc", Name: "http.request", Resource: "POST /cart", Start: start, Duration: 200}},
+	}
+	data, err := json.Marshal(traces)
+	assert.Nil(err)
+	resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(data))
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	// both variants are aggregated together in the stats
+	c := NewConcentrator([]string{}, testBucketInterval, 0)
+	for range traces {
+		select {
+		case rt := <-r.traces:
+			assert.Equal("checkout", rt[0].Service)
+			c.Add(processedTrace{Trace: rt, Root: rt.GetRoot(), Env: "none"}, 1)
+		default:
+			t.Fatalf("no data received")
+		}
+	}
+
+	counts := make(map[string]float64)
+	for _, b := range c.Flush() {
+		for k, v := range b.Counts {
+			counts[k] += v.Value
+		}
+	}
+	assert.Equal(map[string]float64{
+		"http.request|hits|env:none,resource:POST /cart,service:checkout":     2,
+		"http.request|errors|env:none,resource:POST /cart,service:checkout":   0,
+		"http.request|duration|env:none,resource:POST /cart,service:checkout": 300,
+	}, counts)
+}
+
+func TestReceiverZeroTraceIDs(t *testing.T) {
+	now := model.Now()
+	traces := model.Traces{
+		model.Trace{
+			model.Span{TraceID: 0, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100},
+			model.Span{TraceID: 0, SpanID: 2, Service: "web", Name: "http.request", Resource: "GET /users", Start: now, Duration: 100},
+		},
+		model.Trace{model.Span{TraceID: 0, SpanID: 3, Service: "db", Name: "db.query", Resource: "SELECT", Start: now, Duration: 100}},
+		model.Trace{model.Span{TraceID: 42, SpanID: 4, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100}},
+	}
+	data, err := json.Marshal(traces)
+	assert.Nil(t, err)
+
+	for _, assign := range []bool{false, true} {
+		assert := assert.New(t)
+
+		conf := config.NewDefaultAgentConfig()
+		conf.AssignZeroTraceIDs = assign
+		r := NewHTTPReceiver(conf)
+		server := httptest.NewServer(
+			http.HandlerFunc(r.httpHandleWithVersion(v03, r.handleTraces)),
+		)
+
+		resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(data))
+		assert.Nil(err)
+		assert.Equal(200, resp.StatusCode)
+		resp.Body.Close()
+		server.Close()
+
+		var received []model.Trace
+	loop:
+		for {
+			select {
+			case rt := <-r.traces:
+				received = append(received, rt)
+			default:
+				break loop
+			}
+		}
+
+		if !assign {
+			// only the trace with a valid ID is kept
+			assert.Len(received, 1)
+			assert.Equal(uint64(42), received[0][0].TraceID)
+			assert.Equal(int64(2), r.stats.TracesDropped)
+			assert.Equal(int64(3), r.stats.SpansDropped)
+			continue
+		}
+
+		// each span with a zero trace ID is its own trace
+		assert.Len(received, 4)
+		ids := make(map[uint64]uint64)
+		for _, rt := range received {
+			assert.Len(rt, 1)
+			assert.NotEqual(uint64(0), rt[0].TraceID)
+			ids[rt[0].TraceID] = rt[0].SpanID
+		}
+		assert.Len(ids, 4)
+		assert.Equal(uint64(4), ids[42])
+		assert.Equal(int64(0), r.stats.TracesDropped)
+	}
+}
+
+func TestReceiverDefaultEnvs(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	r := NewHTTPReceiver(conf)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v0.3/traces", r.httpHandleWithVersion(v03, r.handleTraces))
+
+	// two endpoints serving apps of different envs, and the main one
+	staging := httptest.NewServer(withDefaultEnv("staging", mux))
+	defer staging.Close()
+	qa := httptest.NewServer(withDefaultEnv("qa", mux))
+	defer qa.Close()
+	global := httptest.NewServer(mux)
+	defer global.Close()
+
+	now := model.Now()
+	post := func(url string, meta map[string]string) model.Trace {
+		traces := model.Traces{model.Trace{
+			model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100, Meta: meta},
+			model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Start: now, Duration: 50},
+		}}
+		data, err := json.Marshal(traces)
+		assert.Nil(err)
+
+		resp, err := http.Post(url+"/v0.3/traces", "application/json", bytes.NewBuffer(data))
+		assert.Nil(err)
+		assert.Equal(200, resp.StatusCode)
+		resp.Body.Close()
+
+		select {
+		case rt := <-r.traces:
+			return rt
+		case <-time.After(time.Second):
+			t.Fatal("no trace received")
+		}
+		return nil
+	}
+
+	assert.Equal("staging", post(staging.URL, nil).GetEnv())
+	assert.Equal("qa", post(qa.URL, nil).GetEnv())
+
+	// the env of the trace wins over the one of the endpoint
+	assert.Equal("prod", post(qa.URL, map[string]string{"env": "prod"}).GetEnv())
+
+	// the agent DefaultEnv applies on the main endpoint
+	assert.Equal("", post(global.URL, nil).GetEnv())
+}
+
+func TestReceiverZipkinSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	r := NewHTTPReceiver(conf)
+	server := httptest.NewServer(http.HandlerFunc(r.httpHandle(r.handleZipkinSpans)))
+	defer server.Close()
+
+	now := model.Now() / 1000
+	payload := fmt.Sprintf(`[
+		{"traceId": "5af7183fb1d4cf5f", "id": "6b221d5bc9e6496c", "name": "get /users", "kind": "SERVER",
+		 "timestamp": %d, "duration": 2000, "localEndpoint": {"serviceName": "frontend"}},
+		{"traceId": "5af7183fb1d4cf5f", "id": "352bff9a74ca9ad2", "parentId": "6b221d5bc9e6496c", "name": "select users",
+		 "kind": "CLIENT", "timestamp": %d, "duration": 1000, "localEndpoint": {"serviceName": "frontend"},
+		 "remoteEndpoint": {"serviceName": "mysql"}, "tags": {"error": "deadlock"}}
+	]`, now, now+500)
+
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(payload))
+	assert.Nil(err)
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+	resp.Body.Close()
+
+	var rt model.Trace
+	select {
+	case rt = <-r.traces:
+	case <-time.After(time.Second):
+		t.Fatal("no trace received")
+	}
+	assert.Len(rt, 2)
+	rt.Sort()
+	root := rt.GetRoot()
+	assert.Equal(uint64(0x6b221d5bc9e6496c), root.SpanID)
+	assert.Equal("frontend", root.Service)
+	assert.Equal(int64(2000000), root.Duration)
+	for _, s := range rt {
+		assert.Equal(uint64(0x5af7183fb1d4cf5f), s.TraceID)
+		if s.SpanID == 0x352bff9a74ca9ad2 {
+			assert.Equal(root.SpanID, s.ParentID)
+			assert.Equal(int32(1), s.Error)
+			assert.Equal("mysql", s.Meta["peer.service"])
+			assert.Equal("client", s.Meta[model.SpanKindMetaKey])
+		}
+	}
+
+	// parameters of the media type are ignored
+	resp, err = http.Post(server.URL, "application/json; charset=utf-8", strings.NewReader(payload))
+	assert.Nil(err)
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+	resp.Body.Close()
+	select {
+	case rt = <-r.traces:
+		assert.Len(rt, 2)
+	case <-time.After(time.Second):
+		t.Fatal("no trace received")
+	}
+
+	// only the JSON format is supported
+	resp, err = http.Post(server.URL, "application/x-protobuf", strings.NewReader(payload))
+	assert.Nil(err)
+	assert.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = http.Post(server.URL, "application/json", strings.NewReader(`[{"traceId": "nothex", "id": "1"}]`))
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestReceiverTracePayloadTags(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewHTTPReceiver(config.NewDefaultAgentConfig())
+	server := httptest.NewServer(
+		http.HandlerFunc(r.httpHandleWithVersion(v03Tagged, r.handleTraces)),
+	)
+	defer server.Close()
+
+	now := model.Now()
+	payload := model.TracePayload{
+		Tags: map[string]string{"env": "prod", "version": "1.2"},
+		Traces: model.Traces{
+			model.Trace{
+				model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now, Duration: 100},
+				model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Start: now, Duration: 10,
+					Meta: map[string]string{"env": "staging"}},
+			},
+		},
+	}
+
+	jsonData, err := json.Marshal(payload)
+	assert.Nil(err)
+	var msgpackData bytes.Buffer
+	assert.Nil(msgp.Encode(&msgpackData, &payload))
+
+	for _, tc := range []struct {
+		contentType string
+		data        []byte
+	}{
+		{"application/json", jsonData},
+		{"application/msgpack", msgpackData.Bytes()},
+	} {
+		resp, err := http.Post(server.URL, tc.contentType, bytes.NewReader(tc.data))
+		assert.Nil(err)
+		assert.Equal(200, resp.StatusCode, tc.contentType)
+		resp.Body.Close()
+
+		select {
+		case rt := <-r.traces:
+			if assert.Len(rt, 2) {
+				assert.Equal(map[string]string{"env": "prod", "version": "1.2"}, rt[0].Meta)
+				assert.Equal(map[string]string{"env": "staging", "version": "1.2"}, rt[1].Meta)
+			}
+		default:
+			t.Fatalf("%s: no data received", tc.contentType)
+		}
+	}
+}
+
+func TestReceiverStreamingDecoding(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ReceiverStreamingDecoding = true
+	r := NewHTTPReceiver(conf)
+	server := httptest.NewServer(
+		http.HandlerFunc(r.httpHandleWithVersion(v03, r.handleTraces)),
+	)
+	defer server.Close()
+
+	var traces model.Traces
+	for i := uint64(1); i <= 10; i++ {
+		traces = append(traces, model.Trace{
+			model.Span{TraceID: i, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: model.Now(), Duration: 100},
+			model.Span{TraceID: i, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Start: model.Now(), Duration: 10},
+			model.Span{TraceID: i, SpanID: 3, ParentID: 1, Service: "cache", Name: "redis.command", Resource: "GET", Start: model.Now(), Duration: 5},
+		})
+	}
+	jsonData, err := json.Marshal(traces)
+	assert.Nil(err)
+	var msgpackData bytes.Buffer
+	assert.Nil(msgp.Encode(&msgpackData, traces))
+
+	for _, tc := range []struct {
+		contentType string
+		data        []byte
+	}{
+		{"application/json", jsonData},
+		{"application/msgpack", msgpackData.Bytes()},
+	} {
+		resp, err := http.Post(server.URL, tc.contentType, bytes.NewReader(tc.data))
+		assert.Nil(err)
+		assert.Equal(200, resp.StatusCode, tc.contentType)
+		resp.Body.Close()
+
+		for i := range traces {
+			select {
+			case rt := <-r.traces:
+				assert.Len(rt, 3)
+				assert.Equal(traces[i][0].TraceID, rt[0].TraceID)
+			default:
+				t.Fatalf("%s: trace %d not received", tc.contentType, i)
+			}
+		}
+
+		// a truncated payload is rejected, though the traces decoded
+		// before the truncation are processed
+		resp, err = http.Post(server.URL, tc.contentType, bytes.NewReader(tc.data[:len(tc.data)-10]))
+		assert.Nil(err)
+		assert.Equal(400, resp.StatusCode, tc.contentType)
+		resp.Body.Close()
+		assert.Len(r.traces, len(traces)-1)
+		for len(r.traces) > 0 {
+			<-r.traces
+		}
+	}
+	assert.Equal(int64(4*len(traces)-2), r.stats.TracesReceived)
+
+	// unknown content types are rejected rather than decoded as JSON
+	resp, err := http.Post(server.URL, "application/x-custom", bytes.NewReader(jsonData))
+	assert.Nil(err)
+	assert.Equal(415, resp.StatusCode)
+	resp.Body.Close()
+	assert.Len(r.traces, 0)
+}
+
+func TestContentTypeTag(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("content_type:application/msgpack", contentTypeTag("application/msgpack"))
+	assert.Equal("content_type:application/json", contentTypeTag("application/json"))
+	assert.Equal("content_type:none", contentTypeTag(""))
+	// the headers of the clients never end up in the tags
+	assert.Equal("content_type:other", contentTypeTag("application/x-custom"))
+}
+
 func TestReceiverMsgpackDecoder(t *testing.T) {
 	// testing traces without content-type in agent endpoints, it should use Msgpack decoding
 	// or it should raise a 415 Unsupported media type
@@ -435,6 +998,70 @@ func BenchmarkHandleTraces(b *testing.B) {
 	}
 }
 
+func benchmarkHandleLargePayload(b *testing.B, contentType string, streaming bool) {
+	// a payload of 1000 traces of 50 spans
+	var buf bytes.Buffer
+	if contentType == "application/msgpack" {
+		msgp.Encode(&buf, fixtures.GetTestTrace(1000, 50))
+	} else {
+		json.NewEncoder(&buf).Encode(fixtures.GetTestTrace(1000, 50))
+	}
+
+	config := config.NewDefaultAgentConfig()
+	config.ReceiverStreamingDecoding = streaming
+	receiver := NewHTTPReceiver(config)
+	receiver.maxRequestBodyLength = int64(buf.Len())
+	handler := http.HandlerFunc(receiver.httpHandleWithVersion(v03, receiver.handleTraces))
+
+	// consume the traces as the agent would, so that they can be freed
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-receiver.traces:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v0.3/traces", bytes.NewReader(buf.Bytes()))
+		req.Header.Set("Content-Type", contentType)
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", rr.Code)
+		}
+	}
+}
+
+// BenchmarkHandleLargePayload and BenchmarkHandleLargePayloadStreaming allocate
+// as much, but with streaming the traces can be freed as soon as they are
+// processed, instead of the whole payload being held until the last one is.
+func BenchmarkHandleLargePayload(b *testing.B) {
+	benchmarkHandleLargePayload(b, "application/msgpack", false)
+}
+
+func BenchmarkHandleLargePayloadStreaming(b *testing.B) {
+	benchmarkHandleLargePayload(b, "application/msgpack", true)
+}
+
+// BenchmarkHandleLargeJSONPayload and BenchmarkHandleLargeJSONPayloadStreaming
+// show the allocations saved by streaming JSON payloads: the buffered decoder
+// reads the whole payload in a buffer grown to its size before decoding it,
+// while the streaming one only ever buffers a trace.
+func BenchmarkHandleLargeJSONPayload(b *testing.B) {
+	benchmarkHandleLargePayload(b, "application/json", false)
+}
+
+func BenchmarkHandleLargeJSONPayloadStreaming(b *testing.B) {
+	benchmarkHandleLargePayload(b, "application/json", true)
+}
+
 func BenchmarkDecoderJSON(b *testing.B) {
 	assert := assert.New(b)
 	traces := fixtures.GetTestTrace(150, 66)
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// replayResult is what ReplayTraces returns, printed as JSON by -analyze-file
+type replayResult struct {
+	Stats     []model.StatsBucket `json:"stats"`
+	Decisions []replayDecision    `json:"sampling_decisions"`
+}
+
+// replayDecision is the sampling decision taken for a replayed trace, traces
+// not going through sampling, e.g. with too few spans, are not kept
+type replayDecision struct {
+	TraceID uint64 `json:"trace_id"`
+	Sampled bool   `json:"sampled"`
+}
+
+// ReplayTraces runs the traces read from r, a JSON array of traces as sent to the
+// receiver, through the receiver checks, the concentrator and the sampler, and
+// returns all the stats buckets computed and the sampling decisions taken. It is
+// meant for offline analysis: traces are never dropped for being too old, and
+// everything is done synchronously, on an agent which must not be running.
+func (a *Agent) ReplayTraces(r io.Reader) (replayResult, error) {
+	res := replayResult{
+		Stats:     []model.StatsBucket{},
+		Decisions: []replayDecision{},
+	}
+
+	dec := model.NewJSONTracesDecoder(r)
+	for {
+		t, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+
+		// the receiver queues the trace, possibly split in several ones, or
+		// drops it
+		a.Receiver.processTrace(t, "")
+	queued:
+		for {
+			select {
+			case t := <-a.Receiver.traces:
+				a.replayTrace(t, &res)
+			default:
+				break queued
+			}
+		}
+	}
+
+	// the buckets of the traces replayed are all complete
+	res.Stats = append(res.Stats, a.Concentrator.flushAt(math.MaxInt64)...)
+	a.Sampler.Drain()
+	return res, nil
+}
+
+// replayTrace processes a trace like Process, synchronously
+func (a *Agent) replayTrace(t model.Trace, res *replayResult) {
+	pt, weight, sampled, ok := a.prepareTrace(t, false)
+	if !ok {
+		return
+	}
+
+	if a.inStats(pt.Root) {
+		a.Concentrator.Add(pt, weight)
+	}
+	if sampled {
+		res.Decisions = append(res.Decisions, replayDecision{
+			TraceID: pt.Root.TraceID,
+			Sampled: a.Sampler.Add(pt),
+		})
+	}
+}
+
+// analyzeFile replays the traces of the given file, or of stdin if path is "-",
+// and writes the results to w as JSON
+func analyzeFile(conf *config.AgentConfig, path string, w io.Writer) error {
+	r := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	res, err := NewAgent(conf).ReplayTraces(r)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentReplayTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	agent := NewAgent(conf)
+
+	f, err := os.Open("testdata/replay.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	res, err := agent.ReplayTraces(f)
+	assert.Nil(err)
+
+	// the traces are old, they are neither dropped nor left in open buckets
+	assert.Len(res.Stats, 2)
+	var hits, errors float64
+	for _, sb := range res.Stats {
+		hits += sb.Counts["http.request|hits|env:prod,resource:GET /users,service:web"].Value
+		errors += sb.Counts["http.request|errors|env:prod,resource:GET /users,service:web"].Value
+	}
+	assert.Equal(2.0, hits)
+	assert.Equal(1.0, errors)
+	assert.Len(agent.Concentrator.buckets, 0)
+
+	// the invalid trace was rejected by the receiver
+	assert.Len(res.Decisions, 2)
+	assert.Equal(uint64(1), res.Decisions[0].TraceID)
+	assert.Equal(uint64(2), res.Decisions[1].TraceID)
+	assert.EqualValues(1, agent.Receiver.stats.TracesDropped)
+
+	_, err = agent.ReplayTraces(bytes.NewBufferString(`[[{"span_id": 1`))
+	assert.NotNil(err)
+}
+
+func TestAgentReplayTracesZeroTraceIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+	conf.AssignZeroTraceIDs = true
+	agent := NewAgent(conf)
+
+	// spans without trace ID are split in traces of their own like by the receiver
+	res, err := agent.ReplayTraces(bytes.NewBufferString(`[[
+		{"span_id": 1, "service": "web", "name": "http.request", "resource": "GET /", "start": 1500000000000000000, "duration": 10},
+		{"span_id": 2, "service": "web", "name": "http.request", "resource": "GET /", "start": 1500000000000000000, "duration": 10}
+	]]`))
+	assert.Nil(err)
+	var hits float64
+	for _, sb := range res.Stats {
+		hits += sb.Counts["http.request|hits|env:none,resource:GET /,service:web"].Value
+	}
+	assert.Equal(2.0, hits)
+	assert.EqualValues(0, agent.Receiver.stats.TracesDropped)
+}
+
+func TestAnalyzeFile(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIKeys = append(conf.APIKeys, "")
+
+	var buf bytes.Buffer
+	assert.Nil(analyzeFile(conf, "testdata/replay.json", &buf))
+
+	var res replayResult
+	assert.Nil(json.NewDecoder(&buf).Decode(&res))
+	assert.Len(res.Stats, 2)
+	assert.Len(res.Decisions, 2)
+
+	assert.NotNil(analyzeFile(conf, "testdata/missing.json", &buf))
+}
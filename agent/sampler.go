@@ -9,6 +9,7 @@ import (
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/DataDog/datadog-trace-agent/statsd"
 	"github.com/DataDog/datadog-trace-agent/watchdog"
 )
 
@@ -20,6 +21,13 @@ type Sampler struct {
 	lastFlush     time.Time
 
 	samplerEngine SamplerEngine
+	decisions     *sampler.DecisionCache // nil if decisions are not sticky
+	maxTraceSpans int                    // sampled traces are truncated to this number of spans, 0 for no limit
+	unsampledEnvs map[string]struct{}    // envs whose traces are all kept, without going through the engine
+
+	// shadow engine whose decisions are only counted, nil if disabled
+	shadowEngine SamplerEngine
+	shadowCount  int // number of traces the shadow engine kept since the last flush
 }
 
 // samplerStats contains sampler statistics
@@ -46,11 +54,48 @@ type SamplerEngine interface {
 
 // NewSampler creates a new empty sampler ready to be started
 func NewSampler(conf *config.AgentConfig) *Sampler {
-	return &Sampler{
+	engine := sampler.NewSampler(conf.ExtraSampleRate, conf.MaxTPS)
+	engine.UpdateErrorTracesFloor(conf.ErrorTracesFloor)
+	engine.UpdateSlowTraceThreshold(conf.KeepSlowTracesAbove)
+	engine.UpdateSlowSpanThresholds(conf.KeepSlowSpansAbove)
+	engine.Backend.SetMaxSignatureScore(conf.MaxSignatureScore)
+	engine.UpdateTargetRate(conf.SignatureTargetRate)
+	engine.UpdateSeed(conf.SamplingSeed)
+
+	s := &Sampler{
 		sampledTraces: []model.Trace{},
 		traceCount:    0,
-		samplerEngine: sampler.NewSampler(conf.ExtraSampleRate, conf.MaxTPS),
+		samplerEngine: engine,
+		maxTraceSpans: conf.MaxTraceSpans,
+	}
+	if len(conf.UnsampledEnvs) > 0 {
+		s.unsampledEnvs = make(map[string]struct{}, len(conf.UnsampledEnvs))
+		for _, env := range conf.UnsampledEnvs {
+			s.unsampledEnvs[env] = struct{}{}
+		}
+	}
+	if conf.SamplingDecisionTTL > 0 {
+		decisions := sampler.NewDecisionCache(conf.SamplingDecisionCacheSize, conf.SamplingDecisionTTL)
+		// sweep the expired decisions on the decay tick, so that they do not
+		// linger until the next trace comes in
+		engine.Backend.OnDecay(func() {
+			if n := decisions.Sweep(time.Now()); n > 0 {
+				log.Debugf("swept %d expired sampling decisions", n)
+			}
+		})
+		s.decisions = decisions
 	}
+	if conf.ShadowSamplerEnabled {
+		shadow := sampler.NewSampler(conf.ShadowExtraSampleRate, conf.ShadowMaxTPS)
+		shadow.UpdateErrorTracesFloor(conf.ErrorTracesFloor)
+		shadow.UpdateSlowTraceThreshold(conf.KeepSlowTracesAbove)
+		shadow.UpdateSlowSpanThresholds(conf.KeepSlowSpansAbove)
+		shadow.Backend.SetMaxSignatureScore(conf.MaxSignatureScore)
+		shadow.UpdateSeed(conf.SamplingSeed)
+		s.shadowEngine = shadow
+	}
+
+	return s
 }
 
 // Run starts sampling traces
@@ -58,21 +103,103 @@ func (s *Sampler) Run() {
 	watchdog.Go(func() {
 		s.samplerEngine.Run()
 	})
+	if s.shadowEngine != nil {
+		watchdog.Go(func() {
+			s.shadowEngine.Run()
+		})
+	}
 }
 
-// Add samples a trace then keep it until the next flush
-func (s *Sampler) Add(t processedTrace) {
+// Add samples a trace then keep it until the next flush, it returns true if the
+// trace was kept
+func (s *Sampler) Add(t processedTrace) bool {
 	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.traceCount++
-	if s.samplerEngine.Sample(t.Trace, t.Root, t.Env) {
-		s.sampledTraces = append(s.sampledTraces, t.Trace)
+	if s.shadowEngine != nil && s.shadowSample(t) {
+		s.shadowCount++
 	}
-	s.mu.Unlock()
+	sampled := s.sample(t)
+	if sampled {
+		s.sampledTraces = append(s.sampledTraces, s.truncate(t.Trace))
+	}
+	return sampled
+}
+
+// shadowSample tells if the shadow engine would keep the trace. The engine
+// works on a copy of the root, so that it does not alter the trace shipped.
+func (s *Sampler) shadowSample(t processedTrace) bool {
+	if t.Root == nil {
+		return s.shadowEngine.Sample(t.Trace, t.Root, t.Env)
+	}
+	root := *t.Root
+	root.Metrics = make(map[string]float64, len(t.Root.Metrics))
+	for k, v := range t.Root.Metrics {
+		root.Metrics[k] = v
+	}
+	return s.shadowEngine.Sample(t.Trace, &root, t.Env)
+}
+
+// truncate caps the number of spans of a sampled trace, so that the payloads
+// are not rejected by the API
+func (s *Sampler) truncate(t model.Trace) model.Trace {
+	t, dropped := t.Truncate(s.maxTraceSpans)
+	if dropped > 0 {
+		log.Debugf("truncated sampled trace %d, %d spans dropped", t[0].TraceID, dropped)
+		statsd.Client.Count("datadog.trace_agent.sampler.truncated_traces", 1, nil, 1)
+		statsd.Client.Count("datadog.trace_agent.sampler.truncated_spans", int64(dropped), nil, 1)
+	}
+	return t
+}
+
+// sample tells if a trace should be kept. If decisions are sticky, parts of a trace
+// received separately get the decision taken for the first one. The traces of the
+// unsampled envs are always kept, and are not scored by the engine, so that they
+// do not change the rates applied to the other envs.
+func (s *Sampler) sample(t processedTrace) bool {
+	if _, ok := s.unsampledEnvs[t.Env]; ok {
+		return true
+	}
+	if s.decisions == nil || len(t.Trace) == 0 {
+		return s.samplerEngine.Sample(t.Trace, t.Root, t.Env)
+	}
+
+	now := time.Now()
+	traceID := t.Trace[0].TraceID
+	if sampled, ok := s.decisions.Get(traceID, now); ok {
+		return sampled
+	}
+
+	sampled := s.samplerEngine.Sample(t.Trace, t.Root, t.Env)
+	s.decisions.Set(traceID, sampled, now)
+	return sampled
+}
+
+// Drain returns the traces sampled since the last flush and forgets the sticky
+// decisions. It waits for the decisions being taken, so it is meant to be called
+// on shutdown once no new trace is added, to ship the traces already kept.
+func (s *Sampler) Drain() []model.Trace {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	traces := s.sampledTraces
+	s.sampledTraces = []model.Trace{}
+	s.traceCount = 0
+	s.shadowCount = 0
+	if s.decisions != nil {
+		s.decisions.Clear()
+	}
+
+	return traces
 }
 
 // Stop stops the sampler
 func (s *Sampler) Stop() {
 	s.samplerEngine.Stop()
+	if s.shadowEngine != nil {
+		s.shadowEngine.Stop()
+	}
 }
 
 // Flush returns representative spans based on GetSamples and reset its internal memory
@@ -83,6 +210,8 @@ func (s *Sampler) Flush() []model.Trace {
 	s.sampledTraces = []model.Trace{}
 	traceCount := s.traceCount
 	s.traceCount = 0
+	shadowCount := s.shadowCount
+	s.shadowCount = 0
 
 	now := time.Now()
 	duration := now.Sub(s.lastFlush)
@@ -104,5 +233,11 @@ func (s *Sampler) Flush() []model.Trace {
 	// publish through expvar
 	updateSamplerInfo(samplerInfo{Stats: stats, State: state})
 
+	if s.shadowEngine != nil && traceCount > 0 {
+		shadowRate := float64(shadowCount) / float64(traceCount)
+		log.Debugf("shadow sampler kept %d traces out of %d, sampler kept %d", shadowCount, traceCount, len(traces))
+		statsd.Client.Gauge("datadog.trace_agent.sampler.shadow.rate", shadowRate, nil, 1)
+	}
+
 	return traces
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/stretchr/testify/assert"
+)
+
+// alternateEngine is a sampler engine alternating keep and drop decisions
+type alternateEngine struct {
+	calls int
+}
+
+func (e *alternateEngine) Run()  {}
+func (e *alternateEngine) Stop() {}
+func (e *alternateEngine) Sample(t model.Trace, root *model.Span, env string) bool {
+	e.calls++
+	return e.calls%2 == 1
+}
+
+func TestSamplerStickyDecisions(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.SamplingDecisionTTL = time.Minute
+	s := NewSampler(conf)
+	engine := &alternateEngine{}
+	s.samplerEngine = engine
+
+	// a trace split across two payloads
+	root := model.Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request"}
+	part1 := model.Trace{root}
+	part2 := model.Trace{model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "db.query"}}
+
+	s.Add(processedTrace{Trace: part1, Root: &part1[0]})
+	s.Add(processedTrace{Trace: part2, Root: &part2[0]})
+
+	// both parts are kept, and the engine only decided once
+	assert.Equal(1, engine.calls)
+	assert.Equal(2, len(s.sampledTraces))
+
+	// a different trace gets its own decision
+	other := model.Trace{model.Span{TraceID: 2, SpanID: 3}}
+	s.Add(processedTrace{Trace: other, Root: &other[0]})
+	assert.Equal(2, engine.calls)
+	assert.Equal(2, len(s.sampledTraces))
+}
+
+func TestSamplerUnsampledEnvs(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.UnsampledEnvs = []string{"dev"}
+	s := NewSampler(conf)
+	engine := &alternateEngine{}
+	s.samplerEngine = engine
+
+	for i := 0; i < 4; i++ {
+		tr := model.Trace{model.Span{TraceID: uint64(i), SpanID: uint64(i)}}
+		s.Add(processedTrace{Trace: tr, Root: &tr[0], Env: "dev"})
+	}
+	// all kept, without being scored
+	assert.Equal(0, engine.calls)
+	assert.Len(s.sampledTraces, 4)
+
+	for i := 4; i < 8; i++ {
+		tr := model.Trace{model.Span{TraceID: uint64(i), SpanID: uint64(i)}}
+		s.Add(processedTrace{Trace: tr, Root: &tr[0], Env: "prod"})
+	}
+	// the traces of other envs go through the engine
+	assert.Equal(4, engine.calls)
+	assert.Len(s.sampledTraces, 6)
+	assert.Equal(8, s.traceCount)
+}
+
+func TestSamplerNonStickyDecisions(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSampler(config.NewDefaultAgentConfig())
+	engine := &alternateEngine{}
+	s.samplerEngine = engine
+
+	part1 := model.Trace{model.Span{TraceID: 1, SpanID: 1}}
+	part2 := model.Trace{model.Span{TraceID: 1, SpanID: 2, ParentID: 1}}
+
+	s.Add(processedTrace{Trace: part1, Root: &part1[0]})
+	s.Add(processedTrace{Trace: part2, Root: &part2[0]})
+
+	// by default, each part is sampled independently
+	assert.Equal(2, engine.calls)
+	assert.Equal(1, len(s.sampledTraces))
+}
+
+func TestSamplerStickyDecisionsSweep(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.SamplingDecisionTTL = 10 * time.Millisecond
+	s := NewSampler(conf)
+
+	for i := uint64(1); i <= 5; i++ {
+		trace := model.Trace{model.Span{TraceID: i, SpanID: i, Service: "web", Name: "http.request", Duration: 100}}
+		s.Add(processedTrace{Trace: trace, Root: &trace[0]})
+	}
+	assert.Equal(5, s.decisions.Len())
+
+	// the decay tick of the engine evicts the expired decisions
+	time.Sleep(20 * time.Millisecond)
+	s.samplerEngine.(*sampler.Sampler).Backend.DecayScore()
+	assert.Equal(0, s.decisions.Len())
+}
+
+func TestSamplerDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.SamplingDecisionTTL = time.Minute
+	s := NewSampler(conf)
+	engine := &alternateEngine{}
+	s.samplerEngine = engine
+
+	trace := model.Trace{model.Span{TraceID: 1, SpanID: 1}}
+	s.Add(processedTrace{Trace: trace, Root: &trace[0]})
+
+	// the trace which was just kept is not lost
+	drained := s.Drain()
+	if assert.Equal(1, len(drained)) {
+		assert.Equal(uint64(1), drained[0][0].TraceID)
+	}
+	assert.Equal(0, len(s.sampledTraces))
+	assert.Equal(0, s.decisions.Len())
+	assert.Equal(0, len(s.Drain()))
+}
+
+func TestSamplerTruncatesTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.MaxTraceSpans = 2
+	s := NewSampler(conf)
+	s.samplerEngine = &alternateEngine{}
+
+	trace := model.Trace{
+		model.Span{TraceID: 1, SpanID: 1, Duration: 100},
+		model.Span{TraceID: 1, SpanID: 2, ParentID: 1, Duration: 10},
+		model.Span{TraceID: 1, SpanID: 3, ParentID: 1, Duration: 50},
+	}
+	s.Add(processedTrace{Trace: trace, Root: &trace[0]})
+
+	assert.Equal(1, len(s.sampledTraces))
+	assert.Equal(model.Trace{trace[0], trace[2]}, s.sampledTraces[0])
+
+	metrics := statsdServer.waitMetrics(t,
+		"datadog.trace_agent.sampler.truncated_traces",
+		"datadog.trace_agent.sampler.truncated_spans",
+	)
+	assert.Equal("datadog.trace_agent.sampler.truncated_traces:1|c", metrics[0])
+	assert.Equal("datadog.trace_agent.sampler.truncated_spans:1|c", metrics[1])
+}
+
+// rateEngine is a sampler engine keeping one trace out of every n, tagging
+// the root of the traces it keeps
+type rateEngine struct {
+	n     int
+	calls int
+}
+
+func (e *rateEngine) Run()  {}
+func (e *rateEngine) Stop() {}
+func (e *rateEngine) Sample(t model.Trace, root *model.Span, env string) bool {
+	e.calls++
+	sampled := e.calls%e.n == 0
+	if sampled {
+		root.Metrics[model.SpanSampleRateMetricKey] = 1 / float64(e.n)
+	}
+	return sampled
+}
+
+func TestSamplerShadow(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	// the sampler keeps all the traces of such a low traffic
+	conf := config.NewDefaultAgentConfig()
+	conf.MaxTPS = 0
+	conf.ShadowSamplerEnabled = true
+	s := NewSampler(conf)
+	shadow := &rateEngine{n: 4}
+	s.shadowEngine = shadow
+
+	for i := 0; i < 8; i++ {
+		trace := model.Trace{model.Span{TraceID: uint64(i), SpanID: 1, Metrics: map[string]float64{}}}
+		s.Add(processedTrace{Trace: trace, Root: &trace[0]})
+	}
+
+	// the shadow saw all the traces, but only the sampler decided what is shipped
+	assert.Equal(8, shadow.calls)
+	assert.Equal(2, s.shadowCount)
+	traces := s.Flush()
+	assert.Equal(8, len(traces))
+	for _, trace := range traces {
+		// the shadow did not alter the shipped traces
+		assert.Equal(1.0, trace[0].Metrics[model.SpanSampleRateMetricKey])
+	}
+
+	metrics := statsdServer.waitMetrics(t, "datadog.trace_agent.sampler.shadow.rate")
+	assert.Equal("datadog.trace_agent.sampler.shadow.rate:0.250000|g", metrics[0])
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// durationMetric is the prefix of the metrics under which the latency
+// distributions of the stats are sent to dogstatsd
+const durationMetric = "datadog.trace_agent.trace.duration"
+
+// durationQuantiles are the quantiles of the latency distributions sent to
+// dogstatsd, by metric suffix
+var durationQuantiles = []struct {
+	suffix string
+	q      float64
+}{
+	{".p50", 0.5},
+	{".p95", 0.95},
+	{".p99", 0.99},
+	{".max", 1},
+}
+
+// emitDurationMetrics sends the duration distributions of the given stats buckets
+// to dogstatsd, tagged by env, service, resource and the other aggregators, so that
+// they can be used without the trace intake. A gauge is sent for each of the
+// durationQuantiles of a distribution, computed from its summary, so that the
+// number of packets depends on the number of aggregations rather than on the
+// number of spans.
+func emitDurationMetrics(buckets []model.StatsBucket) {
+	for _, b := range buckets {
+		for _, d := range b.Distributions {
+			if d.Measure != model.DURATION || d.Summary == nil || len(d.Summary.Entries) == 0 {
+				continue
+			}
+
+			tags := make([]string, 0, len(d.TagSet)+1)
+			tags = append(tags, "name:"+d.Name)
+			for _, t := range d.TagSet {
+				tags = append(tags, t.String())
+			}
+
+			for _, q := range durationQuantiles {
+				statsd.Client.Gauge(durationMetric+q.suffix, d.Summary.Quantile(q.q), tags, 1)
+			}
+		}
+	}
+}
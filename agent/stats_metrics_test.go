@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmitDurationMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	statsdServer := newTestStatsdServer(t)
+	defer statsdServer.Close()
+
+	srb := model.NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(model.Span{SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Duration: 100}, "prod", "", nil, 1, nil)
+	srb.HandleSpan(model.Span{SpanID: 2, Service: "web", Name: "http.request", Resource: "GET /", Duration: 200}, "prod", "", nil, 1, nil)
+
+	emitDurationMetrics([]model.StatsBucket{srb.Export()})
+
+	// a gauge per quantile, whatever the number of spans
+	tags := "|#name:http.request,env:prod,resource:GET /,service:web"
+	var metrics []string
+	for _, q := range durationQuantiles {
+		metrics = append(metrics, statsdServer.waitMetrics(t, durationMetric+q.suffix)...)
+	}
+	assert.Equal([]string{
+		durationMetric + ".p50:100.000000|g" + tags,
+		durationMetric + ".p95:200.000000|g" + tags,
+		durationMetric + ".p99:200.000000|g" + tags,
+		durationMetric + ".max:200.000000|g" + tags,
+	}, metrics)
+}
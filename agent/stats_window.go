@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// statsWindow computes stats over a sliding window, for debugging purposes. It
+// keeps a ring of sub-buckets which are merged when the window is queried, so
+// the window slides by one sub-bucket at a time. Its stats are computed with the
+// settings of the concentrator, but independently from it: nothing computed
+// here is ever sent.
+type statsWindow struct {
+	c     *Concentrator // sets up the sub-buckets and adds the spans to them
+	bsize int64         // size of the sub-buckets, in nanoseconds
+
+	slots []statsWindowSlot // indexed by the start of the sub-buckets modulo their number
+	mu    sync.Mutex
+}
+
+type statsWindowSlot struct {
+	start  int64
+	bucket *model.StatsRawBucket // nil until a span ends in this slot
+}
+
+// newStatsWindow returns a window of the given length, split in n sub-buckets,
+// computing the stats like c
+func newStatsWindow(c *Concentrator, length time.Duration, n int) *statsWindow {
+	if n < 1 {
+		n = 1
+	}
+	bsize := length.Nanoseconds() / int64(n)
+	if bsize < 1 {
+		bsize = 1
+	}
+
+	return &statsWindow{
+		c:     c,
+		bsize: bsize,
+		slots: make([]statsWindowSlot, n),
+	}
+}
+
+// Add adds the spans of the trace to the sub-buckets they ended in. Spans older
+// than the oldest sub-bucket still in the ring are ignored.
+func (w *statsWindow) Add(t processedTrace, weight float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	distWeights := w.c.distributionWeights(t.Trace)
+	for _, s := range t.Trace {
+		start := s.End() - s.End()%w.bsize
+		slot := &w.slots[(start/w.bsize)%int64(len(w.slots))]
+		if slot.bucket == nil || slot.start < start {
+			// the slot is reused once the window slid past it
+			slot.start = start
+			slot.bucket = w.c.newRawBucket(bucketKey{start: start, duration: w.bsize})
+		} else if slot.start > start {
+			continue
+		}
+		w.c.handleSpan(slot.bucket, s, t, weight, distWeights)
+	}
+}
+
+// Query returns the stats of the window ending with the sub-bucket containing
+// now, a unix nanosecond timestamp, merged in a single bucket.
+func (w *statsWindow) Query(now int64) model.StatsBucket {
+	end := now - now%w.bsize + w.bsize
+	start := end - w.bsize*int64(len(w.slots))
+	sb := model.NewStatsBucket(start, end-start)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, slot := range w.slots {
+		if slot.bucket == nil || slot.start < start || slot.start >= end {
+			continue
+		}
+		sb.Merge(slot.bucket.Export())
+	}
+	return sb
+}
+
+// handleQuery reports the stats of the current window, as JSON
+func (w *statsWindow) handleQuery(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(w.Query(model.Now())); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
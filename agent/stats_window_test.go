@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	// 4 sub-buckets of 1s
+	w := newStatsWindow(NewConcentrator(nil, testBucketInterval, 0), 4*time.Second, 4)
+	now := int64(100e9)
+
+	// a span ending in the given sub-bucket before now, 0 being the current one
+	span := func(id uint64, offset int64, duration int64) model.Span {
+		return model.Span{
+			SpanID:   id,
+			Service:  "web",
+			Name:     "http.request",
+			Resource: "GET /",
+			Start:    now - offset*1e9 - duration,
+			Duration: duration,
+		}
+	}
+	add := func(spans ...model.Span) {
+		for _, s := range spans {
+			w.Add(processedTrace{Trace: model.Trace{s}, Root: &s, Env: "prod"}, 1)
+		}
+	}
+	hits := "http.request|hits|env:prod,resource:GET /,service:web"
+	duration := "http.request|duration|env:prod,resource:GET /,service:web"
+
+	add(span(1, 0, 10), span(2, 1, 20), span(3, 3, 30))
+	// too old for the window
+	add(span(4, 4, 40))
+
+	sb := w.Query(now)
+	assert.Equal(now-3e9, sb.Start)
+	assert.Equal(int64(4e9), sb.Duration)
+	assert.Equal(3.0, sb.Counts[hits].Value)
+	assert.Equal(60.0, sb.Counts[duration].Value)
+	assert.Equal(3, sb.Distributions[duration].Summary.N)
+
+	// the window slides by 2s, the spans of the 2 oldest sub-buckets leave it
+	now += 2e9
+	sb = w.Query(now)
+	assert.Equal(2.0, sb.Counts[hits].Value)
+	assert.Equal(30.0, sb.Counts[duration].Value)
+
+	// new spans take over the slots of the old ones
+	add(span(5, 0, 50), span(7, 1, 70))
+	// spans older than the slot they fall in are dropped
+	add(span(6, 4, 60))
+	sb = w.Query(now)
+	assert.Equal(4.0, sb.Counts[hits].Value)
+	assert.Equal(150.0, sb.Counts[duration].Value)
+
+	// querying does not consume the sub-buckets
+	assert.Equal(sb, w.Query(now))
+	assert.Len(w.Query(now+10e9).Counts, 0)
+}
+
+func TestStatsWindowHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	w := newStatsWindow(NewConcentrator([]string{"version"}, testBucketInterval, 0), time.Minute, 6)
+	s := model.Span{SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: model.Now() - 10, Duration: 10}
+	w.Add(processedTrace{Trace: model.Trace{s}, Root: &s, Env: "prod", Version: "1.2"}, 1)
+
+	rec := httptest.NewRecorder()
+	w.handleQuery(rec, httptest.NewRequest("GET", "/debug/stats_window", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var sb model.StatsBucket
+	assert.Nil(json.NewDecoder(rec.Body).Decode(&sb))
+	assert.Equal(int64(time.Minute), sb.Duration)
+	assert.Equal(1.0, sb.Counts["http.request|hits|env:prod,resource:GET /,service:web,version:1.2"].Value)
+}
+
+func TestStatsWindowConcentratorSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewConcentrator(nil, testBucketInterval, 1000)
+	c.errorDistributions = true
+	c.maxResourcesPerService = 1
+	w := newStatsWindow(c, time.Minute, 6)
+
+	now := model.Now()
+	trace := model.Trace{
+		model.Span{SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: now - 1400, Duration: 1400},
+		model.Span{SpanID: 2, ParentID: 1, Service: "web", Name: "http.request", Resource: "GET /users", Start: now - 600, Duration: 600, Error: 1},
+	}
+	w.Add(processedTrace{Trace: trace, Root: &trace[0], Env: "prod"}, 1)
+	sb := w.Query(now)
+
+	// the resources are limited, the durations rounded and the errors split
+	// like in the buckets of the concentrator
+	assert.Equal(1.0, sb.Counts["http.request|hits|env:prod,resource:GET /,service:web"].Value)
+	assert.Equal(1.0, sb.Counts["http.request|hits|env:prod,resource:"+model.TooManyResources+",service:web"].Value)
+	d := sb.Distributions["http.request|duration|env:prod,resource:GET /,service:web,error:false"]
+	if assert.NotNil(d.Summary) {
+		assert.Equal(1000.0, d.Summary.Quantile(1))
+	}
+	assert.Len(sb.Distributions, 2)
+}
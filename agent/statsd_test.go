@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	dogstatsd "github.com/DataDog/datadog-go/statsd"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// testStatsdServer catches the metrics sent through the global statsd client
+type testStatsdServer struct {
+	conn          net.PacketConn
+	client        *dogstatsd.Client
+	defaultClient statsd.StatsClient
+}
+
+func newTestStatsdServer(t *testing.T) *testStatsdServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen for statsd metrics: %v", err)
+	}
+
+	client, err := dogstatsd.New(conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		t.Fatalf("cannot create statsd client: %v", err)
+	}
+
+	s := &testStatsdServer{conn: conn, client: client, defaultClient: statsd.Client}
+	statsd.Client = client
+	return s
+}
+
+// Close restores the global statsd client
+func (s *testStatsdServer) Close() {
+	statsd.Client = s.defaultClient
+	s.client.Close()
+	s.conn.Close()
+}
+
+// waitMetrics returns, in order of arrival, the first metrics received with one
+// of the given names, until one of each is received. Other metrics are ignored
+// since other components might report some concurrently.
+func (s *testStatsdServer) waitMetrics(t *testing.T, names ...string) []string {
+	var metrics []string
+	missing := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		missing[name] = struct{}{}
+	}
+
+	buf := make([]byte, 1024)
+	for len(missing) > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("missing metrics %v, got %v: %v", missing, metrics, err)
+		}
+
+		m := string(buf[:n])
+		name := m[:strings.Index(m, ":")]
+		if _, ok := missing[name]; ok {
+			delete(missing, name)
+			metrics = append(metrics, m)
+		}
+	}
+
+	return metrics
+}
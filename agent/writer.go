@@ -42,6 +42,15 @@ func (p *writerPayload) write() error {
 	return err
 }
 
+// payloadBatch coalesces several payloads into a single one, so that they are
+// sent with a single request.
+type payloadBatch struct {
+	payload model.AgentPayload // the coalesced payload
+	size    int                // estimated size, the sum of the approximate sizes of the coalesced payloads
+	count   int                // the number of coalesced payloads
+	start   time.Time          // the time the first payload was added
+}
+
 // Writer is the last chain of trace-agent which takes the
 // pre-processed data from channels and tentatively output them
 // to a given endpoint.
@@ -54,6 +63,10 @@ type Writer struct {
 
 	payloadBuffer []*writerPayload       // buffer of payloads ready to send
 	serviceBuffer model.ServicesMetadata // services are merged into this map continuously
+	batch         *payloadBatch          // payloads being coalesced, nil if there are none
+
+	// meta keys kept in the spans of the traces sent, nil to keep them all
+	metaKeys map[string]struct{}
 
 	exit   chan struct{}
 	exitWG *sync.WaitGroup
@@ -78,11 +91,20 @@ func NewWriter(conf *config.AgentConfig) *Writer {
 		endpoint = NullEndpoint{}
 	}
 
+	var metaKeys map[string]struct{}
+	if len(conf.APIMetaKeys) > 0 {
+		metaKeys = make(map[string]struct{}, len(conf.APIMetaKeys))
+		for _, k := range conf.APIMetaKeys {
+			metaKeys[k] = struct{}{}
+		}
+	}
+
 	return &Writer{
 		endpoint: endpoint,
+		metaKeys: metaKeys,
 
 		// small buffer to not block in case we're flushing
-		inPayloads: make(chan model.AgentPayload, 1),
+		inPayloads: make(chan model.AgentPayload, conf.FlushQueueSize),
 
 		payloadBuffer: make([]*writerPayload, 0, 5),
 		serviceBuffer: make(model.ServicesMetadata),
@@ -100,6 +122,61 @@ func (w *Writer) isPayloadBufferingEnabled() bool {
 	return w.conf.APIPayloadBufferMaxSize > 0
 }
 
+// isBatchingEnabled returns true if payloads are coalesced before being sent.
+func (w *Writer) isBatchingEnabled() bool {
+	return w.conf.APIBatchInterval > 0
+}
+
+// addToBatch coalesces a payload into the current batch. It returns true if
+// the batch reached its maximum size and was moved to the payload buffer.
+func (w *Writer) addToBatch(p model.AgentPayload, now time.Time) bool {
+	if w.batch == nil {
+		w.batch = &payloadBatch{
+			payload: model.AgentPayload{HostName: p.HostName, Env: p.Env},
+			start:   now,
+		}
+	}
+
+	w.batch.payload.Traces = append(w.batch.payload.Traces, p.Traces...)
+	w.batch.payload.Stats = append(w.batch.payload.Stats, p.Stats...)
+	w.batch.count++
+
+	if w.conf.APIBatchMaxSize > 0 {
+		// the payloads are encoded once, when the batch is sent, their
+		// sizes before compression are estimated from their contents
+		w.batch.size += p.ApproxSizeBytes()
+		if w.batch.size >= w.conf.APIBatchMaxSize {
+			w.flushBatch()
+			return true
+		}
+	}
+
+	return false
+}
+
+// isBatchExpired returns true if the current batch is older than the batching interval.
+func (w *Writer) isBatchExpired(now time.Time) bool {
+	return w.batch != nil && now.Sub(w.batch.start) >= w.conf.APIBatchInterval
+}
+
+// flushBatch moves the current batch, if any, to the payload buffer.
+func (w *Writer) flushBatch() {
+	if w.batch == nil {
+		return
+	}
+
+	statsd.Client.Histogram("datadog.trace_agent.writer.batch_count",
+		float64(w.batch.count), nil, 1)
+	if w.conf.APIBatchMaxSize > 0 {
+		statsd.Client.Histogram("datadog.trace_agent.writer.batch_size",
+			float64(w.batch.size), nil, 1)
+	}
+
+	w.payloadBuffer = append(w.payloadBuffer,
+		newWriterPayload(w.batch.payload, w.endpoint))
+	w.batch = nil
+}
+
 // Run starts the writer.
 func (w *Writer) Run() {
 	w.exitWG.Add(1)
@@ -121,13 +198,13 @@ func (w *Writer) main() {
 	for {
 		select {
 		case p := <-w.inPayloads:
-			if p.IsEmpty() {
-				continue
+			if w.addPayload(p) {
+				w.Flush()
+			}
+		case now := <-flushTicker.C:
+			if w.isBatchExpired(now) {
+				w.flushBatch()
 			}
-			w.payloadBuffer = append(w.payloadBuffer,
-				newWriterPayload(p, w.endpoint))
-			w.Flush()
-		case <-flushTicker.C:
 			w.Flush()
 		case sm := <-w.inServices:
 			updated := w.serviceBuffer.Update(sm)
@@ -136,12 +213,48 @@ func (w *Writer) main() {
 			}
 		case <-w.exit:
 			log.Info("exiting, trying to flush all remaining data")
+			// payloads sent right before stopping, like the traces drained
+			// from the sampler, must still be shipped
+			for pending := true; pending; {
+				select {
+				case p := <-w.inPayloads:
+					w.addPayload(p)
+				default:
+					pending = false
+				}
+			}
+			w.flushBatch()
 			w.Flush()
 			return
 		}
 	}
 }
 
+// addPayload buffers a payload, or adds it to the current batch. It returns
+// true if there are new payloads ready to be sent.
+func (w *Writer) addPayload(p model.AgentPayload) bool {
+	if p.IsEmpty() {
+		return false
+	}
+	if w.metaKeys != nil {
+		p.Traces = w.projectMeta(p.Traces)
+	}
+	if w.isBatchingEnabled() {
+		return w.addToBatch(p, time.Now())
+	}
+	w.payloadBuffer = append(w.payloadBuffer, newWriterPayload(p, w.endpoint))
+	return true
+}
+
+// projectMeta returns copies of the traces only keeping the configured meta keys
+func (w *Writer) projectMeta(traces []model.Trace) []model.Trace {
+	projected := make([]model.Trace, len(traces))
+	for i, t := range traces {
+		projected[i] = t.ProjectMeta(w.metaKeys)
+	}
+	return projected
+}
+
 // Stop stops the main Run loop
 func (w *Writer) Stop() {
 	close(w.exit)
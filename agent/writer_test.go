@@ -258,3 +258,134 @@ func TestWriterDisabledBuffering(t *testing.T) {
 	// dropped and the buffer should be empty.
 	assert.Equal(0, len(w.payloadBuffer))
 }
+
+func TestWriterBatchingByTime(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEnabled = false
+	conf.APIBatchInterval = 10 * time.Second
+
+	w := NewWriter(conf)
+
+	now := time.Now()
+	w.addToBatch(newTestPayload("test"), now)
+	w.addToBatch(newTestPayload("test"), now.Add(time.Second))
+	w.addToBatch(newTestPayload("test"), now.Add(2*time.Second))
+
+	// nothing is ready to be sent until the batch expires
+	assert.Equal(0, len(w.payloadBuffer))
+	assert.False(w.isBatchExpired(now.Add(9 * time.Second)))
+	assert.True(w.isBatchExpired(now.Add(10 * time.Second)))
+
+	w.flushBatch()
+
+	assert.Nil(w.batch)
+	if assert.Equal(1, len(w.payloadBuffer)) {
+		p := w.payloadBuffer[0].payload
+		assert.Equal("test.host", p.HostName)
+		assert.Equal("test", p.Env)
+		assert.Equal(3, len(p.Traces))
+		assert.Equal(3, len(p.Stats))
+	}
+}
+
+func TestWriterBatchingBySize(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newTestPayload("test")
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEnabled = false
+	conf.APIBatchInterval = time.Hour
+	conf.APIBatchMaxSize = 2*p.ApproxSizeBytes() + 1
+
+	w := NewWriter(conf)
+
+	now := time.Now()
+	assert.False(w.addToBatch(newTestPayload("test"), now))
+	assert.False(w.addToBatch(newTestPayload("test"), now))
+	assert.Equal(0, len(w.payloadBuffer))
+
+	// the third payload makes the batch exceed its max size
+	assert.True(w.addToBatch(newTestPayload("test"), now))
+	assert.Nil(w.batch)
+	if assert.Equal(1, len(w.payloadBuffer)) {
+		assert.Equal(3, len(w.payloadBuffer[0].payload.Traces))
+	}
+
+	// a new batch is started
+	assert.False(w.addToBatch(newTestPayload("test"), now))
+	assert.Equal(1, w.batch.count)
+}
+
+func TestWriterBatchingFlushOnStop(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 1)
+
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+	conf.APIBatchInterval = time.Hour
+
+	w := NewWriter(conf)
+	// Make the chan unbuffered to block on write
+	w.inPayloads = make(chan model.AgentPayload)
+	go w.Run()
+
+	w.inPayloads <- newTestPayload("test")
+	w.inPayloads <- newTestPayload("test")
+
+	select {
+	case <-data:
+		t.Fatal("batch should not have been sent before stopping")
+	default:
+	}
+
+	w.Stop()
+
+	select {
+	case received := <-data:
+		assert.Equal("/api/v0.1/collector", received.urlPath)
+	case <-time.After(time.Second):
+		t.Fatal("did not receive the partial batch in time")
+	}
+	assert.Equal(0, len(w.payloadBuffer))
+}
+
+func TestWriterPendingPayloadsOnStop(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make(chan dataFromAPI, 2)
+
+	server := newTestServer(t, data)
+	defer server.Close()
+
+	conf := config.NewDefaultAgentConfig()
+	conf.APIEndpoints = []string{server.URL}
+	conf.APIKeys = []string{"key"}
+
+	w := NewWriter(conf)
+	w.inPayloads = make(chan model.AgentPayload, 2)
+
+	// payloads sent right before stopping are still shipped
+	w.inPayloads <- newTestPayload("test")
+	w.inPayloads <- newTestPayload("test")
+	close(w.exit)
+	w.exitWG.Add(1)
+	w.main()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case received := <-data:
+			assert.Equal("/api/v0.1/collector", received.urlPath)
+		case <-time.After(time.Second):
+			t.Fatal("did not receive the pending payloads in time")
+		}
+	}
+	assert.Equal(0, len(w.payloadBuffer))
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
 	"strconv"
@@ -32,24 +34,101 @@ type AgentConfig struct {
 	APIKeys                 []string `json:"-"` // never publish this
 	APIEnabled              bool
 	APIPayloadBufferMaxSize int
+	APIBatchInterval        time.Duration // payloads are coalesced during this interval before being sent, 0 to disable
+	APIBatchMaxSize         int           // a batch of payloads is sent as soon as it reaches this approximate size in bytes before compression, 0 for no limit
+	APIMetaKeys             []string      // if set, only these meta keys are kept in the spans of the traces sent
 
 	// Concentrator
-	BucketInterval   time.Duration // the size of our pre-aggregation per bucket
-	ExtraAggregators []string
+	BucketInterval             time.Duration            // the size of our pre-aggregation per bucket
+	ServiceBucketIntervals     map[string]time.Duration // bucket sizes of the services overriding BucketInterval
+	ExtraAggregators           []string
+	SublayersEnabled           bool               // whether sublayers are computed at all, disabling them saves some work when only the stats are used
+	SublayerMode               model.SublayerMode // how sublayer durations are computed
+	SublayerMinDuration        time.Duration      // sublayers lasting less are rolled up in the "__other__" sublayer
+	SublayerByCaller           bool               // whether the sublayers by service are also split by calling service
+	SublayerByError            bool               // whether the sublayers by service are also split by the error flag of the spans
+	SublayerIdleTime           bool               // whether the idle time of the traces is reported as the "_sublayers.idle" metric
+	SublayerMetricsOnSpan      bool               // whether the sublayers are set as metrics of the root spans
+	SublayerTagsOnSpan         bool               // whether the largest sublayers are set as meta of the root spans, see model.SetTopSublayersOnSpan
+	StatsDurationGranularity   time.Duration      // durations are rounded to it in the stats distributions, 0 to disable
+	StatsWeightedDistributions bool               // whether durations are weighted in the stats distributions by the number of spans of their resource in the trace
+	StatsErrorDistributions    bool               // whether the durations of errors and successes are in separate stats distributions
+	StatsMinSamples            int                // stats distributions with fewer samples are suppressed, 0 to disable
+	StatsFlagLowSamples        bool               // whether these distributions are flagged as low confidence instead of suppressed
+	StatsSynthetics            model.Tag          // spans with this meta, e.g. synthetics:true, are excluded from the stats, disabled if its name is empty
+	StatsSyntheticsApart       bool               // whether these spans are counted in aggregations of their own, tagged with this meta, instead of excluded
+	StatsExtrapolateSampled    bool               // whether the traces already sampled by an agent are weighted by the inverse of its sample rate in the stats
+	MaxResourcesPerService     int                // resources of a service beyond this number are rolled up in the stats, 0 for no limit
+	MaxBucketsPerFlush         int                // stats buckets returned by a flush, the oldest first, beyond this number wait for the next flushes, 0 for no limit
+	StatsMaxMemory             int64              // approximate memory budget of the stats buckets in bytes, beyond it the least recently updated are flushed early or dropped, 0 for no limit
+	FlushJitter                time.Duration      // range of the random offset of the flushes after the boundaries of the bucket interval, 0 to disable
+	FlushQueueSize             int                // number of flushed payloads which can wait for the writer without blocking the agent
+	StatsInputSize             int                // number of traces which can wait for the concentrator, beyond it they are dropped, 0 for no limit
+	StatsInputDropOldest       bool               // whether the oldest waiting traces are dropped instead of the new ones
+	StatsSamplingPriorities    []int              // if set, only traces with one of these sampling priorities, or none, are counted in the stats
+	StatsDurationMetrics       bool               // whether the duration distributions are also sent to dogstatsd
+	SpanKindTypes              map[string]string  // types given to spans without one, by span kind
+	StatsWindow                time.Duration      // length of the sliding window of stats served on /debug/stats_window, 0 to disable
+	StatsWindowBuckets         int                // number of sub-buckets the sliding window moves by
+	StatsRecentFlushes         int                // number of flushes of stats buckets kept in memory for debugging, 0 to disable
+
+	// if set, the spans are aggregated in the stats by the resource derived
+	// from their meta with this template, or by their raw resource if some
+	// of its meta are missing
+	StatsResourceTemplate *model.ResourceTemplate
+
+	// Late traces, by default the ones received 2 buckets after their end are dropped
+	LateSpanCutoffPercentile float64       // if set, the cutoff is tuned to this percentile of the observed lag
+	LateSpanCutoffMargin     time.Duration // added to the tuned cutoff
+	DropLateSpans            bool          // whether the spans older than the cutoff are also dropped from the traces whose root is not
+
+	RootlessTraces model.RootlessMode // what is done with the traces without a root span
 
 	// Sampler configuration
-	ExtraSampleRate float64
-	MaxTPS          float64
+	ExtraSampleRate    float64
+	MaxTPS             float64
+	ErrorTracesFloor   int  // minimum number of error traces kept per signature and decay period
+	MinTraceSpans      int  // traces with fewer spans are not sampled
+	ShortTracesInStats bool // whether traces not sampled because of MinTraceSpans are counted in the stats
+	MaxTraceSpans      int  // sampled traces with more spans are truncated before being sent, 0 for no limit
+
+	KeepSlowTracesAbove time.Duration            // traces lasting longer are always kept, 0 to disable
+	KeepSlowSpansAbove  map[string]time.Duration // traces with a span of one of these types lasting longer are always kept
+	MaxSignatureScore   float64                  // maximum score of a signature, in traces per second, 0 for no limit
+	SignatureTargetRate float64                  // if set, each signature is kept at this rate instead of a rate derived from its score
+	UnsampledEnvs       []string                 // all the traces of these envs are kept, they are not sampled
+	SamplingSeed        uint64                   // mixed with the trace IDs to take the sampling decisions, agents sharing it take the same ones
+
+	SamplingDecisionTTL       time.Duration // sampling decisions are reused for parts of a trace received within this TTL, 0 to disable
+	SamplingDecisionCacheSize int           // maximum number of sampling decisions remembered
+
+	// Shadow sampler, running on the same traffic with its own settings, its
+	// decisions are only reported to compare them with the ones of the sampler
+	ShadowSamplerEnabled  bool
+	ShadowExtraSampleRate float64
+	ShadowMaxTPS          float64
 
 	// Receiver
-	ReceiverHost    string
-	ReceiverPort    int
-	ConnectionLimit int // for rate-limiting, how many unique connections to allow in a lease period (30s)
-	ReceiverTimeout int
+	ReceiverHost              string
+	ReceiverPort              int
+	ConnectionLimit           int // for rate-limiting, how many unique connections to allow in a lease period (30s)
+	ReceiverTimeout           int
+	IgnoreServices            []string          // spans of these services are dropped as soon as they are received
+	ReceiverStreamingDecoding bool              // whether trace payloads are decoded and processed one trace at a time
+	ReceiverDefaultEnvs       map[int]string    // additional ports to listen on, with the env of their traces defaulting to another one than DefaultEnv
+	OriginTags                bool              // whether the accepted and late spans metrics are tagged by the language and version of the tracer
+	MaxOriginTags             int               // distinct tracer languages and versions beyond this number are tagged as "other"
+	ServiceAliases            map[string]string // services renamed on reception, from their alias to their canonical name
+	LowercaseNames            bool              // whether span names are lowercased on reception, like services are
+	MaxResourceLen            int               // resources longer than this are truncated on reception, at most model.MaxResourceLen
+	RejectLongResources       bool              // whether traces with a resource longer than MaxResourceLen are rejected instead
+	AssignZeroTraceIDs        bool              // whether spans with a zero trace ID get a random one instead of being rejected
 
 	// internal telemetry
-	StatsdHost string
-	StatsdPort int
+	StatsdHost          string
+	StatsdPort          int
+	StatsdBufferLength  int           // number of metrics buffered before being sent together, 0 to send them one by one
+	StatsdFlushInterval time.Duration // buffered metrics are sent at least this often
 
 	// logging
 	LogLevel    string
@@ -86,6 +165,15 @@ func mergeEnv(c *AgentConfig) {
 		c.APIKeys = vals
 	}
 
+	if v := os.Getenv("DD_APM_DD_URL"); v != "" {
+		log.Info("overriding API endpoint from env DD_APM_DD_URL value")
+		vals := strings.Split(v, ",")
+		for i := range vals {
+			vals[i] = strings.TrimSpace(vals[i])
+		}
+		c.APIEndpoints = vals
+	}
+
 	if v := os.Getenv("DD_RECEIVER_PORT"); v != "" {
 		port, err := strconv.Atoi(v)
 		if err != nil {
@@ -159,16 +247,40 @@ func NewDefaultAgentConfig() *AgentConfig {
 
 		BucketInterval:   time.Duration(10) * time.Second,
 		ExtraAggregators: []string{},
+		SpanKindTypes:    make(map[string]string, len(model.DefaultSpanKindTypes)),
+		FlushQueueSize:   1,
+		SublayersEnabled: true,
+
+		SublayerMetricsOnSpan:  true,
+		ServiceBucketIntervals: make(map[string]time.Duration),
+
+		StatsWindowBuckets: 10,
+
+		ExtraSampleRate:    1.0,
+		MaxTPS:             10,
+		ErrorTracesFloor:   1,
+		MinTraceSpans:      1,
+		ShortTracesInStats: true,
+
+		KeepSlowSpansAbove:        make(map[string]time.Duration),
+		SamplingDecisionCacheSize: 10000,
 
-		ExtraSampleRate: 1.0,
-		MaxTPS:          10,
+		ShadowExtraSampleRate: 1.0,
+		ShadowMaxTPS:          10,
 
 		ReceiverHost:    "localhost",
 		ReceiverPort:    8126,
 		ConnectionLimit: 2000,
+		IgnoreServices:  []string{},
+		ServiceAliases:  make(map[string]string),
+		MaxResourceLen:  model.MaxResourceLen,
 
-		StatsdHost: "localhost",
-		StatsdPort: 8125,
+		ReceiverDefaultEnvs: make(map[int]string),
+		MaxOriginTags:       100,
+
+		StatsdHost:          "localhost",
+		StatsdPort:          8125,
+		StatsdFlushInterval: 100 * time.Millisecond,
 
 		LogLevel:    "INFO",
 		LogFilePath: "/var/log/datadog/trace-agent.log",
@@ -178,6 +290,10 @@ func NewDefaultAgentConfig() *AgentConfig {
 		WatchdogInterval: time.Minute,
 	}
 
+	for k, v := range model.DefaultSpanKindTypes {
+		ac.SpanKindTypes[k] = v
+	}
+
 	return ac
 }
 
@@ -258,6 +374,18 @@ APM_CONF:
 		c.LogFilePath = v
 	}
 
+	if v, e := conf.GetInt("trace.config", "statsd_buffer_length"); e == nil && v >= 0 {
+		c.StatsdBufferLength = v
+	}
+
+	if v, e := conf.GetInt("trace.config", "statsd_flush_interval_ms"); e == nil {
+		if v > 0 {
+			c.StatsdFlushInterval = time.Duration(v) * time.Millisecond
+		} else {
+			log.Errorf("invalid statsd flush interval %d, using the default", v)
+		}
+	}
+
 	if v, _ := conf.Get("trace.api", "api_key"); v != "" {
 		vals := strings.Split(v, ",")
 		for i := range vals {
@@ -278,22 +406,250 @@ APM_CONF:
 		c.APIPayloadBufferMaxSize = v
 	}
 
+	if v, e := conf.GetInt("trace.api", "batch_interval_seconds"); e == nil {
+		c.APIBatchInterval = time.Duration(v) * time.Second
+	}
+
+	if v, e := conf.GetStrArray("trace.api", "meta_keys", ","); e == nil {
+		c.APIMetaKeys = v
+	}
+
+	if v, e := conf.GetInt("trace.api", "batch_max_size"); e == nil {
+		c.APIBatchMaxSize = v
+	}
+
 	if v, e := conf.GetInt("trace.concentrator", "bucket_size_seconds"); e == nil {
 		c.BucketInterval = time.Duration(v) * time.Second
 	}
 
+	if v, e := conf.GetInt("trace.concentrator", "duration_granularity_ms"); e == nil {
+		c.StatsDurationGranularity = time.Duration(v) * time.Millisecond
+	}
+
+	if v, e := conf.Get("trace.concentrator", "weighted_distributions"); e == nil {
+		c.StatsWeightedDistributions = v == "true"
+	}
+
+	if v, e := conf.Get("trace.concentrator", "error_distributions"); e == nil {
+		c.StatsErrorDistributions = v == "true"
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "min_distribution_samples"); e == nil && v >= 0 {
+		c.StatsMinSamples = v
+	}
+
+	if v, e := conf.Get("trace.concentrator", "flag_low_sample_distributions"); e == nil {
+		c.StatsFlagLowSamples = v == "true"
+	}
+
+	if v, _ := conf.Get("trace.concentrator", "synthetics_meta"); v != "" {
+		if tag := model.NewTagFromString(strings.TrimSpace(v)); tag.Name != "" {
+			c.StatsSynthetics = tag
+		} else {
+			log.Errorf("invalid synthetics meta %q, it should be of the form key:value, ignoring it", v)
+		}
+	}
+
+	if v, e := conf.Get("trace.concentrator", "synthetics_stats_apart"); e == nil {
+		c.StatsSyntheticsApart = v == "true"
+	}
+
+	if v, _ := conf.Get("trace.concentrator", "resource_template"); v != "" {
+		if t, err := model.ParseResourceTemplate(v); err == nil {
+			c.StatsResourceTemplate = t
+		} else {
+			log.Errorf("%v, ignoring it", err)
+		}
+	}
+
+	if v, e := conf.Get("trace.concentrator", "extrapolate_sampled_traces"); e == nil {
+		c.StatsExtrapolateSampled = v == "true"
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "max_resources_per_service"); e == nil && v >= 0 {
+		c.MaxResourcesPerService = v
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "max_buckets_per_flush"); e == nil && v >= 0 {
+		c.MaxBucketsPerFlush = v
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "max_memory_mb"); e == nil && v >= 0 {
+		c.StatsMaxMemory = int64(v) * 1024 * 1024
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "flush_jitter_seconds"); e == nil && v >= 0 {
+		c.FlushJitter = time.Duration(v) * time.Second
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "flush_queue_size"); e == nil && v >= 0 {
+		c.FlushQueueSize = v
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "input_queue_size"); e == nil && v >= 0 {
+		c.StatsInputSize = v
+	}
+	if v, e := conf.Get("trace.concentrator", "input_drop_oldest"); e == nil {
+		c.StatsInputDropOldest = v == "true"
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "sublayer_min_duration_ms"); e == nil {
+		c.SublayerMinDuration = time.Duration(v) * time.Millisecond
+	}
+
+	if v, e := conf.Get("trace.concentrator", "duration_metrics"); e == nil {
+		c.StatsDurationMetrics = v == "true"
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "sliding_window_seconds"); e == nil && v >= 0 {
+		c.StatsWindow = time.Duration(v) * time.Second
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "sliding_window_buckets"); e == nil && v > 0 {
+		c.StatsWindowBuckets = v
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "recent_flushes"); e == nil && v >= 0 {
+		c.StatsRecentFlushes = v
+	}
+
+	if v, e := conf.Get("trace.concentrator", "sublayers"); e == nil {
+		c.SublayersEnabled = v == "true"
+	}
+
+	if v, e := conf.Get("trace.concentrator", "sublayer_by_caller"); e == nil {
+		c.SublayerByCaller = v == "true"
+	}
+
+	if v, e := conf.Get("trace.concentrator", "sublayer_by_error"); e == nil {
+		c.SublayerByError = v == "true"
+	}
+
+	if v, e := conf.Get("trace.concentrator", "sublayer_metrics_on_span"); e == nil {
+		c.SublayerMetricsOnSpan = v == "true"
+	}
+
+	if v, e := conf.Get("trace.concentrator", "sublayer_tags_on_span"); e == nil {
+		c.SublayerTagsOnSpan = v == "true"
+	}
+
+	if v, e := conf.Get("trace.concentrator", "sublayer_idle_time"); e == nil {
+		c.SublayerIdleTime = v == "true"
+	}
+
+	if s, e := conf.GetSection("trace.span_kinds"); e == nil {
+		for kind, t := range s.KeysHash() {
+			c.SpanKindTypes[strings.ToLower(kind)] = t
+		}
+	}
+
+	if v, e := conf.GetFloat("trace.concentrator", "late_span_cutoff_percentile"); e == nil {
+		c.LateSpanCutoffPercentile = v
+	}
+
+	if v, e := conf.GetInt("trace.concentrator", "late_span_cutoff_margin_seconds"); e == nil {
+		c.LateSpanCutoffMargin = time.Duration(v) * time.Second
+	}
+
+	if v, e := conf.Get("trace.concentrator", "drop_late_spans"); e == nil {
+		c.DropLateSpans = v == "true"
+	}
+
+	if v, _ := conf.Get("trace.concentrator", "rootless_traces"); v != "" {
+		if mode, err := model.ParseRootlessMode(v); err == nil {
+			c.RootlessTraces = mode
+		} else {
+			log.Errorf("%v, using default", err)
+		}
+	}
+
 	if v, e := conf.GetStrArray("trace.concentrator", "extra_aggregators", ","); e == nil {
 		c.ExtraAggregators = v
 	} else {
 		log.Debug("No aggregator configuration, using defaults")
 	}
 
+	if v, e := conf.GetStrArray("trace.concentrator", "stats_sampling_priorities", ","); e == nil {
+		for _, p := range v {
+			priority, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil {
+				log.Errorf("invalid sampling priority %q in stats_sampling_priorities, ignoring it", p)
+				continue
+			}
+			c.StatsSamplingPriorities = append(c.StatsSamplingPriorities, priority)
+		}
+	}
+
+	if v, _ := conf.Get("trace.concentrator", "sublayer_mode"); v != "" {
+		if mode, err := model.ParseSublayerMode(v); err == nil {
+			c.SublayerMode = mode
+		} else {
+			log.Errorf("%v, using default", err)
+		}
+	}
+
 	if v, e := conf.GetFloat("trace.sampler", "extra_sample_rate"); e == nil {
 		c.ExtraSampleRate = v
 	}
 	if v, e := conf.GetFloat("trace.sampler", "max_traces_per_second"); e == nil {
 		c.MaxTPS = v
 	}
+	if v, e := conf.GetInt("trace.sampler", "min_error_traces_per_signature"); e == nil {
+		c.ErrorTracesFloor = v
+	}
+	if v, e := conf.GetInt("trace.sampler", "min_trace_spans"); e == nil {
+		c.MinTraceSpans = v
+	}
+	if v, e := conf.Get("trace.sampler", "short_traces_in_stats"); e == nil {
+		c.ShortTracesInStats = v == "true"
+	}
+	if v, e := conf.GetInt("trace.sampler", "max_trace_spans"); e == nil {
+		c.MaxTraceSpans = v
+	}
+	if v, e := conf.GetInt("trace.sampler", "keep_slow_traces_above_ms"); e == nil {
+		c.KeepSlowTracesAbove = time.Duration(v) * time.Millisecond
+	}
+	if v, e := conf.GetFloat("trace.sampler", "max_signature_score"); e == nil && v >= 0 {
+		c.MaxSignatureScore = v
+	}
+
+	if v, e := conf.GetFloat("trace.sampler", "signature_target_rate"); e == nil && v >= 0 && v <= 1 {
+		c.SignatureTargetRate = v
+	}
+
+	if v, e := conf.GetStrArray("trace.sampler", "unsampled_envs", ","); e == nil {
+		for _, env := range v {
+			// compared to the envs of the traces, which are normalized
+			if env = model.NormalizeTag(strings.TrimSpace(env)); env != "" {
+				c.UnsampledEnvs = append(c.UnsampledEnvs, env)
+			}
+		}
+	}
+
+	if v, e := conf.Get("trace.sampler", "seed"); e == nil {
+		seed, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			log.Errorf("invalid sampler seed %q, ignoring it", v)
+		} else {
+			c.SamplingSeed = seed
+		}
+	}
+
+	if v, e := conf.Get("trace.sampler", "shadow_enabled"); e == nil {
+		c.ShadowSamplerEnabled = v == "true"
+	}
+	if v, e := conf.GetFloat("trace.sampler", "shadow_extra_sample_rate"); e == nil {
+		c.ShadowExtraSampleRate = v
+	}
+	if v, e := conf.GetFloat("trace.sampler", "shadow_max_traces_per_second"); e == nil {
+		c.ShadowMaxTPS = v
+	}
+	if v, e := conf.GetInt("trace.sampler", "decision_ttl_seconds"); e == nil {
+		c.SamplingDecisionTTL = time.Duration(v) * time.Second
+	}
+	if v, e := conf.GetInt("trace.sampler", "decision_cache_size"); e == nil {
+		c.SamplingDecisionCacheSize = v
+	}
 
 	if v, e := conf.GetInt("trace.receiver", "receiver_port"); e == nil {
 		c.ReceiverPort = v
@@ -303,6 +659,84 @@ APM_CONF:
 		c.ConnectionLimit = v
 	}
 
+	if v, e := conf.GetStrArray("trace.receiver", "ignore_services", ","); e == nil {
+		for _, service := range v {
+			// compared to the services of the spans, which are normalized
+			if service = model.NormalizeTag(strings.TrimSpace(service)); service != "" {
+				c.IgnoreServices = append(c.IgnoreServices, service)
+			}
+		}
+	}
+
+	if v, e := conf.Get("trace.receiver", "streaming_decoding"); e == nil {
+		c.ReceiverStreamingDecoding = v == "true"
+	}
+
+	if v, e := conf.GetInt("trace.receiver", "max_resource_length"); e == nil && v > 0 && v <= model.MaxResourceLen {
+		c.MaxResourceLen = v
+	}
+
+	if v, e := conf.Get("trace.receiver", "reject_long_resources"); e == nil {
+		c.RejectLongResources = v == "true"
+	}
+
+	if v, e := conf.Get("trace.receiver", "assign_zero_trace_ids"); e == nil {
+		c.AssignZeroTraceIDs = v == "true"
+	}
+
+	if v, e := conf.Get("trace.receiver", "lowercase_names"); e == nil {
+		c.LowercaseNames = v == "true"
+	}
+
+	if v, e := conf.Get("trace.receiver", "origin_tags"); e == nil {
+		c.OriginTags = v == "true"
+	}
+
+	if v, e := conf.GetInt("trace.receiver", "max_origin_tags"); e == nil && v > 0 {
+		c.MaxOriginTags = v
+	}
+
+	if s, e := conf.GetSection("trace.receiver.default_envs"); e == nil {
+		for port, env := range s.KeysHash() {
+			p, err := strconv.Atoi(port)
+			if err != nil || p <= 0 || p > 65535 || env == "" {
+				log.Errorf("invalid default env for receiver port %s: %s", port, env)
+				continue
+			}
+			c.ReceiverDefaultEnvs[p] = model.NormalizeTag(env)
+		}
+	}
+
+	if s, e := conf.GetSection("trace.concentrator.service_bucket_size_seconds"); e == nil {
+		for service, v := range s.KeysHash() {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds <= 0 {
+				log.Errorf("invalid bucket size for service %s: %s", service, v)
+				continue
+			}
+			// compare them to the normalized services of the spans
+			c.ServiceBucketIntervals[model.NormalizeTag(service)] = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if s, e := conf.GetSection("trace.sampler.keep_slow_spans_above_ms"); e == nil {
+		for spanType, v := range s.KeysHash() {
+			ms, err := strconv.Atoi(v)
+			if err != nil || ms <= 0 {
+				log.Errorf("invalid threshold for the slow spans of type %s: %s", spanType, v)
+				continue
+			}
+			c.KeepSlowSpansAbove[spanType] = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	if s, e := conf.GetSection("trace.service_aliases"); e == nil {
+		for alias, canonical := range s.KeysHash() {
+			// compare them to the normalized services of the spans
+			c.ServiceAliases[model.NormalizeTag(alias)] = model.NormalizeTag(canonical)
+		}
+	}
+
 	if v, e := conf.GetInt("trace.receiver", "timeout"); e == nil {
 		c.ReceiverTimeout = v
 	}
@@ -331,5 +765,31 @@ ENV_CONF:
 	if len(c.APIKeys) != len(c.APIEndpoints) {
 		return c, errors.New("every API key needs to have an explicit endpoint associated")
 	}
+
+	if err := validateAPI(c); err != nil {
+		return c, err
+	}
 	return c, nil
 }
+
+// validateAPI checks that the API keys are not empty and that the API endpoints
+// are valid URLs, so that the agent does not start without being able to ship data
+func validateAPI(c *AgentConfig) error {
+	for i, key := range c.APIKeys {
+		if key == "" {
+			return fmt.Errorf("API key #%d is empty", i+1)
+		}
+	}
+
+	for _, endpoint := range c.APIEndpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid API endpoint %q: %v", endpoint, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid API endpoint %q: it should be an http or https URL", endpoint)
+		}
+	}
+
+	return nil
+}
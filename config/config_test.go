@@ -3,11 +3,13 @@ package config
 import (
 	"os"
 	"strings"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"testing"
 
+	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/go-ini/ini"
 )
 
@@ -48,6 +50,47 @@ func TestOnlyEnvConfig(t *testing.T) {
 	os.Setenv("DD_API_KEY", "")
 }
 
+func TestEnvAPIEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("DD_API_KEY", "apikey_from_env")
+	os.Setenv("DD_APM_DD_URL", "https://trace.agent.example.com")
+	defer os.Setenv("DD_API_KEY", "")
+	defer os.Setenv("DD_APM_DD_URL", "")
+
+	agentConfig, err := NewAgentConfig(nil, nil)
+	assert.Nil(err)
+	assert.Equal([]string{"https://trace.agent.example.com"}, agentConfig.APIEndpoints)
+
+	// malformed URLs are rejected
+	for _, endpoint := range []string{"trace.agent.example.com", "ftp://trace.agent.example.com", "https://", "http://[::1"} {
+		os.Setenv("DD_APM_DD_URL", endpoint)
+		_, err = NewAgentConfig(nil, nil)
+		if assert.NotNil(err, endpoint) {
+			assert.Contains(err.Error(), "invalid API endpoint")
+		}
+	}
+}
+
+func TestEnvMissingAPIKey(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("DD_API_KEY", "")
+	_, err := NewAgentConfig(nil, nil)
+	assert.NotNil(err)
+
+	// empty keys are rejected too
+	os.Setenv("DD_API_KEY", "apikey_1, ")
+	os.Setenv("DD_APM_DD_URL", "https://a.example.com,https://b.example.com")
+	defer os.Setenv("DD_API_KEY", "")
+	defer os.Setenv("DD_APM_DD_URL", "")
+
+	_, err = NewAgentConfig(nil, nil)
+	if assert.NotNil(err) {
+		assert.Equal("API key #2 is empty", err.Error())
+	}
+}
+
 func TestOnlyDDAgentConfig(t *testing.T) {
 	assert := assert.New(t)
 
@@ -131,6 +174,217 @@ func TestDDAgentConfigWithNewOpts(t *testing.T) {
 	assert.Equal(0.33, agentConfig.ExtraSampleRate)
 }
 
+func TestSpanKindTypesConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.span_kinds]",
+		"consumer = queue",
+		"Batch = worker",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	// overridden and added kinds
+	assert.Equal("queue", agentConfig.SpanKindTypes["consumer"])
+	assert.Equal("worker", agentConfig.SpanKindTypes["batch"])
+	// defaults are kept
+	assert.Equal("web", agentConfig.SpanKindTypes["server"])
+	// without touching the package defaults
+	assert.Equal("worker", model.DefaultSpanKindTypes["consumer"])
+}
+
+func TestStatsSamplingPrioritiesConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.concentrator]",
+		"stats_sampling_priorities = 1, 2,high",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+	assert.Equal([]int{1, 2}, agentConfig.StatsSamplingPriorities)
+
+	// everything is counted by default
+	assert.Nil(NewDefaultAgentConfig().StatsSamplingPriorities)
+}
+
+func TestServiceAliasesConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.service_aliases]",
+		"checkout-svc = checkout",
+		"Checkout_Service = Checkout",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	// names are normalized like the services of the spans
+	assert.Equal(map[string]string{
+		"checkout-svc":     "checkout",
+		"checkout_service": "checkout",
+	}, agentConfig.ServiceAliases)
+
+	assert.Len(NewDefaultAgentConfig().ServiceAliases, 0)
+}
+
+func TestServiceBucketIntervalsConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.concentrator.service_bucket_size_seconds]",
+		"Cron-Jobs = 60",
+		"web = -1",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	// services are normalized like the ones of the spans, invalid sizes are ignored
+	assert.Equal(map[string]time.Duration{"cron-jobs": time.Minute}, agentConfig.ServiceBucketIntervals)
+
+	assert.Len(NewDefaultAgentConfig().ServiceBucketIntervals, 0)
+}
+
+func TestReceiverDefaultEnvsConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.receiver.default_envs]",
+		"8127 = Staging",
+		"8128 = qa",
+		"http = dev",
+		"70000 = dev",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	// envs are normalized like DefaultEnv, invalid ports are ignored
+	assert.Equal(map[int]string{8127: "staging", 8128: "qa"}, agentConfig.ReceiverDefaultEnvs)
+
+	assert.Len(NewDefaultAgentConfig().ReceiverDefaultEnvs, 0)
+}
+
+func TestUnsampledEnvsConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.sampler]",
+		"unsampled_envs = dev, Staging,",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	// envs are normalized like the ones of the traces
+	assert.Equal([]string{"dev", "staging"}, agentConfig.UnsampledEnvs)
+
+	assert.Len(NewDefaultAgentConfig().UnsampledEnvs, 0)
+}
+
+func TestStatsdBufferConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.config]",
+		"statsd_buffer_length = 50",
+		"statsd_flush_interval_ms = 250",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+	assert.Equal(50, agentConfig.StatsdBufferLength)
+	assert.Equal(250*time.Millisecond, agentConfig.StatsdFlushInterval)
+
+	// invalid intervals are ignored
+	dd, _ = ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.config]",
+		"statsd_flush_interval_ms = 0",
+	}, "\n")))
+	conf = &File{instance: dd, Path: "whatever"}
+	agentConfig, _ = NewAgentConfig(conf, nil)
+	assert.Equal(100*time.Millisecond, agentConfig.StatsdFlushInterval)
+}
+
+func TestIgnoreServicesConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.receiver]",
+		"ignore_services = envoy.internal, Health-Check,",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	// services are normalized like the ones of the spans
+	assert.Equal([]string{"envoy.internal", "health-check"}, agentConfig.IgnoreServices)
+
+	assert.Len(NewDefaultAgentConfig().IgnoreServices, 0)
+}
+
+func TestSamplingSeedConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.sampler]",
+		"seed = 18446744073709551615",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+	assert.Equal(uint64(18446744073709551615), agentConfig.SamplingSeed)
+
+	assert.Equal(uint64(0), NewDefaultAgentConfig().SamplingSeed)
+}
+
+func TestKeepSlowSpansAboveConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.sampler.keep_slow_spans_above_ms]",
+		"sql = 500",
+		"cache = 0",
+		"http = slow",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	// invalid thresholds are ignored
+	assert.Equal(map[string]time.Duration{"sql": 500 * time.Millisecond}, agentConfig.KeepSlowSpansAbove)
+
+	assert.Len(NewDefaultAgentConfig().KeepSlowSpansAbove, 0)
+}
+
 func TestConfigNewIfExists(t *testing.T) {
 	// The file does not exist: no error returned
 	conf, err := NewIfExists("/does-not-exist")
@@ -155,3 +409,71 @@ func TestGetHostname(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotEqual(t, "", h)
 }
+
+func TestStatsSyntheticsConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.concentrator]",
+		"synthetics_meta = synthetics:true",
+		"synthetics_stats_apart = true",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+	assert.Equal(model.Tag{Name: "synthetics", Value: "true"}, agentConfig.StatsSynthetics)
+	assert.True(agentConfig.StatsSyntheticsApart)
+
+	// a meta without a name is ignored
+	dd, _ = ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.concentrator]",
+		"synthetics_meta = synthetics",
+	}, "\n")))
+	conf = &File{instance: dd, Path: "whatever"}
+	agentConfig, _ = NewAgentConfig(conf, nil)
+	assert.Equal("", agentConfig.StatsSynthetics.Name)
+}
+
+func TestStatsResourceTemplateConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.concentrator]",
+		"resource_template = {http.method} {http.route}",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+	if assert.NotNil(agentConfig.StatsResourceTemplate) {
+		assert.Equal("{http.method} {http.route}", agentConfig.StatsResourceTemplate.String())
+	}
+
+	assert.Nil(NewDefaultAgentConfig().StatsResourceTemplate)
+}
+
+func TestStatsInputConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"hostname = thing",
+		"api_key = apikey_12",
+		"[trace.concentrator]",
+		"input_queue_size = 1000",
+		"input_drop_oldest = true",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+	assert.Equal(1000, agentConfig.StatsInputSize)
+	assert.True(agentConfig.StatsInputDropOldest)
+
+	// no limit by default
+	assert.Equal(0, NewDefaultAgentConfig().StatsInputSize)
+}
@@ -70,6 +70,35 @@ func parseFloat64(dc *msgp.Reader) (float64, error) {
 	}
 }
 
+// parseUint64 parses an uint64 even if the sent value is an int64; some clients,
+// typically Java ones, send the IDs as signed integers, making the ones with the
+// highest bit set negative. Their bit pattern is kept as it is, so that they
+// still match the same IDs sent as unsigned integers, e.g. as parent IDs.
+func parseUint64(dc *msgp.Reader) (uint64, error) {
+	// read the generic representation type without decoding
+	t, err := dc.NextType()
+	if err != nil {
+		return 0, err
+	}
+
+	switch t {
+	case msgp.UintType:
+		u, err := dc.ReadUint64()
+		if err != nil {
+			return 0, err
+		}
+		return u, nil
+	case msgp.IntType:
+		i, err := dc.ReadInt64()
+		if err != nil {
+			return 0, err
+		}
+		return uint64(i), nil
+	default:
+		return 0, msgp.TypeError{Encoded: t, Method: msgp.UintType}
+	}
+}
+
 // cast to int64 values that are int64 but that are sent in uint64
 // over the wire. Set to 0 if they overflow the MaxInt64 size. This
 // cast should be used ONLY while decoding int64 values that are
@@ -8,6 +8,40 @@ import (
 	"github.com/tinylib/msgp/msgp"
 )
 
+func TestParseUint64(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []byte{
+		0x2a,                                                 // 42
+		0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe, // uint64(18446744073709551614)
+		0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe, // int64(-2)
+		0xd0, 0x9c, // int8(-100)
+		0xa1, 0x41, // "A"
+	}
+
+	reader := msgp.NewReader(bytes.NewReader(data))
+
+	u, err := parseUint64(reader)
+	assert.NoError(err)
+	assert.Equal(uint64(42), u)
+
+	u, err = parseUint64(reader)
+	assert.NoError(err)
+	assert.Equal(uint64(18446744073709551614), u)
+
+	// signed IDs keep their bit pattern
+	u, err = parseUint64(reader)
+	assert.NoError(err)
+	assert.Equal(uint64(18446744073709551614), u)
+
+	u, err = parseUint64(reader)
+	assert.NoError(err)
+	assert.Equal(uint64(1<<64-100), u)
+
+	_, err = parseUint64(reader)
+	assert.Error(err)
+}
+
 func TestParseFloat64(t *testing.T) {
 	assert := assert.New(t)
 
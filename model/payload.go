@@ -24,6 +24,55 @@ func (p *AgentPayload) IsEmpty() bool {
 	return len(p.Stats) == 0 && len(p.Traces) == 0
 }
 
+// ApproxSizeBytes returns a cheap estimation of the size of the payload once
+// encoded, before compression, from the sizes of its spans and stats. It is meant
+// for the callers which cannot afford to encode the payloads only to measure them,
+// e.g. to bound the size of batches.
+func (p *AgentPayload) ApproxSizeBytes() int {
+	size := len(p.HostName) + len(p.Env) + 50
+	for _, t := range p.Traces {
+		for i := range t {
+			size += spanSizeBytes(&t[i])
+		}
+	}
+	for _, b := range p.Stats {
+		size += 70
+		for _, c := range b.Counts {
+			size += statSizeBytes(c.Key, c.Name, c.Measure, c.TagSet) + 20
+		}
+		for _, d := range b.Distributions {
+			size += statSizeBytes(d.Key, d.Name, d.Measure, d.TagSet) + 30
+			if d.Summary != nil {
+				size += 40 * len(d.Summary.Entries)
+			}
+		}
+	}
+	return size
+}
+
+// spanSizeBytes estimates the encoded size of a span: the lengths of its strings
+// plus the field names and the numbers, which are close to constant
+func spanSizeBytes(s *Span) int {
+	size := len(s.Service) + len(s.Name) + len(s.Resource) + len(s.Type) + 190
+	for k, v := range s.Meta {
+		size += len(k) + len(v) + 6
+	}
+	for k := range s.Metrics {
+		size += len(k) + 24
+	}
+	return size
+}
+
+// statSizeBytes estimates the encoded size of a count or a distribution, without
+// its value, keyed by its key in its bucket
+func statSizeBytes(key, name, measure string, tags TagSet) int {
+	size := 2*len(key) + len(name) + len(measure) + 50
+	for _, t := range tags {
+		size += len(t.Name) + len(t.Value) + 22
+	}
+	return size
+}
+
 // AgentPayloadVersion is the version the agent agrees to with
 // the API so that they can encode/decode the data accordingly
 type AgentPayloadVersion string
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentPayloadApproxSizeBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1234567890123, SpanID: 42, Service: "billing", Name: "http.request", Resource: "GET /invoices", Type: "web",
+			Start: 1500000000000000000, Duration: 12345678, Meta: map[string]string{"env": "prod", "http.url": "https://internal/invoices"},
+			Metrics: map[string]float64{"_sample_rate": 0.5, "_sublayers.span_count": 2}},
+		Span{TraceID: 1234567890123, SpanID: 43, ParentID: 42, Service: "billing-db", Name: "postgres.query", Resource: "SELECT * FROM invoices",
+			Type: "sql", Start: 1500000000001000000, Duration: 2345678},
+	}
+	b := NewStatsRawBucket(1500000000000000000, 1e10)
+	for _, s := range trace {
+		b.HandleSpan(s, "prod", "", nil, 1, nil)
+	}
+
+	p := AgentPayload{HostName: "test.host", Env: "prod", Traces: []Trace{trace}, Stats: []StatsBucket{b.Export()}}
+	data, err := json.Marshal(p)
+	assert.Nil(err)
+
+	// close enough to the encoded size to bound the size of batches
+	size := p.ApproxSizeBytes()
+	assert.InEpsilon(len(data), size, 0.2, "encoded size %d, estimated %d", len(data), size)
+
+	assert.True((&AgentPayload{}).ApproxSizeBytes() < size)
+}
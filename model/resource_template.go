@@ -0,0 +1,79 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ResourceTemplate derives the resource of spans from their meta, for the
+// frameworks whose meaningful resource is a combination of meta, e.g.
+// "{http.method} {http.route}". Each field between braces is replaced by the
+// meta of the span with this key, the rest of the template is kept as is.
+type ResourceTemplate struct {
+	template string
+	parts    []templatePart
+}
+
+// templatePart is a literal string, or the key of a meta if field is set
+type templatePart struct {
+	value string
+	field bool
+}
+
+// ParseResourceTemplate parses a resource template. Fields are the keys of meta
+// between braces, which can neither be empty nor nested.
+func ParseResourceTemplate(template string) (*ResourceTemplate, error) {
+	t := &ResourceTemplate{template: template}
+	rest := template
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{value: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unexpected '}' in resource template %q", template)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{value: rest[:open]})
+		}
+		rest = rest[open+1:]
+
+		end := strings.IndexAny(rest, "{}")
+		if end < 0 || rest[end] == '{' {
+			return nil, fmt.Errorf("unclosed field in resource template %q", template)
+		}
+		field := strings.TrimSpace(rest[:end])
+		if field == "" {
+			return nil, fmt.Errorf("empty field in resource template %q", template)
+		}
+		t.parts = append(t.parts, templatePart{value: field, field: true})
+		rest = rest[end+1:]
+	}
+	return t, nil
+}
+
+// String returns the template as it was parsed
+func (t *ResourceTemplate) String() string {
+	return t.template
+}
+
+// Resource returns the resource derived from the meta of the span, and false
+// if one of the fields of the template is missing or empty, in which case the
+// raw resource of the span should be used.
+func (t *ResourceTemplate) Resource(s Span) (string, bool) {
+	var b bytes.Buffer
+	for _, p := range t.parts {
+		if !p.field {
+			b.WriteString(p.value)
+			continue
+		}
+		v := s.Meta[p.value]
+		if v == "" {
+			return "", false
+		}
+		b.WriteString(v)
+	}
+	return b.String(), true
+}
@@ -0,0 +1,55 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResourceTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, template := range []string{
+		"{http.method} {http.route}",
+		"GET {http.route}",
+		"{ http.route }",
+		"static",
+	} {
+		tmpl, err := ParseResourceTemplate(template)
+		assert.NoError(err, template)
+		assert.Equal(template, tmpl.String())
+	}
+
+	for _, template := range []string{
+		"{http.method",
+		"http.method}",
+		"{}",
+		"{ }",
+		"{http.{method}}",
+	} {
+		_, err := ParseResourceTemplate(template)
+		assert.Error(err, template)
+	}
+}
+
+func TestResourceTemplateResource(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpl, err := ParseResourceTemplate("{http.method} {http.route}")
+	assert.NoError(err)
+
+	s := Span{Resource: "GET /users/42", Meta: map[string]string{"http.method": "GET", "http.route": "/users/{id}"}}
+	resource, ok := tmpl.Resource(s)
+	assert.True(ok)
+	assert.Equal("GET /users/{id}", resource)
+
+	// missing or empty meta
+	for _, meta := range []map[string]string{
+		nil,
+		{"http.method": "GET"},
+		{"http.method": "GET", "http.route": ""},
+	} {
+		_, ok := tmpl.Resource(Span{Resource: "GET /users/42", Meta: meta})
+		assert.False(ok)
+	}
+}
@@ -0,0 +1,97 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RootlessMode tells what is done with the traces without a root span, i.e.
+// whose spans all have a parent, usually because their root was sent in another
+// payload or lost. Their sublayers are computed from the span standing for the
+// root, which gives ambiguous results.
+type RootlessMode int
+
+const (
+	// RootlessKeep processes rootless traces as is, a span whose parent is not
+	// in the trace standing for the root. This is the default.
+	RootlessKeep RootlessMode = iota
+	// RootlessSynthesize completes rootless traces with a virtual root, see
+	// WithVirtualRoot.
+	RootlessSynthesize
+	// RootlessReject drops rootless traces.
+	RootlessReject
+)
+
+// ParseRootlessMode returns the RootlessMode matching the given name, either
+// "keep", "synthesize" or "reject".
+func ParseRootlessMode(name string) (RootlessMode, error) {
+	switch strings.ToLower(name) {
+	case "keep":
+		return RootlessKeep, nil
+	case "synthesize":
+		return RootlessSynthesize, nil
+	case "reject":
+		return RootlessReject, nil
+	default:
+		return RootlessKeep, fmt.Errorf("unknown rootless traces mode %q", name)
+	}
+}
+
+// VirtualRootName is the name of the roots added by WithVirtualRoot
+const VirtualRootName = "trace.virtual_root"
+
+// HasRoot tells if the trace has a root span, i.e. a span without parent.
+func (t Trace) HasRoot() bool {
+	for i := range t {
+		if t[i].ParentID == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// WithVirtualRoot returns the rootless trace completed with a virtual root
+// spanning all its spans. The virtual root takes the service and resource of the
+// span GetRoot picks, and becomes the parent of all the spans whose parent is not
+// in the trace. It gets a new random ID rather than the ID of a missing parent,
+// which would be duplicated by the actual root if it was sent later. The spans
+// of the trace are modified in place. Traces with no missing parent, i.e. whose
+// parents form a cycle, are returned unchanged.
+func (t Trace) WithVirtualRoot() Trace {
+	if len(t) == 0 {
+		return t
+	}
+
+	ids := make(map[uint64]struct{}, len(t))
+	for i := range t {
+		ids[t[i].SpanID] = struct{}{}
+	}
+	orphan := t.GetRoot()
+	if _, ok := ids[orphan.ParentID]; ok {
+		return t
+	}
+
+	id := RandomID()
+	for _, ok := ids[id]; ok || id == 0; _, ok = ids[id] {
+		id = RandomID()
+	}
+
+	root := Span{
+		TraceID:  orphan.TraceID,
+		SpanID:   id,
+		Service:  orphan.Service,
+		Name:     VirtualRootName,
+		Resource: orphan.Resource,
+		Start:    t[0].Start,
+		Duration: t.WallDuration(),
+	}
+	for i := range t {
+		if t[i].Start < root.Start {
+			root.Start = t[i].Start
+		}
+		if _, ok := ids[t[i].ParentID]; !ok {
+			t[i].ParentID = root.SpanID
+		}
+	}
+	return append(t, root)
+}
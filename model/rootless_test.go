@@ -0,0 +1,55 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRootlessMode(t *testing.T) {
+	assert := assert.New(t)
+
+	for name, expected := range map[string]RootlessMode{
+		"keep":       RootlessKeep,
+		"Synthesize": RootlessSynthesize,
+		"reject":     RootlessReject,
+	} {
+		mode, err := ParseRootlessMode(name)
+		assert.NoError(err)
+		assert.Equal(expected, mode)
+	}
+
+	_, err := ParseRootlessMode("drop")
+	assert.Error(err)
+}
+
+func TestWithVirtualRoot(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: 10, Duration: 80},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Service: "db", Name: "db.query", Resource: "SELECT", Start: 20, Duration: 50},
+		Span{TraceID: 1, SpanID: 4, ParentID: 5, Service: "cache", Name: "cache.get", Resource: "GET", Start: 95, Duration: 10},
+	}
+	assert.False(trace.HasRoot())
+
+	trace = trace.WithVirtualRoot()
+	assert.True(trace.HasRoot())
+	assert.Len(trace, 4)
+
+	root := trace.GetRoot()
+	assert.Equal(Span{TraceID: 1, SpanID: root.SpanID, Service: root.Service, Name: VirtualRootName, Resource: root.Resource, Start: 10, Duration: 95}, *root)
+	// all the spans whose parent is missing are attached to the virtual root
+	assert.Equal(root.SpanID, trace[0].ParentID)
+	assert.Equal(uint64(2), trace[1].ParentID)
+	assert.Equal(root.SpanID, trace[2].ParentID)
+	// the virtual root has its own ID, not the one of a missing parent
+	assert.NotContains([]uint64{0, 1, 2, 3, 4, 5}, root.SpanID)
+
+	// cycles have no missing parent to become the root
+	cycle := Trace{
+		Span{TraceID: 1, SpanID: 1, ParentID: 2},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1},
+	}
+	assert.Len(cycle.WithVirtualRoot(), 2)
+}
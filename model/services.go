@@ -27,6 +27,34 @@ func (s1 ServicesMetadata) Update(s2 ServicesMetadata) bool {
 	return updated
 }
 
+// RenameServices renames the services of the metadata according to the given
+// aliases, mapping normalized service names to their canonical name. The
+// services of the metadata are sent as is by the clients, so they are
+// normalized to be compared with the aliases and the canonical names. When
+// metadata exists for both an alias and its canonical name, the canonical one
+// is kept.
+func (s1 ServicesMetadata) RenameServices(aliases map[string]string) {
+	renamed := make(map[string]string)
+	services := make(map[string]struct{}, len(s1))
+	for service := range s1 {
+		normalized := NormalizeTag(service)
+		if canonical, ok := aliases[normalized]; ok {
+			renamed[service] = canonical
+		} else {
+			services[normalized] = struct{}{}
+		}
+	}
+
+	for alias, canonical := range renamed {
+		metas := s1[alias]
+		delete(s1, alias)
+		if _, ok := services[canonical]; !ok {
+			s1[canonical] = metas
+			services[canonical] = struct{}{}
+		}
+	}
+}
+
 // EncodeServicesPayload will return a slice of bytes representing the
 // services metadata, this uses the same versioned endpoint that AgentPayload
 // uses for serialization.
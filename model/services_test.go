@@ -62,3 +62,30 @@ func TestServiceMetadataEmpty(t *testing.T) {
 
 	assert.False(t, metas.Update(metas2))
 }
+
+func TestServiceMetadataRenameServices(t *testing.T) {
+	assert := assert.New(t)
+
+	metas := ServicesMetadata{
+		"checkout-svc": map[string]string{"app_type": "web", "app": "flask"},
+		"payments-svc": map[string]string{"app_type": "web", "app": "django"},
+		"payments":     map[string]string{"app_type": "web", "app": "rails"},
+		"postgres":     map[string]string{"app_type": "db", "app": "postgres"},
+		// sent as is by the client, normalized to "billing-svc"
+		"Billing-Svc": map[string]string{"app_type": "web", "app": "flask"},
+		"Billing":     map[string]string{"app_type": "web", "app": "rails"},
+	}
+	metas.RenameServices(map[string]string{
+		"checkout-svc": "checkout",
+		"payments-svc": "payments",
+		"billing-svc":  "billing",
+	})
+
+	assert.Equal(ServicesMetadata{
+		"checkout": map[string]string{"app_type": "web", "app": "flask"},
+		// the metadata of the canonical name wins, even not normalized
+		"payments": map[string]string{"app_type": "web", "app": "rails"},
+		"postgres": map[string]string{"app_type": "db", "app": "postgres"},
+		"Billing":  map[string]string{"app_type": "web", "app": "rails"},
+	}, metas)
+}
@@ -1,13 +1,20 @@
 package model
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strconv"
+	"strings"
 )
 
 const (
 	// SpanSampleRateMetricKey is the metric key holding the sample rate
 	SpanSampleRateMetricKey = "_sample_rate"
+	// SpanAgentSampleRateMetricKey is the metric key holding the sample rate applied
+	// by the agent alone to a kept trace, allowing to extrapolate counts from sampled traces
+	SpanAgentSampleRateMetricKey = "_dd.sample_rate"
 )
 
 // Span is the common struct we use to represent a dapper-like span
@@ -43,11 +50,95 @@ func (s Span) String() string {
 	)
 }
 
+// UnmarshalJSON implements json.Unmarshaler. The IDs can be sent as signed
+// integers, see parseUint64, and the end of the span instead of its duration,
+// see setDurationFromEnd.
+func (s *Span) UnmarshalJSON(data []byte) error {
+	type span Span // without this method, to decode the other fields
+	ids := struct {
+		*span
+		TraceID  json.Number `json:"trace_id"`
+		SpanID   json.Number `json:"span_id"`
+		ParentID json.Number `json:"parent_id"`
+		Duration *int64      `json:"duration"`
+		End      *int64      `json:"end"`
+	}{span: (*span)(s)}
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+
+	var err error
+	if s.TraceID, err = parseIDNumber(ids.TraceID); err != nil {
+		return err
+	}
+	if s.SpanID, err = parseIDNumber(ids.SpanID); err != nil {
+		return err
+	}
+	if s.ParentID, err = parseIDNumber(ids.ParentID); err != nil {
+		return err
+	}
+
+	var end int64
+	if ids.Duration != nil {
+		s.Duration = *ids.Duration
+	}
+	if ids.End != nil {
+		end = *ids.End
+	}
+	return s.setDurationFromEnd(end, ids.Duration != nil, ids.End != nil)
+}
+
+// setDurationFromEnd sets the duration of a decoded span from its end, for the
+// clients sending the start and the end of their spans rather than the start
+// and the duration. Sending both is an error, sending none leaves the duration
+// to 0, which is rejected by the normalization.
+func (s *Span) setDurationFromEnd(end int64, hasDuration, hasEnd bool) error {
+	if !hasEnd {
+		return nil
+	}
+	if hasDuration {
+		return errors.New("span has both a duration and an end")
+	}
+	s.Duration = end - s.Start
+	return nil
+}
+
+// parseIDNumber parses an ID sent as an unsigned or a signed integer, keeping
+// the bit pattern of the negative ones
+func parseIDNumber(n json.Number) (uint64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return u, nil
+	}
+	i, err := strconv.ParseInt(string(n), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %s: %v", n, err)
+	}
+	return uint64(i), nil
+}
+
 // RandomID generates a random uint64 that we use for IDs
 func RandomID() uint64 {
 	return uint64(rand.Int63())
 }
 
+// parseHexID parses a hexadecimal ID of up to 128 bits, as sent by Zipkin or in
+// the span links, only keeping its lower 64 bits
+func parseHexID(id string) (uint64, error) {
+	if len(id) > 16 {
+		if len(id) > 32 {
+			return 0, fmt.Errorf("longer than 32 characters")
+		}
+		if _, err := strconv.ParseUint(id[:len(id)-16], 16, 64); err != nil {
+			return 0, err
+		}
+		id = id[len(id)-16:]
+	}
+	return strconv.ParseUint(id, 16, 64)
+}
+
 const flushMarkerType = "_FLUSH_MARKER"
 
 // IsFlushMarker tells if this is a marker span, which signals the system to flush
@@ -65,6 +156,43 @@ func (s *Span) End() int64 {
 	return s.Start + s.Duration
 }
 
+// SpanKindMetaKey is the meta key holding the OpenTelemetry kind of the span
+const SpanKindMetaKey = "span.kind"
+
+// DefaultSpanKindTypes maps the OpenTelemetry span kinds to the types of
+// native spans
+var DefaultSpanKindTypes = map[string]string{
+	"server":   "web",
+	"client":   "http",
+	"producer": "queue",
+	"consumer": "worker",
+	"internal": "custom",
+}
+
+// SetTypeFromKind sets the type of a span without one from its span kind, using
+// the given mapping from span kinds to types. Spans with a type are left untouched.
+func (s *Span) SetTypeFromKind(kindTypes map[string]string) {
+	if s.Type != "" {
+		return
+	}
+	kind, ok := s.Meta[SpanKindMetaKey]
+	if !ok {
+		return
+	}
+	s.Type = kindTypes[strings.ToLower(kind)]
+}
+
+// SamplingPriorityMetricKey is the metric key holding the sampling priority
+// given by the client to the trace of a root span
+const SamplingPriorityMetricKey = "_sampling_priority_v1"
+
+// SamplingPriority returns the sampling priority of the span, ok is false if
+// it has none.
+func (s *Span) SamplingPriority() (priority int, ok bool) {
+	p, ok := s.Metrics[SamplingPriorityMetricKey]
+	return int(p), ok
+}
+
 // Weight returns the weight of the span as defined for sampling, i.e. the
 // inverse of the sampling rate.
 func (s *Span) Weight() float64 {
@@ -75,3 +203,63 @@ func (s *Span) Weight() float64 {
 
 	return 1.0 / sampleRate
 }
+
+// ExtrapolationWeight returns the inverse of the sample rate applied by an agent
+// to the trace of this root span, read from its "_dd.sample_rate" metric, or 1
+// if it was not sampled. It allows to extrapolate the number of traces a sampled
+// one stands for, when computing stats from traces which were already sampled.
+func (s *Span) ExtrapolationWeight() float64 {
+	rate, ok := s.Metrics[SpanAgentSampleRateMetricKey]
+	if !ok || rate <= 0.0 || rate > 1.0 {
+		return 1.0
+	}
+
+	return 1.0 / rate
+}
+
+// SpanLinksMetaKey is the meta key holding the links of a span, as a JSON list
+const SpanLinksMetaKey = "_dd.span_links"
+
+// SpanLink is a reference from a span to another one, usually from another
+// trace, which is neither its parent nor its child, such as the spans which
+// produced the messages of a batch processed by a consumer span.
+type SpanLink struct {
+	TraceID    uint64
+	SpanID     uint64
+	Attributes map[string]string
+}
+
+// Links decodes the links of the span, from its "_dd.span_links" meta in which
+// they are sent as a JSON list of objects with hexadecimal "trace_id" and
+// "span_id" strings, and optional "attributes". A span without this meta has no
+// links. 128-bit trace IDs are truncated to their lower 64 bits.
+func (s *Span) Links() ([]SpanLink, error) {
+	v, ok := s.Meta[SpanLinksMetaKey]
+	if !ok || v == "" {
+		return nil, nil
+	}
+
+	var raw []struct {
+		TraceID    string            `json:"trace_id"`
+		SpanID     string            `json:"span_id"`
+		Attributes map[string]string `json:"attributes"`
+	}
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		return nil, fmt.Errorf("cannot decode span links: %v", err)
+	}
+
+	links := make([]SpanLink, 0, len(raw))
+	for _, l := range raw {
+		var link SpanLink
+		var err error
+		if link.TraceID, err = parseHexID(l.TraceID); err != nil {
+			return nil, fmt.Errorf("invalid linked trace ID %q: %v", l.TraceID, err)
+		}
+		if link.SpanID, err = parseHexID(l.SpanID); err != nil {
+			return nil, fmt.Errorf("invalid linked span ID %q: %v", l.SpanID, err)
+		}
+		link.Attributes = l.Attributes
+		links = append(links, link)
+	}
+	return links, nil
+}
@@ -13,6 +13,9 @@ func (z *Span) DecodeMsg(dc *msgp.Reader) (err error) {
 	if err != nil {
 		return
 	}
+	// some clients send the end of the spans instead of their duration
+	var end int64
+	var hasDuration, hasEnd bool
 	for zajw > 0 {
 		zajw--
 		field, err = dc.ReadMapKeyPtr()
@@ -57,7 +60,7 @@ func (z *Span) DecodeMsg(dc *msgp.Reader) (err error) {
 				break
 			}
 
-			z.TraceID, err = dc.ReadUint64()
+			z.TraceID, err = parseUint64(dc)
 			if err != nil {
 				return
 			}
@@ -67,7 +70,7 @@ func (z *Span) DecodeMsg(dc *msgp.Reader) (err error) {
 				break
 			}
 
-			z.SpanID, err = dc.ReadUint64()
+			z.SpanID, err = parseUint64(dc)
 			if err != nil {
 				return
 			}
@@ -91,6 +94,18 @@ func (z *Span) DecodeMsg(dc *msgp.Reader) (err error) {
 			if err != nil {
 				return
 			}
+			hasDuration = true
+		case "end":
+			if dc.IsNil() {
+				err = dc.ReadNil()
+				break
+			}
+
+			end, err = parseInt64(dc)
+			if err != nil {
+				return
+			}
+			hasEnd = true
 		case "error":
 			if dc.IsNil() {
 				z.Error, err = 0, dc.ReadNil()
@@ -171,7 +186,7 @@ func (z *Span) DecodeMsg(dc *msgp.Reader) (err error) {
 				break
 			}
 
-			z.ParentID, err = dc.ReadUint64()
+			z.ParentID, err = parseUint64(dc)
 			if err != nil {
 				return
 			}
@@ -192,7 +207,7 @@ func (z *Span) DecodeMsg(dc *msgp.Reader) (err error) {
 			}
 		}
 	}
-	return
+	return z.setDurationFromEnd(end, hasDuration, hasEnd)
 }
 
 // EncodeMsg implements msgp.Encodable
@@ -1,9 +1,12 @@
 package model
 
 import (
+	"bytes"
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
 )
 
 func testSpan() Span {
@@ -33,6 +36,104 @@ func TestSpanString(t *testing.T) {
 	assert.NotEqual("", testSpan().String())
 }
 
+func TestSpanUnmarshalJSONSignedIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	// a Java client sending its IDs as signed integers, the root has the
+	// highest bit of its ID set
+	data := `[
+		{"trace_id": -2, "span_id": -2, "parent_id": 0, "service": "web", "name": "http.request", "resource": "GET /", "start": 1, "duration": 10},
+		{"trace_id": -2, "span_id": 12, "parent_id": -2, "service": "db", "name": "db.query", "resource": "SELECT", "start": 2, "duration": 5},
+		{"trace_id": 18446744073709551614, "span_id": 13, "parent_id": 18446744073709551614, "service": "cache", "name": "redis.command", "resource": "GET"}
+	]`
+
+	var trace Trace
+	assert.NoError(json.Unmarshal([]byte(data), &trace))
+
+	assert.Equal(uint64(18446744073709551614), trace[0].SpanID)
+	for _, s := range trace {
+		assert.Equal(uint64(18446744073709551614), s.TraceID)
+	}
+	// the children are attached to their root, whatever the representation of their parent ID
+	assert.Equal(&trace[0], trace.GetRoot())
+	assert.Equal(trace[0].SpanID, trace[1].ParentID)
+	assert.Equal(trace[0].SpanID, trace[2].ParentID)
+	assert.Equal(2, trace.Depth())
+
+	// the other fields are decoded as usual
+	assert.Equal("db", trace[1].Service)
+	assert.Equal(int64(5), trace[1].Duration)
+
+	var s Span
+	assert.NoError(json.Unmarshal([]byte(`{"service": "web"}`), &s))
+	assert.Equal(Span{Service: "web"}, s)
+	assert.Error(json.Unmarshal([]byte(`{"span_id": 1.5}`), &s))
+	assert.Error(json.Unmarshal([]byte(`{"span_id": 18446744073709551616}`), &s))
+}
+
+func TestSpanMsgpackSignedIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	w := msgp.NewWriter(&buf)
+	w.WriteArrayHeader(2)
+	w.WriteMapHeader(3)
+	w.WriteString("trace_id")
+	w.WriteInt64(-2)
+	w.WriteString("span_id")
+	w.WriteInt64(-2)
+	w.WriteString("service")
+	w.WriteString("web")
+	w.WriteMapHeader(3)
+	w.WriteString("trace_id")
+	w.WriteUint64(18446744073709551614)
+	w.WriteString("span_id")
+	w.WriteUint64(12)
+	w.WriteString("parent_id")
+	w.WriteInt64(-2)
+	w.Flush()
+
+	var trace Trace
+	assert.NoError(msgp.Decode(&buf, &trace))
+	assert.Equal(trace[0].SpanID, trace[1].ParentID)
+	assert.Equal(trace[0].TraceID, trace[1].TraceID)
+	assert.Equal(&trace[0], trace.GetRoot())
+}
+
+func TestSpanDecodeEnd(t *testing.T) {
+	assert := assert.New(t)
+
+	var s Span
+	assert.NoError(json.Unmarshal([]byte(`{"span_id": 1, "start": 100, "duration": 20}`), &s))
+	assert.Equal(int64(20), s.Duration)
+	s = Span{}
+	assert.NoError(json.Unmarshal([]byte(`{"span_id": 1, "end": 120, "start": 100}`), &s))
+	assert.Equal(int64(100), s.Start)
+	assert.Equal(int64(20), s.Duration)
+	assert.Error(json.Unmarshal([]byte(`{"span_id": 1, "start": 100, "duration": 20, "end": 120}`), &s))
+
+	msgpackSpan := func(fields map[string]int64) *bytes.Buffer {
+		var buf bytes.Buffer
+		w := msgp.NewWriter(&buf)
+		w.WriteMapHeader(uint32(len(fields)))
+		for k, v := range fields {
+			w.WriteString(k)
+			w.WriteInt64(v)
+		}
+		w.Flush()
+		return &buf
+	}
+
+	s = Span{}
+	assert.NoError(msgp.Decode(msgpackSpan(map[string]int64{"start": 100, "duration": 20}), &s))
+	assert.Equal(int64(20), s.Duration)
+	s = Span{}
+	assert.NoError(msgp.Decode(msgpackSpan(map[string]int64{"start": 100, "end": 120}), &s))
+	assert.Equal(int64(100), s.Start)
+	assert.Equal(int64(20), s.Duration)
+	assert.Error(msgp.Decode(msgpackSpan(map[string]int64{"start": 100, "duration": 20, "end": 120}), &s))
+}
+
 func TestSpanFlushMarker(t *testing.T) {
 	assert := assert.New(t)
 	s := NewFlushMarker()
@@ -60,3 +161,83 @@ func TestSpanWeight(t *testing.T) {
 	span.Metrics[SpanSampleRateMetricKey] = 1.5
 	assert.Equal(1.0, span.Weight())
 }
+
+func TestSpanExtrapolationWeight(t *testing.T) {
+	assert := assert.New(t)
+
+	span := testSpan()
+	assert.Equal(1.0, span.ExtrapolationWeight())
+
+	span.Metrics[SpanAgentSampleRateMetricKey] = 0.1
+	assert.Equal(10.0, span.ExtrapolationWeight())
+
+	// independent from the client sample rate
+	span.Metrics[SpanSampleRateMetricKey] = 0.5
+	assert.Equal(10.0, span.ExtrapolationWeight())
+	assert.Equal(2.0, span.Weight())
+
+	span.Metrics[SpanAgentSampleRateMetricKey] = 0
+	assert.Equal(1.0, span.ExtrapolationWeight())
+
+	span.Metrics[SpanAgentSampleRateMetricKey] = 2
+	assert.Equal(1.0, span.ExtrapolationWeight())
+}
+
+func TestSpanSetTypeFromKind(t *testing.T) {
+	assert := assert.New(t)
+
+	for kind, expected := range map[string]string{
+		"server":   "web",
+		"client":   "http",
+		"producer": "queue",
+		"consumer": "worker",
+		"internal": "custom",
+		"SERVER":   "web",
+		"unknown":  "",
+	} {
+		s := Span{Meta: map[string]string{SpanKindMetaKey: kind}}
+		s.SetTypeFromKind(DefaultSpanKindTypes)
+		assert.Equal(expected, s.Type, "kind: %s", kind)
+	}
+
+	// the type is preferred over the span kind
+	s := Span{Type: "db", Meta: map[string]string{SpanKindMetaKey: "client"}}
+	s.SetTypeFromKind(DefaultSpanKindTypes)
+	assert.Equal("db", s.Type)
+
+	// spans without kind are left untouched
+	s = Span{}
+	s.SetTypeFromKind(DefaultSpanKindTypes)
+	assert.Equal("", s.Type)
+
+	// custom mappings
+	s = Span{Meta: map[string]string{SpanKindMetaKey: "consumer"}}
+	s.SetTypeFromKind(map[string]string{"consumer": "queue"})
+	assert.Equal("queue", s.Type)
+}
+
+func TestSpanLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	s := Span{Meta: map[string]string{
+		SpanLinksMetaKey: `[{"trace_id":"00000000000000010000000000000002","span_id":"0a","attributes":{"link.kind":"batch"}},{"trace_id":"3","span_id":"4"}]`,
+	}}
+	links, err := s.Links()
+	assert.Nil(err)
+	assert.Equal([]SpanLink{
+		{TraceID: 2, SpanID: 10, Attributes: map[string]string{"link.kind": "batch"}},
+		{TraceID: 3, SpanID: 4},
+	}, links)
+
+	// no links
+	s = Span{}
+	links, err = s.Links()
+	assert.Nil(err)
+	assert.Len(links, 0)
+
+	for _, v := range []string{`{}`, `[{"trace_id":"xyz","span_id":"1"}]`, `[{"trace_id":"1","span_id":"-1"}]`} {
+		s = Span{Meta: map[string]string{SpanLinksMetaKey: v}}
+		_, err = s.Links()
+		assert.NotNil(err, v)
+	}
+}
@@ -2,6 +2,8 @@ package model
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/DataDog/datadog-trace-agent/quantile"
 )
@@ -39,6 +41,9 @@ type Distribution struct {
 	TagSet  TagSet `json:"tagset"`  // set of tags for which we account this Distribution
 
 	Summary *quantile.SliceSummary `json:"summary"` // actual representation of data
+
+	// set when the distribution has too few samples for its quantiles to be trusted
+	LowConfidence bool `json:"low_confidence,omitempty"`
 }
 
 // GrainKey generates the key used to aggregate counts and distributions
@@ -138,3 +143,89 @@ func NewStatsBucket(ts, d int64) StatsBucket {
 func (sb StatsBucket) IsEmpty() bool {
 	return len(sb.Counts) == 0 && len(sb.Distributions) == 0
 }
+
+// Keys returns the sorted aggregation keys of the bucket, of the form name|aggr,
+// for example: serve|env:prod,resource:GET /,service:webserver. Each of them
+// groups the counts and distributions of the measures of an aggregation,
+// sublayer counts having their own keys, except the untagged ones which belong
+// to the key of their aggregation.
+func (sb StatsBucket) Keys() []string {
+	seen := make(map[string]struct{}, len(sb.Counts))
+	add := func(key, name, measure string) {
+		// keys are built with GrainKey, drop their measure
+		prefix := name + "|" + measure + "|"
+		if len(key) < len(prefix) || key[:len(prefix)] != prefix {
+			return
+		}
+		// untagged sublayers, such as the span count, get an empty tag
+		aggr := strings.TrimSuffix(key[len(prefix):], ",:")
+		seen[name+"|"+aggr] = struct{}{}
+	}
+	for k, c := range sb.Counts {
+		add(k, c.Name, c.Measure)
+	}
+	for k, d := range sb.Distributions {
+		add(k, d.Name, d.Measure)
+	}
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ErrorRate returns the ratio of errors to hits across all the aggregations of
+// the bucket, or 0 if it has no hits.
+func (sb StatsBucket) ErrorRate() float64 {
+	var hits, errors float64
+	for _, c := range sb.Counts {
+		switch c.Measure {
+		case HITS:
+			hits += c.Value
+		case ERRORS:
+			errors += c.Value
+		}
+	}
+	if hits == 0 {
+		return 0
+	}
+	return errors / hits
+}
+
+// Mean returns the mean duration of the spans of an aggregation, from the sum of
+// their durations and their number of hits, which is cheaper than querying its
+// distribution. The key is the one of any count or distribution of the
+// aggregation, e.g. "http.request|duration|env:prod,resource:GET /,service:web".
+// It returns 0 if the aggregation has no hits.
+func (sb StatsBucket) Mean(key string) float64 {
+	parts := strings.SplitN(key, "|", 3)
+	if len(parts) != 3 {
+		return 0
+	}
+	hits := sb.Counts[GrainKey(parts[0], HITS, parts[2])].Value
+	if hits == 0 {
+		return 0
+	}
+	return sb.Counts[GrainKey(parts[0], DURATION, parts[2])].Value / hits
+}
+
+// Merge adds the counts and distributions of sb2 to the ones of sb, which must
+// cover the same aggregations. The distributions of sb2 are copied, never shared.
+func (sb StatsBucket) Merge(sb2 StatsBucket) {
+	for k, c := range sb2.Counts {
+		if c1, ok := sb.Counts[k]; ok {
+			sb.Counts[k] = c1.Merge(c)
+		} else {
+			sb.Counts[k] = c
+		}
+	}
+	for k, d := range sb2.Distributions {
+		if d1, ok := sb.Distributions[k]; ok {
+			d1.Merge(d)
+		} else {
+			sb.Distributions[k] = d.Copy()
+		}
+	}
+}
@@ -62,7 +62,7 @@ func TestStatsBucketDefault(t *testing.T) {
 	// No custom aggregators only the defaults
 	aggr := []string{}
 	for _, s := range testSpans() {
-		srb.HandleSpan(s, defaultEnv, aggr, 1.0, nil)
+		srb.HandleSpan(s, defaultEnv, "", aggr, 1.0, nil)
 	}
 	sb := srb.Export()
 
@@ -130,7 +130,7 @@ func TestStatsBucketExtraAggregators(t *testing.T) {
 	// one custom aggregator
 	aggr := []string{"version"}
 	for _, s := range testSpans() {
-		srb.HandleSpan(s, defaultEnv, aggr, 1.0, nil)
+		srb.HandleSpan(s, defaultEnv, "", aggr, 1.0, nil)
 	}
 	sb := srb.Export()
 
@@ -171,6 +171,54 @@ func TestStatsBucketExtraAggregators(t *testing.T) {
 	}
 }
 
+func TestStatsBucketPeerServiceAggregator(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+
+	spans := []Span{
+		// peer.service is preferred over out.host
+		Span{Service: "A", Name: "http.request", Resource: "α", Duration: 1,
+			Meta: map[string]string{"peer.service": "billing", "out.host": "10.0.0.1"}},
+		// fallback on out.host
+		Span{Service: "A", Name: "http.request", Resource: "α", Duration: 2,
+			Meta: map[string]string{"out.host": "10.0.0.1"}},
+		// neither of them, no extra dimension
+		Span{Service: "A", Name: "http.request", Resource: "α", Duration: 3,
+			Meta: map[string]string{"version": "1.3"}},
+		// empty peer.service is ignored
+		Span{Service: "A", Name: "http.request", Resource: "α", Duration: 4,
+			Meta: map[string]string{"peer.service": "", "out.host": "10.0.0.1"}},
+	}
+
+	aggr := []string{PeerServiceAggregator}
+	for _, s := range spans {
+		srb.HandleSpan(s, defaultEnv, "", aggr, 1.0, nil)
+	}
+	sb := srb.Export()
+
+	expectedCounts := map[string]float64{
+		"http.request|duration|env:default,resource:α,service:A,peer.service:billing":  1,
+		"http.request|duration|env:default,resource:α,service:A,peer.service:10.0.0.1": 6,
+		"http.request|duration|env:default,resource:α,service:A":                       3,
+		"http.request|errors|env:default,resource:α,service:A,peer.service:billing":    0,
+		"http.request|errors|env:default,resource:α,service:A,peer.service:10.0.0.1":   0,
+		"http.request|errors|env:default,resource:α,service:A":                         0,
+		"http.request|hits|env:default,resource:α,service:A,peer.service:billing":      1,
+		"http.request|hits|env:default,resource:α,service:A,peer.service:10.0.0.1":     2,
+		"http.request|hits|env:default,resource:α,service:A":                           1,
+	}
+
+	assert.Len(sb.Counts, len(expectedCounts), "Missing counts!")
+	for ckey, c := range sb.Counts {
+		val, ok := expectedCounts[ckey]
+		if !ok {
+			assert.Fail("Unexpected count %s", ckey)
+		}
+		assert.Equal(val, c.Value, "Count %s wrong value", ckey)
+	}
+}
+
 func TestStatsBucketMany(t *testing.T) {
 	if testing.Short() {
 		return
@@ -189,7 +237,7 @@ func TestStatsBucketMany(t *testing.T) {
 		s := templateSpan
 		s.Resource = "α" + strconv.Itoa(i)
 		srbCopy := *srb
-		srbCopy.HandleSpan(s, defaultEnv, aggr, 1.0, nil)
+		srbCopy.HandleSpan(s, defaultEnv, "", aggr, 1.0, nil)
 	}
 	sb := srb.Export()
 
@@ -207,11 +255,104 @@ func TestStatsBucketMany(t *testing.T) {
 	}
 }
 
+func TestStatsBucketKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	root := Span{SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Duration: 100}
+	sublayers := []SublayerValue{
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "db"}, Value: 10},
+		SublayerValue{Metric: "_sublayers.span_count", Value: 2},
+	}
+	srb.HandleSpan(root, defaultEnv, "", nil, 1, &sublayers)
+	srb.HandleSpan(Span{SpanID: 2, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Duration: 10}, defaultEnv, "", nil, 1, nil)
+	srb.HandleSpan(Span{SpanID: 3, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Duration: 20}, defaultEnv, "", nil, 1, nil)
+
+	assert.Equal([]string{
+		"db.query|env:default,resource:SELECT,service:db",
+		// untagged sublayers such as the span count are part of their aggregation
+		"http.request|env:default,resource:GET /,service:web",
+		"http.request|env:default,resource:GET /,service:web,sublayer_service:db",
+	}, srb.Export().Keys())
+
+	assert.Len(NewStatsBucket(0, 1e9).Keys(), 0)
+}
+
+func TestStatsBucketErrorRate(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	sublayers := []SublayerValue{SublayerValue{Metric: "_sublayers.span_count", Value: 3}}
+	srb.HandleSpan(Span{SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Duration: 100, Error: 1}, defaultEnv, "", nil, 1, &sublayers)
+	srb.HandleSpan(Span{SpanID: 2, ParentID: 1, Service: "web", Name: "http.request", Resource: "GET /users", Duration: 100}, defaultEnv, "", nil, 1, nil)
+	srb.HandleSpan(Span{SpanID: 3, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Duration: 10, Error: 1}, defaultEnv, "", nil, 1, nil)
+	srb.HandleSpan(Span{SpanID: 4, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Duration: 10}, defaultEnv, "", nil, 1, nil)
+
+	// sublayer counts are not hits
+	assert.Equal(0.5, srb.Export().ErrorRate())
+
+	// weights count as many hits and errors
+	srb.HandleSpan(Span{SpanID: 5, ParentID: 1, Service: "db", Name: "db.query", Resource: "SELECT", Duration: 10}, defaultEnv, "", nil, 4, nil)
+	assert.Equal(0.25, srb.Export().ErrorRate())
+
+	assert.Equal(0.0, NewStatsBucket(0, 1e9).ErrorRate())
+}
+
+func TestStatsBucketMean(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	for i, d := range []int64{10, 20, 30, 100} {
+		srb.HandleSpan(Span{SpanID: uint64(i), Service: "web", Name: "http.request", Resource: "GET /", Duration: d}, defaultEnv, "", nil, 1, nil)
+	}
+	srb.HandleSpan(Span{SpanID: 10, Service: "db", Name: "db.query", Resource: "SELECT", Duration: 7}, defaultEnv, "", nil, 1, nil)
+	// weighted spans count as many spans of their duration
+	srb.HandleSpan(Span{SpanID: 11, Service: "db", Name: "db.query", Resource: "SELECT", Duration: 1}, defaultEnv, "", nil, 2, nil)
+	sb := srb.Export()
+
+	aggr := "env:default,resource:GET /,service:web"
+	assert.Equal(40.0, sb.Mean(GrainKey("http.request", DURATION, aggr)))
+	// any measure of the aggregation can be used
+	assert.Equal(40.0, sb.Mean(GrainKey("http.request", HITS, aggr)))
+	assert.Equal(3.0, sb.Mean(GrainKey("db.query", DURATION, "env:default,resource:SELECT,service:db")))
+
+	assert.Equal(0.0, sb.Mean(GrainKey("db.query", DURATION, "env:default,resource:INSERT,service:db")))
+	assert.Equal(0.0, sb.Mean("invalid"))
+}
+
+func TestStatsBucketMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	srb1 := NewStatsRawBucket(0, 1e9)
+	srb1.HandleSpan(Span{SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Duration: 100}, defaultEnv, "", nil, 1, nil)
+	srb2 := NewStatsRawBucket(1e9, 1e9)
+	srb2.HandleSpan(Span{SpanID: 2, Service: "web", Name: "http.request", Resource: "GET /", Duration: 300, Error: 1}, defaultEnv, "", nil, 1, nil)
+	srb2.HandleSpan(Span{SpanID: 3, Service: "db", Name: "db.query", Resource: "SELECT", Duration: 10}, defaultEnv, "", nil, 1, nil)
+
+	sb := NewStatsBucket(0, 2e9)
+	sb.Merge(srb1.Export())
+	b2 := srb2.Export()
+	sb.Merge(b2)
+
+	key := "http.request|%s|env:default,resource:GET /,service:web"
+	assert.Equal(2.0, sb.Counts[fmt.Sprintf(key, HITS)].Value)
+	assert.Equal(1.0, sb.Counts[fmt.Sprintf(key, ERRORS)].Value)
+	assert.Equal(400.0, sb.Counts[fmt.Sprintf(key, DURATION)].Value)
+	assert.Equal(2, sb.Distributions[fmt.Sprintf(key, DURATION)].Summary.N)
+	assert.Equal(1.0, sb.Counts["db.query|hits|env:default,resource:SELECT,service:db"].Value)
+
+	// the merged distributions are not shared with the source buckets
+	assert.Equal(1, b2.Distributions[fmt.Sprintf(key, DURATION)].Summary.N)
+	sb.Merge(b2)
+	assert.Equal(1, b2.Distributions[fmt.Sprintf(key, DURATION)].Summary.N)
+	assert.Equal(1, b2.Distributions["db.query|duration|env:default,resource:SELECT,service:db"].Summary.N)
+}
+
 func TestStatsBucketSublayers(t *testing.T) {
 	assert := assert.New(t)
 
 	tr := testTrace()
-	sublayers := ComputeSublayers(&tr)
+	sublayers := ComputeSublayers(&tr, SublayerModeExclusive, 0)
 	root := tr.GetRoot()
 	SetSublayersOnSpan(root, sublayers)
 
@@ -222,7 +363,7 @@ func TestStatsBucketSublayers(t *testing.T) {
 	// No custom aggregators only the defaults
 	aggr := []string{}
 	for _, s := range tr {
-		srb.HandleSpan(s, defaultEnv, aggr, root.Weight(), &sublayers)
+		srb.HandleSpan(s, defaultEnv, "", aggr, root.Weight(), &sublayers)
 	}
 	sb := srb.Export()
 
@@ -331,7 +472,7 @@ func BenchmarkHandleSpan(b *testing.B) {
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		for _, s := range testSpans() {
-			srb.HandleSpan(s, defaultEnv, aggr, 1.0, nil)
+			srb.HandleSpan(s, defaultEnv, "", aggr, 1.0, nil)
 		}
 	}
 }
@@ -342,7 +483,7 @@ func BenchmarkHandleSpanSublayers(b *testing.B) {
 	aggr := []string{}
 
 	tr := testTrace()
-	sublayers := ComputeSublayers(&tr)
+	sublayers := ComputeSublayers(&tr, SublayerModeExclusive, 0)
 	root := tr.GetRoot()
 	SetSublayersOnSpan(root, sublayers)
 
@@ -350,7 +491,7 @@ func BenchmarkHandleSpanSublayers(b *testing.B) {
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		for _, s := range tr {
-			srb.HandleSpan(s, defaultEnv, aggr, root.Weight(), &sublayers)
+			srb.HandleSpan(s, defaultEnv, "", aggr, root.Weight(), &sublayers)
 		}
 	}
 }
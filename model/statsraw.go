@@ -3,6 +3,8 @@ package model
 import (
 	"bytes"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/DataDog/datadog-trace-agent/quantile"
 )
@@ -16,6 +18,8 @@ type groupedStats struct {
 	errors               float64
 	duration             float64
 	durationDistribution *quantile.SliceSummary
+	// durations of the errors, when split from the ones of the successes
+	errorDurationDistribution *quantile.SliceSummary
 }
 
 type sublayerStats struct {
@@ -60,10 +64,49 @@ type StatsRawBucket struct {
 	data         map[statsKey]groupedStats
 	sublayerData map[statsSubKey]sublayerStats
 
+	// durations inserted in the distributions are rounded to this granularity
+	// in nanoseconds, 0 to only truncate them to a fixed precision
+	durationGranularity int64
+	// whether the durations of the errors and of the successes are inserted
+	// in separate distributions
+	errorDistributions bool
+	// distributions with fewer samples are suppressed, or flagged as low
+	// confidence if flagLowSampleDistributions is set, 0 to disable
+	minDistributionSamples     int
+	flagLowSampleDistributions bool
+
+	// spans with this meta are synthetic, e.g. from synthetic monitoring, and
+	// excluded from the stats unless syntheticsApart is set, disabled if its
+	// name is empty
+	syntheticsMarker Tag
+	syntheticsApart  bool
+
+	// if set, the resource of the spans is derived from their meta with it
+	resourceTemplate *ResourceTemplate
+
+	// maximum number of distinct resources per service, 0 for no limit
+	maxResourcesPerService int
+	// distinct resources seen per service
+	resources map[string]map[string]struct{}
+	// number of spans whose resource was rolled up in TooManyResources, per service
+	rolledUpResources map[string]int64
+
+	// approximate memory used by the bucket in bytes, see ApproxSizeBytes
+	size int64
+
 	// internal buffer for aggregate strings - not threadsafe
 	keyBuf bytes.Buffer
 }
 
+// Rough sizes, in bytes, of the parts of a bucket, for ApproxSizeBytes. They
+// include the overhead of the maps and of the headers of the distributions.
+const (
+	groupedStatsSize  = 200
+	sublayerStatsSize = 100
+	tagSize           = 32 // a Tag, without the content of its strings
+	summaryEntrySize  = 24 // a quantile.Entry
+)
+
 // NewStatsRawBucket opens a new calculation bucket for time ts and initializes it properly
 func NewStatsRawBucket(ts, d int64) *StatsRawBucket {
 	// The only non-initialized value is the Duration which should be set by whoever closes that bucket
@@ -75,6 +118,112 @@ func NewStatsRawBucket(ts, d int64) *StatsRawBucket {
 	}
 }
 
+// SetDurationGranularity makes the bucket round the durations inserted in its
+// distributions to the given granularity in nanoseconds. This reduces the noise
+// of the distributions, and makes them comparable across agents.
+func (sb *StatsRawBucket) SetDurationGranularity(granularity int64) {
+	sb.durationGranularity = granularity
+}
+
+// SetErrorDistributions makes the bucket split the duration distributions of its
+// aggregations by the error flag of their spans, so that the latency of errors,
+// often failing fast or timing out, does not blur the one of successes. The
+// distributions then get an "error" tag, "true" or "false". The counts are not
+// affected.
+func (sb *StatsRawBucket) SetErrorDistributions(split bool) {
+	sb.errorDistributions = split
+}
+
+// SetMinDistributionSamples makes the bucket suppress the distributions with
+// fewer than min samples, whose quantiles would be misleading, or only flag them
+// with LowConfidence if flag is set. The counts are not affected. 0 disables it.
+func (sb *StatsRawBucket) SetMinDistributionSamples(min int, flag bool) {
+	sb.minDistributionSamples = min
+	sb.flagLowSampleDistributions = flag
+}
+
+// SetSyntheticsFilter makes the bucket exclude the synthetic spans, i.e. the ones
+// with the meta of the marker, e.g. "synthetics:true", so that the traffic of
+// synthetic monitoring does not skew the latency of the users. With apart, they
+// are counted in aggregations of their own instead, tagged with the marker, and
+// left out of the other ones. A marker with an empty name disables it.
+func (sb *StatsRawBucket) SetSyntheticsFilter(marker Tag, apart bool) {
+	sb.syntheticsMarker = marker
+	sb.syntheticsApart = apart
+}
+
+// SetResourceTemplate makes the bucket aggregate the spans by the resource the
+// template derives from their meta, or by their raw resource if the template
+// cannot be applied to them. A nil template disables it.
+func (sb *StatsRawBucket) SetResourceTemplate(t *ResourceTemplate) {
+	sb.resourceTemplate = t
+}
+
+// ApproxSizeBytes returns an approximation of the memory used by the bucket, in
+// bytes. It is tracked as spans are added, from the number of aggregations and
+// of entries of the distributions, so it is cheap enough to be called after
+// every span, but it is only meant to bound the memory used by the buckets.
+func (sb *StatsRawBucket) ApproxSizeBytes() int64 {
+	return sb.size
+}
+
+// tagsSize returns the approximate size of a tag set, in bytes
+func tagsSize(tags TagSet) int64 {
+	size := int64(len(tags) * tagSize)
+	for _, t := range tags {
+		size += int64(len(t.Name) + len(t.Value))
+	}
+	return size
+}
+
+// TooManyResources is the resource in which the spans of a service are rolled up
+// once it has too many distinct resources, see SetMaxResourcesPerService.
+const TooManyResources = "__toomany__"
+
+// SetMaxResourcesPerService limits the number of distinct resources of a service
+// in the bucket, typically exploding when IDs are not obfuscated from them. Once
+// the limit is reached, the spans with new resources are accounted to the
+// TooManyResources resource instead. 0 disables the limit.
+func (sb *StatsRawBucket) SetMaxResourcesPerService(max int) {
+	sb.maxResourcesPerService = max
+}
+
+// RolledUpResources returns, per service, the number of spans whose resource was
+// rolled up in TooManyResources because the service had too many resources.
+func (sb *StatsRawBucket) RolledUpResources() map[string]int64 {
+	return sb.rolledUpResources
+}
+
+// limitResource returns the resource the span is accounted to, enforcing the
+// maximum number of resources per service
+func (sb *StatsRawBucket) limitResource(s Span) string {
+	if sb.maxResourcesPerService <= 0 {
+		return s.Resource
+	}
+	if sb.resources == nil {
+		sb.resources = make(map[string]map[string]struct{})
+	}
+
+	resources, ok := sb.resources[s.Service]
+	if !ok {
+		resources = make(map[string]struct{})
+		sb.resources[s.Service] = resources
+	}
+	if _, ok := resources[s.Resource]; ok {
+		return s.Resource
+	}
+	if len(resources) < sb.maxResourcesPerService {
+		resources[s.Resource] = struct{}{}
+		return s.Resource
+	}
+
+	if sb.rolledUpResources == nil {
+		sb.rolledUpResources = make(map[string]int64)
+	}
+	sb.rolledUpResources[s.Service]++
+	return TooManyResources
+}
+
 // Export transforms a StatsRawBucket into a StatsBucket, typically used
 // before communicating data to the API, as StatsRawBucket is the internal
 // type while StatsBucket is the public, shared one.
@@ -105,12 +254,32 @@ func (sb *StatsRawBucket) Export() StatsBucket {
 			TagSet:  v.tags,
 			Value:   float64(v.duration),
 		}
-		ret.Distributions[durationKey] = Distribution{
-			Key:     durationKey,
-			Name:    k.name,
-			Measure: DURATION,
-			TagSet:  v.tags,
-			Summary: v.durationDistribution,
+		if !sb.errorDistributions {
+			sb.exportDistribution(ret, Distribution{
+				Key:     durationKey,
+				Name:    k.name,
+				Measure: DURATION,
+				TagSet:  v.tags,
+				Summary: v.durationDistribution,
+			})
+			continue
+		}
+		for _, d := range []struct {
+			isError string
+			summary *quantile.SliceSummary
+		}{{"false", v.durationDistribution}, {"true", v.errorDurationDistribution}} {
+			if d.summary == nil || d.summary.N == 0 {
+				continue
+			}
+			aggr, tags := sb.grainWithTag(v.tags, Tag{"error", d.isError})
+			key := GrainKey(k.name, DURATION, aggr)
+			sb.exportDistribution(ret, Distribution{
+				Key:     key,
+				Name:    k.name,
+				Measure: DURATION,
+				TagSet:  tags,
+				Summary: d.summary,
+			})
 		}
 	}
 	for k, v := range sb.sublayerData {
@@ -126,6 +295,18 @@ func (sb *StatsRawBucket) Export() StatsBucket {
 	return ret
 }
 
+// exportDistribution adds the distribution to the exported bucket, unless it
+// has too few samples
+func (sb *StatsRawBucket) exportDistribution(ret StatsBucket, d Distribution) {
+	if d.Summary.N < sb.minDistributionSamples {
+		if !sb.flagLowSampleDistributions {
+			return
+		}
+		d.LowConfidence = true
+	}
+	ret.Distributions[d.Key] = d
+}
+
 func assembleGrain(b *bytes.Buffer, env, resource, service string, m map[string]string) (string, TagSet) {
 	b.Reset()
 
@@ -162,24 +343,113 @@ func assembleGrain(b *bytes.Buffer, env, resource, service string, m map[string]
 	return b.String(), tagset
 }
 
-// HandleSpan adds the span to this bucket stats, aggregated with the finest grain matching given aggregators
-func (sb *StatsRawBucket) HandleSpan(s Span, env string, aggregators []string, weight float64, sublayers *[]SublayerValue) {
+// grainWithTag returns the grain and tags of an aggregation with the given tags
+// plus tag, assembled like the ones of the spans so that the tag is sorted with
+// the others
+func (sb *StatsRawBucket) grainWithTag(tags TagSet, tag Tag) (string, TagSet) {
+	var env, resource, service string
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		switch t.Name {
+		case "env":
+			env = t.Value
+		case "resource":
+			resource = t.Value
+		case "service":
+			service = t.Value
+		default:
+			m[t.Name] = t.Value
+		}
+	}
+	m[tag.Name] = tag.Value
+	return assembleGrain(&sb.keyBuf, env, resource, service, m)
+}
+
+// PeerServiceAggregator is the name of the derived aggregator describing the
+// downstream service a span is calling.
+const PeerServiceAggregator = "peer.service"
+
+// resolvePeerService returns the downstream service of a span, preferring the
+// "peer.service" meta and falling back on the "out.host" one. It returns
+// an empty string if none of them is set.
+func resolvePeerService(s Span) string {
+	if v := s.Meta["peer.service"]; v != "" {
+		return v
+	}
+	return s.Meta["out.host"]
+}
+
+// VersionAggregator is the name of the derived aggregator describing the
+// version of the application. Spans without a "version" meta get the one of
+// the root span of their trace.
+const VersionAggregator = "version"
+
+// HourOfDayAggregator is the name of the derived aggregator describing the hour
+// of the day, in UTC, at which a span ended, from 0 to 23, to compare latencies
+// across the day.
+const HourOfDayAggregator = "hour_of_day"
+
+// hourOfDay returns the hour of the day, in UTC, of a timestamp in nanoseconds
+func hourOfDay(ts int64) string {
+	return strconv.Itoa(time.Unix(0, ts).UTC().Hour())
+}
+
+// HandleSpan adds the span to this bucket stats, aggregated with the finest grain matching given aggregators.
+// version is the one of the root of the trace, it is only used by the VersionAggregator.
+func (sb *StatsRawBucket) HandleSpan(s Span, env, version string, aggregators []string, weight float64, sublayers *[]SublayerValue) {
+	sb.HandleSpanWeighted(s, env, version, aggregators, weight, 1, sublayers)
+}
+
+// HandleSpanWeighted is HandleSpan, with the duration of the span inserted in its
+// distribution as if it was inserted distWeight times instead of once, e.g. the
+// number of spans of its resource in the trace, so that the resources called
+// many times per trace weigh accordingly in the distributions. distWeight must
+// be positive, and does not change the counts.
+func (sb *StatsRawBucket) HandleSpanWeighted(s Span, env, version string, aggregators []string, weight float64, distWeight int, sublayers *[]SublayerValue) {
 	if env == "" {
 		panic("env should never be empty")
 	}
 
+	synthetic := sb.syntheticsMarker.Name != "" && s.Meta[sb.syntheticsMarker.Name] == sb.syntheticsMarker.Value
+	if synthetic && !sb.syntheticsApart {
+		return
+	}
+	if sb.resourceTemplate != nil {
+		if resource, ok := sb.resourceTemplate.Resource(s); ok {
+			s.Resource = resource
+		}
+	}
+
 	m := make(map[string]string)
 
 	for _, agg := range aggregators {
-		if agg != "env" && agg != "resource" && agg != "service" {
+		switch agg {
+		case "env", "resource", "service":
+			// always part of the grain
+		case PeerServiceAggregator:
+			if v := resolvePeerService(s); v != "" {
+				m[agg] = v
+			}
+		case VersionAggregator:
+			if v, ok := s.Meta[agg]; ok {
+				m[agg] = v
+			} else if version != "" {
+				m[agg] = version
+			}
+		case HourOfDayAggregator:
+			m[agg] = hourOfDay(s.End())
+		default:
 			if v, ok := s.Meta[agg]; ok {
 				m[agg] = v
 			}
 		}
 	}
+	if synthetic {
+		m[sb.syntheticsMarker.Name] = sb.syntheticsMarker.Value
+	}
 
-	grain, tags := assembleGrain(&sb.keyBuf, env, s.Resource, s.Service, m)
-	sb.add(s, weight, grain, tags)
+	grain, tags := assembleGrain(&sb.keyBuf, env, sb.limitResource(s), s.Service, m)
+	sb.add(s, weight, distWeight, grain, tags)
 
 	// sublayers - special case
 	if sublayers != nil {
@@ -189,13 +459,14 @@ func (sb *StatsRawBucket) HandleSpan(s Span, env string, aggregators []string, w
 	}
 }
 
-func (sb *StatsRawBucket) add(s Span, weight float64, aggr string, tags TagSet) {
+func (sb *StatsRawBucket) add(s Span, weight float64, distWeight int, aggr string, tags TagSet) {
 	var gs groupedStats
 	var ok bool
 
 	key := statsKey{name: s.Name, aggr: aggr}
 	if gs, ok = sb.data[key]; !ok {
 		gs = newGroupedStats(tags)
+		sb.size += groupedStatsSize + int64(len(key.name)+len(key.aggr)) + tagsSize(tags)
 	}
 
 	gs.hits += weight
@@ -206,8 +477,22 @@ func (sb *StatsRawBucket) add(s Span, weight float64, aggr string, tags TagSet)
 
 	// TODO add for s.Metrics ability to define arbitrary counts and distros, check some config?
 	// alter resolution of duration distro
-	trundur := nsTimestampToFloat(s.Duration)
-	gs.durationDistribution.Insert(trundur, s.SpanID)
+	var trundur float64
+	if sb.durationGranularity > 0 {
+		trundur = roundDuration(s.Duration, sb.durationGranularity)
+	} else {
+		trundur = nsTimestampToFloat(s.Duration)
+	}
+	distribution := gs.durationDistribution
+	if sb.errorDistributions && s.Error != 0 {
+		if gs.errorDurationDistribution == nil {
+			gs.errorDurationDistribution = quantile.NewSliceSummary()
+		}
+		distribution = gs.errorDurationDistribution
+	}
+	entries := len(distribution.Entries)
+	distribution.InsertN(trundur, s.SpanID, distWeight)
+	sb.size += int64(len(distribution.Entries)-entries) * summaryEntrySize
 
 	sb.data[key] = gs
 }
@@ -229,6 +514,7 @@ func (sb *StatsRawBucket) addSublayer(s Span, aggr string, tags TagSet, sub Subl
 	key := statsSubKey{name: s.Name, measure: sub.Metric, aggr: subAggr}
 	if ss, ok = sb.sublayerData[key]; !ok {
 		ss = newSublayerStats(subTags)
+		sb.size += sublayerStatsSize + int64(len(key.name)+len(key.measure)+len(key.aggr)) + tagsSize(subTags)
 	}
 
 	ss.value += int64(sub.Value)
@@ -236,6 +522,11 @@ func (sb *StatsRawBucket) addSublayer(s Span, aggr string, tags TagSet, sub Subl
 	sb.sublayerData[key] = ss
 }
 
+// roundDuration rounds a nanosecond duration to the nearest multiple of granularity
+func roundDuration(ns, granularity int64) float64 {
+	return float64((ns + granularity/2) / granularity * granularity)
+}
+
 // 10 bits precision (any value will be +/- 1/1024)
 const roundMask int64 = 1 << 10
 
@@ -1,7 +1,9 @@
 package model
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -27,3 +29,349 @@ func TestGrainWithExtraTags(t *testing.T) {
 	assert.Equal("env:default,resource:yo,service:thing,meta1:ONE,meta2:two", aggr)
 	assert.Equal(TagSet{Tag{"env", "default"}, Tag{"resource", "yo"}, Tag{"service", "thing"}, Tag{"meta1", "ONE"}, Tag{"meta2", "two"}}, tgs)
 }
+
+func TestStatsRawBucketDurationGranularity(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.SetDurationGranularity(1e6)
+
+	root := Span{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 12345678}
+	child := Span{SpanID: 2, ParentID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 1499999}
+	sublayers := []SublayerValue{
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "thing"}, Value: 12345678},
+	}
+	srb.HandleSpan(root, "default", "", nil, 1, &sublayers)
+	srb.HandleSpan(child, "default", "", nil, 1, nil)
+
+	sb := srb.Export()
+
+	// durations are rounded to the millisecond before being inserted in the distribution
+	key := "other|duration|env:default,resource:yo,service:thing"
+	d, ok := sb.Distributions[key]
+	if assert.True(ok) {
+		assert.Equal(2, d.Summary.N)
+		assert.Equal(1e6, d.Summary.Quantile(0))
+		assert.Equal(12e6, d.Summary.Quantile(1))
+	}
+
+	// the total duration and the sublayers use the raw durations
+	assert.Equal(float64(12345678+1499999), sb.Counts[key].Value)
+	subKey := "other|_sublayers.duration.by_service|env:default,resource:yo,service:thing,sublayer_service:thing"
+	assert.Equal(float64(12345678), sb.Counts[subKey].Value)
+}
+
+func TestStatsRawBucketVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+
+	// the child span has no version of its own, the trace one is used
+	for _, version := range []string{"1.0", "1.1", "1.1", ""} {
+		root := Span{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 100}
+		if version != "" {
+			root.Meta = map[string]string{"version": version}
+		}
+		child := Span{SpanID: 2, ParentID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 50, Error: 1}
+		srb.HandleSpan(root, "default", version, []string{VersionAggregator}, 1, nil)
+		srb.HandleSpan(child, "default", version, []string{VersionAggregator}, 1, nil)
+	}
+
+	sb := srb.Export()
+
+	assert.Equal(2.0, sb.Counts["other|hits|env:default,resource:yo,service:thing,version:1.0"].Value)
+	assert.Equal(1.0, sb.Counts["other|errors|env:default,resource:yo,service:thing,version:1.0"].Value)
+	assert.Equal(4.0, sb.Counts["other|hits|env:default,resource:yo,service:thing,version:1.1"].Value)
+	assert.Equal(2.0, sb.Counts["other|errors|env:default,resource:yo,service:thing,version:1.1"].Value)
+	// traces without a version are aggregated without it
+	assert.Equal(2.0, sb.Counts["other|hits|env:default,resource:yo,service:thing"].Value)
+
+	// spans with their own version keep it
+	srb = NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(Span{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Meta: map[string]string{"version": "2.0"}}, "default", "1.0", []string{VersionAggregator}, 1, nil)
+	_, ok := srb.Export().Counts["other|hits|env:default,resource:yo,service:thing,version:2.0"]
+	assert.True(ok)
+
+	// the version is ignored unless its aggregator is enabled
+	srb = NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(Span{SpanID: 1, Service: "thing", Name: "other", Resource: "yo"}, "default", "1.0", nil, 1, nil)
+	_, ok = srb.Export().Counts["other|hits|env:default,resource:yo,service:thing"]
+	assert.True(ok)
+}
+
+func TestStatsRawBucketWeightedDistributions(t *testing.T) {
+	assert := assert.New(t)
+
+	fast := Span{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 1e6}
+	slow := Span{SpanID: 2, Service: "thing", Name: "other", Resource: "yo", Duration: 100e6}
+	key := "other|duration|env:default,resource:yo,service:thing"
+
+	distribution := func(fastWeight int) Distribution {
+		srb := NewStatsRawBucket(0, 1e9)
+		srb.HandleSpanWeighted(fast, "default", "", nil, 1, fastWeight, nil)
+		srb.HandleSpan(slow, "default", "", nil, 1, nil)
+		return srb.Export().Distributions[key]
+	}
+
+	unweighted := distribution(1)
+	// the fast span is one of the 4 spans of its resource in its trace
+	weighted := distribution(4)
+
+	// by default every span is inserted once, so the p75 is the slow one
+	assert.Equal(2, unweighted.Summary.N)
+	assert.InEpsilon(100e6, unweighted.Summary.Quantile(0.75), 0.01)
+
+	// weighted, the fast span counts for 4 of the 5 spans represented
+	assert.Equal(5, weighted.Summary.N)
+	assert.InEpsilon(1e6, weighted.Summary.Quantile(0.75), 0.01)
+	assert.InEpsilon(100e6, weighted.Summary.Quantile(1), 0.01)
+
+	// the counts are not weighted
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.HandleSpanWeighted(fast, "default", "", nil, 1, 4, nil)
+	assert.Equal(float64(1), srb.Export().Counts["other|hits|env:default,resource:yo,service:thing"].Value)
+}
+
+func TestStatsRawBucketErrorDistributions(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.SetErrorDistributions(true)
+	// errors time out, successes are fast
+	for i := 0; i < 10; i++ {
+		srb.HandleSpan(Span{SpanID: uint64(i), Service: "thing", Name: "other", Resource: "yo", Duration: 1e6}, "default", "", nil, 1, nil)
+	}
+	for i := 10; i < 13; i++ {
+		srb.HandleSpan(Span{SpanID: uint64(i), Service: "thing", Name: "other", Resource: "yo", Duration: 5e9, Error: 1}, "default", "", nil, 1, nil)
+	}
+	sb := srb.Export()
+
+	assert.Len(sb.Distributions, 2)
+	success := sb.Distributions["other|duration|env:default,resource:yo,service:thing,error:false"]
+	assert.Equal(10, success.Summary.N)
+	assert.InEpsilon(1e6, success.Summary.Quantile(0.99), 0.01)
+	assert.Equal(Tag{"error", "false"}, success.TagSet[len(success.TagSet)-1])
+
+	errors := sb.Distributions["other|duration|env:default,resource:yo,service:thing,error:true"]
+	assert.Equal(3, errors.Summary.N)
+	assert.InEpsilon(5e9, errors.Summary.Quantile(0.5), 0.01)
+	assert.Equal(Tag{"error", "true"}, errors.TagSet[len(errors.TagSet)-1])
+
+	// the counts are left as they are
+	assert.Equal(float64(13), sb.Counts["other|hits|env:default,resource:yo,service:thing"].Value)
+	assert.Equal(float64(3), sb.Counts["other|errors|env:default,resource:yo,service:thing"].Value)
+
+	// the error tag is sorted with the other tags of the grain
+	srb = NewStatsRawBucket(0, 1e9)
+	srb.SetErrorDistributions(true)
+	srb.HandleSpan(Span{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 1e6, Error: 1, Meta: map[string]string{"version": "1.2"}}, "default", "", []string{"version"}, 1, nil)
+	d, ok := srb.Export().Distributions["other|duration|env:default,resource:yo,service:thing,error:true,version:1.2"]
+	if assert.True(ok) {
+		assert.Equal(TagSet{{"env", "default"}, {"resource", "yo"}, {"service", "thing"}, {"error", "true"}, {"version", "1.2"}}, d.TagSet)
+	}
+
+	// an aggregation without errors has no error distribution
+	srb = NewStatsRawBucket(0, 1e9)
+	srb.SetErrorDistributions(true)
+	srb.HandleSpan(Span{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 1e6}, "default", "", nil, 1, nil)
+	assert.Len(srb.Export().Distributions, 1)
+
+	// by default errors and successes share the same distribution
+	srb = NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(Span{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 1e6}, "default", "", nil, 1, nil)
+	srb.HandleSpan(Span{SpanID: 2, Service: "thing", Name: "other", Resource: "yo", Duration: 5e9, Error: 1}, "default", "", nil, 1, nil)
+	sb = srb.Export()
+	assert.Len(sb.Distributions, 1)
+	assert.Equal(2, sb.Distributions["other|duration|env:default,resource:yo,service:thing"].Summary.N)
+}
+
+func TestStatsRawBucketMaxResourcesPerService(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.SetMaxResourcesPerService(2)
+
+	for i, resource := range []string{"GET /users/1", "GET /users/2", "GET /users/3", "GET /users/1", "GET /users/4"} {
+		srb.HandleSpan(Span{SpanID: uint64(i), Service: "users", Name: "http.request", Resource: resource, Duration: 1}, "default", "", nil, 1, nil)
+	}
+	// other services have their own limit
+	srb.HandleSpan(Span{SpanID: 10, Service: "db", Name: "db.query", Resource: "SELECT", Duration: 1}, "default", "", nil, 1, nil)
+
+	counts := srb.Export().Counts
+	hits := func(name, resource, service string) float64 {
+		return counts[name+"|hits|env:default,resource:"+resource+",service:"+service].Value
+	}
+	assert.Equal(float64(2), hits("http.request", "GET /users/1", "users"))
+	assert.Equal(float64(1), hits("http.request", "GET /users/2", "users"))
+	assert.Equal(float64(2), hits("http.request", TooManyResources, "users"))
+	assert.Equal(float64(1), hits("db.query", "SELECT", "db"))
+	assert.Len(counts, 4*3)
+
+	assert.Equal(map[string]int64{"users": 2}, srb.RolledUpResources())
+
+	// no limit by default
+	srb = NewStatsRawBucket(0, 1e9)
+	for i := 0; i < 100; i++ {
+		srb.HandleSpan(Span{SpanID: uint64(i), Service: "users", Name: "http.request", Resource: fmt.Sprintf("GET /users/%d", i), Duration: 1}, "default", "", nil, 1, nil)
+	}
+	assert.Len(srb.Export().Counts, 100*3)
+	assert.Len(srb.RolledUpResources(), 0)
+}
+
+func TestStatsRawBucketMinDistributionSamples(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(srb *StatsRawBucket) {
+		// few spans for the slow resource, many for the fast one
+		for i := 0; i < 3; i++ {
+			srb.HandleSpan(Span{SpanID: uint64(i), Service: "thing", Name: "other", Resource: "slow", Duration: 5e9}, "default", "", nil, 1, nil)
+		}
+		for i := 3; i < 13; i++ {
+			srb.HandleSpan(Span{SpanID: uint64(i), Service: "thing", Name: "other", Resource: "fast", Duration: 1e6, Error: int32(i % 2)}, "default", "", nil, 1, nil)
+		}
+	}
+	slow := "other|duration|env:default,resource:slow,service:thing"
+	fast := "other|duration|env:default,resource:fast,service:thing"
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.SetMinDistributionSamples(5, false)
+	handle(srb)
+	sb := srb.Export()
+	assert.Len(sb.Distributions, 1)
+	assert.Equal(10, sb.Distributions[fast].Summary.N)
+	assert.False(sb.Distributions[fast].LowConfidence)
+	// the counts are still there
+	assert.Equal(float64(3), sb.Counts["other|hits|env:default,resource:slow,service:thing"].Value)
+	assert.Equal(float64(15e9), sb.Counts[slow].Value)
+
+	// flagged instead of suppressed
+	srb = NewStatsRawBucket(0, 1e9)
+	srb.SetMinDistributionSamples(5, true)
+	handle(srb)
+	sb = srb.Export()
+	assert.Len(sb.Distributions, 2)
+	assert.True(sb.Distributions[slow].LowConfidence)
+	assert.Equal(3, sb.Distributions[slow].Summary.N)
+	assert.False(sb.Distributions[fast].LowConfidence)
+
+	// errors and successes have their own number of samples
+	srb = NewStatsRawBucket(0, 1e9)
+	srb.SetErrorDistributions(true)
+	srb.SetMinDistributionSamples(5, false)
+	handle(srb)
+	sb = srb.Export()
+	assert.Len(sb.Distributions, 2)
+	assert.Equal(5, sb.Distributions[fast+",error:false"].Summary.N)
+	assert.Equal(5, sb.Distributions[fast+",error:true"].Summary.N)
+
+	// disabled by default
+	srb = NewStatsRawBucket(0, 1e9)
+	handle(srb)
+	assert.Len(srb.Export().Distributions, 2)
+}
+
+func TestStatsRawBucketApproxSizeBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	assert.Equal(int64(0), srb.ApproxSizeBytes())
+
+	srb.HandleSpan(Span{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 1}, "default", "", nil, 1, nil)
+	one := srb.ApproxSizeBytes()
+	assert.True(one > 0)
+
+	// a new value in the same aggregation only grows its distribution
+	srb.HandleSpan(Span{SpanID: 2, Service: "thing", Name: "other", Resource: "yo", Duration: 2}, "default", "", nil, 1, nil)
+	assert.Equal(one+summaryEntrySize, srb.ApproxSizeBytes())
+
+	// a new aggregation, with sublayers
+	sublayers := []SublayerValue{{Metric: "_sublayers.span_count", Value: 2}}
+	srb.HandleSpan(Span{SpanID: 3, Service: "thing", Name: "other", Resource: "yo2", Duration: 1}, "default", "", nil, 1, &sublayers)
+	assert.True(srb.ApproxSizeBytes() > 2*one+summaryEntrySize)
+}
+
+func TestStatsRawBucketHourOfDay(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+
+	// 2018-01-01 01:30 UTC, the span ends after 2 a.m.
+	start := time.Date(2018, 1, 1, 1, 30, 0, 0, time.UTC).UnixNano()
+	for _, s := range []Span{
+		{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Start: start, Duration: int64(time.Minute)},
+		{SpanID: 2, Service: "thing", Name: "other", Resource: "yo", Start: start, Duration: int64(time.Hour)},
+		{SpanID: 3, Service: "thing", Name: "other", Resource: "yo", Start: start + int64(22*time.Hour), Duration: 1},
+	} {
+		srb.HandleSpan(s, "default", "", []string{HourOfDayAggregator}, 1, nil)
+	}
+
+	sb := srb.Export()
+
+	assert.Equal(1.0, sb.Counts["other|hits|env:default,resource:yo,service:thing,hour_of_day:1"].Value)
+	assert.Equal(1.0, sb.Counts["other|hits|env:default,resource:yo,service:thing,hour_of_day:2"].Value)
+	assert.Equal(1.0, sb.Counts["other|hits|env:default,resource:yo,service:thing,hour_of_day:23"].Value)
+	assert.Len(sb.Counts, 9)
+}
+
+func TestStatsRawBucketSynthetics(t *testing.T) {
+	assert := assert.New(t)
+
+	spans := []Span{
+		{SpanID: 1, Service: "thing", Name: "other", Resource: "yo", Duration: 100},
+		{SpanID: 2, Service: "thing", Name: "other", Resource: "yo", Duration: 5, Meta: map[string]string{"synthetics": "true"}},
+		{SpanID: 3, Service: "thing", Name: "other", Resource: "yo", Duration: 50, Meta: map[string]string{"synthetics": "false"}},
+	}
+	marker := Tag{"synthetics", "true"}
+
+	// synthetic spans are excluded
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.SetSyntheticsFilter(marker, false)
+	for _, s := range spans {
+		srb.HandleSpan(s, "default", "", nil, 1, nil)
+	}
+	sb := srb.Export()
+	assert.Equal(2.0, sb.Counts["other|hits|env:default,resource:yo,service:thing"].Value)
+	assert.Equal(150.0, sb.Counts["other|duration|env:default,resource:yo,service:thing"].Value)
+	assert.Len(sb.Counts, 3)
+
+	// or counted apart
+	srb = NewStatsRawBucket(0, 1e9)
+	srb.SetSyntheticsFilter(marker, true)
+	for _, s := range spans {
+		srb.HandleSpan(s, "default", "", nil, 1, nil)
+	}
+	sb = srb.Export()
+	assert.Equal(2.0, sb.Counts["other|hits|env:default,resource:yo,service:thing"].Value)
+	assert.Equal(1.0, sb.Counts["other|hits|env:default,resource:yo,service:thing,synthetics:true"].Value)
+	assert.Equal(5.0, sb.Counts["other|duration|env:default,resource:yo,service:thing,synthetics:true"].Value)
+
+	// all the spans are counted by default
+	srb = NewStatsRawBucket(0, 1e9)
+	for _, s := range spans {
+		srb.HandleSpan(s, "default", "", nil, 1, nil)
+	}
+	assert.Equal(3.0, srb.Export().Counts["other|hits|env:default,resource:yo,service:thing"].Value)
+}
+
+func TestStatsRawBucketResourceTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpl, err := ParseResourceTemplate("{http.method} {http.route}")
+	assert.NoError(err)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.SetResourceTemplate(tmpl)
+	for _, s := range []Span{
+		{SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /users/42", Meta: map[string]string{"http.method": "GET", "http.route": "/users/{id}"}},
+		{SpanID: 2, Service: "web", Name: "http.request", Resource: "GET /users/43", Meta: map[string]string{"http.method": "GET", "http.route": "/users/{id}"}},
+		// no route, the raw resource is kept
+		{SpanID: 3, Service: "web", Name: "http.request", Resource: "GET /health", Meta: map[string]string{"http.method": "GET"}},
+	} {
+		srb.HandleSpan(s, "default", "", nil, 1, nil)
+	}
+
+	sb := srb.Export()
+	assert.Equal(2.0, sb.Counts["http.request|hits|env:default,resource:GET /users/{id},service:web"].Value)
+	assert.Equal(1.0, sb.Counts["http.request|hits|env:default,resource:GET /health,service:web"].Value)
+	assert.Len(sb.Counts, 6)
+}
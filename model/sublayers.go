@@ -1,6 +1,9 @@
 package model
 
-import "bytes"
+import (
+	"fmt"
+	"strings"
+)
 
 // SublayerValue is just a span-metric placeholder for a given
 // sublayer val
@@ -10,8 +13,57 @@ type SublayerValue struct {
 	Value  float64
 }
 
-// ComputeSublayers extracts sublayer values by type & service for a trace
-func ComputeSublayers(t *Trace) []SublayerValue {
+// SublayerMode tells how the durations of the sublayers are computed
+type SublayerMode int
+
+const (
+	// SublayerModeExclusive accounts for each sublayer the time exclusively
+	// spent in it, removing the time overlapped by its children. This is the default.
+	SublayerModeExclusive SublayerMode = iota
+	// SublayerModeAdditive accounts for each sublayer the raw sum of the
+	// durations of its spans, ignoring any overlap.
+	SublayerModeAdditive
+)
+
+// SublayerOther is the sublayer in which the durations below the minimum
+// duration given to ComputeSublayers are rolled up. Normalized services never
+// start with an underscore, so it cannot be mistaken for one of them.
+const SublayerOther = "__other__"
+
+// ParseSublayerMode returns the SublayerMode matching the given name,
+// either "exclusive" or "additive".
+func ParseSublayerMode(name string) (SublayerMode, error) {
+	switch strings.ToLower(name) {
+	case "exclusive":
+		return SublayerModeExclusive, nil
+	case "additive":
+		return SublayerModeAdditive, nil
+	default:
+		return SublayerModeExclusive, fmt.Errorf("unknown sublayer mode %q", name)
+	}
+}
+
+// sublayerMetrics returns the metric names used for durations by type and
+// by service in the given mode
+func (m SublayerMode) sublayerMetrics() (byType, byService string) {
+	if m == SublayerModeAdditive {
+		return "_sublayers.raw_duration.by_type", "_sublayers.raw_duration.by_service"
+	}
+	return "_sublayers.duration.by_type", "_sublayers.duration.by_service"
+}
+
+// ComputeSublayers extracts sublayer values by type & service for a trace,
+// computing their durations according to the given mode. Sublayers lasting less
+// than minDuration nanoseconds are rolled up in the SublayerOther sublayer.
+// Spans are clamped to the time window of the root, so that asynchronous spans
+// finishing after it only account for the part overlapping the root.
+// The "_sublayers.span_count" metric counts the spans of the trace, the spans it
+// only links to, see Span.Links, are counted apart in the
+// "_sublayers.linked_span_count" metric, which is omitted without links.
+// The trace is sorted in place, which is free if it already is, see Trace.Sort.
+func ComputeSublayers(t *Trace, mode SublayerMode, minDuration int64) []SublayerValue {
+	t.Sort()
+
 	iter := NewTraceLevelIterator(*t)
 	root, err := iter.NextSpan()
 	if err != nil {
@@ -19,42 +71,329 @@ func ComputeSublayers(t *Trace) []SublayerValue {
 		return []SublayerValue{}
 	}
 
-	ss := newSublayerSpans()
-	ss.Add(root)
+	var s []SublayerValue
+	if mode == SublayerModeAdditive {
+		s = computeAdditiveSublayers(*t, root, minDuration)
+	} else {
+		ss := newSublayerSpans(root)
+		ss.Add(root)
 
-	for iter.NextLevel() == nil {
-		for cur, err := iter.NextSpan(); err == nil; cur, err = iter.NextSpan() {
-			ss.Add(cur)
+		for iter.NextLevel() == nil {
+			for cur, err := iter.NextSpan(); err == nil; cur, err = iter.NextSpan() {
+				ss.Add(cur)
+			}
 		}
-	}
 
-	s := ss.OutputSublayers()
+		s = ss.OutputSublayers(minDuration)
+	}
 	s = append(s, SublayerValue{
 		Metric: "_sublayers.span_count",
 		Value:  float64(len(*t)),
 	})
+	if n := countLinkedSpans(*t); n > 0 {
+		s = append(s, SublayerValue{
+			Metric: "_sublayers.linked_span_count",
+			Value:  float64(n),
+		})
+	}
 
 	return s
 }
 
-// SetSublayersOnSpan takes some sublayers and pins them on the given span.Metrics
-func SetSublayersOnSpan(span *Span, sv []SublayerValue) {
-	var b bytes.Buffer
+// countLinkedSpans returns the number of distinct spans linked to by the spans of
+// the trace and which are not part of it. Links which cannot be decoded are
+// ignored, they must not prevent the sublayers of the trace from being computed.
+func countLinkedSpans(t Trace) int {
+	var linked map[[2]uint64]struct{}
+	for i := range t {
+		links, err := t[i].Links()
+		if err != nil {
+			continue
+		}
+		for _, l := range links {
+			if linked == nil {
+				linked = make(map[[2]uint64]struct{})
+			}
+			linked[[2]uint64{l.TraceID, l.SpanID}] = struct{}{}
+		}
+	}
+	for _, s := range t {
+		delete(linked, [2]uint64{s.TraceID, s.SpanID})
+	}
+	return len(linked)
+}
+
+// ComputeCallerSublayers extracts the durations of the sublayers by service like
+// ComputeSublayers, splitting them by calling service: the spans of a service
+// are accounted to the service of their closest ancestor in another service, so
+// that the time a service spends in itself can be told from the time spent in
+// each of its downstream services. They are reported in the
+// "_sublayers.duration.by_caller" metric, or "_sublayers.raw_duration.by_caller"
+// in the additive mode, with a "sublayer_call" tag such as "checkout>db", or
+// just "checkout" for the service of the root.
+// The trace is sorted in place, which is free if it already is, see Trace.Sort.
+func ComputeCallerSublayers(t *Trace, mode SublayerMode, minDuration int64) []SublayerValue {
+	t.Sort()
+
+	iter := NewTraceLevelIterator(*t)
+	root, err := iter.NextSpan()
+	if err != nil {
+		// no root, skip sublayers
+		return []SublayerValue{}
+	}
+
+	calls := callLabels(*t)
+	mCall := computeLabeledSublayers(iter, root, *t, mode, func(s *Span) string {
+		return calls[s.SpanID]
+	})
+	rollUpSublayers(mCall, minDuration)
+
+	metric := "_sublayers.duration.by_caller"
+	if mode == SublayerModeAdditive {
+		metric = "_sublayers.raw_duration.by_caller"
+	}
+	return labeledSublayers(metric, "sublayer_call", mCall)
+}
+
+// ComputeErrorSublayers extracts the durations of the sublayers by service like
+// ComputeSublayers, splitting them by the error flag of the spans, to tell the
+// time spent in failed spans from the time spent in successful ones. They are
+// reported in the "_sublayers.duration.by_service_error" metric, or
+// "_sublayers.raw_duration.by_service_error" in the additive mode, with a
+// "sublayer_service_error" tag such as "db/error" or "db/ok".
+// The trace is sorted in place, which is free if it already is, see Trace.Sort.
+func ComputeErrorSublayers(t *Trace, mode SublayerMode, minDuration int64) []SublayerValue {
+	t.Sort()
+
+	iter := NewTraceLevelIterator(*t)
+	root, err := iter.NextSpan()
+	if err != nil {
+		// no root, skip sublayers
+		return []SublayerValue{}
+	}
+
+	mError := computeLabeledSublayers(iter, root, *t, mode, func(s *Span) string {
+		if s.Service == "" {
+			return ""
+		}
+		if s.Error != 0 {
+			return s.Service + "/error"
+		}
+		return s.Service + "/ok"
+	})
+	rollUpSublayers(mError, minDuration)
+
+	metric := "_sublayers.duration.by_service_error"
+	if mode == SublayerModeAdditive {
+		metric = "_sublayers.raw_duration.by_service_error"
+	}
+	return labeledSublayers(metric, "sublayer_service_error", mError)
+}
+
+// computeLabeledSublayers returns the durations of the sublayers of the trace
+// grouped by the label of their spans, the iterator being positioned after its
+// root. Spans with an empty label are not accounted for.
+func computeLabeledSublayers(iter *TraceLevelIterator, root *Span, t Trace, mode SublayerMode, label func(*Span) string) map[string]float64 {
+	m := make(map[string]float64)
+
+	if mode == SublayerModeAdditive {
+		for i := range t {
+			s := &t[i]
+			_, duration, ok := clampToRoot(s, root)
+			if !ok || s.Service == "" {
+				continue
+			}
+			m[label(s)] += float64(duration)
+		}
+		return m
+	}
+
+	var byLabel []timeSpan
+	add := func(s *Span) {
+		if start, duration, ok := clampToRoot(s, root); ok {
+			byLabel = insertTS(byLabel, timeSpan{label(s), start, duration})
+		}
+	}
+
+	add(root)
+	for iter.NextLevel() == nil {
+		for cur, err := iter.NextSpan(); err == nil; cur, err = iter.NextSpan() {
+			add(cur)
+		}
+	}
+
+	for _, ts := range byLabel {
+		m[ts.Name] += float64(ts.Duration)
+	}
+	return m
+}
+
+// labeledSublayers returns the sublayer values of the given durations by label
+func labeledSublayers(metric, tagName string, m map[string]float64) []SublayerValue {
+	sublayers := make([]SublayerValue, 0, len(m))
+	for k, v := range m {
+		sublayers = append(sublayers, SublayerValue{
+			Metric: metric,
+			Tag:    Tag{tagName, k},
+			Value:  v,
+		})
+	}
+	return sublayers
+}
+
+// callLabels returns, by span ID, the label of the call the span is part of:
+// "caller>service" where caller is the service of its closest ancestor in
+// another service, or just its service if there is none. Spans without a
+// service get an empty label.
+func callLabels(t Trace) map[uint64]string {
+	spans := make(map[uint64]*Span, len(t))
+	for i := range t {
+		spans[t[i].SpanID] = &t[i]
+	}
 
+	labels := make(map[uint64]string, len(t))
+	for i := range t {
+		s := &t[i]
+		if s.Service == "" {
+			continue
+		}
+		label := s.Service
+		// the bound protects us against cycles
+		parent := spans[s.ParentID]
+		for n := 0; parent != nil && n < len(t); n++ {
+			if parent.Service != "" && parent.Service != s.Service {
+				label = parent.Service + ">" + s.Service
+				break
+			}
+			parent = spans[parent.ParentID]
+		}
+		labels[s.SpanID] = label
+	}
+	return labels
+}
+
+// sublayerTagEscaper escapes the tag value separator of the sublayer metric keys
+// found in tag values, so that keys can be parsed back unambiguously. Dots are
+// left as is: the tag value is everything after the separator, and the existing
+// consumers of the keys expect them unescaped, e.g. in "sublayer_service:api.v2".
+var sublayerTagEscaper = strings.NewReplacer(`\`, `\\`, ":", `\:`)
+
+// sublayerTagUnescaper reverts sublayerTagEscaper
+var sublayerTagUnescaper = strings.NewReplacer(`\\`, `\`, `\:`, ":")
+
+// SublayerMetricKey returns the span metric key of a sublayer value, such as
+// `_sublayers.duration.by_service.sublayer_service:mcnulty`. The `\` and `:`
+// characters of the tag value are escaped with a backslash.
+func SublayerMetricKey(s SublayerValue) string {
+	if s.Tag.Name == "" {
+		return s.Metric
+	}
+	return s.Metric + "." + s.Tag.Name + ":" + sublayerTagEscaper.Replace(s.Tag.Value)
+}
+
+// ParseSublayerMetricKey splits a key built by SublayerMetricKey back into
+// its metric name and unescaped tag.
+func ParseSublayerMetricKey(key string) (metric string, tag Tag) {
+	// neither metric names nor tag names contain ':', the first one is the
+	// tag value separator, escaped ones can only come after it
+	sep := strings.IndexByte(key, ':')
+	if sep < 0 {
+		return key, Tag{}
+	}
+	dot := strings.LastIndexByte(key[:sep], '.')
+	if dot < 0 {
+		return key, Tag{}
+	}
+	return key[:dot], Tag{key[dot+1 : sep], sublayerTagUnescaper.Replace(key[sep+1:])}
+}
+
+// SublayersToMap returns the given sublayer values indexed by their metric key,
+// the same ones SetSublayersOnSpan uses, see SublayerMetricKey.
+func SublayersToMap(values []SublayerValue) map[string]float64 {
+	m := make(map[string]float64, len(values))
+	for _, s := range values {
+		m[SublayerMetricKey(s)] = s.Value
+	}
+	return m
+}
+
+// SetSublayersOnSpan takes some sublayers and pins them on the given span.Metrics,
+// it does nothing on a nil span
+func SetSublayersOnSpan(span *Span, sv []SublayerValue) {
+	if span == nil {
+		return
+	}
 	if span.Metrics == nil {
 		span.Metrics = make(map[string]float64, len(sv))
 	}
 
 	for _, s := range sv {
-		b.WriteString(s.Metric)
-		if s.Tag.Name != "" {
-			b.WriteRune('.')
-			b.WriteString(s.Tag.Name)
-			b.WriteRune(':')
-			b.WriteString(s.Tag.Value)
+		span.Metrics[SublayerMetricKey(s)] = s.Value
+	}
+}
+
+// sublayerMetricPrefix prefixes the metrics of all the sublayers
+const sublayerMetricPrefix = "_sublayers."
+
+// RecomputeSublayers computes the sublayers of the trace like ComputeSublayers,
+// and pins them on its root like SetSublayersOnSpan, after clearing the metrics
+// of these sublayers already pinned on it. It is meant for traces whose spans
+// were modified after their sublayers were computed, e.g. whose durations were
+// clamped: it is idempotent, and no metric of a sublayer which is gone is left
+// on the root. The metrics of the other sublayers, e.g. by caller, are left
+// untouched.
+func RecomputeSublayers(t *Trace, mode SublayerMode, minDuration int64) []SublayerValue {
+	sublayers := ComputeSublayers(t, mode, minDuration)
+
+	root := t.GetRoot()
+	if root == nil {
+		return sublayers
+	}
+	byType, byService := mode.sublayerMetrics()
+	for k := range root.Metrics {
+		if !strings.HasPrefix(k, sublayerMetricPrefix) {
+			continue
+		}
+		switch metric, _ := ParseSublayerMetricKey(k); metric {
+		case byType, byService, "_sublayers.span_count", "_sublayers.linked_span_count":
+			delete(root.Metrics, k)
 		}
-		span.Metrics[b.String()] = s.Value
-		b.Reset()
+	}
+	SetSublayersOnSpan(root, sublayers)
+	return sublayers
+}
+
+// TopSublayerMetaPrefix prefixes the span meta keys set by SetTopSublayersOnSpan
+const TopSublayerMetaPrefix = "_dd.top_sublayer."
+
+// SetTopSublayersOnSpan pins on the given span.Meta the largest sublayer of each
+// sublayer tag, such as `_dd.top_sublayer.sublayer_service: mcnulty`, for the
+// consumers indexing string tags rather than numeric metrics. Untagged sublayers
+// are ignored, and ties go to the smallest tag value so that the result does not
+// depend on the order of the sublayers. It does nothing on a nil span.
+func SetTopSublayersOnSpan(span *Span, sv []SublayerValue) {
+	if span == nil {
+		return
+	}
+	top := make(map[string]SublayerValue)
+	for _, s := range sv {
+		if s.Tag.Name == "" {
+			continue
+		}
+		t, ok := top[s.Tag.Name]
+		if !ok || s.Value > t.Value || (s.Value == t.Value && s.Tag.Value < t.Tag.Value) {
+			top[s.Tag.Name] = s
+		}
+	}
+	if len(top) == 0 {
+		return
+	}
+
+	if span.Meta == nil {
+		span.Meta = make(map[string]string, len(top))
+	}
+	for name, s := range top {
+		span.Meta[TopSublayerMetaPrefix+name] = s.Tag.Value
 	}
 }
 
@@ -103,27 +442,49 @@ func insertTS(sts []timeSpan, ts timeSpan) []timeSpan {
 	return sts
 }
 
+// clampToRoot returns the start and duration of the part of the span which
+// overlaps the root, ok is false if they do not overlap at all
+func clampToRoot(s, root *Span) (start, duration int64, ok bool) {
+	start, end := s.Start, s.End()
+	if start < root.Start {
+		start = root.Start
+	}
+	if end > root.End() {
+		end = root.End()
+	}
+	if end < start || (end == start && s.Duration > 0) {
+		return 0, 0, false
+	}
+	return start, end - start, true
+}
+
 type sublayerSpans struct {
+	root      *Span
 	byType    []timeSpan
 	byService []timeSpan
 }
 
-func newSublayerSpans() *sublayerSpans {
+func newSublayerSpans(root *Span) *sublayerSpans {
 	return &sublayerSpans{
+		root:      root,
 		byType:    []timeSpan{},
 		byService: []timeSpan{},
 	}
 }
 
 func (ss *sublayerSpans) Add(s *Span) {
-	tsType := timeSpan{s.Type, s.Start, s.Duration}
-	tsService := timeSpan{s.Service, s.Start, s.Duration}
+	start, duration, ok := clampToRoot(s, ss.root)
+	if !ok {
+		return
+	}
+	tsType := timeSpan{s.Type, start, duration}
+	tsService := timeSpan{s.Service, start, duration}
 
 	ss.byType = insertTS(ss.byType, tsType)
 	ss.byService = insertTS(ss.byService, tsService)
 }
 
-func (ss *sublayerSpans) OutputSublayers() []SublayerValue {
+func (ss *sublayerSpans) OutputSublayers(minDuration int64) []SublayerValue {
 	mType := make(map[string]float64)
 	mService := make(map[string]float64)
 
@@ -134,17 +495,67 @@ func (ss *sublayerSpans) OutputSublayers() []SublayerValue {
 		mService[ts.Name] += float64(ts.Duration)
 	}
 
+	return outputSublayers(SublayerModeExclusive, minDuration, mType, mService)
+}
+
+// computeAdditiveSublayers sums the durations of all the spans of the trace
+// by type & service, without taking care of their overlap
+func computeAdditiveSublayers(t Trace, root *Span, minDuration int64) []SublayerValue {
+	mType := make(map[string]float64)
+	mService := make(map[string]float64)
+
+	for i := range t {
+		_, duration, ok := clampToRoot(&t[i], root)
+		if !ok {
+			continue
+		}
+		// don't do anything with unnamed
+		if t[i].Type != "" {
+			mType[t[i].Type] += float64(duration)
+		}
+		if t[i].Service != "" {
+			mService[t[i].Service] += float64(duration)
+		}
+	}
+
+	return outputSublayers(SublayerModeAdditive, minDuration, mType, mService)
+}
+
+// rollUpSublayers moves the durations below minDuration to the SublayerOther sublayer
+func rollUpSublayers(m map[string]float64, minDuration int64) {
+	if minDuration <= 0 {
+		return
+	}
+
+	var other float64
+	for k, v := range m {
+		if v < float64(minDuration) {
+			other += v
+			delete(m, k)
+		}
+	}
+	if other > 0 {
+		m[SublayerOther] += other
+	}
+}
+
+func outputSublayers(mode SublayerMode, minDuration int64, mType, mService map[string]float64) []SublayerValue {
+	byType, byService := mode.sublayerMetrics()
+
+	rollUpSublayers(mType, minDuration)
+	rollUpSublayers(mService, minDuration)
+
 	sublayers := make([]SublayerValue, 0, len(mType)+len(mService)+1)
 	for k, v := range mType {
 		sublayers = append(sublayers, SublayerValue{
-			Metric: "_sublayers.duration.by_type",
+			Metric: byType,
 			Tag:    Tag{"sublayer_type", k},
 			Value:  v,
 		})
 	}
 	for k, v := range mService {
 		sublayers = append(sublayers, SublayerValue{
-			Metric: "_sublayers.duration.by_service",
+			Metric: byService,
 			Tag:    Tag{"sublayer_service", k},
 			Value:  v,
 		})
@@ -29,7 +29,7 @@ func TestSublayerNested(t *testing.T) {
 		Span{TraceID: 1, SpanID: 5, ParentID: 1, Start: now + 700000000, Duration: 700000, Service: "mcnulty", Type: ""},
 	}
 
-	sublayers := ComputeSublayers(&tr)
+	sublayers := ComputeSublayers(&tr, SublayerModeExclusive, 0)
 
 	sortedSublayers := sortableSublayers(sublayers)
 	sort.Sort(sortedSublayers)
@@ -60,6 +60,9 @@ func TestSublayerNested(t *testing.T) {
 		"_sublayers.duration.by_service.sublayer_service:redis":     500000,
 	}
 
+	// the map of the sublayers uses the same keys
+	assert.Equal(expectedMetrics, SublayersToMap(sublayers))
+
 	// assert sublayers result in original trace
 	for _, s := range tr {
 		if s.ParentID == 0 {
@@ -85,6 +88,191 @@ func TestSublayerNested(t *testing.T) {
 	}
 }
 
+func TestSublayerModes(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UnixNano()
+	tr := Trace{
+		Span{TraceID: 1, SpanID: 1, ParentID: 0, Start: now + 42, Duration: 1000000000, Service: "mcnulty", Type: "web"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: now + 100, Duration: 200000000, Service: "mcnulty", Type: "sql"},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Start: now + 150, Duration: 199999000, Service: "master-db", Type: "sql"},
+		Span{TraceID: 1, SpanID: 4, ParentID: 1, Start: now + 500000000, Duration: 500000, Service: "redis", Type: "redis"},
+		Span{TraceID: 1, SpanID: 5, ParentID: 1, Start: now + 700000000, Duration: 700000, Service: "mcnulty", Type: ""},
+	}
+
+	exclusive := sortableSublayers(ComputeSublayers(&tr, SublayerModeExclusive, 0))
+	sort.Sort(exclusive)
+	assert.Equal(sortableSublayers{
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "master-db"}, Value: 199999000},
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "mcnulty"}, Value: 1000000000 - 199999000 - 500000},
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "redis"}, Value: 500000},
+		SublayerValue{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "redis"}, Value: 500000},
+		SublayerValue{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "sql"}, Value: 200000000},
+		SublayerValue{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "web"}, Value: 1000000000 - 200000000 - 500000},
+		SublayerValue{Metric: "_sublayers.span_count", Value: 5},
+	}, exclusive)
+
+	additive := sortableSublayers(ComputeSublayers(&tr, SublayerModeAdditive, 0))
+	sort.Sort(additive)
+	assert.Equal(sortableSublayers{
+		SublayerValue{Metric: "_sublayers.raw_duration.by_service", Tag: Tag{"sublayer_service", "master-db"}, Value: 199999000},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_service", Tag: Tag{"sublayer_service", "mcnulty"}, Value: 1000000000 + 200000000 + 700000},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_service", Tag: Tag{"sublayer_service", "redis"}, Value: 500000},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_type", Tag: Tag{"sublayer_type", "redis"}, Value: 500000},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_type", Tag: Tag{"sublayer_type", "sql"}, Value: 200000000 + 199999000},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_type", Tag: Tag{"sublayer_type", "web"}, Value: 1000000000},
+		SublayerValue{Metric: "_sublayers.span_count", Value: 5},
+	}, additive)
+}
+
+func TestSublayerMinDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UnixNano()
+	tr := Trace{
+		Span{TraceID: 1, SpanID: 1, ParentID: 0, Start: now + 42, Duration: 1000000000, Service: "mcnulty", Type: "web"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: now + 100, Duration: 200000000, Service: "master-db", Type: "sql"},
+		Span{TraceID: 1, SpanID: 3, ParentID: 1, Start: now + 500000000, Duration: 5000, Service: "redis", Type: "redis"},
+		Span{TraceID: 1, SpanID: 4, ParentID: 1, Start: now + 700000000, Duration: 3000, Service: "memcached", Type: "cache"},
+	}
+
+	sublayers := sortableSublayers(ComputeSublayers(&tr, SublayerModeExclusive, 10000))
+	sort.Sort(sublayers)
+
+	// sublayers below 10µs are rolled up, and the span count still reflects all the spans
+	assert.Equal(sortableSublayers{
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", SublayerOther}, Value: 5000 + 3000},
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "master-db"}, Value: 200000000},
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "mcnulty"}, Value: 1000000000 - 200000000 - 5000 - 3000},
+		SublayerValue{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", SublayerOther}, Value: 5000 + 3000},
+		SublayerValue{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "sql"}, Value: 200000000},
+		SublayerValue{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "web"}, Value: 1000000000 - 200000000 - 5000 - 3000},
+		SublayerValue{Metric: "_sublayers.span_count", Value: 4},
+	}, sublayers)
+}
+
+func TestSublayerAsyncSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UnixNano()
+	tr := Trace{
+		Span{TraceID: 1, SpanID: 1, ParentID: 0, Start: now, Duration: 1000000000, Service: "mcnulty", Type: "web"},
+		// fire-and-forget job started at the end of the request, only its first 100ms count
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: now + 900000000, Duration: 5000000000, Service: "worker", Type: "worker"},
+		// started after the end of the root, not accounted at all
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Start: now + 2000000000, Duration: 1000000, Service: "master-db", Type: "sql"},
+	}
+
+	exclusive := sortableSublayers(ComputeSublayers(&tr, SublayerModeExclusive, 0))
+	sort.Sort(exclusive)
+	assert.Equal(sortableSublayers{
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "mcnulty"}, Value: 900000000},
+		SublayerValue{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "worker"}, Value: 100000000},
+		SublayerValue{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "web"}, Value: 900000000},
+		SublayerValue{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "worker"}, Value: 100000000},
+		SublayerValue{Metric: "_sublayers.span_count", Value: 3},
+	}, exclusive)
+
+	additive := sortableSublayers(ComputeSublayers(&tr, SublayerModeAdditive, 0))
+	sort.Sort(additive)
+	assert.Equal(sortableSublayers{
+		SublayerValue{Metric: "_sublayers.raw_duration.by_service", Tag: Tag{"sublayer_service", "mcnulty"}, Value: 1000000000},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_service", Tag: Tag{"sublayer_service", "worker"}, Value: 100000000},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_type", Tag: Tag{"sublayer_type", "web"}, Value: 1000000000},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_type", Tag: Tag{"sublayer_type", "worker"}, Value: 100000000},
+		SublayerValue{Metric: "_sublayers.span_count", Value: 3},
+	}, additive)
+}
+
+func TestCallerSublayers(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UnixNano()
+	tr := Trace{
+		Span{TraceID: 1, SpanID: 1, ParentID: 0, Start: now, Duration: 1000, Service: "checkout", Type: "web"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: now + 100, Duration: 200, Service: "checkout", Type: "custom"},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Start: now + 150, Duration: 100, Service: "db", Type: "sql"},
+		Span{TraceID: 1, SpanID: 4, ParentID: 1, Start: now + 400, Duration: 300, Service: "payments", Type: "web"},
+		Span{TraceID: 1, SpanID: 5, ParentID: 4, Start: now + 450, Duration: 100, Service: "db", Type: "sql"},
+		Span{TraceID: 1, SpanID: 6, ParentID: 4, Start: now + 600, Duration: 50, Service: "payments", Type: "custom"},
+	}
+
+	// the db time is split between its two callers, and checkout only keeps its own time
+	exclusive := sortableSublayers(ComputeCallerSublayers(&tr, SublayerModeExclusive, 0))
+	sort.Sort(exclusive)
+	assert.Equal(sortableSublayers{
+		SublayerValue{Metric: "_sublayers.duration.by_caller", Tag: Tag{"sublayer_call", "checkout"}, Value: 600},
+		SublayerValue{Metric: "_sublayers.duration.by_caller", Tag: Tag{"sublayer_call", "checkout>db"}, Value: 100},
+		SublayerValue{Metric: "_sublayers.duration.by_caller", Tag: Tag{"sublayer_call", "checkout>payments"}, Value: 200},
+		SublayerValue{Metric: "_sublayers.duration.by_caller", Tag: Tag{"sublayer_call", "payments>db"}, Value: 100},
+	}, exclusive)
+
+	additive := sortableSublayers(ComputeCallerSublayers(&tr, SublayerModeAdditive, 0))
+	sort.Sort(additive)
+	assert.Equal(sortableSublayers{
+		SublayerValue{Metric: "_sublayers.raw_duration.by_caller", Tag: Tag{"sublayer_call", "checkout"}, Value: 1200},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_caller", Tag: Tag{"sublayer_call", "checkout>db"}, Value: 100},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_caller", Tag: Tag{"sublayer_call", "checkout>payments"}, Value: 350},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_caller", Tag: Tag{"sublayer_call", "payments>db"}, Value: 100},
+	}, additive)
+
+	// the split adds up to the sublayers by service
+	byService := SublayersToMap(ComputeSublayers(&tr, SublayerModeExclusive, 0))
+	assert.Equal(float64(600), byService["_sublayers.duration.by_service.sublayer_service:checkout"])
+	assert.Equal(float64(200), byService["_sublayers.duration.by_service.sublayer_service:db"])
+	assert.Equal(float64(200), byService["_sublayers.duration.by_service.sublayer_service:payments"])
+}
+
+func TestErrorSublayers(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UnixNano()
+	tr := Trace{
+		Span{TraceID: 1, SpanID: 1, ParentID: 0, Start: now, Duration: 1000, Service: "web", Type: "web"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: now + 100, Duration: 200, Service: "web", Type: "custom", Error: 1},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Start: now + 150, Duration: 100, Service: "db", Type: "sql", Error: 1},
+		Span{TraceID: 1, SpanID: 4, ParentID: 1, Start: now + 400, Duration: 100, Service: "db", Type: "sql"},
+	}
+
+	exclusive := sortableSublayers(ComputeErrorSublayers(&tr, SublayerModeExclusive, 0))
+	sort.Sort(exclusive)
+	assert.Equal(sortableSublayers{
+		SublayerValue{Metric: "_sublayers.duration.by_service_error", Tag: Tag{"sublayer_service_error", "db/error"}, Value: 100},
+		SublayerValue{Metric: "_sublayers.duration.by_service_error", Tag: Tag{"sublayer_service_error", "db/ok"}, Value: 100},
+		SublayerValue{Metric: "_sublayers.duration.by_service_error", Tag: Tag{"sublayer_service_error", "web/error"}, Value: 100},
+		SublayerValue{Metric: "_sublayers.duration.by_service_error", Tag: Tag{"sublayer_service_error", "web/ok"}, Value: 700},
+	}, exclusive)
+
+	additive := sortableSublayers(ComputeErrorSublayers(&tr, SublayerModeAdditive, 0))
+	sort.Sort(additive)
+	assert.Equal(sortableSublayers{
+		SublayerValue{Metric: "_sublayers.raw_duration.by_service_error", Tag: Tag{"sublayer_service_error", "db/error"}, Value: 100},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_service_error", Tag: Tag{"sublayer_service_error", "db/ok"}, Value: 100},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_service_error", Tag: Tag{"sublayer_service_error", "web/error"}, Value: 200},
+		SublayerValue{Metric: "_sublayers.raw_duration.by_service_error", Tag: Tag{"sublayer_service_error", "web/ok"}, Value: 1000},
+	}, additive)
+
+	// the split adds up to the sublayers by service
+	byService := SublayersToMap(ComputeSublayers(&tr, SublayerModeExclusive, 0))
+	assert.Equal(float64(800), byService["_sublayers.duration.by_service.sublayer_service:web"])
+	assert.Equal(float64(200), byService["_sublayers.duration.by_service.sublayer_service:db"])
+}
+
+func TestParseSublayerMode(t *testing.T) {
+	assert := assert.New(t)
+
+	mode, err := ParseSublayerMode("exclusive")
+	assert.Nil(err)
+	assert.Equal(SublayerModeExclusive, mode)
+
+	mode, err = ParseSublayerMode("Additive")
+	assert.Nil(err)
+	assert.Equal(SublayerModeAdditive, mode)
+
+	_, err = ParseSublayerMode("foo")
+	assert.NotNil(err)
+}
+
 func BenchmarkSublayerThru(b *testing.B) {
 	// real trace
 	tr := Trace{
@@ -98,6 +286,141 @@ func BenchmarkSublayerThru(b *testing.B) {
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		ComputeSublayers(&tr)
+		ComputeSublayers(&tr, SublayerModeExclusive, 0)
+	}
+}
+
+func TestSetTopSublayersOnSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	sv := []SublayerValue{
+		{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "master-db"}, Value: 200},
+		{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "mcnulty"}, Value: 700},
+		{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "redis"}, Value: 100},
+		{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "web"}, Value: 400},
+		{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "sql"}, Value: 400},
+		{Metric: "_sublayers.span_count", Value: 5},
+	}
+
+	span := &Span{Meta: map[string]string{"env": "prod"}}
+	SetTopSublayersOnSpan(span, sv)
+
+	assert.Equal(map[string]string{
+		"env":                               "prod",
+		"_dd.top_sublayer.sublayer_service": "mcnulty",
+		// ties go to the smallest value
+		"_dd.top_sublayer.sublayer_type": "sql",
+	}, span.Meta)
+	// the metrics are left alone
+	assert.Nil(span.Metrics)
+
+	// nothing to pin without tagged sublayers
+	span = &Span{}
+	SetTopSublayersOnSpan(span, sv[5:])
+	assert.Nil(span.Meta)
+}
+
+func TestSetSublayersOnNilSpan(t *testing.T) {
+	sv := []SublayerValue{
+		{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "mcnulty"}, Value: 700},
+		{Metric: "_sublayers.span_count", Value: 5},
+	}
+
+	// e.g. the root of an empty trace, nothing to pin
+	SetSublayersOnSpan(nil, sv)
+	SetTopSublayersOnSpan(nil, sv)
+}
+
+func TestSublayerMetricKeyEscaping(t *testing.T) {
+	assert := assert.New(t)
+
+	sv := []SublayerValue{
+		{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", "ns:team.svc"}, Value: 1},
+		{Metric: "_sublayers.duration.by_service", Tag: Tag{"sublayer_service", `odd\:name`}, Value: 2},
+		{Metric: "_sublayers.duration.by_type", Tag: Tag{"sublayer_type", "web"}, Value: 3},
+		{Metric: "_sublayers.span_count", Value: 4},
+	}
+
+	span := &Span{}
+	SetSublayersOnSpan(span, sv)
+
+	assert.Equal(map[string]float64{
+		`_sublayers.duration.by_service.sublayer_service:ns\:team.svc`: 1,
+		`_sublayers.duration.by_service.sublayer_service:odd\\\:name`:  2,
+		"_sublayers.duration.by_type.sublayer_type:web":                3,
+		"_sublayers.span_count":                                        4,
+	}, span.Metrics)
+
+	for _, s := range sv {
+		metric, tag := ParseSublayerMetricKey(SublayerMetricKey(s))
+		assert.Equal(s.Metric, metric)
+		assert.Equal(s.Tag, tag)
+	}
+}
+
+func TestSublayerLinkedSpanCount(t *testing.T) {
+	assert := assert.New(t)
+
+	// a consumer span processing a batch of messages produced in 2 other traces
+	tr := Trace{
+		Span{TraceID: 1, SpanID: 1, ParentID: 0, Start: 0, Duration: 100, Service: "worker", Type: "worker",
+			Meta: map[string]string{SpanLinksMetaKey: `[{"trace_id":"2","span_id":"20"},{"trace_id":"3","span_id":"30"}]`}},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: 10, Duration: 50, Service: "worker", Type: "sql",
+			// the same message again, and a span of this trace
+			Meta: map[string]string{SpanLinksMetaKey: `[{"trace_id":"2","span_id":"20"},{"trace_id":"1","span_id":"1"}]`}},
+		Span{TraceID: 1, SpanID: 3, ParentID: 1, Start: 60, Duration: 10, Service: "worker", Type: "sql",
+			// links which cannot be decoded are ignored
+			Meta: map[string]string{SpanLinksMetaKey: `not json`}},
 	}
+
+	metrics := make(map[string]float64)
+	for _, sv := range ComputeSublayers(&tr, SublayerModeExclusive, 0) {
+		metrics[SublayerMetricKey(sv)] = sv.Value
+	}
+	assert.Equal(float64(3), metrics["_sublayers.span_count"])
+	assert.Equal(float64(2), metrics["_sublayers.linked_span_count"])
+	assert.Equal(float64(60), metrics["_sublayers.duration.by_type.sublayer_type:sql"])
+
+	// traces without links have no linked span count
+	tr = Trace{Span{TraceID: 1, SpanID: 1, Start: 0, Duration: 100, Service: "worker", Type: "worker"}}
+	for _, sv := range ComputeSublayers(&tr, SublayerModeExclusive, 0) {
+		assert.NotEqual("_sublayers.linked_span_count", sv.Metric)
+	}
+}
+
+func TestRecomputeSublayers(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := Trace{
+		Span{TraceID: 1, SpanID: 1, ParentID: 0, Start: 0, Duration: 100, Service: "web", Type: "web"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: 10, Duration: 50, Service: "db", Type: "sql"},
+		Span{TraceID: 1, SpanID: 3, ParentID: 1, Start: 70, Duration: 10, Service: "cache", Type: "redis"},
+	}
+
+	sublayers := RecomputeSublayers(&tr, SublayerModeExclusive, 0)
+	metrics := make(map[string]float64)
+	for k, v := range tr.GetRoot().Metrics {
+		metrics[k] = v
+	}
+	assert.Equal(float64(3), metrics["_sublayers.span_count"])
+	assert.Equal(float64(10), metrics["_sublayers.duration.by_service.sublayer_service:cache"])
+	assert.Len(metrics, len(sublayers))
+
+	// idempotent
+	RecomputeSublayers(&tr, SublayerModeExclusive, 0)
+	assert.Equal(metrics, tr.GetRoot().Metrics)
+
+	// the cache span is dropped, e.g. by the normalization, its sublayers go
+	// away, the other metrics of the root are kept
+	tr = Trace{tr[0], tr[1]}
+	tr[0].Metrics["_sample_rate"] = 0.5
+	tr[0].Metrics["_sublayers.duration.by_caller.sublayer_call:web"] = 100
+	RecomputeSublayers(&tr, SublayerModeExclusive, 0)
+	root := tr.GetRoot()
+	assert.Equal(float64(2), root.Metrics["_sublayers.span_count"])
+	assert.Equal(float64(50), root.Metrics["_sublayers.duration.by_service.sublayer_service:web"])
+	assert.NotContains(root.Metrics, "_sublayers.duration.by_service.sublayer_service:cache")
+	assert.NotContains(root.Metrics, "_sublayers.duration.by_type.sublayer_type:redis")
+	assert.Equal(0.5, root.Metrics["_sample_rate"])
+	assert.Equal(float64(100), root.Metrics["_sublayers.duration.by_caller.sublayer_call:web"])
 }
@@ -1,6 +1,13 @@
 package model
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sort"
+	"strings"
+
 	log "github.com/cihub/seelog"
 )
 
@@ -26,6 +33,20 @@ func (t Trace) GetEnv() string {
 	return ""
 }
 
+// SetDefaultEnv sets env in the meta of the root span, unless a span of the
+// trace already has an env. It returns true if the env was set.
+func (t Trace) SetDefaultEnv(env string) bool {
+	if len(t) == 0 || t.GetEnv() != "" {
+		return false
+	}
+	root := t.GetRoot()
+	if root.Meta == nil {
+		root.Meta = make(map[string]string, 1)
+	}
+	root.Meta["env"] = env
+	return true
+}
+
 // GetRoot extracts the root span from a trace
 func (t Trace) GetRoot() *Span {
 	// That should be caught beforehand
@@ -66,7 +87,554 @@ func (t Trace) GetRoot() *Span {
 	return &t[len(t)-1]
 }
 
+// spansByStart sorts the spans of a trace by start time, then by span ID
+type spansByStart Trace
+
+func (t spansByStart) Len() int      { return len(t) }
+func (t spansByStart) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t spansByStart) Less(i, j int) bool {
+	if t[i].Start != t[j].Start {
+		return t[i].Start < t[j].Start
+	}
+	return t[i].SpanID < t[j].SpanID
+}
+
+// Sort orders the spans of the trace in place by start time, then by span ID,
+// which gives a canonical order computations can rely on. Since it moves the
+// spans around, pointers to them obtained before sorting are invalidated.
+func (t Trace) Sort() {
+	// sorting is actually expensive so skip it if we can
+	if !sort.IsSorted(spansByStart(t)) {
+		sort.Sort(spansByStart(t))
+	}
+}
+
 // NewTraceFlushMarker returns a trace with a single span as flush marker
 func NewTraceFlushMarker() Trace {
 	return []Span{NewFlushMarker()}
 }
+
+// childrenByParent maps each span ID of the trace to the spans it is the parent of
+func (t Trace) childrenByParent() map[uint64][]*Span {
+	children := make(map[uint64][]*Span, len(t))
+	for i := range t {
+		children[t[i].ParentID] = append(children[t[i].ParentID], &t[i])
+	}
+	return children
+}
+
+// levelWidths returns the number of spans found at each level of the trace,
+// starting from its root.
+func (t Trace) levelWidths() []int {
+	root := t.GetRoot()
+	if root == nil {
+		return nil
+	}
+
+	children := t.childrenByParent()
+	visited := map[uint64]struct{}{root.SpanID: struct{}{}}
+
+	var widths []int
+	level := []*Span{root}
+	for len(level) > 0 {
+		widths = append(widths, len(level))
+
+		var next []*Span
+		for _, s := range level {
+			for _, c := range children[s.SpanID] {
+				// protect ourselves against cycles in malformed traces
+				if _, ok := visited[c.SpanID]; ok {
+					continue
+				}
+				visited[c.SpanID] = struct{}{}
+				next = append(next, c)
+			}
+		}
+		level = next
+	}
+
+	return widths
+}
+
+// Depth returns the number of spans of the longest chain going from the root
+// of the trace down to a leaf. It is 0 for an empty trace.
+func (t Trace) Depth() int {
+	return len(t.levelWidths())
+}
+
+// MaxWidth returns the largest number of spans found at the same level of the
+// trace. It is 0 for an empty trace.
+func (t Trace) MaxWidth() int {
+	max := 0
+	for _, w := range t.levelWidths() {
+		if w > max {
+			max = w
+		}
+	}
+	return max
+}
+
+// OversizedResources returns the number of spans of the trace whose resource is
+// longer than max bytes.
+func (t Trace) OversizedResources(max int) int {
+	n := 0
+	for i := range t {
+		if len(t[i].Resource) > max {
+			n++
+		}
+	}
+	return n
+}
+
+// TruncateResources truncates the resources of the spans of the trace to max
+// bytes, and returns the number of spans truncated.
+func (t Trace) TruncateResources(max int) int {
+	n := 0
+	for i := range t {
+		if len(t[i].Resource) > max {
+			t[i].Resource = t[i].Resource[:max]
+			n++
+		}
+	}
+	return n
+}
+
+// ClockSkewedSpans returns the number of spans starting before their parent or
+// ending after it, which hints at clocks skewed between the hosts reporting the
+// spans of the trace.
+func (t Trace) ClockSkewedSpans() int {
+	spans := make(map[uint64]*Span, len(t))
+	for i := range t {
+		spans[t[i].SpanID] = &t[i]
+	}
+
+	skewed := 0
+	for i := range t {
+		p, ok := spans[t[i].ParentID]
+		if !ok || p == &t[i] {
+			continue
+		}
+		if t[i].Start < p.Start || t[i].End() > p.End() {
+			skewed++
+		}
+	}
+	return skewed
+}
+
+// MixedEnvSpans returns the number of spans of the trace with an env meta other
+// than env, the one resolved for the whole trace. A trace should have a single
+// env, these spans come from services tagged with the wrong one.
+func (t Trace) MixedEnvSpans(env string) int {
+	mixed := 0
+	for i := range t {
+		if v, ok := t[i].Meta["env"]; ok && v != env {
+			mixed++
+		}
+	}
+	return mixed
+}
+
+// DropServices returns the trace without the spans of the given services, along
+// with the number of spans dropped. The children of a dropped span are re-parented
+// to their closest kept ancestor so that the remaining trace stays valid.
+func (t Trace) DropServices(services map[string]struct{}) (Trace, int) {
+	dropped := make(map[uint64]*Span)
+	for i := range t {
+		if _, ok := services[t[i].Service]; ok {
+			dropped[t[i].SpanID] = &t[i]
+		}
+	}
+	return t.dropSpans(dropped)
+}
+
+// DropSpansEndedBefore returns the trace without the spans which ended before
+// the given timestamp, along with the number of spans dropped. Their children
+// are re-parented like with DropServices.
+func (t Trace) DropSpansEndedBefore(ts int64) (Trace, int) {
+	dropped := make(map[uint64]*Span)
+	for i := range t {
+		if t[i].End() < ts {
+			dropped[t[i].SpanID] = &t[i]
+		}
+	}
+	return t.dropSpans(dropped)
+}
+
+// dropSpans returns the trace without the given spans, indexed by span ID, and
+// re-parents their children to their closest kept ancestor
+func (t Trace) dropSpans(dropped map[uint64]*Span) (Trace, int) {
+	if len(dropped) == 0 {
+		return t, 0
+	}
+
+	kept := make(Trace, 0, len(t)-len(dropped))
+	for i := range t {
+		if _, ok := dropped[t[i].SpanID]; ok {
+			continue
+		}
+		s := t[i]
+		// climb up the dropped ancestors, the bound protects us against cycles
+		for n := 0; n < len(dropped); n++ {
+			parent, ok := dropped[s.ParentID]
+			if !ok {
+				break
+			}
+			s.ParentID = parent.ParentID
+		}
+		kept = append(kept, s)
+	}
+
+	return kept, len(dropped)
+}
+
+// RenameServices renames the services of the spans of the trace according to
+// the given aliases, mapping normalized service names to their canonical name,
+// and returns the number of spans renamed. The services are normalized to be
+// compared with the aliases, in case the trace was not normalized yet.
+func (t Trace) RenameServices(aliases map[string]string) int {
+	var renamed int
+	for i := range t {
+		canonical, ok := aliases[t[i].Service]
+		if !ok {
+			canonical, ok = aliases[NormalizeTag(t[i].Service)]
+		}
+		if ok {
+			t[i].Service = canonical
+			renamed++
+		}
+	}
+	return renamed
+}
+
+// OriginalNameMetaKey is the meta holding the name of a span before it was
+// lowercased, for display
+const OriginalNameMetaKey = "_dd.original_name"
+
+// LowercaseNames lowercases the names of the spans of the trace, so that their
+// case variants are aggregated together, and returns the number of spans renamed.
+// Their original name is kept in the OriginalNameMetaKey meta. Services need no
+// such thing, they are already lowercased by the normalization.
+func (t Trace) LowercaseNames() int {
+	var renamed int
+	for i := range t {
+		s := &t[i]
+		name := strings.ToLower(s.Name)
+		if name == s.Name {
+			continue
+		}
+		if s.Meta == nil {
+			s.Meta = make(map[string]string, 1)
+		}
+		s.Meta[OriginalNameMetaKey] = s.Name
+		s.Name = name
+		renamed++
+	}
+	return renamed
+}
+
+// WallDuration returns the time, in nanoseconds, between the start of the
+// earliest span of the trace and the end of the latest one.
+func (t Trace) WallDuration() int64 {
+	if len(t) == 0 {
+		return 0
+	}
+	start, end := t[0].Start, t[0].End()
+	for i := range t[1:] {
+		s := &t[i+1]
+		if s.Start < start {
+			start = s.Start
+		}
+		if s.End() > end {
+			end = s.End()
+		}
+	}
+	return end - start
+}
+
+// IdleTime returns the time, in nanoseconds, during which the root of the trace
+// is the only active span, i.e. the duration of the root minus the union of
+// the intervals of the other spans within it. A high idle time points to work
+// which is not instrumented.
+func (t Trace) IdleTime() int64 {
+	root := t.GetRoot()
+	if root == nil {
+		return 0
+	}
+
+	intervals := make([][2]int64, 0, len(t)-1)
+	for i := range t {
+		s := &t[i]
+		if s == root {
+			continue
+		}
+		start, end := s.Start, s.End()
+		if start < root.Start {
+			start = root.Start
+		}
+		if end > root.End() {
+			end = root.End()
+		}
+		if end > start {
+			intervals = append(intervals, [2]int64{start, end})
+		}
+	}
+	sort.Sort(intervalsByStart(intervals))
+
+	var busy int64
+	cur := root.Start
+	for _, in := range intervals {
+		if in[1] <= cur {
+			continue
+		}
+		if in[0] > cur {
+			cur = in[0]
+		}
+		busy += in[1] - cur
+		cur = in[1]
+	}
+
+	return root.Duration - busy
+}
+
+// intervalsByStart sorts [start, end] intervals by start
+type intervalsByStart [][2]int64
+
+func (s intervalsByStart) Len() int           { return len(s) }
+func (s intervalsByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s intervalsByStart) Less(i, j int) bool { return s[i][0] < s[j][0] }
+
+// DropDuplicateSpanIDs returns the trace with only the first span of each span
+// ID, along with the number of spans dropped. Buggy clients sometimes reuse span
+// IDs, which makes the parent of their children ambiguous.
+func (t Trace) DropDuplicateSpanIDs() (Trace, int) {
+	seen := make(map[uint64]struct{}, len(t))
+	var dedup Trace
+	for i := range t {
+		if _, ok := seen[t[i].SpanID]; !ok {
+			seen[t[i].SpanID] = struct{}{}
+			if dedup != nil {
+				dedup = append(dedup, t[i])
+			}
+			continue
+		}
+		if dedup == nil {
+			// first duplicate, only copy the trace now
+			dedup = make(Trace, i, len(t)-1)
+			copy(dedup, t[:i])
+		}
+	}
+	if dedup == nil {
+		return t, 0
+	}
+	return dedup, len(t) - len(dedup)
+}
+
+// SplitZeroTraceIDs returns the trace without its spans having a zero trace ID,
+// followed by one single-span trace for each of these spans, with a new random
+// trace ID so that they do not collide with each other, along with the number
+// of such spans. Traces without any are returned as they are.
+func (t Trace) SplitZeroTraceIDs() (Traces, int) {
+	var rest Trace
+	var split Traces
+	for i := range t {
+		if t[i].TraceID != 0 {
+			if split != nil {
+				rest = append(rest, t[i])
+			}
+			continue
+		}
+		if split == nil {
+			// first zero trace ID, only copy the trace now
+			rest = make(Trace, i, len(t)-1)
+			copy(rest, t[:i])
+		}
+		s := t[i]
+		s.TraceID = RandomID()
+		split = append(split, Trace{s})
+	}
+	if split == nil {
+		return Traces{t}, 0
+	}
+	zero := len(split)
+	if len(rest) > 0 {
+		split = append(Traces{rest}, split...)
+	}
+	return split, zero
+}
+
+// ProjectMeta returns a copy of the trace in which the meta of the spans only
+// has the given keys, to reduce the size of the traces shipped. The trace itself
+// is left untouched, since other components might still be reading it.
+func (t Trace) ProjectMeta(keep map[string]struct{}) Trace {
+	projected := make(Trace, len(t))
+	for i, s := range t {
+		if s.Meta != nil {
+			meta := make(map[string]string, len(keep))
+			for k, v := range s.Meta {
+				if _, ok := keep[k]; ok {
+					meta[k] = v
+				}
+			}
+			s.Meta = meta
+		}
+		projected[i] = s
+	}
+	return projected
+}
+
+// Anonymize returns a copy of the trace in which the services, resources and
+// meta values are replaced by their HMAC keyed with salt, so that it can be
+// shared without leaking their contents. The salt must be kept secret, else the
+// common values could be found back by hashing guesses. The values of the meta
+// keys listed in keep are left untouched, so are the metrics, except the
+// services named in the keys of the sublayer metrics, which are hashed too.
+// Hashing is deterministic for a given salt: equal values stay equal across
+// spans and traces, so the structure of the trace is preserved.
+func (t Trace) Anonymize(salt []byte, keep []string) Trace {
+	kept := make(map[string]struct{}, len(keep))
+	for _, k := range keep {
+		kept[k] = struct{}{}
+	}
+
+	a := anonymizer{mac: hmac.New(sha256.New, salt)}
+	anonymized := make(Trace, len(t))
+	for i, s := range t {
+		s.Service = a.hash(s.Service)
+		s.Resource = a.hash(s.Resource)
+		if s.Meta != nil {
+			meta := make(map[string]string, len(s.Meta))
+			for k, v := range s.Meta {
+				if _, ok := kept[k]; !ok {
+					v = a.hash(v)
+				}
+				meta[k] = v
+			}
+			s.Meta = meta
+		}
+		if s.Metrics != nil {
+			metrics := make(map[string]float64, len(s.Metrics))
+			for k, v := range s.Metrics {
+				if strings.HasPrefix(k, sublayerMetricPrefix) {
+					if metric, tag := ParseSublayerMetricKey(k); tag.Name != "" {
+						k = SublayerMetricKey(SublayerValue{Metric: metric, Tag: a.sublayerTag(tag)})
+					}
+				}
+				metrics[k] = v
+			}
+			s.Metrics = metrics
+		}
+		anonymized[i] = s
+	}
+
+	return anonymized
+}
+
+// anonymizer hashes the values of the traces given to Anonymize
+type anonymizer struct {
+	mac hash.Hash
+}
+
+// sublayerTag returns the tag of a sublayer metric with the services it names
+// hashed like the services of the spans, see Anonymize. Span types are left
+// untouched, like the types of the spans.
+func (a anonymizer) sublayerTag(tag Tag) Tag {
+	switch tag.Name {
+	case "sublayer_type":
+	case "sublayer_call":
+		// "caller>callee", or just "caller" for the service of the root
+		services := strings.Split(tag.Value, ">")
+		for i := range services {
+			services[i] = a.hash(services[i])
+		}
+		tag.Value = strings.Join(services, ">")
+	case "sublayer_service_error":
+		// "service/error" or "service/ok"
+		if i := strings.LastIndexByte(tag.Value, '/'); i >= 0 {
+			tag.Value = a.hash(tag.Value[:i]) + tag.Value[i:]
+		} else {
+			tag.Value = a.hash(tag.Value)
+		}
+	default:
+		tag.Value = a.hash(tag.Value)
+	}
+	return tag
+}
+
+// hash returns an opaque but deterministic replacement for the given value, the
+// first 8 bytes of its HMAC in hexadecimal
+func (a anonymizer) hash(v string) string {
+	if v == "" {
+		return v
+	}
+	a.mac.Reset()
+	a.mac.Write([]byte(v))
+	return hex.EncodeToString(a.mac.Sum(nil)[:8])
+}
+
+// spansByDuration sorts spans by decreasing duration
+type spansByDuration []*Span
+
+func (s spansByDuration) Len() int           { return len(s) }
+func (s spansByDuration) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s spansByDuration) Less(i, j int) bool { return s[i].Duration > s[j].Duration }
+
+// Truncate returns the trace reduced to at most maxSpans spans, along with the
+// number of spans removed. The root and its critical path, following the longest
+// child at each level, are always kept first, then the longest spans closest to
+// the root, so that every kept span still has its parent in the trace.
+// A maxSpans of 0 or less means no limit.
+func (t Trace) Truncate(maxSpans int) (Trace, int) {
+	if maxSpans <= 0 || len(t) <= maxSpans {
+		return t, 0
+	}
+
+	children := t.childrenByParent()
+	for _, c := range children {
+		sort.Stable(spansByDuration(c))
+	}
+
+	root := t.GetRoot()
+	kept := make(map[*Span]struct{}, maxSpans)
+	kept[root] = struct{}{}
+
+	// the critical path first
+	for cur := root; len(kept) < maxSpans; {
+		c := children[cur.SpanID]
+		if len(c) == 0 {
+			break
+		}
+		if _, ok := kept[c[0]]; ok {
+			break // cycle
+		}
+		cur = c[0]
+		kept[cur] = struct{}{}
+	}
+
+	// then breadth first, longest spans first
+	queue := []*Span{root}
+	visited := map[*Span]struct{}{root: {}}
+	for len(queue) > 0 && len(kept) < maxSpans {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, c := range children[cur.SpanID] {
+			if _, ok := visited[c]; ok {
+				continue
+			}
+			if len(kept) >= maxSpans {
+				break
+			}
+			visited[c] = struct{}{}
+			kept[c] = struct{}{}
+			queue = append(queue, c)
+		}
+	}
+
+	truncated := make(Trace, 0, len(kept))
+	for i := range t {
+		if _, ok := kept[&t[i]]; ok {
+			truncated = append(truncated, t[i])
+		}
+	}
+
+	return truncated, len(t) - len(truncated)
+}
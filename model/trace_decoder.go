@@ -0,0 +1,100 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// TracesDecoder decodes a payload of traces one trace at a time, so that the
+// whole payload never has to be held in memory at once.
+type TracesDecoder interface {
+	// Next decodes the next trace of the payload. It returns io.EOF once
+	// all the traces were read.
+	Next() (Trace, error)
+}
+
+// jsonTracesDecoder decodes a JSON array of traces
+type jsonTracesDecoder struct {
+	dec     *json.Decoder
+	started bool
+}
+
+// NewJSONTracesDecoder returns a TracesDecoder reading a JSON array of traces from r.
+func NewJSONTracesDecoder(r io.Reader) TracesDecoder {
+	return &jsonTracesDecoder{dec: json.NewDecoder(r)}
+}
+
+// Next implements TracesDecoder
+func (d *jsonTracesDecoder) Next() (Trace, error) {
+	if !d.started {
+		tok, err := d.dec.Token()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("expected an array of traces, got %v", tok)
+		}
+		d.started = true
+	}
+
+	if !d.dec.More() {
+		// consume the closing bracket, so that a truncated payload is an error
+		if _, err := d.dec.Token(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return nil, io.EOF
+	}
+
+	var t Trace
+	if err := d.dec.Decode(&t); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return t, nil
+}
+
+// msgpackTracesDecoder decodes a msgpack array of traces
+type msgpackTracesDecoder struct {
+	dc        *msgp.Reader
+	started   bool
+	remaining uint32
+}
+
+// NewMsgpackTracesDecoder returns a TracesDecoder reading a msgpack array of traces from r.
+func NewMsgpackTracesDecoder(r io.Reader) TracesDecoder {
+	return &msgpackTracesDecoder{dc: msgp.NewReader(r)}
+}
+
+// Next implements TracesDecoder
+func (d *msgpackTracesDecoder) Next() (Trace, error) {
+	if !d.started {
+		n, err := d.dc.ReadArrayHeader()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		d.remaining = n
+		d.started = true
+	}
+
+	if d.remaining == 0 {
+		return nil, io.EOF
+	}
+
+	var t Trace
+	if err := t.DecodeMsg(d.dc); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	d.remaining--
+	return t, nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, since the decoders only
+// return io.EOF once the whole array of traces was read
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
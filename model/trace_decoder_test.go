@@ -0,0 +1,89 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func testDecoderTraces() Traces {
+	return Traces{
+		Trace{
+			Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Start: 1e9, Duration: 1e6},
+			Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Name: "sql.query", Resource: "SELECT", Start: 1e9, Duration: 1e5},
+		},
+		Trace{
+			Span{TraceID: 2, SpanID: 3, Service: "web", Name: "http.request", Resource: "POST /", Start: 2e9, Duration: 2e6, Meta: map[string]string{"env": "prod"}},
+		},
+	}
+}
+
+func decodeAll(dec TracesDecoder) (Traces, error) {
+	var traces Traces
+	for {
+		t, err := dec.Next()
+		if err == io.EOF {
+			return traces, nil
+		}
+		if err != nil {
+			return traces, err
+		}
+		traces = append(traces, t)
+	}
+}
+
+func TestJSONTracesDecoder(t *testing.T) {
+	assert := assert.New(t)
+
+	traces := testDecoderTraces()
+	data, err := json.Marshal(traces)
+	assert.Nil(err)
+
+	decoded, err := decodeAll(NewJSONTracesDecoder(bytes.NewReader(data)))
+	assert.Nil(err)
+	assert.Equal(traces, decoded)
+
+	// an empty payload has no traces
+	decoded, err = decodeAll(NewJSONTracesDecoder(bytes.NewReader([]byte("[]"))))
+	assert.Nil(err)
+	assert.Len(decoded, 0)
+
+	// the traces before a truncation are returned before the error
+	decoded, err = decodeAll(NewJSONTracesDecoder(bytes.NewReader(data[:len(data)-1])))
+	assert.NotNil(err)
+	assert.Equal(traces, decoded)
+
+	_, err = decodeAll(NewJSONTracesDecoder(bytes.NewReader([]byte(`{"traces": []}`))))
+	assert.NotNil(err)
+}
+
+func TestMsgpackTracesDecoder(t *testing.T) {
+	assert := assert.New(t)
+
+	traces := testDecoderTraces()
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, traces))
+	data := buf.Bytes()
+
+	decoded, err := decodeAll(NewMsgpackTracesDecoder(bytes.NewReader(data)))
+	assert.Nil(err)
+	assert.Equal(traces, decoded)
+
+	decoded, err = decodeAll(NewMsgpackTracesDecoder(bytes.NewReader(data[:len(data)-1])))
+	assert.NotNil(err)
+	assert.Equal(traces[:1], decoded)
+}
+
+func TestTracesDecoderEmptyPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	// an empty body is not an empty array of traces
+	_, err := NewJSONTracesDecoder(bytes.NewReader(nil)).Next()
+	assert.Equal(io.ErrUnexpectedEOF, err)
+	_, err = NewMsgpackTracesDecoder(bytes.NewReader(nil)).Next()
+	assert.Equal(io.ErrUnexpectedEOF, err)
+}
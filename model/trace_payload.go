@@ -0,0 +1,106 @@
+package model
+
+import "github.com/tinylib/msgp/msgp"
+
+// TracePayload is a payload of traces sent by the clients along with tags
+// common to all their spans, so that they are not repeated on every span.
+type TracePayload struct {
+	Tags   map[string]string `json:"tags"`
+	Traces Traces            `json:"traces"`
+}
+
+// SpreadTags sets the tags of the payload in the meta of all the spans of its
+// traces, without overriding the meta the spans already have.
+func (p *TracePayload) SpreadTags() {
+	if len(p.Tags) == 0 {
+		return
+	}
+	for _, t := range p.Traces {
+		for i := range t {
+			s := &t[i]
+			if s.Meta == nil {
+				s.Meta = make(map[string]string, len(p.Tags))
+			}
+			for k, v := range p.Tags {
+				if _, ok := s.Meta[k]; !ok {
+					s.Meta[k] = v
+				}
+			}
+		}
+	}
+}
+
+// DecodeMsg implements msgp.Decodable
+func (p *TracePayload) DecodeMsg(dc *msgp.Reader) error {
+	n, err := dc.ReadMapHeader()
+	if err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		field, err := dc.ReadMapKeyPtr()
+		if err != nil {
+			return err
+		}
+
+		switch msgp.UnsafeString(field) {
+		case "tags":
+			if dc.IsNil() {
+				p.Tags = nil
+				if err := dc.ReadNil(); err != nil {
+					return err
+				}
+				continue
+			}
+			sz, err := dc.ReadMapHeader()
+			if err != nil {
+				return err
+			}
+			p.Tags = make(map[string]string, sz)
+			for ; sz > 0; sz-- {
+				k, err := parseString(dc)
+				if err != nil {
+					return err
+				}
+				v, err := parseString(dc)
+				if err != nil {
+					return err
+				}
+				p.Tags[k] = v
+			}
+		case "traces":
+			if err := p.Traces.DecodeMsg(dc); err != nil {
+				return err
+			}
+		default:
+			if err := dc.Skip(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EncodeMsg implements msgp.Encodable
+func (p *TracePayload) EncodeMsg(en *msgp.Writer) error {
+	if err := en.WriteMapHeader(2); err != nil {
+		return err
+	}
+	if err := en.WriteString("tags"); err != nil {
+		return err
+	}
+	if err := en.WriteMapHeader(uint32(len(p.Tags))); err != nil {
+		return err
+	}
+	for k, v := range p.Tags {
+		if err := en.WriteString(k); err != nil {
+			return err
+		}
+		if err := en.WriteString(v); err != nil {
+			return err
+		}
+	}
+	if err := en.WriteString("traces"); err != nil {
+		return err
+	}
+	return p.Traces.EncodeMsg(en)
+}
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestTracePayloadSpreadTags(t *testing.T) {
+	assert := assert.New(t)
+
+	p := TracePayload{
+		Tags: map[string]string{"env": "prod", "version": "1.2"},
+		Traces: Traces{
+			Trace{
+				Span{SpanID: 1, Service: "web"},
+				Span{SpanID: 2, ParentID: 1, Service: "db", Meta: map[string]string{"env": "staging", "db.type": "pg"}},
+			},
+		},
+	}
+	p.SpreadTags()
+
+	assert.Equal(map[string]string{"env": "prod", "version": "1.2"}, p.Traces[0][0].Meta)
+	// the meta of the spans wins over the tags of the payload
+	assert.Equal(map[string]string{"env": "staging", "version": "1.2", "db.type": "pg"}, p.Traces[0][1].Meta)
+}
+
+func TestTracePayloadDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := map[string]string{"env": "prod"}
+	traces := Traces{
+		Trace{Span{TraceID: 1, SpanID: 1, Service: "web", Name: "http.request", Resource: "GET /", Duration: 10}},
+	}
+
+	// JSON
+	data, err := json.Marshal(map[string]interface{}{"tags": tags, "traces": traces})
+	assert.Nil(err)
+	var p TracePayload
+	assert.Nil(json.Unmarshal(data, &p))
+	assert.Equal(tags, p.Tags)
+	assert.Equal(traces, p.Traces)
+
+	// msgpack
+	var buf bytes.Buffer
+	assert.Nil(msgp.Encode(&buf, &TracePayload{Tags: tags, Traces: traces}))
+	p = TracePayload{}
+	assert.Nil(msgp.Decode(&buf, &p))
+	assert.Equal(tags, p.Tags)
+	assert.Equal(traces, p.Traces)
+
+	// unknown fields are skipped
+	buf.Reset()
+	w := msgp.NewWriter(&buf)
+	assert.Nil(w.WriteMapHeader(2))
+	assert.Nil(w.WriteString("language"))
+	assert.Nil(w.WriteString("go"))
+	assert.Nil(w.WriteString("traces"))
+	assert.Nil(traces.EncodeMsg(w))
+	assert.Nil(w.Flush())
+
+	p = TracePayload{}
+	assert.Nil(msgp.Decode(&buf, &p))
+	assert.Len(p.Tags, 0)
+	assert.Equal(traces, p.Traces)
+}
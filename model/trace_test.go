@@ -1,6 +1,7 @@
 package model
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,3 +32,545 @@ func TestGetRootFromPartialTrace(t *testing.T) {
 
 	assert.Equal(trace.GetRoot().SpanID, uint64(12341))
 }
+
+func TestTraceShapeEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{}
+	assert.Equal(0, trace.Depth())
+	assert.Equal(0, trace.MaxWidth())
+}
+
+func TestTraceShapeSingleSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Service: "s1", Name: "n1"},
+	}
+	assert.Equal(1, trace.Depth())
+	assert.Equal(1, trace.MaxWidth())
+}
+
+func TestTraceShapeDeep(t *testing.T) {
+	assert := assert.New(t)
+
+	// a chain of 10 spans, each one the child of the previous one
+	trace := Trace{}
+	for i := uint64(1); i <= 10; i++ {
+		trace = append(trace, Span{TraceID: 1, SpanID: i, ParentID: i - 1, Service: "s1", Name: "n1"})
+	}
+	assert.Equal(10, trace.Depth())
+	assert.Equal(1, trace.MaxWidth())
+}
+
+func TestTraceShapeWide(t *testing.T) {
+	assert := assert.New(t)
+
+	// a root with 10 direct children, two of them having a child of their own
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Service: "s1", Name: "n1"},
+	}
+	for i := uint64(2); i <= 11; i++ {
+		trace = append(trace, Span{TraceID: 1, SpanID: i, ParentID: 1, Service: "s1", Name: "n1"})
+	}
+	trace = append(trace,
+		Span{TraceID: 1, SpanID: 12, ParentID: 2, Service: "s2", Name: "n2"},
+		Span{TraceID: 1, SpanID: 13, ParentID: 3, Service: "s2", Name: "n2"},
+	)
+	assert.Equal(3, trace.Depth())
+	assert.Equal(10, trace.MaxWidth())
+}
+
+func TestTraceShapePartial(t *testing.T) {
+	assert := assert.New(t)
+
+	// root is missing, its first child should be used as the root
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "s1", Name: "n1"},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Service: "s1", Name: "n1"},
+		Span{TraceID: 1, SpanID: 4, ParentID: 2, Service: "s2", Name: "n2"},
+	}
+	assert.Equal(2, trace.Depth())
+	assert.Equal(2, trace.MaxWidth())
+}
+
+func TestTraceDropServices(t *testing.T) {
+	assert := assert.New(t)
+
+	ignored := map[string]struct{}{"envoy.internal": struct{}{}}
+
+	// nothing to drop
+	tr := Trace{
+		Span{SpanID: 1, Service: "web"},
+		Span{SpanID: 2, ParentID: 1, Service: "db"},
+	}
+	kept, n := tr.DropServices(ignored)
+	assert.Equal(0, n)
+	assert.Equal(tr, kept)
+
+	// leaf spans are simply removed
+	tr = Trace{
+		Span{SpanID: 1, Service: "web"},
+		Span{SpanID: 2, ParentID: 1, Service: "envoy.internal"},
+		Span{SpanID: 3, ParentID: 1, Service: "db"},
+	}
+	kept, n = tr.DropServices(ignored)
+	assert.Equal(1, n)
+	assert.Equal(Trace{
+		Span{SpanID: 1, Service: "web"},
+		Span{SpanID: 3, ParentID: 1, Service: "db"},
+	}, kept)
+
+	// children of internal spans are attached to their closest kept ancestor
+	tr = Trace{
+		Span{SpanID: 1, Service: "web"},
+		Span{SpanID: 2, ParentID: 1, Service: "envoy.internal"},
+		Span{SpanID: 3, ParentID: 2, Service: "envoy.internal"},
+		Span{SpanID: 4, ParentID: 3, Service: "db"},
+		Span{SpanID: 5, ParentID: 2, Service: "cache"},
+	}
+	kept, n = tr.DropServices(ignored)
+	assert.Equal(2, n)
+	assert.Equal(Trace{
+		Span{SpanID: 1, Service: "web"},
+		Span{SpanID: 4, ParentID: 1, Service: "db"},
+		Span{SpanID: 5, ParentID: 1, Service: "cache"},
+	}, kept)
+	assert.Equal(2, kept.Depth())
+
+	// when the root is dropped, its children become roots
+	tr = Trace{
+		Span{SpanID: 1, Service: "envoy.internal"},
+		Span{SpanID: 2, ParentID: 1, Service: "web"},
+	}
+	kept, n = tr.DropServices(ignored)
+	assert.Equal(1, n)
+	assert.Equal(Trace{Span{SpanID: 2, Service: "web"}}, kept)
+	assert.Equal(uint64(2), kept.GetRoot().SpanID)
+}
+
+func TestTraceRenameServices(t *testing.T) {
+	assert := assert.New(t)
+
+	aliases := map[string]string{"checkout-svc": "checkout"}
+	tr := Trace{
+		Span{SpanID: 1, Service: "checkout-svc"},
+		Span{SpanID: 2, ParentID: 1, Service: "checkout"},
+		Span{SpanID: 3, ParentID: 1, Service: "db"},
+		Span{SpanID: 4, ParentID: 1, Service: "Checkout-Svc"},
+	}
+
+	// the services are normalized to be compared with the aliases
+	assert.Equal(2, tr.RenameServices(aliases))
+	assert.Equal("checkout", tr[0].Service)
+	assert.Equal("checkout", tr[1].Service)
+	assert.Equal("db", tr[2].Service)
+	assert.Equal("checkout", tr[3].Service)
+}
+
+func TestTraceSort(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := Trace{
+		Span{SpanID: 4, Start: 20},
+		Span{SpanID: 3, Start: 10},
+		Span{SpanID: 1, Start: 10},
+		Span{SpanID: 5, Start: 0},
+		Span{SpanID: 2, Start: 10},
+	}
+
+	tr.Sort()
+
+	var ids []uint64
+	for _, s := range tr {
+		ids = append(ids, s.SpanID)
+	}
+	// ties on start time are broken by span ID
+	assert.Equal([]uint64{5, 1, 2, 3, 4}, ids)
+
+	// sorting again does not change anything
+	tr.Sort()
+	assert.Equal(uint64(5), tr[0].SpanID)
+	assert.Equal(uint64(4), tr[4].SpanID)
+
+	// empty traces are fine too
+	Trace{}.Sort()
+}
+
+func TestTraceAnonymize(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Service: "billing", Name: "http.request", Resource: "GET /invoices", Start: 42, Duration: 100,
+			Meta: map[string]string{"env": "prod", "http.url": "https://internal/invoices"}, Metrics: map[string]float64{"_sample_rate": 0.5}},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "billing-db", Name: "postgres.query", Resource: "SELECT * FROM invoices", Start: 50, Duration: 20},
+		Span{TraceID: 1, SpanID: 3, ParentID: 1, Service: "billing", Name: "template.render", Resource: "", Start: 80, Duration: 10},
+	}
+
+	salt := []byte("secret")
+	anonymized := trace.Anonymize(salt, []string{"env"})
+
+	// the structure is preserved
+	assert.Len(anonymized, len(trace))
+	for i := range trace {
+		assert.Equal(trace[i].TraceID, anonymized[i].TraceID)
+		assert.Equal(trace[i].SpanID, anonymized[i].SpanID)
+		assert.Equal(trace[i].ParentID, anonymized[i].ParentID)
+		assert.Equal(trace[i].Name, anonymized[i].Name)
+		assert.Equal(trace[i].Start, anonymized[i].Start)
+		assert.Equal(trace[i].Duration, anonymized[i].Duration)
+		assert.NotEqual(trace[i].Service, anonymized[i].Service)
+	}
+	assert.Equal(trace[0].Metrics, anonymized[0].Metrics)
+
+	// the values are masked, except the allowed meta
+	assert.NotEqual("GET /invoices", anonymized[0].Resource)
+	assert.NotContains(anonymized[0].Meta["http.url"], "internal")
+	assert.Equal("prod", anonymized[0].Meta["env"])
+	assert.Equal("", anonymized[2].Resource)
+
+	// equal values stay linked
+	assert.Equal(anonymized[0].Service, anonymized[2].Service)
+	assert.NotEqual(anonymized[0].Service, anonymized[1].Service)
+	assert.Equal(anonymized, trace.Anonymize(salt, []string{"env"}))
+
+	// the hashes depend on the salt, they cannot be matched without it
+	other := trace.Anonymize([]byte("other secret"), []string{"env"})
+	assert.NotEqual(anonymized[0].Service, other[0].Service)
+	assert.Equal(other[0].Service, other[2].Service)
+
+	// the services named by the sublayer metrics are hashed like the services
+	trace[0].Metrics["_sublayers.duration.by_service.sublayer_service:billing-db"] = 20
+	trace[0].Metrics["_sublayers.duration.by_type.sublayer_type:db"] = 20
+	trace[0].Metrics["_sublayers.duration.by_caller.sublayer_call:billing>billing-db"] = 20
+	trace[0].Metrics["_sublayers.duration.by_service_error.sublayer_service_error:billing-db/ok"] = 20
+	anonymized = trace.Anonymize(salt, []string{"env"})
+	db, billing := anonymized[1].Service, anonymized[0].Service
+	assert.Equal(map[string]float64{
+		"_sample_rate": 0.5,
+		"_sublayers.duration.by_service.sublayer_service:" + db:                     20,
+		"_sublayers.duration.by_type.sublayer_type:db":                              20,
+		"_sublayers.duration.by_caller.sublayer_call:" + billing + ">" + db:         20,
+		"_sublayers.duration.by_service_error.sublayer_service_error:" + db + "/ok": 20,
+	}, anonymized[0].Metrics)
+
+	// the original trace is untouched
+	assert.Equal("billing", trace[0].Service)
+	assert.Contains(trace[0].Metrics, "_sublayers.duration.by_service.sublayer_service:billing-db")
+	assert.Equal("https://internal/invoices", trace[0].Meta["http.url"])
+}
+
+func TestTraceTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	//  1 ----------------------------------------------
+	//    2 ---------------------   5 --------
+	//      3 -------   4 --          6 ---
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 6, ParentID: 5, Start: 55, Duration: 10},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: 10, Duration: 40},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Start: 15, Duration: 20},
+		Span{TraceID: 1, SpanID: 1, Start: 0, Duration: 100},
+		Span{TraceID: 1, SpanID: 4, ParentID: 2, Start: 40, Duration: 5},
+		Span{TraceID: 1, SpanID: 5, ParentID: 1, Start: 50, Duration: 30},
+	}
+
+	// small enough traces are untouched
+	truncated, dropped := trace.Truncate(6)
+	assert.Equal(trace, truncated)
+	assert.Equal(0, dropped)
+	truncated, dropped = trace.Truncate(0)
+	assert.Equal(trace, truncated)
+	assert.Equal(0, dropped)
+
+	spanIDs := func(t Trace) []uint64 {
+		var ids []uint64
+		for _, s := range t {
+			ids = append(ids, s.SpanID)
+		}
+		return ids
+	}
+
+	// the critical path is kept first
+	truncated, dropped = trace.Truncate(3)
+	assert.Equal(3, dropped)
+	assert.Equal([]uint64{2, 3, 1}, spanIDs(truncated))
+
+	// then the longest spans closest to the root
+	truncated, dropped = trace.Truncate(4)
+	assert.Equal(2, dropped)
+	assert.Equal([]uint64{2, 3, 1, 5}, spanIDs(truncated))
+
+	truncated, dropped = trace.Truncate(5)
+	assert.Equal(1, dropped)
+	assert.Equal([]uint64{2, 3, 1, 4, 5}, spanIDs(truncated))
+
+	// every kept span still has its parent
+	for max := 1; max < len(trace); max++ {
+		truncated, _ := trace.Truncate(max)
+		assert.Len(truncated, max)
+		kept := make(map[uint64]struct{})
+		for _, s := range truncated {
+			kept[s.SpanID] = struct{}{}
+		}
+		for _, s := range truncated {
+			if s.ParentID != 0 {
+				_, ok := kept[s.ParentID]
+				assert.True(ok, "parent of span %d missing with max %d", s.SpanID, max)
+			}
+		}
+	}
+}
+
+func TestTraceDropDuplicateSpanIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Service: "a"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "b"},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Service: "c"},
+	}
+
+	// traces without duplicates are untouched
+	dedup, dropped := trace.DropDuplicateSpanIDs()
+	assert.Equal(trace, dedup)
+	assert.Equal(0, dropped)
+
+	trace = append(trace,
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "d"},
+		Span{TraceID: 1, SpanID: 4, ParentID: 2, Service: "e"},
+		Span{TraceID: 1, SpanID: 1, Service: "f"},
+	)
+	dedup, dropped = trace.DropDuplicateSpanIDs()
+	assert.Equal(2, dropped)
+	assert.Equal(Trace{trace[0], trace[1], trace[2], trace[4]}, dedup)
+}
+
+func TestTraceOversizedResources(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Resource: "GET /"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Resource: strings.Repeat("SELECT ", 100)},
+		Span{TraceID: 1, SpanID: 3, ParentID: 1, Resource: "0123456789"},
+	}
+
+	assert.Equal(1, trace.OversizedResources(10))
+	assert.Equal(2, trace.OversizedResources(9))
+	assert.Equal(0, trace.OversizedResources(1000))
+
+	assert.Equal(1, trace.TruncateResources(10))
+	assert.Equal("GET /", trace[0].Resource)
+	assert.Equal("SELECT SEL", trace[1].Resource)
+	assert.Equal("0123456789", trace[2].Resource)
+	assert.Equal(0, trace.OversizedResources(10))
+}
+
+func TestTraceProjectMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Service: "web", Meta: map[string]string{"env": "prod", "http.url": "/users/1", "user.id": "1"}},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Meta: map[string]string{"sql.query": "SELECT"}},
+		Span{TraceID: 1, SpanID: 3, ParentID: 1, Service: "cache", Metrics: map[string]float64{"hits": 1}},
+	}
+
+	projected := trace.ProjectMeta(map[string]struct{}{"env": struct{}{}, "http.url": struct{}{}})
+
+	assert.Equal(map[string]string{"env": "prod", "http.url": "/users/1"}, projected[0].Meta)
+	assert.Equal(map[string]string{}, projected[1].Meta)
+	assert.Nil(projected[2].Meta)
+
+	// the structural fields and the metrics are kept
+	for i := range trace {
+		assert.Equal(trace[i].SpanID, projected[i].SpanID)
+		assert.Equal(trace[i].ParentID, projected[i].ParentID)
+		assert.Equal(trace[i].Service, projected[i].Service)
+		assert.Equal(trace[i].Metrics, projected[i].Metrics)
+	}
+
+	// the original trace is untouched
+	assert.Equal("1", trace[0].Meta["user.id"])
+	assert.Equal("SELECT", trace[1].Meta["sql.query"])
+}
+
+func TestTraceDropSpansEndedBefore(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Start: 0, Duration: 100},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: 0, Duration: 10},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Start: 0, Duration: 60},
+		Span{TraceID: 1, SpanID: 4, ParentID: 1, Start: 50, Duration: 10},
+	}
+
+	kept, dropped := trace.DropSpansEndedBefore(50)
+	assert.Equal(1, dropped)
+	assert.Len(kept, 3)
+	// the child of the dropped span is attached to its parent
+	assert.Equal(uint64(3), kept[1].SpanID)
+	assert.Equal(uint64(1), kept[1].ParentID)
+
+	kept, dropped = trace.DropSpansEndedBefore(0)
+	assert.Equal(0, dropped)
+	assert.Equal(trace, kept)
+}
+
+func TestTraceLowercaseNames(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Name: "HTTP.Request"},
+		Span{TraceID: 1, SpanID: 2, Name: "db.query", Meta: map[string]string{"sql.query": "SELECT"}},
+		Span{TraceID: 1, SpanID: 3, Name: "Cache.Get", Meta: map[string]string{"key": "users"}},
+	}
+	assert.Equal(2, trace.LowercaseNames())
+
+	assert.Equal("http.request", trace[0].Name)
+	assert.Equal(map[string]string{OriginalNameMetaKey: "HTTP.Request"}, trace[0].Meta)
+	assert.Equal("db.query", trace[1].Name)
+	assert.Equal(map[string]string{"sql.query": "SELECT"}, trace[1].Meta)
+	assert.Equal("cache.get", trace[2].Name)
+	assert.Equal("Cache.Get", trace[2].Meta[OriginalNameMetaKey])
+
+	assert.Equal(0, trace.LowercaseNames())
+}
+
+func TestTraceSetDefaultEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db"},
+		Span{TraceID: 1, SpanID: 1, Service: "web"},
+	}
+	assert.True(trace.SetDefaultEnv("staging"))
+	assert.Equal("staging", trace[1].Meta["env"])
+	assert.Nil(trace[0].Meta)
+
+	// the env of any span wins
+	trace = Trace{
+		Span{TraceID: 1, SpanID: 1, Service: "web"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "db", Meta: map[string]string{"env": "prod"}},
+	}
+	assert.False(trace.SetDefaultEnv("staging"))
+	assert.Equal("prod", trace.GetEnv())
+	assert.Nil(trace[0].Meta)
+
+	assert.False(Trace{}.SetDefaultEnv("staging"))
+}
+
+func TestTraceClockSkewedSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Start: 100, Duration: 100},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: 100, Duration: 100},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Start: 150, Duration: 10},
+		// parent missing from the trace, nothing to compare to
+		Span{TraceID: 1, SpanID: 4, ParentID: 42, Start: 0, Duration: 10},
+	}
+	assert.Equal(0, trace.ClockSkewedSpans())
+
+	trace = append(trace,
+		// starts before its parent
+		Span{TraceID: 1, SpanID: 5, ParentID: 1, Start: 90, Duration: 20},
+		// ends after its parent
+		Span{TraceID: 1, SpanID: 6, ParentID: 2, Start: 190, Duration: 20},
+	)
+	assert.Equal(2, trace.ClockSkewedSpans())
+	assert.Equal(0, Trace{}.ClockSkewedSpans())
+}
+
+func TestTraceMixedEnvSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Meta: map[string]string{"env": "prod"}},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1},
+		Span{TraceID: 1, SpanID: 3, ParentID: 1, Meta: map[string]string{"env": "prod"}},
+	}
+	assert.Equal(0, trace.MixedEnvSpans("prod"))
+
+	trace = append(trace,
+		Span{TraceID: 1, SpanID: 4, ParentID: 1, Meta: map[string]string{"env": "staging"}},
+		Span{TraceID: 1, SpanID: 5, ParentID: 4, Meta: map[string]string{"env": ""}},
+	)
+	assert.Equal(2, trace.MixedEnvSpans("prod"))
+	assert.Equal(0, Trace{}.MixedEnvSpans("prod"))
+}
+
+func TestTraceSplitZeroTraceIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Service: "a"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "b"},
+	}
+
+	// traces without zero trace IDs are untouched
+	traces, zero := trace.SplitZeroTraceIDs()
+	assert.Equal(Traces{trace}, traces)
+	assert.Equal(0, zero)
+
+	trace = append(trace,
+		Span{TraceID: 0, SpanID: 3, ParentID: 1, Service: "c"},
+		Span{TraceID: 0, SpanID: 4, Service: "d"},
+	)
+	traces, zero = trace.SplitZeroTraceIDs()
+	assert.Equal(2, zero)
+	assert.Len(traces, 3)
+	assert.Equal(Trace{trace[0], trace[1]}, traces[0])
+
+	ids := map[uint64]struct{}{1: struct{}{}}
+	for i, t := range traces[1:] {
+		assert.Len(t, 1)
+		assert.Equal(trace[2+i].SpanID, t[0].SpanID)
+		assert.Equal(trace[2+i].Service, t[0].Service)
+		assert.NotEqual(uint64(0), t[0].TraceID)
+		ids[t[0].TraceID] = struct{}{}
+	}
+	// every span gets its own trace ID
+	assert.Len(ids, 3)
+	// and the original trace is left untouched
+	assert.Equal(uint64(0), trace[2].TraceID)
+
+	// traces made only of zero trace IDs are fully split
+	traces, zero = Trace{trace[2], trace[3]}.SplitZeroTraceIDs()
+	assert.Equal(2, zero)
+	assert.Len(traces, 2)
+}
+
+func TestTraceIdleTime(t *testing.T) {
+	assert := assert.New(t)
+
+	// a root on [0, 100] with children on [10, 30], [15, 25], [40, 60], [50, 70] and [95, 120]
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Start: 0, Duration: 100},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: 10, Duration: 20},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Start: 15, Duration: 10},
+		Span{TraceID: 1, SpanID: 4, ParentID: 1, Start: 50, Duration: 20},
+		Span{TraceID: 1, SpanID: 5, ParentID: 1, Start: 40, Duration: 20},
+		// async span finishing after the root, only its part within it counts
+		Span{TraceID: 1, SpanID: 6, ParentID: 1, Start: 95, Duration: 25},
+	}
+
+	// idle during [0, 10], [30, 40] and [70, 95]
+	assert.Equal(int64(10+10+25), trace.IdleTime())
+
+	// a root alone is always idle
+	assert.Equal(int64(100), Trace{trace[0]}.IdleTime())
+	assert.Equal(int64(0), Trace{}.IdleTime())
+}
+
+func TestTraceWallDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Start: 10, Duration: 20},
+		Span{TraceID: 1, SpanID: 1, Start: 5, Duration: 100},
+		// async span finishing after the root
+		Span{TraceID: 1, SpanID: 3, ParentID: 1, Start: 95, Duration: 25},
+	}
+	assert.Equal(int64(120-5), trace.WallDuration())
+	assert.Equal(int64(0), Trace{}.WallDuration())
+}
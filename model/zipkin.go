@@ -0,0 +1,95 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// zipkinUnnamed is the name given to the Zipkin spans without one
+const zipkinUnnamed = "zipkin.span"
+
+// ZipkinEndpoint is the network context of a node in a Zipkin span
+type ZipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+	IPv4        string `json:"ipv4"`
+	IPv6        string `json:"ipv6"`
+	Port        int    `json:"port"`
+}
+
+// ZipkinSpan is a span in the Zipkin v2 JSON format
+type ZipkinSpan struct {
+	TraceID        string            `json:"traceId"`
+	ID             string            `json:"id"`
+	ParentID       string            `json:"parentId"`
+	Name           string            `json:"name"`
+	Kind           string            `json:"kind"`
+	Timestamp      int64             `json:"timestamp"` // epoch in microseconds
+	Duration       int64             `json:"duration"`  // in microseconds
+	LocalEndpoint  *ZipkinEndpoint   `json:"localEndpoint"`
+	RemoteEndpoint *ZipkinEndpoint   `json:"remoteEndpoint"`
+	Tags           map[string]string `json:"tags"`
+}
+
+// ToSpan converts a Zipkin span to a span. Zipkin spans have no resource, they
+// get their name as resource, and their kind is set as the span.kind meta, so
+// that they get the type of their kind. 128-bit trace IDs are truncated to
+// their lower 64 bits.
+func (zs ZipkinSpan) ToSpan() (Span, error) {
+	var s Span
+	var err error
+
+	if s.TraceID, err = parseHexID(zs.TraceID); err != nil {
+		return s, fmt.Errorf("invalid trace ID %q: %v", zs.TraceID, err)
+	}
+	if s.SpanID, err = parseHexID(zs.ID); err != nil {
+		return s, fmt.Errorf("invalid span ID %q: %v", zs.ID, err)
+	}
+	if zs.ParentID != "" {
+		if s.ParentID, err = parseHexID(zs.ParentID); err != nil {
+			return s, fmt.Errorf("invalid parent ID %q: %v", zs.ParentID, err)
+		}
+	}
+
+	s.Name = zs.Name
+	if s.Name == "" {
+		s.Name = zipkinUnnamed
+	}
+	s.Resource = s.Name
+	if zs.LocalEndpoint != nil {
+		s.Service = zs.LocalEndpoint.ServiceName
+	}
+	s.Start = zs.Timestamp * 1000
+	s.Duration = zs.Duration * 1000
+
+	s.Meta = make(map[string]string, len(zs.Tags)+2)
+	for k, v := range zs.Tags {
+		s.Meta[k] = v
+	}
+	if _, ok := zs.Tags["error"]; ok {
+		// Zipkin flags errors with this tag, its value being the error message
+		s.Error = 1
+	}
+	if zs.Kind != "" {
+		s.Meta[SpanKindMetaKey] = strings.ToLower(zs.Kind)
+	}
+	if zs.RemoteEndpoint != nil && zs.RemoteEndpoint.ServiceName != "" {
+		if _, ok := s.Meta["peer.service"]; !ok {
+			s.Meta["peer.service"] = zs.RemoteEndpoint.ServiceName
+		}
+	}
+
+	return s, nil
+}
+
+// TracesFromZipkinSpans converts Zipkin spans to spans and groups them by trace.
+func TracesFromZipkinSpans(zspans []ZipkinSpan) (Traces, error) {
+	spans := make([]Span, 0, len(zspans))
+	for _, zs := range zspans {
+		s, err := zs.ToSpan()
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, s)
+	}
+	return TracesFromSpans(spans), nil
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZipkinSpanToSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	var zs ZipkinSpan
+	assert.Nil(json.Unmarshal([]byte(`{
+		"traceId": "463ac35c9f6413ad48485a3953bb6124",
+		"id": "a2fb4a1d1a96d312",
+		"parentId": "48485a3953bb6124",
+		"name": "get /api",
+		"kind": "CLIENT",
+		"timestamp": 1472470996199000,
+		"duration": 207000,
+		"localEndpoint": {"serviceName": "frontend", "ipv4": "192.168.99.1", "port": 3306},
+		"remoteEndpoint": {"serviceName": "backend"},
+		"tags": {"http.method": "GET", "http.path": "/api", "error": "timeout"}
+	}`), &zs))
+
+	s, err := zs.ToSpan()
+	assert.Nil(err)
+	assert.Equal(uint64(0x48485a3953bb6124), s.TraceID)
+	assert.Equal(uint64(0xa2fb4a1d1a96d312), s.SpanID)
+	assert.Equal(uint64(0x48485a3953bb6124), s.ParentID)
+	assert.Equal("frontend", s.Service)
+	assert.Equal("get /api", s.Name)
+	assert.Equal("get /api", s.Resource)
+	assert.Equal(int64(1472470996199000000), s.Start)
+	assert.Equal(int64(207000000), s.Duration)
+	assert.Equal(int32(1), s.Error)
+	assert.Equal(map[string]string{
+		"http.method":   "GET",
+		"http.path":     "/api",
+		"error":         "timeout",
+		SpanKindMetaKey: "client",
+		"peer.service":  "backend",
+	}, s.Meta)
+
+	// the type comes from the kind
+	s.SetTypeFromKind(DefaultSpanKindTypes)
+	assert.Equal("http", s.Type)
+
+	// minimal span
+	s, err = ZipkinSpan{TraceID: "1", ID: "2"}.ToSpan()
+	assert.Nil(err)
+	assert.Equal(uint64(1), s.TraceID)
+	assert.Equal(uint64(0), s.ParentID)
+	assert.Equal(zipkinUnnamed, s.Name)
+	assert.Equal(int32(0), s.Error)
+
+	for _, zs := range []ZipkinSpan{
+		{TraceID: "xyz", ID: "2"},
+		{TraceID: "zz3ac35c9f6413ad48485a3953bb6124", ID: "2"},
+		{TraceID: "1", ID: "463ac35c9f6413ad48485a3953bb6124ab"},
+		{TraceID: "1", ID: "2", ParentID: "-1"},
+	} {
+		_, err := zs.ToSpan()
+		assert.NotNil(err)
+	}
+}
+
+func TestTracesFromZipkinSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	traces, err := TracesFromZipkinSpans([]ZipkinSpan{
+		{TraceID: "a", ID: "1", Name: "get", LocalEndpoint: &ZipkinEndpoint{ServiceName: "web"}},
+		{TraceID: "b", ID: "3", Name: "get", LocalEndpoint: &ZipkinEndpoint{ServiceName: "web"}},
+		{TraceID: "a", ID: "2", ParentID: "1", Name: "query", LocalEndpoint: &ZipkinEndpoint{ServiceName: "db"}},
+	})
+	assert.Nil(err)
+	assert.Len(traces, 2)
+	for _, t := range traces {
+		if t[0].TraceID == 0xa {
+			assert.Len(t, 2)
+		} else {
+			assert.Len(t, 1)
+		}
+	}
+
+	_, err = TracesFromZipkinSpans([]ZipkinSpan{{TraceID: "a", ID: "1"}, {TraceID: "a", ID: "x"}})
+	assert.NotNil(err)
+}
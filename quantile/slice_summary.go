@@ -38,9 +38,15 @@ func (s SliceSummary) String() string {
 
 // Insert inserts a new value v in the summary paired with t (the ID of the span it was reported from)
 func (s *SliceSummary) Insert(v float64, t uint64) {
+	s.InsertN(v, t, 1)
+}
+
+// InsertN inserts a new value v in the summary paired with t, as if it had
+// been inserted n times. n must be positive.
+func (s *SliceSummary) InsertN(v float64, t uint64, n int) {
 	newEntry := Entry{
 		V:     v,
-		G:     1,
+		G:     n,
 		Delta: int(2 * EPSILON * float64(s.N)),
 	}
 
@@ -54,9 +60,11 @@ func (s *SliceSummary) Insert(v float64, t uint64) {
 	s.Entries = append(s.Entries, Entry{})
 	copy(s.Entries[i+1:], s.Entries[i:])
 	s.Entries[i] = newEntry
-	s.N++
+	s.N += n
 
-	if s.N%int(1.0/float64(2.0*EPSILON)) == 0 {
+	// compress every time N goes past a multiple of the compression period
+	period := int(1.0 / float64(2.0*EPSILON))
+	if s.N/period != (s.N-n)/period {
 		s.compress()
 	}
 }
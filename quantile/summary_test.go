@@ -354,3 +354,31 @@ func TestSummaryBySlices(t *testing.T) {
 		}
 	}
 }
+
+func TestSliceSummaryInsertN(t *testing.T) {
+	assert := assert.New(t)
+
+	weighted := NewSliceSummary()
+	repeated := NewSliceSummary()
+	for i := 0; i < 10000; i++ {
+		n := 1 + i%5
+		weighted.InsertN(float64(i), uint64(i), n)
+		for j := 0; j < n; j++ {
+			repeated.Insert(float64(i), uint64(i))
+		}
+	}
+
+	assert.Equal(repeated.N, weighted.N)
+	for _, q := range testQuantiles {
+		// both are epsilon-approximate over the same N values
+		assert.InDelta(repeated.Quantile(q), weighted.Quantile(q), 2*EPSILON*10000, "quantile %f", q)
+	}
+
+	// a value inserted n times weighs n times more in the ranks
+	s := NewSliceSummary()
+	s.InsertN(1, 1, 3)
+	s.InsertN(2, 2, 1)
+	assert.Equal(4, s.N)
+	assert.Equal(1.0, s.Quantile(0.5))
+	assert.Equal(2.0, s.Quantile(1))
+}
@@ -4,8 +4,17 @@ import (
 	"math"
 )
 
+const (
+	// minKeepRate is the lowest keep rate a signature can be given to reach the target rate
+	minKeepRate = 0.0001
+	// maxKeepRateStep bounds the factor a keep rate is multiplied or divided by on each adjustment
+	maxKeepRateStep = 2.0
+)
+
 // AdjustScoring modifies sampler coefficients to fit better the `maxTPS` condition
 func (s *Sampler) AdjustScoring() {
+	s.adjustKeepRates()
+
 	currentTPS := s.Backend.GetSampledScore()
 	totalTPS := s.Backend.GetTotalScore()
 	offset := s.signatureScoreOffset
@@ -65,3 +74,33 @@ func adjustCoefficients(currentTPS, totalTPS, maxTPS, offset, cardinality float6
 
 	return newOffset, newSlope
 }
+
+// adjustKeepRates moves the keep rate of each signature towards the one which
+// makes its sampled rate, as counted by the backend, reach the target rate.
+// Signatures not seen anymore are forgotten.
+func (s *Sampler) adjustKeepRates() {
+	if s.targetRate <= 0 {
+		return
+	}
+
+	s.keepRatesMu.Lock()
+	defer s.keepRatesMu.Unlock()
+
+	for signature, rate := range s.keepRates {
+		if s.Backend.GetSignatureScore(signature) == 0 {
+			delete(s.keepRates, signature)
+			continue
+		}
+		s.keepRates[signature] = adjustKeepRate(rate, s.Backend.GetSignatureSampledRate(signature), s.targetRate)
+	}
+}
+
+// adjustKeepRate returns the keep rate which should bring the observed rate to
+// the target, if both are proportional, by steps of at most maxKeepRateStep.
+func adjustKeepRate(rate, observed, target float64) float64 {
+	factor := maxKeepRateStep
+	if observed > 0 {
+		factor = math.Max(math.Min(target/observed, maxKeepRateStep), 1/maxKeepRateStep)
+	}
+	return math.Max(math.Min(rate*factor, 1), minKeepRate)
+}
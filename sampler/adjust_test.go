@@ -30,3 +30,55 @@ func TestAdjustCoefficients(t *testing.T) {
 		}
 	}
 }
+
+func TestAdjustKeepRate(t *testing.T) {
+	assert := assert.New(t)
+
+	// proportional correction, by bounded steps
+	assert.InDelta(0.2, adjustKeepRate(0.1, 0.05, 0.1), 1e-9)
+	assert.InDelta(0.2, adjustKeepRate(0.1, 0.01, 0.1), 1e-9)
+	assert.InDelta(0.05, adjustKeepRate(0.1, 0.5, 0.1), 1e-9)
+	assert.InDelta(0.2, adjustKeepRate(0.1, 0, 0.1), 1e-9)
+
+	// within [minKeepRate, 1]
+	assert.Equal(1.0, adjustKeepRate(0.8, 0.1, 0.5))
+	assert.Equal(minKeepRate, adjustKeepRate(minKeepRate, 1, 0.1))
+}
+
+func TestSignatureTargetRate(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	target := 0.1
+	s.UpdateTargetRate(target)
+
+	// the clients already keep half of the traces, which halves the rate
+	// observed with a keep rate equal to the target
+	var sampled, total int
+	for period := 0; period < 40; period++ {
+		s.Backend.DecayScore()
+		for i := 0; i < 2000; i++ {
+			trace, root := getTestTrace()
+			SetTraceAppliedSampleRate(root, 0.5)
+			kept := s.Sample(trace, root, defaultEnv)
+			if period >= 30 {
+				total++
+				if kept {
+					sampled++
+				}
+			}
+		}
+		if period == 0 {
+			trace, root := getTestTrace()
+			assert.InDelta(target/2, s.Backend.GetSignatureSampledRate(ComputeSignatureWithRootAndEnv(trace, root, defaultEnv)), 0.02)
+		}
+		s.AdjustScoring()
+	}
+
+	// the keep rate converged towards the one compensating the client sampling
+	trace, root := getTestTrace()
+	signature := ComputeSignatureWithRootAndEnv(trace, root, defaultEnv)
+	assert.InDelta(2*target, s.keepRates[signature], 0.03)
+	assert.InDelta(target, float64(sampled)/float64(total), 0.015)
+	assert.InDelta(target, s.Backend.GetSignatureSampledRate(signature), 0.015)
+}
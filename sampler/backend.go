@@ -1,8 +1,12 @@
 package sampler
 
 import (
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/DataDog/datadog-trace-agent/statsd"
 )
 
 // Backend storing any state required to run the sampling algorithms.
@@ -17,7 +21,15 @@ type Backend struct {
 	totalScore float64
 	// Score of sampled traces
 	sampledScore float64
-	mu           sync.Mutex
+	// Score of sampled traces per signature
+	sampledScores map[Signature]float64
+	// Number of error traces sampled per signature since the last decay
+	errorSamples map[Signature]int
+	// Last time each signature was counted
+	lastSeen map[Signature]time.Time
+	// Maximum score of a signature, normalized like GetSignatureScore, 0 for no limit
+	maxSignatureScore float64
+	mu                sync.Mutex
 
 	// Every decayPeriod, decay the score
 	// Lower value is more reactive, but forgets quicker
@@ -31,7 +43,25 @@ type Backend struct {
 	// its immediate count will be increased by N / countScaleFactor.
 	countScaleFactor float64
 
-	exit chan struct{}
+	// Unix nanosecond timestamp of the last decay, accessed atomically so that
+	// it can be read without taking the lock
+	lastDecay int64
+
+	// functions called after each decay tick
+	decayHooks []func()
+
+	// signals the Run loop that decayPeriod changed
+	decayPeriodUpdate chan struct{}
+	exit              chan struct{}
+}
+
+// BackendStats is a snapshot of the state of a Backend
+type BackendStats struct {
+	TotalScore   float64
+	SampledScore float64
+	Cardinality  int64
+	// LastSeen is the last time each signature was counted
+	LastSeen map[Signature]time.Time
 }
 
 // NewBackend returns an initialized Backend
@@ -43,22 +73,36 @@ func NewBackend(decayPeriod time.Duration) *Backend {
 	return &Backend{
 		scores:           make(map[Signature]float64),
 		sampledScore:     0,
+		sampledScores:    make(map[Signature]float64),
+		errorSamples:     make(map[Signature]int),
+		lastSeen:         make(map[Signature]time.Time),
 		decayPeriod:      decayPeriod,
 		decayFactor:      decayFactor,
 		countScaleFactor: (decayFactor / (decayFactor - 1)) * decayPeriod.Seconds(),
-		exit:             make(chan struct{}),
+		lastDecay:        time.Now().UnixNano(),
+
+		decayPeriodUpdate: make(chan struct{}, 1),
+		exit:              make(chan struct{}),
 	}
 }
 
 // Run runs and block on the Sampler main loop
 func (b *Backend) Run() {
-	t := time.NewTicker(b.decayPeriod)
-	defer t.Stop()
+	t := time.NewTicker(b.DecayPeriod())
+	defer func() { t.Stop() }()
 
 	for {
 		select {
 		case <-t.C:
 			b.DecayScore()
+		case <-b.decayPeriodUpdate:
+			t.Stop()
+			period := b.DecayPeriod()
+			// don't drop the tick which would have happened with the new period
+			if time.Since(b.LastDecay()) >= period {
+				b.DecayScore()
+			}
+			t = time.NewTicker(period)
 		case <-b.exit:
 			return
 		}
@@ -70,11 +114,30 @@ func (b *Backend) Stop() {
 	close(b.exit)
 }
 
-// CountSignature counts an incoming signature
+// CountSignature counts an incoming signature. Its score is capped to the
+// maximum signature score, if any.
 func (b *Backend) CountSignature(signature Signature) {
 	b.mu.Lock()
-	b.scores[signature]++
-	b.totalScore++
+	inc := 1.0
+	if b.maxSignatureScore > 0 {
+		// the maximum is normalized, scale it back to raw counts
+		max := b.maxSignatureScore * b.countScaleFactor
+		if score := b.scores[signature]; score+inc > max {
+			inc = math.Max(max-score, 0)
+		}
+	}
+	b.scores[signature] += inc
+	b.totalScore += inc
+	b.lastSeen[signature] = time.Now()
+	b.mu.Unlock()
+}
+
+// SetMaxSignatureScore sets the maximum score of a single signature, in traces
+// per second like GetSignatureScore, so that a flood of traces of one signature
+// does not take the whole score. 0 means no limit.
+func (b *Backend) SetMaxSignatureScore(max float64) {
+	b.mu.Lock()
+	b.maxSignatureScore = max
 	b.mu.Unlock()
 }
 
@@ -85,6 +148,30 @@ func (b *Backend) CountSample() {
 	b.mu.Unlock()
 }
 
+// CountSampleForSignature counts a trace of the given signature sampled by the sampler
+func (b *Backend) CountSampleForSignature(signature Signature) {
+	b.mu.Lock()
+	b.sampledScores[signature]++
+	b.mu.Unlock()
+}
+
+// CountErrorSample counts an error trace sampled by the sampler for the given signature
+func (b *Backend) CountErrorSample(signature Signature) {
+	b.mu.Lock()
+	b.errorSamples[signature]++
+	b.mu.Unlock()
+}
+
+// GetErrorSampleCount returns the number of error traces sampled for a signature
+// since the last decay.
+func (b *Backend) GetErrorSampleCount(signature Signature) int {
+	b.mu.Lock()
+	count := b.errorSamples[signature]
+	b.mu.Unlock()
+
+	return count
+}
+
 // GetSignatureScore returns the score of a signature.
 // It is normalized to represent a number of signatures per second.
 func (b *Backend) GetSignatureScore(signature Signature) float64 {
@@ -104,6 +191,20 @@ func (b *Backend) GetSampledScore() float64 {
 	return score
 }
 
+// GetSignatureSampledRate returns the ratio of the traces of a signature which
+// were sampled, or 0 if the signature was not seen recently.
+func (b *Backend) GetSignatureSampledRate(signature Signature) float64 {
+	b.mu.Lock()
+	score := b.scores[signature]
+	sampled := b.sampledScores[signature]
+	b.mu.Unlock()
+
+	if score == 0 {
+		return 0
+	}
+	return math.Min(sampled/score, 1)
+}
+
 // GetTotalScore returns the global score of all sampled traces.
 func (b *Backend) GetTotalScore() float64 {
 	b.mu.Lock()
@@ -128,19 +229,242 @@ func (b *Backend) GetCardinality() int64 {
 	return cardinality
 }
 
-// DecayScore applies the decay to the rolling counters
+// Stats returns a snapshot of the state of the backend.
+func (b *Backend) Stats() BackendStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lastSeen := make(map[Signature]time.Time, len(b.lastSeen))
+	for sig, t := range b.lastSeen {
+		lastSeen[sig] = t
+	}
+
+	return BackendStats{
+		TotalScore:   b.totalScore / b.countScaleFactor,
+		SampledScore: b.sampledScore / b.countScaleFactor,
+		Cardinality:  int64(len(b.scores)),
+		LastSeen:     lastSeen,
+	}
+}
+
+// DecayScore applies the decay to the rolling counters, and reports the number
+// of signatures tracked, to follow the memory used by the backend over time, and
+// the number of signatures evicted because their score decayed to almost 0, to
+// follow their churn.
 func (b *Backend) DecayScore() {
 	b.mu.Lock()
+	evicted := b.decay(b.decayFactor)
+	statsd.Client.Gauge("datadog.trace_agent.sampler.signatures", float64(len(b.scores)), nil, 1)
+	statsd.Client.Count("datadog.trace_agent.sampler.signatures_evicted", int64(evicted), nil, 1)
+	hooks := b.decayHooks
+	b.mu.Unlock()
+
+	atomic.StoreInt64(&b.lastDecay, time.Now().UnixNano())
+
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// OnDecay registers a function called after each decay of the scores by
+// DecayScore, outside of the backend lock. It lets periodic housekeeping ride
+// on the decay tick instead of running its own goroutine.
+func (b *Backend) OnDecay(f func()) {
+	b.mu.Lock()
+	b.decayHooks = append(b.decayHooks, f)
+	b.mu.Unlock()
+}
+
+// LastDecay returns the time of the last decay of the scores. It does not take
+// the backend lock, so it is cheap enough to be used by health checks.
+func (b *Backend) LastDecay() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&b.lastDecay))
+}
+
+// DecayPeriod returns the period at which the scores are decayed.
+func (b *Backend) DecayPeriod() time.Duration {
+	b.mu.Lock()
+	period := b.decayPeriod
+	b.mu.Unlock()
+
+	return period
+}
+
+// CountScaleFactor returns the factor by which the raw scores are divided to get
+// the normalized ones returned by GetSignatureScore and the like, expressed in
+// traces per second. It is derived from the decay parameters:
+// countScaleFactor = (decayFactor / (decayFactor - 1)) * decayPeriod in seconds,
+// so that a steady flow of 1 trace per second converges to a score of 1.
+func (b *Backend) CountScaleFactor() float64 {
+	b.mu.Lock()
+	factor := b.countScaleFactor
+	b.mu.Unlock()
+
+	return factor
+}
+
+// SetDecayPeriod changes the period at which the scores are decayed, a shorter
+// period making the sampler more reactive. The scores are rescaled so that they
+// keep representing the same number of traces per second, and the Run loop, if
+// any, switches to the new period.
+func (b *Backend) SetDecayPeriod(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	ratio := d.Seconds() / b.decayPeriod.Seconds()
+	for sig := range b.scores {
+		b.scores[sig] *= ratio
+	}
+	for sig := range b.sampledScores {
+		b.sampledScores[sig] *= ratio
+	}
+	b.totalScore *= ratio
+	b.sampledScore *= ratio
+	b.decayPeriod = d
+	b.countScaleFactor = (b.decayFactor / (b.decayFactor - 1)) * d.Seconds()
+	b.mu.Unlock()
+
+	select {
+	case b.decayPeriodUpdate <- struct{}{}:
+	default:
+		// an update is already pending, it will pick this period
+	}
+}
+
+// DecayN applies the decay to the rolling counters n times at once, as if
+// DecayScore had been called n times in a row. This is typically used to age
+// scores restored from a snapshot by the time elapsed since it was taken.
+func (b *Backend) DecayN(n int) {
+	if n <= 0 {
+		return
+	}
+	factor := math.Pow(b.decayFactor, float64(n))
+
+	b.mu.Lock()
+	b.decay(factor)
+	b.mu.Unlock()
+}
+
+// Reset clears all the counters of the backend, as if it had just been
+// created, without interrupting its Run loop.
+func (b *Backend) Reset() {
+	b.mu.Lock()
+	b.scores = make(map[Signature]float64)
+	b.totalScore = 0
+	b.sampledScore = 0
+	b.sampledScores = make(map[Signature]float64)
+	b.errorSamples = make(map[Signature]int)
+	b.lastSeen = make(map[Signature]time.Time)
+	b.mu.Unlock()
+}
+
+// backendSnapshot is a copy of the counters of a Backend, with the scores
+// normalized like GetSignatureScore so that they do not depend on its decay
+// period
+type backendSnapshot struct {
+	scores        map[Signature]float64
+	sampledScore  float64
+	sampledScores map[Signature]float64
+	errorSamples  map[Signature]int
+	lastSeen      map[Signature]time.Time
+}
+
+// snapshot returns a copy of the counters of the backend
+func (b *Backend) snapshot() backendSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := backendSnapshot{
+		scores:        make(map[Signature]float64, len(b.scores)),
+		sampledScore:  b.sampledScore / b.countScaleFactor,
+		sampledScores: make(map[Signature]float64, len(b.sampledScores)),
+		errorSamples:  make(map[Signature]int, len(b.errorSamples)),
+		lastSeen:      make(map[Signature]time.Time, len(b.lastSeen)),
+	}
+	for sig, score := range b.scores {
+		s.scores[sig] = score / b.countScaleFactor
+	}
+	for sig, score := range b.sampledScores {
+		s.sampledScores[sig] = score / b.countScaleFactor
+	}
+	for sig, n := range b.errorSamples {
+		s.errorSamples[sig] = n
+	}
+	for sig, seen := range b.lastSeen {
+		s.lastSeen[sig] = seen
+	}
+	return s
+}
+
+// Merge adds the scores of other to the ones of b, so that backends fed by
+// parallel samplers can be combined into a single view. The scores of other are
+// rescaled to the decay period of b, and the signature scores keep being capped
+// to the maximum signature score of b, if any. other is left untouched.
+func (b *Backend) Merge(other *Backend) {
+	if other == nil || other == b {
+		return
+	}
+
+	// other is copied before b is locked, so that concurrent merges of a into
+	// b and of b into a never hold both locks
+	s := other.snapshot()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var max float64
+	if b.maxSignatureScore > 0 {
+		max = b.maxSignatureScore * b.countScaleFactor
+	}
+	for sig, score := range s.scores {
+		inc := score * b.countScaleFactor
+		if max > 0 {
+			inc = math.Max(math.Min(b.scores[sig]+inc, max)-b.scores[sig], 0)
+		}
+		b.scores[sig] += inc
+		b.totalScore += inc
+	}
+	for sig, score := range s.sampledScores {
+		b.sampledScores[sig] += score * b.countScaleFactor
+	}
+	for sig, n := range s.errorSamples {
+		b.errorSamples[sig] += n
+	}
+	for sig, seen := range s.lastSeen {
+		if seen.After(b.lastSeen[sig]) {
+			b.lastSeen[sig] = seen
+		}
+	}
+	b.sampledScore += s.sampledScore * b.countScaleFactor
+}
+
+// decay divides the rolling counters by the given factor, it must be called
+// with the lock held. It returns the number of signatures evicted.
+func (b *Backend) decay(factor float64) (evicted int) {
 	for sig := range b.scores {
 		score := b.scores[sig]
-		if score > b.decayFactor*minSignatureScoreOffset {
-			b.scores[sig] /= b.decayFactor
+		if score > factor*minSignatureScoreOffset {
+			b.scores[sig] /= factor
 		} else {
 			// When the score is too small, we can optimize by simply dropping the entry
 			delete(b.scores, sig)
+			delete(b.lastSeen, sig)
+			evicted++
 		}
 	}
-	b.totalScore /= b.decayFactor
-	b.sampledScore /= b.decayFactor
-	b.mu.Unlock()
+	// sampled scores are decayed together with the scores of their signatures
+	for sig := range b.sampledScores {
+		if _, ok := b.scores[sig]; ok {
+			b.sampledScores[sig] /= factor
+		} else {
+			delete(b.sampledScores, sig)
+		}
+	}
+	b.totalScore /= factor
+	b.sampledScore /= factor
+	// error samples are only tracked per decay period
+	b.errorSamples = make(map[Signature]int)
+	return evicted
 }
@@ -0,0 +1,115 @@
+package sampler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// scoresExportVersion is the version of the format written by ExportJSON, to be
+// bumped on any incompatible change
+const scoresExportVersion = 1
+
+// scoresExport is the format written by ExportJSON, see there
+type scoresExport struct {
+	Version      int               `json:"version"`
+	ExportedAt   time.Time         `json:"exported_at"`
+	DecayPeriod  float64           `json:"decay_period_seconds"`
+	TotalScore   float64           `json:"total_score"`
+	SampledScore float64           `json:"sampled_score"`
+	Signatures   []signatureExport `json:"signatures"`
+}
+
+// signatureExport is the state of a signature in a scoresExport
+type signatureExport struct {
+	Signature    Signature `json:"signature,string"`
+	Score        float64   `json:"score"`
+	SampledScore float64   `json:"sampled_score"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// signatureExports sorts signatures by decreasing score, then by signature
+type signatureExports []signatureExport
+
+func (s signatureExports) Len() int      { return len(s) }
+func (s signatureExports) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s signatureExports) Less(i, j int) bool {
+	return s[i].Score > s[j].Score || (s[i].Score == s[j].Score && s[i].Signature < s[j].Signature)
+}
+
+// ExportJSON serializes the scores of the backend for offline analysis. The
+// format is stable, any incompatible change bumps its version:
+//
+//	{
+//	  "version": 1,
+//	  "exported_at": "2018-01-01T00:00:00Z",
+//	  "decay_period_seconds": 5,
+//	  "total_score": 12.5,
+//	  "sampled_score": 3.2,
+//	  "signatures": [
+//	    {"signature": "1234", "score": 10.1, "sampled_score": 2.1, "last_seen": "2018-01-01T00:00:00Z"}
+//	  ]
+//	}
+//
+// Scores are normalized like GetSignatureScore, in traces per second. Signatures
+// are hashes, see ComputeSignatureWithRootAndEnv, written as strings since they
+// do not fit in the numbers of all JSON parsers. They are sorted by decreasing
+// score. The backend can be restored from the export with RestoreScores.
+func (b *Backend) ExportJSON() ([]byte, error) {
+	b.mu.Lock()
+	export := scoresExport{
+		Version:      scoresExportVersion,
+		ExportedAt:   time.Now().UTC(),
+		DecayPeriod:  b.decayPeriod.Seconds(),
+		TotalScore:   b.totalScore / b.countScaleFactor,
+		SampledScore: b.sampledScore / b.countScaleFactor,
+		Signatures:   make([]signatureExport, 0, len(b.scores)),
+	}
+	for sig, score := range b.scores {
+		export.Signatures = append(export.Signatures, signatureExport{
+			Signature:    sig,
+			Score:        score / b.countScaleFactor,
+			SampledScore: b.sampledScores[sig] / b.countScaleFactor,
+			LastSeen:     b.lastSeen[sig].UTC(),
+		})
+	}
+	b.mu.Unlock()
+
+	sort.Sort(signatureExports(export.Signatures))
+	return json.Marshal(export)
+}
+
+// RestoreScores replaces the scores of the backend with the ones exported by
+// ExportJSON. The normalized scores are rescaled to the decay period of the
+// backend. They are not aged by the time elapsed since the export, which DecayN
+// can do. The error samples, only tracked per decay period, are reset.
+func (b *Backend) RestoreScores(data []byte) error {
+	var export scoresExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return err
+	}
+	if export.Version != scoresExportVersion {
+		return fmt.Errorf("unsupported scores export version %d", export.Version)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.scores = make(map[Signature]float64, len(export.Signatures))
+	b.sampledScores = make(map[Signature]float64, len(export.Signatures))
+	b.errorSamples = make(map[Signature]int)
+	b.lastSeen = make(map[Signature]time.Time, len(export.Signatures))
+	for _, s := range export.Signatures {
+		b.scores[s.Signature] = s.Score * b.countScaleFactor
+		if s.SampledScore > 0 {
+			b.sampledScores[s.Signature] = s.SampledScore * b.countScaleFactor
+		}
+		if !s.LastSeen.IsZero() {
+			b.lastSeen[s.Signature] = s.LastSeen
+		}
+	}
+	b.totalScore = export.TotalScore * b.countScaleFactor
+	b.sampledScore = export.SampledScore * b.countScaleFactor
+	return nil
+}
@@ -0,0 +1,80 @@
+package sampler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendExportJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := getTestBackend()
+	sign1, sign2 := Signature(1<<63+1), Signature(2)
+	for i := 0; i < 100; i++ {
+		backend.CountSignature(sign1)
+		backend.CountSample()
+		backend.CountSampleForSignature(sign1)
+	}
+	for i := 0; i < 10; i++ {
+		backend.CountSignature(sign2)
+	}
+	backend.DecayScore()
+
+	data, err := backend.ExportJSON()
+	assert.NoError(err)
+
+	// the format is documented, check its fields
+	var export map[string]interface{}
+	assert.NoError(json.Unmarshal(data, &export))
+	assert.Equal(1.0, export["version"])
+	assert.Equal(5.0, export["decay_period_seconds"])
+	assert.InEpsilon(backend.GetTotalScore(), export["total_score"], 1e-9)
+	signatures := export["signatures"].([]interface{})
+	if assert.Len(signatures, 2) {
+		// the signatures with the highest scores first, as strings
+		first := signatures[0].(map[string]interface{})
+		assert.Equal("9223372036854775809", first["signature"])
+		assert.InEpsilon(backend.GetSignatureScore(sign1), first["score"], 1e-9)
+		assert.Contains(first, "sampled_score")
+		assert.Contains(first, "last_seen")
+	}
+
+	// restored in a backend with another decay period
+	restored := NewBackend(10 * time.Second)
+	assert.NoError(restored.RestoreScores(data))
+	for _, sign := range []Signature{sign1, sign2} {
+		assert.InEpsilon(backend.GetSignatureScore(sign), restored.GetSignatureScore(sign), 1e-9)
+	}
+	assert.InEpsilon(backend.GetTotalScore(), restored.GetTotalScore(), 1e-9)
+	assert.InEpsilon(backend.GetSampledScore(), restored.GetSampledScore(), 1e-9)
+	assert.InEpsilon(backend.GetSignatureSampledRate(sign1), restored.GetSignatureSampledRate(sign1), 1e-9)
+	assert.Equal(0.0, restored.GetSignatureSampledRate(sign2))
+	assert.Equal(backend.GetCardinality(), restored.GetCardinality())
+	for sign, seen := range backend.Stats().LastSeen {
+		assert.True(seen.Equal(restored.Stats().LastSeen[sign]))
+	}
+
+	// and exported again the same way
+	again, err := restored.ExportJSON()
+	assert.NoError(err)
+	var exportAgain map[string]interface{}
+	assert.NoError(json.Unmarshal(again, &exportAgain))
+	assert.Equal(10.0, exportAgain["decay_period_seconds"])
+	assert.Equal(len(signatures), len(exportAgain["signatures"].([]interface{})))
+}
+
+func TestBackendRestoreScoresErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := getTestBackend()
+	backend.CountSignature(Signature(1))
+
+	assert.Error(backend.RestoreScores([]byte("{")))
+	assert.Error(backend.RestoreScores([]byte(`{"version": 2, "signatures": []}`)))
+
+	// the scores are left untouched
+	assert.True(backend.GetSignatureScore(Signature(1)) > 0)
+}
@@ -1,10 +1,14 @@
 package sampler
 
 import (
+	"fmt"
 	"math/rand"
+	"net"
 	"testing"
 	"time"
 
+	dogstatsd "github.com/DataDog/datadog-go/statsd"
+	"github.com/DataDog/datadog-trace-agent/statsd"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -90,3 +94,422 @@ func TestCountScoreOblivion(t *testing.T) {
 
 	assert.True(backend.GetSignatureScore(sign) < 0.01*float64(tracesPerPeriod))
 }
+
+func TestDecayN(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := getTestBackend()
+	expected := getTestBackend()
+
+	sign := randomSignature()
+	// this one should be dropped after a few decays
+	smallSign := randomSignature()
+
+	for _, b := range []*Backend{backend, expected} {
+		for i := 0; i < 1000; i++ {
+			b.CountSignature(sign)
+			b.CountSample()
+		}
+		b.scores[smallSign] = 1.2 * minSignatureScoreOffset
+	}
+
+	backend.DecayN(3)
+	for i := 0; i < 3; i++ {
+		expected.DecayScore()
+	}
+
+	assert.InEpsilon(expected.GetSignatureScore(sign), backend.GetSignatureScore(sign), 1e-9)
+	assert.InEpsilon(expected.GetTotalScore(), backend.GetTotalScore(), 1e-9)
+	assert.InEpsilon(expected.GetSampledScore(), backend.GetSampledScore(), 1e-9)
+	assert.Equal(expected.GetCardinality(), backend.GetCardinality())
+	assert.Equal(int64(1), backend.GetCardinality())
+
+	// no-op with a non-positive count
+	score := backend.GetSignatureScore(sign)
+	backend.DecayN(0)
+	assert.Equal(score, backend.GetSignatureScore(sign))
+}
+
+func TestSignatureSampledRate(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := getTestBackend()
+
+	sign := randomSignature()
+	otherSign := randomSignature()
+
+	for i := 0; i < 400; i++ {
+		backend.CountSignature(sign)
+		if i%4 == 0 {
+			backend.CountSampleForSignature(sign)
+		}
+	}
+	backend.CountSignature(otherSign)
+
+	assert.InEpsilon(0.25, backend.GetSignatureSampledRate(sign), 1e-9)
+	assert.Equal(0.0, backend.GetSignatureSampledRate(otherSign))
+	assert.Equal(0.0, backend.GetSignatureSampledRate(randomSignature()))
+
+	// both counters are decayed together, the ratio stays the same
+	backend.DecayScore()
+	backend.DecayN(3)
+	assert.InEpsilon(0.25, backend.GetSignatureSampledRate(sign), 1e-9)
+
+	// and forgotten together
+	backend.DecayN(200)
+	assert.Equal(0.0, backend.GetSignatureSampledRate(sign))
+	assert.Equal(0, len(backend.sampledScores))
+}
+
+func TestBackendLastSeen(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := getTestBackend()
+
+	sign := randomSignature()
+	// this one should be dropped after a few decays
+	smallSign := randomSignature()
+
+	before := time.Now()
+	for i := 0; i < 1000; i++ {
+		backend.CountSignature(sign)
+	}
+	backend.CountSignature(smallSign)
+	backend.scores[smallSign] = 1.2 * minSignatureScoreOffset
+
+	stats := backend.Stats()
+	assert.Equal(2, len(stats.LastSeen))
+	assert.False(stats.LastSeen[sign].Before(before))
+	assert.False(stats.LastSeen[smallSign].Before(stats.LastSeen[sign]))
+
+	// counting again updates the last seen time
+	lastSeen := stats.LastSeen[sign]
+	time.Sleep(time.Millisecond)
+	backend.CountSignature(sign)
+	assert.True(backend.Stats().LastSeen[sign].After(lastSeen))
+
+	// the snapshot is a copy
+	stats.LastSeen[randomSignature()] = time.Now()
+	assert.Equal(2, len(backend.Stats().LastSeen))
+
+	// entries are dropped with their scores
+	backend.DecayScore()
+	backend.DecayScore()
+	stats = backend.Stats()
+	assert.Equal(int64(1), stats.Cardinality)
+	assert.Equal(1, len(stats.LastSeen))
+	_, ok := stats.LastSeen[sign]
+	assert.True(ok)
+}
+
+func TestBackendReset(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := getTestBackend()
+	go backend.Run()
+	defer backend.Stop()
+
+	sign := randomSignature()
+	for i := 0; i < 100; i++ {
+		backend.CountSignature(sign)
+		backend.CountSample()
+		backend.CountSampleForSignature(sign)
+		backend.CountErrorSample(sign)
+	}
+	assert.True(backend.GetTotalScore() > 0)
+
+	backend.Reset()
+
+	assert.Equal(0.0, backend.GetSignatureScore(sign))
+	assert.Equal(0.0, backend.GetTotalScore())
+	assert.Equal(0.0, backend.GetSampledScore())
+	assert.Equal(0.0, backend.GetUpperSampledScore())
+	assert.Equal(0.0, backend.GetSignatureSampledRate(sign))
+	assert.Equal(0, backend.GetErrorSampleCount(sign))
+	assert.Equal(int64(0), backend.GetCardinality())
+	assert.Equal(0, len(backend.Stats().LastSeen))
+
+	// the backend is still usable afterwards
+	backend.CountSignature(sign)
+	assert.True(backend.GetSignatureScore(sign) > 0)
+}
+
+func TestBackendCountScaleFactor(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, period := range []time.Duration{time.Second, 5 * time.Second, 30 * time.Second} {
+		backend := NewBackend(period)
+		assert.Equal((backend.decayFactor/(backend.decayFactor-1))*period.Seconds(), backend.CountScaleFactor())
+	}
+
+	// with the default decay factor of 9/8, it is 9 decay periods
+	assert.InEpsilon(45, getTestBackend().CountScaleFactor(), 1e-9)
+
+	// it follows the changes of the decay period
+	backend := getTestBackend()
+	backend.SetDecayPeriod(time.Second)
+	assert.InEpsilon(9, backend.CountScaleFactor(), 1e-9)
+}
+
+func TestBackendOnDecay(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := getTestBackend()
+	var calls []int
+	backend.OnDecay(func() { calls = append(calls, 1) })
+	backend.OnDecay(func() {
+		// called outside of the lock
+		backend.CountSignature(randomSignature())
+		calls = append(calls, 2)
+	})
+
+	backend.DecayScore()
+	assert.Equal([]int{1, 2}, calls)
+	backend.DecayScore()
+	assert.Equal([]int{1, 2, 1, 2}, calls)
+
+	// aging a snapshot is not a tick
+	backend.DecayN(3)
+	assert.Len(calls, 4)
+}
+
+func TestBackendMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	shared := randomSignature()
+	only1 := randomSignature()
+	only2 := randomSignature()
+
+	b1 := getTestBackend()
+	b2 := getTestBackend()
+	for i := 0; i < 100; i++ {
+		b1.CountSignature(shared)
+		b2.CountSignature(shared)
+		b2.CountSignature(only2)
+		b1.CountSample()
+	}
+	for i := 0; i < 50; i++ {
+		b1.CountSignature(only1)
+		b2.CountSample()
+		b2.CountSampleForSignature(shared)
+	}
+
+	score1, score2 := b1.GetSignatureScore(shared), b2.GetSignatureScore(shared)
+	total1, total2 := b1.GetTotalScore(), b2.GetTotalScore()
+	sampled1, sampled2 := b1.GetSampledScore(), b2.GetSampledScore()
+
+	b1.Merge(b2)
+
+	assert.InEpsilon(score1+score2, b1.GetSignatureScore(shared), 1e-9)
+	assert.InEpsilon(b2.GetSignatureScore(only2), b1.GetSignatureScore(only2), 1e-9)
+	assert.InEpsilon(50/b1.CountScaleFactor(), b1.GetSignatureScore(only1), 1e-9)
+	assert.InEpsilon(total1+total2, b1.GetTotalScore(), 1e-9)
+	assert.InEpsilon(sampled1+sampled2, b1.GetSampledScore(), 1e-9)
+	assert.Equal(int64(3), b1.GetCardinality())
+
+	// the other backend is untouched
+	assert.Equal(score2, b2.GetSignatureScore(shared))
+	assert.Equal(int64(2), b2.GetCardinality())
+
+	// merging a backend into itself is a no-op
+	b1.Merge(b1)
+	assert.InEpsilon(total1+total2, b1.GetTotalScore(), 1e-9)
+}
+
+func TestBackendMergeDecayPeriods(t *testing.T) {
+	assert := assert.New(t)
+
+	sign := randomSignature()
+	b1 := NewBackend(time.Second)
+	b2 := NewBackend(10 * time.Second)
+	for i := 0; i < 100; i++ {
+		b2.CountSignature(sign)
+	}
+
+	// the scores are merged in traces per second, whatever the decay periods
+	b1.Merge(b2)
+	assert.InEpsilon(b2.GetSignatureScore(sign), b1.GetSignatureScore(sign), 1e-9)
+}
+
+func TestBackendMergeConcurrent(t *testing.T) {
+	b1 := getTestBackend()
+	b2 := getTestBackend()
+	b1.CountSignature(randomSignature())
+	b2.CountSignature(randomSignature())
+
+	// merging both ways at once must not deadlock
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			b1.Merge(b2)
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		b2.Merge(b1)
+	}
+	<-done
+}
+
+func TestBackendSetDecayPeriod(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := getTestBackend()
+	sign := randomSignature()
+
+	tracesPerPeriod := 1000
+	for period := 0; period < 50; period++ {
+		backend.DecayScore()
+		for i := 0; i < tracesPerPeriod; i++ {
+			backend.CountSignature(sign)
+			backend.CountSample()
+		}
+	}
+	rate := float64(tracesPerPeriod) / backend.DecayPeriod().Seconds()
+	assert.InEpsilon(rate, backend.GetSignatureScore(sign), 0.01)
+
+	// the normalized scores are not affected by the change
+	backend.SetDecayPeriod(time.Second)
+	assert.Equal(time.Second, backend.DecayPeriod())
+	assert.InEpsilon(rate, backend.GetSignatureScore(sign), 0.01)
+	assert.InEpsilon(rate, backend.GetSampledScore(), 0.01)
+	assert.InEpsilon(rate, backend.GetTotalScore(), 0.01)
+
+	// and they keep converging to the same rate with the new period
+	for period := 0; period < 50; period++ {
+		backend.DecayScore()
+		for i := 0; i < int(rate); i++ {
+			backend.CountSignature(sign)
+			backend.CountSample()
+		}
+	}
+	assert.InEpsilon(rate, backend.GetSignatureScore(sign), 0.01)
+	assert.InEpsilon(rate, backend.GetSampledScore(), 0.01)
+}
+
+func TestBackendSetDecayPeriodRun(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := NewBackend(time.Hour)
+	go backend.Run()
+	defer backend.Stop()
+
+	lastDecay := backend.LastDecay()
+	backend.SetDecayPeriod(10 * time.Millisecond)
+
+	// the Run loop picks the new period instead of waiting for an hour
+	time.Sleep(100 * time.Millisecond)
+	assert.True(backend.LastDecay().After(lastDecay))
+}
+
+func TestBackendMaxSignatureScore(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := getTestBackend()
+	backend.SetMaxSignatureScore(10)
+
+	flood := randomSignature()
+	other := randomSignature()
+	for period := 0; period < 50; period++ {
+		backend.DecayScore()
+		for i := 0; i < 10000; i++ {
+			backend.CountSignature(flood)
+		}
+		for i := 0; i < 5; i++ {
+			backend.CountSignature(other)
+		}
+	}
+
+	// the flood is capped, the other signature is not affected
+	assert.InEpsilon(10, backend.GetSignatureScore(flood), 0.01)
+	assert.InEpsilon(1, backend.GetSignatureScore(other), 0.01)
+	// and the total score only accounts for the capped score
+	assert.InEpsilon(11, backend.GetTotalScore(), 0.01)
+
+	// without limit, the flood takes its real score
+	backend.SetMaxSignatureScore(0)
+	for i := 0; i < 10000; i++ {
+		backend.CountSignature(flood)
+	}
+	assert.True(backend.GetSignatureScore(flood) > 100)
+}
+
+func TestBackendSignaturesGauge(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen for statsd metrics: %v", err)
+	}
+	defer conn.Close()
+
+	defaultClient := statsd.Client
+	defer func() { statsd.Client = defaultClient }()
+	statsd.Client, err = dogstatsd.New(conn.LocalAddr().String())
+	assert.Nil(err)
+
+	backend := getTestBackend()
+	for i := 0; i < 42; i++ {
+		sig := randomSignature()
+		backend.CountSignature(sig)
+		backend.CountSignature(sig)
+	}
+	backend.DecayScore()
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("datadog.trace_agent.sampler.signatures:%f|g", float64(len(backend.scores))), string(buf[:n]))
+	assert.Equal(42, len(backend.scores))
+}
+
+func TestBackendSignaturesEvicted(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen for statsd metrics: %v", err)
+	}
+	defer conn.Close()
+
+	defaultClient := statsd.Client
+	defer func() { statsd.Client = defaultClient }()
+	statsd.Client, err = dogstatsd.New(conn.LocalAddr().String())
+	assert.Nil(err)
+
+	// signatures seen once are evicted long before the busy ones
+	backend := getTestBackend()
+	for i := 0; i < 10; i++ {
+		backend.CountSignature(randomSignature())
+	}
+	for i := 0; i < 5; i++ {
+		sig := randomSignature()
+		for j := 0; j < 1000; j++ {
+			backend.CountSignature(sig)
+		}
+	}
+
+	buf := make([]byte, 1024)
+	read := func() string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no metric received: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	evicted := 0
+	for i := 0; i < 100 && len(backend.scores) > 5; i++ {
+		backend.DecayScore()
+		read() // the signatures gauge
+
+		var n int
+		_, err := fmt.Sscanf(read(), "datadog.trace_agent.sampler.signatures_evicted:%d|c", &n)
+		assert.Nil(err)
+		evicted += n
+	}
+	assert.Equal(10, evicted)
+	assert.Equal(5, len(backend.scores))
+}
@@ -0,0 +1,120 @@
+package sampler
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DecisionCache remembers for a while the sampling decisions taken for traces, so
+// that all the parts of a trace received separately get the same decision.
+//
+// Decisions are forgotten after a fixed TTL, or earlier when the cache is full,
+// oldest first.
+type DecisionCache struct {
+	ttl     time.Duration
+	maxSize int
+
+	// decisions ordered by insertion, hence by expiration since the TTL is fixed
+	order     *list.List
+	decisions map[uint64]*list.Element
+	mu        sync.Mutex
+}
+
+type decision struct {
+	traceID uint64
+	sampled bool
+	expires time.Time
+}
+
+// NewDecisionCache returns an empty cache keeping at most maxSize decisions for ttl.
+func NewDecisionCache(maxSize int, ttl time.Duration) *DecisionCache {
+	return &DecisionCache{
+		ttl:       ttl,
+		maxSize:   maxSize,
+		order:     list.New(),
+		decisions: make(map[uint64]*list.Element),
+	}
+}
+
+// Get returns the decision taken for the given trace, if it is still known.
+func (c *DecisionCache) Get(traceID uint64, now time.Time) (sampled bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+
+	e, ok := c.decisions[traceID]
+	if !ok {
+		return false, false
+	}
+	return e.Value.(decision).sampled, true
+}
+
+// Set records the decision taken for the given trace. Decisions already known
+// are not overridden, nor have their TTL extended.
+func (c *DecisionCache) Set(traceID uint64, sampled bool, now time.Time) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+
+	if _, ok := c.decisions[traceID]; ok {
+		return
+	}
+	for c.order.Len() >= c.maxSize {
+		c.remove(c.order.Front())
+	}
+
+	c.decisions[traceID] = c.order.PushBack(decision{
+		traceID: traceID,
+		sampled: sampled,
+		expires: now.Add(c.ttl),
+	})
+}
+
+// Clear forgets all the decisions.
+func (c *DecisionCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.decisions = make(map[uint64]*list.Element)
+}
+
+// Len returns the number of decisions in the cache.
+func (c *DecisionCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// Sweep removes the decisions expired at the given time and returns how many
+// were removed. Expired decisions are otherwise only removed by Get and Set, so
+// sweeping periodically keeps an idle cache from holding on to them.
+func (c *DecisionCache) Sweep(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.order.Len()
+	c.expire(now)
+	return n - c.order.Len()
+}
+
+// expire removes the expired decisions, it must be called with the lock held.
+func (c *DecisionCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil && !now.Before(e.Value.(decision).expires); e = c.order.Front() {
+		c.remove(e)
+	}
+}
+
+// remove removes a decision, it must be called with the lock held.
+func (c *DecisionCache) remove(e *list.Element) {
+	delete(c.decisions, e.Value.(decision).traceID)
+	c.order.Remove(e)
+}
@@ -0,0 +1,107 @@
+package sampler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisionCacheTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDecisionCache(10, 10*time.Second)
+	now := time.Now()
+
+	c.Set(1, true, now)
+	c.Set(2, false, now.Add(5*time.Second))
+
+	sampled, ok := c.Get(1, now.Add(9*time.Second))
+	assert.True(ok)
+	assert.True(sampled)
+
+	// known decisions are not overridden
+	c.Set(2, true, now.Add(6*time.Second))
+	sampled, ok = c.Get(2, now.Add(6*time.Second))
+	assert.True(ok)
+	assert.False(sampled)
+
+	// the first decision expired, not the second one
+	_, ok = c.Get(1, now.Add(10*time.Second))
+	assert.False(ok)
+	_, ok = c.Get(2, now.Add(10*time.Second))
+	assert.True(ok)
+	assert.Equal(1, c.Len())
+
+	_, ok = c.Get(2, now.Add(15*time.Second))
+	assert.False(ok)
+	assert.Equal(0, c.Len())
+}
+
+func TestDecisionCacheMaxSize(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDecisionCache(3, time.Minute)
+	now := time.Now()
+
+	for i := uint64(1); i <= 5; i++ {
+		c.Set(i, true, now)
+	}
+
+	// the oldest decisions are evicted first
+	assert.Equal(3, c.Len())
+	for i := uint64(1); i <= 5; i++ {
+		_, ok := c.Get(i, now)
+		assert.Equal(i > 2, ok, "trace %d", i)
+	}
+
+	// a cache without size keeps nothing
+	c = NewDecisionCache(0, time.Minute)
+	c.Set(1, true, now)
+	_, ok := c.Get(1, now)
+	assert.False(ok)
+}
+
+func TestDecisionCacheSweep(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDecisionCache(10, 10*time.Second)
+	now := time.Now()
+
+	c.Set(1, true, now)
+	c.Set(2, false, now)
+	c.Set(3, true, now.Add(5*time.Second))
+
+	assert.Equal(0, c.Sweep(now.Add(9*time.Second)))
+	assert.Equal(3, c.Len())
+
+	// only the expired decisions are gone
+	assert.Equal(2, c.Sweep(now.Add(10*time.Second)))
+	assert.Equal(1, c.Len())
+	_, ok := c.Get(3, now.Add(10*time.Second))
+	assert.True(ok)
+
+	assert.Equal(1, c.Sweep(now.Add(time.Minute)))
+	assert.Equal(0, c.Len())
+}
+
+func TestDecisionCacheClear(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDecisionCache(10, time.Minute)
+	now := time.Now()
+
+	c.Set(1, true, now)
+	c.Set(2, false, now)
+	c.Clear()
+
+	assert.Equal(0, c.Len())
+	_, ok := c.Get(1, now)
+	assert.False(ok)
+
+	// the cache is still usable
+	c.Set(1, false, now)
+	sampled, ok := c.Get(1, now)
+	assert.True(ok)
+	assert.False(sampled)
+}
@@ -15,9 +15,11 @@ package sampler
 
 import (
 	"math"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
 	"github.com/DataDog/datadog-trace-agent/watchdog"
 )
 
@@ -39,6 +41,22 @@ type Sampler struct {
 	extraRate float64
 	// Maximum limit to the total number of traces per second to sample
 	maxTPS float64
+	// Minimum number of error traces to keep per signature and decay period, whatever their score
+	errorTracesFloor int
+	// Traces lasting longer than this, in nanoseconds, are always kept, 0 to disable
+	slowTraceThreshold int64
+	// Traces with a span of one of these types lasting longer than its threshold,
+	// in nanoseconds, are always kept
+	slowSpanThresholds map[string]int64
+	// Each signature is kept at this rate instead of a rate derived from its
+	// score, 0 to disable. The keep rates of the signatures are adjusted by a
+	// feedback loop so that the rates observed reach it, whatever else keeps
+	// or drops their traces, e.g. an earlier sampling by the clients.
+	targetRate  float64
+	keepRates   map[Signature]float64
+	keepRatesMu sync.Mutex
+	// Mixed with the trace IDs to take the sampling decisions, see SampleByRateWithSeed
+	seed uint64
 
 	// Sample any signature with a score lower than scoreSamplingOffset
 	// It is basically the number of similar traces per second after which we start sampling
@@ -59,6 +77,7 @@ func NewSampler(extraRate float64, maxTPS float64) *Sampler {
 		Backend:   NewBackend(decayPeriod),
 		extraRate: extraRate,
 		maxTPS:    maxTPS,
+		keepRates: make(map[Signature]float64),
 
 		exit: make(chan struct{}),
 	}
@@ -85,6 +104,37 @@ func (s *Sampler) UpdateMaxTPS(maxTPS float64) {
 	s.maxTPS = maxTPS
 }
 
+// UpdateErrorTracesFloor updates the minimum number of error traces kept per signature
+func (s *Sampler) UpdateErrorTracesFloor(floor int) {
+	s.errorTracesFloor = floor
+}
+
+// UpdateTargetRate updates the rate each signature is kept at, 0 to derive it
+// from the score of the signature instead
+func (s *Sampler) UpdateTargetRate(rate float64) {
+	s.targetRate = rate
+}
+
+// UpdateSlowTraceThreshold updates the duration above which traces are always kept, 0 to disable
+func (s *Sampler) UpdateSlowTraceThreshold(threshold time.Duration) {
+	s.slowTraceThreshold = threshold.Nanoseconds()
+}
+
+// UpdateSlowSpanThresholds updates the durations, by span type, above which a
+// span makes its trace always kept, e.g. to keep the traces of slow queries
+func (s *Sampler) UpdateSlowSpanThresholds(thresholds map[string]time.Duration) {
+	slowSpanThresholds := make(map[string]int64, len(thresholds))
+	for spanType, threshold := range thresholds {
+		slowSpanThresholds[spanType] = threshold.Nanoseconds()
+	}
+	s.slowSpanThresholds = slowSpanThresholds
+}
+
+// UpdateSeed updates the seed mixed with the trace IDs to take the sampling decisions
+func (s *Sampler) UpdateSeed(seed uint64) {
+	s.seed = seed
+}
+
 // Run runs and block on the Sampler main loop
 func (s *Sampler) Run() {
 	watchdog.Go(func() {
@@ -126,9 +176,27 @@ func (s *Sampler) Sample(trace model.Trace, root *model.Span, env string) bool {
 	// Update sampler state by counting this trace
 	s.Backend.CountSignature(signature)
 
+	if spanType, ok := s.slowSpanType(trace); ok {
+		// Traces with a slow span of a watched type are kept, whatever their score.
+		s.Backend.CountSample()
+		if hasError(trace) {
+			s.Backend.CountErrorSample(signature)
+		}
+		s.Backend.CountSampleForSignature(signature)
+		if root.Metrics == nil {
+			root.Metrics = make(map[string]float64, 1)
+		}
+		root.Metrics[model.SpanAgentSampleRateMetricKey] = 1
+		statsd.Client.Count("datadog.trace_agent.sampler.kept_slow_span", 1, []string{"type:" + spanType}, 1)
+		return true
+	}
+
+	initialRate := GetTraceAppliedSampleRate(root)
 	sampleRate := s.GetSampleRate(trace, root, signature)
 
-	sampled := ApplySampleRate(root, sampleRate)
+	sampled := applySampleRate(root, sampleRate, s.seed)
+	// the rate applied by the agent alone, the root one also includes the client rate
+	agentRate := sampleRate
 
 	if sampled {
 		// Count the trace to allow us to check for the maxTPS limit.
@@ -139,20 +207,91 @@ func (s *Sampler) Sample(trace model.Trace, root *model.Span, env string) bool {
 		// No need to check if we already decided not to keep the trace.
 		maxTPSrate := s.GetMaxTPSSampleRate()
 		if maxTPSrate < 1 {
-			sampled = ApplySampleRate(root, maxTPSrate)
+			sampled = applySampleRate(root, maxTPSrate, s.seed)
+			agentRate *= maxTPSrate
 		}
 	}
 
+	if hasError(trace) {
+		if !sampled && s.Backend.GetErrorSampleCount(signature) < s.errorTracesFloor {
+			// Keep a minimum of error traces per signature, whatever their score.
+			// This trace is not sampled anymore, so restore its initial rate.
+			SetTraceAppliedSampleRate(root, initialRate)
+			s.Backend.CountSample()
+			sampled = true
+			agentRate = 1
+		}
+		if sampled {
+			s.Backend.CountErrorSample(signature)
+		}
+	}
+
+	if !sampled && s.slowTraceThreshold > 0 && trace.WallDuration() > s.slowTraceThreshold {
+		// Slow traces are the ones worth investigating, keep them whatever their score.
+		SetTraceAppliedSampleRate(root, initialRate)
+		s.Backend.CountSample()
+		sampled = true
+		agentRate = 1
+		statsd.Client.Count("datadog.trace_agent.sampler.kept_slow", 1, nil, 1)
+	}
+
+	if sampled {
+		s.Backend.CountSampleForSignature(signature)
+		root.Metrics[model.SpanAgentSampleRateMetricKey] = agentRate
+	}
+
 	return sampled
 }
 
+// slowSpanType returns the type of the first span of the trace lasting longer
+// than the threshold of its type, if any
+func (s *Sampler) slowSpanType(trace model.Trace) (string, bool) {
+	if len(s.slowSpanThresholds) == 0 {
+		return "", false
+	}
+	for i := range trace {
+		if threshold, ok := s.slowSpanThresholds[trace[i].Type]; ok && trace[i].Duration > threshold {
+			return trace[i].Type, true
+		}
+	}
+	return "", false
+}
+
+// hasError tells if any span of the trace is an error
+func hasError(trace model.Trace) bool {
+	for i := range trace {
+		if trace[i].Error != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // GetSampleRate returns the sample rate to apply to a trace.
 func (s *Sampler) GetSampleRate(trace model.Trace, root *model.Span, signature Signature) float64 {
+	if s.targetRate > 0 {
+		return s.getSignatureKeepRate(signature) * s.extraRate
+	}
+
 	sampleRate := s.GetSignatureSampleRate(signature) * s.extraRate
 
 	return sampleRate
 }
 
+// getSignatureKeepRate returns the rate a signature is kept at to reach the
+// target rate, starting at the target itself
+func (s *Sampler) getSignatureKeepRate(signature Signature) float64 {
+	s.keepRatesMu.Lock()
+	defer s.keepRatesMu.Unlock()
+
+	rate, ok := s.keepRates[signature]
+	if !ok {
+		rate = s.targetRate
+		s.keepRates[signature] = rate
+	}
+	return rate
+}
+
 // GetMaxTPSSampleRate returns an extra sample rate to apply if we are above maxTPS.
 func (s *Sampler) GetMaxTPSSampleRate() float64 {
 	// When above maxTPS, apply an additional sample rate to statistically respect the limit
@@ -170,13 +309,18 @@ func (s *Sampler) GetMaxTPSSampleRate() float64 {
 // ApplySampleRate applies a sample rate over a trace root, returning if the trace should be sampled or not.
 // It takes into account any previous sampling.
 func ApplySampleRate(root *model.Span, sampleRate float64) bool {
+	return applySampleRate(root, sampleRate, 0)
+}
+
+// applySampleRate is ApplySampleRate taking the decision with the given seed
+func applySampleRate(root *model.Span, sampleRate float64, seed uint64) bool {
 	initialRate := GetTraceAppliedSampleRate(root)
 	newRate := initialRate * sampleRate
 	SetTraceAppliedSampleRate(root, newRate)
 
 	traceID := root.TraceID
 
-	return SampleByRate(traceID, newRate)
+	return SampleByRateWithSeed(traceID, seed, newRate)
 }
 
 // GetTraceAppliedSampleRate gets the sample rate the sample rate applied earlier in the pipeline.
@@ -73,6 +73,32 @@ func TestExtraSampleRate(t *testing.T) {
 	assert.Equal(s.GetSampleRate(trace, root, signature), s.extraRate*sRate)
 }
 
+func TestSamplerSeed(t *testing.T) {
+	assert := assert.New(t)
+
+	newSeededSampler := func(seed uint64) *Sampler {
+		s := getTestSampler()
+		s.UpdateExtraRate(0.5)
+		s.UpdateSeed(seed)
+		return s
+	}
+	samplers := []*Sampler{newSeededSampler(42), newSeededSampler(42), newSeededSampler(43)}
+
+	var decisions [3][]bool
+	for i := 0; i < 1000; i++ {
+		trace, _ := getTestTrace()
+		for j, s := range samplers {
+			// each sampler gets its own copy, the sample rate is set on the root
+			t := model.Trace{trace[0], trace[1]}
+			decisions[j] = append(decisions[j], s.Sample(t, &t[0], defaultEnv))
+		}
+	}
+
+	// two samplers sharing a seed take the same decisions on the same traces
+	assert.Equal(decisions[0], decisions[1])
+	assert.NotEqual(decisions[0], decisions[2])
+}
+
 func TestMaxTPS(t *testing.T) {
 	// Test the "effectiveness" of the maxTPS option.
 	assert := assert.New(t)
@@ -140,6 +166,129 @@ func TestSamplerChainedSampling(t *testing.T) {
 	assert.Equal(0.4, GetTraceAppliedSampleRate(rootAgain))
 }
 
+func TestSlowTracesKept(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	s.UpdateMaxTPS(0)
+
+	trace, root := getTestTrace()
+	signature := ComputeSignatureWithRootAndEnv(trace, root, defaultEnv)
+
+	// Make the signature so frequent that its sample rate is very low
+	for i := 0; i < int(1e6); i++ {
+		s.Backend.CountSignature(signature)
+	}
+	assert.True(s.GetSampleRate(trace, root, signature) < 0.01)
+
+	// Traces slower than the threshold are all kept, those which would have been
+	// dropped keep their initial rate
+	s.UpdateSlowTraceThreshold(time.Duration(trace.WallDuration() - 1))
+	var forced int
+	for i := 0; i < 100; i++ {
+		trace, root := getTestTrace()
+		SetTraceAppliedSampleRate(root, 0.5)
+		assert.True(s.Sample(trace, root, defaultEnv))
+		if root.Metrics[model.SpanAgentSampleRateMetricKey] == 1 {
+			assert.Equal(0.5, GetTraceAppliedSampleRate(root))
+			forced++
+		}
+	}
+	assert.True(forced > 90)
+
+	// Faster ones are sampled like any other trace
+	s.UpdateSlowTraceThreshold(time.Duration(trace.WallDuration()))
+	var kept int
+	for i := 0; i < 100; i++ {
+		trace, root := getTestTrace()
+		if s.Sample(trace, root, defaultEnv) {
+			kept++
+		}
+	}
+	assert.True(kept < 10)
+}
+
+func TestSlowSpansKept(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	s.UpdateMaxTPS(0)
+
+	trace, root := getTestTrace()
+	signature := ComputeSignatureWithRootAndEnv(trace, root, defaultEnv)
+
+	// Make the signature so frequent that its sample rate is very low
+	for i := 0; i < int(1e6); i++ {
+		s.Backend.CountSignature(signature)
+	}
+	assert.True(s.GetSampleRate(trace, root, signature) < 0.01)
+
+	// The sql span of the test traces lasts 200us, slower than the threshold
+	s.UpdateSlowSpanThresholds(map[string]time.Duration{"sql": 100 * time.Microsecond, "cache": time.Nanosecond})
+	for i := 0; i < 100; i++ {
+		trace, root := getTestTrace()
+		SetTraceAppliedSampleRate(root, 0.5)
+		assert.True(s.Sample(trace, root, defaultEnv))
+		// the rate of the trace is left as it was
+		assert.Equal(0.5, GetTraceAppliedSampleRate(root))
+		assert.Equal(1.0, root.Metrics[model.SpanAgentSampleRateMetricKey])
+	}
+
+	// Traces with faster spans, or spans of other types, are sampled like any other trace
+	for _, thresholds := range []map[string]time.Duration{
+		{"sql": 200 * time.Microsecond},
+		{"cache": time.Nanosecond},
+		nil,
+	} {
+		s.UpdateSlowSpanThresholds(thresholds)
+		var kept int
+		for i := 0; i < 100; i++ {
+			trace, root := getTestTrace()
+			if s.Sample(trace, root, defaultEnv) {
+				kept++
+			}
+		}
+		assert.True(kept < 10, "%v: %d", thresholds, kept)
+	}
+}
+
+func TestAgentSampleRateOnKeptTraces(t *testing.T) {
+	assert := assert.New(t)
+	s := getTestSampler()
+	s.UpdateMaxTPS(0)
+
+	trace, root := getTestTrace()
+	signature := ComputeSignatureWithRootAndEnv(trace, root, defaultEnv)
+
+	// Make the signature frequent enough to be sampled
+	for i := 0; i < int(1e4); i++ {
+		s.Backend.CountSignature(signature)
+	}
+
+	var kept, dropped int
+	for i := 0; i < 1000; i++ {
+		trace, root := getTestTrace()
+		root.TraceID = rand.Uint64()
+		// the rate applied by the client is not part of the agent one
+		SetTraceAppliedSampleRate(root, 0.5)
+		expectedRate := s.GetSampleRate(trace, root, signature)
+
+		if s.Sample(trace, root, defaultEnv) {
+			kept++
+			rate, ok := root.Metrics[model.SpanAgentSampleRateMetricKey]
+			assert.True(ok)
+			assert.InEpsilon(expectedRate, rate, 0.01)
+			assert.InEpsilon(0.5*rate, GetTraceAppliedSampleRate(root), 1e-9)
+		} else {
+			dropped++
+			_, ok := root.Metrics[model.SpanAgentSampleRateMetricKey]
+			assert.False(ok)
+		}
+	}
+	assert.True(kept > 0)
+	assert.True(dropped > 0)
+}
+
 func BenchmarkSampler(b *testing.B) {
 	// Benchmark the resource consumption of many traces sampling
 
@@ -162,3 +311,52 @@ func BenchmarkSampler(b *testing.B) {
 		s.Sample(trace, &trace[0], defaultEnv)
 	}
 }
+
+func TestErrorTracesFloor(t *testing.T) {
+	assert := assert.New(t)
+
+	s := getTestSampler()
+	s.UpdateErrorTracesFloor(1)
+	// fixed trace IDs and seed, so that the decisions are deterministic
+	s.UpdateSeed(42)
+
+	trace, root := getTestTrace()
+	trace[1].Error = 1
+	signature := ComputeSignatureWithRootAndEnv(trace, root, defaultEnv)
+
+	// Make the signature so frequent that its sample rate is very low
+	for i := 0; i < int(1e6); i++ {
+		s.Backend.CountSignature(signature)
+	}
+	assert.True(s.GetSampleRate(trace, root, signature) < 0.01)
+
+	// Whatever its score, the first error trace is kept, the next ones are
+	// sampled by their rate
+	var kept []bool
+	for i := 0; i < 10; i++ {
+		trace, root := getTestTrace()
+		trace[0].TraceID = uint64(i + 1)
+		trace[1].TraceID = uint64(i + 1)
+		trace[1].Error = 1
+		kept = append(kept, s.Sample(trace, root, defaultEnv))
+	}
+	assert.Equal([]bool{true, false, false, false, false, false, false, false, false, false}, kept)
+	assert.Equal(1, s.Backend.GetErrorSampleCount(signature))
+
+	// The floor is per decay period
+	s.Backend.DecayScore()
+	assert.Equal(0, s.Backend.GetErrorSampleCount(signature))
+
+	// Without any floor, error traces are sampled like any other trace
+	s.UpdateErrorTracesFloor(0)
+	for i := 0; i < int(1e6); i++ {
+		s.Backend.CountSignature(signature)
+	}
+	trace, root = getTestTrace()
+	trace[1].Error = 1
+	for SampleByRate(root.TraceID, s.GetSampleRate(trace, root, signature)) {
+		trace, root = getTestTrace()
+		trace[1].Error = 1
+	}
+	assert.False(s.Sample(trace, root, defaultEnv))
+}
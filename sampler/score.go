@@ -15,8 +15,17 @@ const (
 // SampleByRate tells if a trace (from its ID) with a given rate should be sampled
 // Use Knuth multiplicative hashing to leverage imbalanced traceID generators
 func SampleByRate(traceID uint64, sampleRate float64) bool {
+	return SampleByRateWithSeed(traceID, 0, sampleRate)
+}
+
+// SampleByRateWithSeed is SampleByRate with the trace ID mixed with a seed
+// before hashing: the decision only depends on the trace ID, the seed and the
+// rate, so that agents sharing a seed take the same decisions on the same traces,
+// and agents with different seeds keep different traces. A 0 seed behaves like
+// SampleByRate.
+func SampleByRateWithSeed(traceID, seed uint64, sampleRate float64) bool {
 	if sampleRate < 1 {
-		return traceID*samplerHasher < uint64(sampleRate*maxTraceIDFloat)
+		return (traceID^seed)*samplerHasher < uint64(sampleRate*maxTraceIDFloat)
 	}
 	return true
 }
@@ -35,3 +35,26 @@ func TestSampleRateManyTraces(t *testing.T) {
 		assert.InEpsilon(float64(sampled), float64(times)*rate, 0.01)
 	}
 }
+
+func TestSampleByRateWithSeed(t *testing.T) {
+	assert := assert.New(t)
+
+	times := 100000
+	sampled, differ := 0, 0
+	for i := 0; i < times; i++ {
+		traceID := randomTraceID()
+		// a 0 seed takes the same decisions as no seed
+		assert.Equal(SampleByRate(traceID, 0.5), SampleByRateWithSeed(traceID, 0, 0.5))
+
+		kept := SampleByRateWithSeed(traceID, 42, 0.5)
+		if kept {
+			sampled++
+		}
+		if kept != SampleByRateWithSeed(traceID, 43, 0.5) {
+			differ++
+		}
+	}
+	// the seed does not change the rate, only which traces are kept
+	assert.InEpsilon(times/2, sampled, 0.02)
+	assert.True(differ > times/10, "only %d decisions differ with another seed", differ)
+}
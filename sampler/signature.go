@@ -44,6 +44,15 @@ func ComputeSignature(trace model.Trace) Signature {
 	return ComputeSignatureWithRootAndEnv(trace, root, env)
 }
 
+// ComputeSpanSignature generates the signature of a single span.
+// This algorithm is stable and can be reproduced outside of the agent: the signature
+// is the 32-bit FNV-1a hash of, in this order and without any separator, the "env" meta
+// of the span, its service, its name, its resource and its error code truncated to a
+// single byte. It is also the hash used for the root of a trace in ComputeSignatureWithRootAndEnv.
+func ComputeSpanSignature(s model.Span) Signature {
+	return Signature(computeRootHash(s, s.Meta["env"]))
+}
+
 func computeSpanHash(span model.Span, env string) spanHash {
 	h := fnv.New32a()
 	h.Write([]byte(env))
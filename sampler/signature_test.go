@@ -57,3 +57,30 @@ func TestSignatureDifferentRoot(t *testing.T) {
 
 	assert.NotEqual(ComputeSignature(t1), ComputeSignature(t2))
 }
+
+func TestSpanSignatureGolden(t *testing.T) {
+	assert := assert.New(t)
+
+	// These values are part of the contract of ComputeSpanSignature, they must never change
+	testCases := []struct {
+		span      model.Span
+		signature Signature
+	}{
+		{model.Span{Service: "mysql", Name: "mysql.query", Resource: "SELECT * FROM users"}, 1363029493},
+		{model.Span{Service: "web", Name: "http.request", Resource: "GET /users", Meta: map[string]string{"env": "prod"}}, 428099346},
+		{model.Span{Service: "web", Name: "http.request", Resource: "GET /users", Error: 1, Meta: map[string]string{"env": "prod"}}, 444876965},
+		{model.Span{Service: "web", Name: "http.request", Resource: "GET /users", Meta: map[string]string{"env": "staging"}}, 3469728964},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(tc.signature, ComputeSpanSignature(tc.span), "span: %v", tc.span)
+	}
+}
+
+func TestSpanSignatureMatchesRootHash(t *testing.T) {
+	assert := assert.New(t)
+
+	root := model.Span{TraceID: 101, SpanID: 1011, Service: "x1", Name: "y1", Resource: "z1", Meta: map[string]string{"env": "prod"}}
+
+	assert.Equal(Signature(computeRootHash(root, "prod")), ComputeSpanSignature(root))
+}
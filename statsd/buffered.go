@@ -0,0 +1,133 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bufferedClient is a StatsClient sending its metrics together, in a single
+// packet, once length of them are buffered or every flushInterval. Unlike the
+// buffered client of datadog-go, its flush interval can be set and it sends the
+// metrics still buffered when closed.
+type bufferedClient struct {
+	conn   net.Conn
+	length int
+
+	mu      sync.Mutex
+	metrics []string
+
+	exit chan struct{}
+	done chan struct{}
+}
+
+// newBufferedClient returns a bufferedClient sending its metrics to addr, in the
+// "hostname:port" format
+func newBufferedClient(addr string, length int, flushInterval time.Duration) (*bufferedClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &bufferedClient{
+		conn:    conn,
+		length:  length,
+		metrics: make([]string, 0, length),
+		exit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run(flushInterval)
+	return c, nil
+}
+
+// run flushes the buffered metrics every flushInterval, until the client is closed
+func (c *bufferedClient) run(flushInterval time.Duration) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			c.flush()
+			c.mu.Unlock()
+		case <-c.exit:
+			return
+		}
+	}
+}
+
+// Gauge implements StatsClient
+func (c *bufferedClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	return c.send(name, fmt.Sprintf("%f|g", value), tags, rate)
+}
+
+// Count implements StatsClient
+func (c *bufferedClient) Count(name string, value int64, tags []string, rate float64) error {
+	return c.send(name, fmt.Sprintf("%d|c", value), tags, rate)
+}
+
+// Histogram implements StatsClient
+func (c *bufferedClient) Histogram(name string, value float64, tags []string, rate float64) error {
+	return c.send(name, fmt.Sprintf("%f|h", value), tags, rate)
+}
+
+// send samples and buffers a metric in the dogstatsd format, flushing the buffer
+// once it is full
+func (c *bufferedClient) send(name, value string, tags []string, rate float64) error {
+	if rate < 1 && rand.Float64() > rate {
+		return nil
+	}
+
+	var b bytes.Buffer
+	b.WriteString(name)
+	b.WriteString(":")
+	b.WriteString(value)
+	if rate < 1 {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	if len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(tags, ","))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = append(c.metrics, b.String())
+	if len(c.metrics) >= c.length {
+		return c.flush()
+	}
+	return nil
+}
+
+// flush sends the buffered metrics, if any. It must be called with the lock held.
+func (c *bufferedClient) flush() error {
+	if len(c.metrics) == 0 {
+		return nil
+	}
+	_, err := c.conn.Write([]byte(strings.Join(c.metrics, "\n")))
+	c.metrics = c.metrics[:0]
+	return err
+}
+
+// Close sends the metrics still buffered and closes the client, which must not
+// be used afterwards.
+func (c *bufferedClient) Close() error {
+	close(c.exit)
+	<-c.done
+
+	c.mu.Lock()
+	err := c.flush()
+	c.mu.Unlock()
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
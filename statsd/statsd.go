@@ -2,18 +2,40 @@ package statsd
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/DataDog/datadog-trace-agent/config"
 )
 
+// StatsClient is the interface of the statsd clients the metrics of the agent
+// are sent with.
+type StatsClient interface {
+	Gauge(name string, value float64, tags []string, rate float64) error
+	Count(name string, value int64, tags []string, rate float64) error
+	Histogram(name string, value float64, tags []string, rate float64) error
+}
+
 // Client is a global Statsd client. When a client is configured via Configure,
-// that becomes the new global Statsd client in the package.
-var Client *statsd.Client
+// that becomes the new global Statsd client in the package. It discards the
+// metrics until then.
+var Client StatsClient = (*statsd.Client)(nil)
 
 // Configure creates a statsd client from a dogweb.ini style config file and set it to the global Statsd.
+// If StatsdBufferLength is set, the metrics are buffered and sent together, either when the
+// buffer is full or every StatsdFlushInterval.
 func Configure(conf *config.AgentConfig) error {
-	client, err := statsd.New(fmt.Sprintf("%s:%d", conf.StatsdHost, conf.StatsdPort))
+	addr := fmt.Sprintf("%s:%d", conf.StatsdHost, conf.StatsdPort)
+
+	var client StatsClient
+	var err error
+	if conf.StatsdBufferLength > 0 {
+		// the buffered client of datadog-go flushes on a fixed interval, and
+		// loses the buffered metrics when closed
+		client, err = newBufferedClient(addr, conf.StatsdBufferLength, conf.StatsdFlushInterval)
+	} else {
+		client, err = statsd.New(addr)
+	}
 	if err != nil {
 		return err
 	}
@@ -21,3 +43,12 @@ func Configure(conf *config.AgentConfig) error {
 	Client = client
 	return nil
 }
+
+// Close flushes the metrics still buffered by the global Statsd client and closes it,
+// so that the last metrics are not lost on shutdown. The client must not be used afterwards.
+func Close() error {
+	if c, ok := Client.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
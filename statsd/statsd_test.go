@@ -0,0 +1,109 @@
+package statsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// listenStatsd returns a connection receiving the metrics sent to the returned config
+func listenStatsd(t *testing.T) (net.PacketConn, *config.AgentConfig) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen for statsd metrics: %v", err)
+	}
+
+	conf := config.NewDefaultAgentConfig()
+	conf.StatsdHost = "127.0.0.1"
+	conf.StatsdPort = conn.LocalAddr().(*net.UDPAddr).Port
+	return conn, conf
+}
+
+// readPacket returns the next packet received on conn, or an error after timeout
+func readPacket(conn net.PacketConn, timeout time.Duration) (string, error) {
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := conn.ReadFrom(buf)
+	return string(buf[:n]), err
+}
+
+func TestConfigureBuffered(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, conf := listenStatsd(t)
+	defer conn.Close()
+
+	defaultClient := Client
+	defer func() { Client = defaultClient }()
+
+	conf.StatsdBufferLength = 10
+	conf.StatsdFlushInterval = time.Hour
+	assert.Nil(Configure(conf))
+	assert.NotNil(Client)
+
+	Client.Count("datadog.trace_agent.test", 1, nil, 1)
+	Client.Gauge("datadog.trace_agent.test.gauge", 2, []string{"a:b"}, 1)
+	_, err := readPacket(conn, 50*time.Millisecond)
+	assert.NotNil(err, "metrics sent before the buffer is full")
+
+	// the buffered metrics are sent when closing the client
+	assert.Nil(Close())
+
+	packet, err := readPacket(conn, time.Second)
+	assert.Nil(err)
+	assert.Equal("datadog.trace_agent.test:1|c\ndatadog.trace_agent.test.gauge:2.000000|g|#a:b", packet)
+}
+
+func TestConfigureBufferedFull(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, conf := listenStatsd(t)
+	defer conn.Close()
+
+	defaultClient := Client
+	defer func() { Client = defaultClient }()
+
+	conf.StatsdBufferLength = 2
+	conf.StatsdFlushInterval = time.Hour
+	assert.Nil(Configure(conf))
+	defer Close()
+
+	// the metrics are sent together once the buffer is full
+	Client.Count("datadog.trace_agent.test", 1, nil, 1)
+	Client.Histogram("datadog.trace_agent.test.histogram", 3, nil, 1)
+	packet, err := readPacket(conn, time.Second)
+	assert.Nil(err)
+	assert.Equal("datadog.trace_agent.test:1|c\ndatadog.trace_agent.test.histogram:3.000000|h", packet)
+}
+
+func TestConfigureBufferedFlushInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, conf := listenStatsd(t)
+	defer conn.Close()
+
+	defaultClient := Client
+	defer func() { Client = defaultClient }()
+
+	conf.StatsdBufferLength = 10
+	conf.StatsdFlushInterval = 10 * time.Millisecond
+	assert.Nil(Configure(conf))
+	defer Close()
+
+	// the buffered metrics are sent periodically, though the buffer is not full
+	Client.Count("datadog.trace_agent.test", 1, nil, 1)
+	packet, err := readPacket(conn, time.Second)
+	assert.Nil(err)
+	assert.Equal("datadog.trace_agent.test:1|c", packet)
+}
+
+func TestCloseUnconfigured(t *testing.T) {
+	assert := assert.New(t)
+
+	// the default client discards the metrics
+	assert.Nil(Client.Count("datadog.trace_agent.test", 1, nil, 1))
+	assert.Nil(Close())
+}